@@ -0,0 +1,306 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/derr"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// ClientIDMetadataKey is the gRPC metadata key identifying the client on
+// whose behalf a query runs. The router forwards it to the backends.
+const ClientIDMetadataKey = "x-search-client-id"
+
+const anonymousClientID = "anonymous"
+
+// ClientIDFromContext returns the client identity found in the incoming
+// gRPC metadata of `ctx`, or an empty string.
+func ClientIDFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	if values := md.Get(ClientIDMetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// WithForwardedClientID propagates the client identity of the incoming
+// gRPC metadata of `ctx` to its outgoing metadata.
+func WithForwardedClientID(ctx context.Context) context.Context {
+	clientID := ClientIDFromContext(ctx)
+	if clientID == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, ClientIDMetadataKey, clientID)
+}
+
+type AdmissionConfig struct {
+	MaxConcurrentQueries          int           // 0 for unbounded
+	MaxConcurrentQueriesPerClient int           // 0 for unbounded
+	MaxQueryThreadsPerClient      int           // shard-scan threads shared by the running queries of a client, 0 for unbounded
+	MaxQueueSize                  int           // queries waiting for a slot, past that they are rejected
+	QueueTimeout                  time.Duration // longest a query waits for a slot, 0 to wait until canceled
+}
+
+// AdmissionController decides which queries run on a backend. Queries
+// over the global or per-client limits wait in a queue where clients are
+// served in turn, so that a client flooding the backend only delays its
+// own queries.
+type AdmissionController struct {
+	config AdmissionConfig
+
+	lock       sync.Mutex
+	active     int
+	clients    map[string]*admissionClient
+	waitingRR  *list.List // clients with waiting queries, in round-robin order
+	queueCount int
+}
+
+type admissionClient struct {
+	id      string
+	active  int
+	waiting *list.List // of *admissionWaiter
+	rr      *list.Element
+}
+
+type admissionWaiter struct {
+	admitted chan struct{}
+	element  *list.Element
+}
+
+// AdmissionTicket is held by a running query, `Release` must be called
+// when the query is done.
+type AdmissionTicket struct {
+	controller *AdmissionController
+	client     *admissionClient
+	once       sync.Once
+}
+
+func NewAdmissionController(config AdmissionConfig) *AdmissionController {
+	return &AdmissionController{
+		config:    config,
+		clients:   map[string]*admissionClient{},
+		waitingRR: list.New(),
+	}
+}
+
+// Admit blocks until the query of `clientID` can run, or returns a
+// `ResourceExhausted` error when it cannot be queued or waited too long.
+func (a *AdmissionController) Admit(ctx context.Context, clientID string) (*AdmissionTicket, error) {
+	if clientID == "" {
+		clientID = anonymousClientID
+	}
+
+	a.lock.Lock()
+	client := a.client(clientID)
+	// Queries waiting while a slot is free are only waiting on their own
+	// client's limit, they do not have precedence over other clients.
+	if client.waiting.Len() == 0 && a.canRun(client) {
+		ticket := a.start(client)
+		a.lock.Unlock()
+		return ticket, nil
+	}
+
+	if a.queueCount >= a.config.MaxQueueSize {
+		a.forgetIfIdle(client)
+		a.lock.Unlock()
+
+		metrics.AdmissionRejections.Inc("queue_full")
+		return nil, derr.Statusf(codes.ResourceExhausted, "too many queries, admission queue is full (%d queries waiting), retry later", a.config.MaxQueueSize)
+	}
+
+	waiter := a.enqueue(client)
+	// queued behind clients at their own limit, it may still be able to run
+	a.admitWaiting()
+	a.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if a.config.QueueTimeout != 0 {
+		timer := time.NewTimer(a.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	queuedAt := time.Now()
+	defer metrics.AdmissionQueueWait.ObserveSince(queuedAt)
+
+	select {
+	case <-waiter.admitted:
+		return &AdmissionTicket{controller: a, client: client}, nil
+	case <-ctx.Done():
+		if a.abandon(client, waiter) {
+			return nil, derr.Status(codes.Canceled, "context canceled while waiting for admission")
+		}
+	case <-timeout:
+		if a.abandon(client, waiter) {
+			metrics.AdmissionRejections.Inc("queue_timeout")
+			return nil, derr.Statusf(codes.ResourceExhausted, "too many queries, waited %s in admission queue, retry later", a.config.QueueTimeout)
+		}
+	}
+
+	// admitted concurrently with the abandon, the slot is ours
+	return &AdmissionTicket{controller: a, client: client}, nil
+}
+
+// QueryThreads returns how many shard-scan threads the query may use,
+// splitting the client's budget between its running queries.
+func (t *AdmissionTicket) QueryThreads(maxQueryThreads int) int {
+	perClient := t.controller.config.MaxQueryThreadsPerClient
+	if perClient == 0 {
+		return maxQueryThreads
+	}
+
+	t.controller.lock.Lock()
+	active := t.client.active
+	t.controller.lock.Unlock()
+
+	threads := perClient / active
+	if threads < 1 {
+		threads = 1
+	}
+	if threads > maxQueryThreads {
+		threads = maxQueryThreads
+	}
+	return threads
+}
+
+func (t *AdmissionTicket) Release() {
+	t.once.Do(func() {
+		a := t.controller
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		a.active--
+		t.client.active--
+		metrics.AdmissionActiveQueries.Dec()
+
+		a.admitWaiting()
+		a.forgetIfIdle(t.client)
+	})
+}
+
+// all the following methods must be called under lock
+
+func (a *AdmissionController) client(clientID string) *admissionClient {
+	client, found := a.clients[clientID]
+	if !found {
+		client = &admissionClient{id: clientID, waiting: list.New()}
+		a.clients[clientID] = client
+	}
+	return client
+}
+
+func (a *AdmissionController) canRun(client *admissionClient) bool {
+	if a.config.MaxConcurrentQueries != 0 && a.active >= a.config.MaxConcurrentQueries {
+		return false
+	}
+	if a.config.MaxConcurrentQueriesPerClient != 0 && client.active >= a.config.MaxConcurrentQueriesPerClient {
+		return false
+	}
+	return true
+}
+
+func (a *AdmissionController) start(client *admissionClient) *AdmissionTicket {
+	a.active++
+	client.active++
+	metrics.AdmissionActiveQueries.Inc()
+	return &AdmissionTicket{controller: a, client: client}
+}
+
+func (a *AdmissionController) enqueue(client *admissionClient) *admissionWaiter {
+	waiter := &admissionWaiter{admitted: make(chan struct{})}
+	waiter.element = client.waiting.PushBack(waiter)
+	if client.rr == nil {
+		client.rr = a.waitingRR.PushBack(client)
+	}
+
+	a.queueCount++
+	metrics.AdmissionQueuedQueries.Inc()
+	zlog.Debug("query queued for admission", zap.String("client_id", client.id), zap.Int("queue_count", a.queueCount))
+	return waiter
+}
+
+// admitWaiting starts as many waiting queries as the limits allow, taking
+// one query per client in turn.
+func (a *AdmissionController) admitWaiting() {
+	skipped := 0
+	for a.waitingRR.Len() > 0 && skipped < a.waitingRR.Len() {
+		if a.config.MaxConcurrentQueries != 0 && a.active >= a.config.MaxConcurrentQueries {
+			return
+		}
+
+		element := a.waitingRR.Front()
+		client := element.Value.(*admissionClient)
+		if !a.canRun(client) {
+			a.waitingRR.MoveToBack(element)
+			skipped++
+			continue
+		}
+		skipped = 0
+
+		waiter := client.waiting.Remove(client.waiting.Front()).(*admissionWaiter)
+		waiter.element = nil
+		a.dequeued(client)
+		a.start(client)
+		close(waiter.admitted)
+	}
+}
+
+// abandon removes a waiter that gave up, returning false when it was
+// admitted in the meantime.
+func (a *AdmissionController) abandon(client *admissionClient, waiter *admissionWaiter) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if waiter.element == nil {
+		return false
+	}
+
+	client.waiting.Remove(waiter.element)
+	waiter.element = nil
+	a.dequeued(client)
+	a.forgetIfIdle(client)
+	return true
+}
+
+func (a *AdmissionController) dequeued(client *admissionClient) {
+	a.queueCount--
+	metrics.AdmissionQueuedQueries.Dec()
+
+	if client.waiting.Len() == 0 {
+		a.waitingRR.Remove(client.rr)
+		client.rr = nil
+	} else {
+		// the client goes to the back of the line for its next query
+		a.waitingRR.MoveToBack(client.rr)
+	}
+}
+
+func (a *AdmissionController) forgetIfIdle(client *admissionClient) {
+	if client.active == 0 && client.waiting.Len() == 0 {
+		delete(a.clients, client.id)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func admitAsync(a *AdmissionController, clientID string, admitted chan<- string) {
+	go func() {
+		// admitted tickets are never released, holding their slot
+		if _, err := a.Admit(context.Background(), clientID); err == nil {
+			admitted <- clientID
+		}
+	}()
+}
+
+func waitQueued(t *testing.T, a *AdmissionController, count int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.queueCount == count
+	}, time.Second, time.Millisecond)
+}
+
+func TestAdmissionController_PerClientLimit(t *testing.T) {
+	a := NewAdmissionController(AdmissionConfig{MaxConcurrentQueriesPerClient: 1, MaxQueueSize: 10})
+
+	heavy, err := a.Admit(context.Background(), "heavy")
+	require.NoError(t, err)
+
+	admitted := make(chan string, 10)
+	admitAsync(a, "heavy", admitted)
+	waitQueued(t, a, 1)
+
+	// another client is not held back by the heavy one's queued query
+	other, err := a.Admit(context.Background(), "other")
+	require.NoError(t, err)
+	other.Release()
+
+	heavy.Release()
+	assert.Equal(t, "heavy", <-admitted)
+}
+
+func TestAdmissionController_FairQueue(t *testing.T) {
+	a := NewAdmissionController(AdmissionConfig{MaxConcurrentQueries: 1, MaxQueueSize: 10})
+
+	running, err := a.Admit(context.Background(), "a")
+	require.NoError(t, err)
+
+	admitted := make(chan string, 10)
+	for i := 0; i < 3; i++ {
+		admitAsync(a, "a", admitted)
+		waitQueued(t, a, i+1)
+	}
+	admitAsync(a, "b", admitted)
+	waitQueued(t, a, 4)
+
+	running.Release()
+	first := <-admitted
+	assert.Equal(t, "a", first)
+
+	// the next slot goes to "b", even though "a" queued more queries before it
+	a.lock.Lock()
+	next := a.waitingRR.Front().Value.(*admissionClient)
+	a.lock.Unlock()
+	assert.Equal(t, "b", next.id)
+}
+
+func TestAdmissionController_Rejections(t *testing.T) {
+	a := NewAdmissionController(AdmissionConfig{MaxConcurrentQueries: 1, MaxQueueSize: 1, QueueTimeout: 20 * time.Millisecond})
+
+	running, err := a.Admit(context.Background(), "a")
+	require.NoError(t, err)
+	defer running.Release()
+
+	admitted := make(chan string, 10)
+	admitAsync(a, "b", admitted)
+	waitQueued(t, a, 1)
+
+	_, err = a.Admit(context.Background(), "c")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "queue full")
+
+	waitQueued(t, a, 0)
+	_, err = a.Admit(context.Background(), "c")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "queue timeout")
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	assert.Len(t, a.clients, 1, "idle clients are forgotten")
+}
+
+func TestAdmissionTicket_QueryThreads(t *testing.T) {
+	a := NewAdmissionController(AdmissionConfig{MaxQueryThreadsPerClient: 8})
+
+	first, err := a.Admit(context.Background(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, 4, first.QueryThreads(4))
+
+	second, err := a.Admit(context.Background(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, 4, second.QueryThreads(16))
+
+	third, err := a.Admit(context.Background(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, third.QueryThreads(16))
+
+	other, err := a.Admit(context.Background(), "b")
+	require.NoError(t, err)
+	assert.Equal(t, 8, other.QueryThreads(16))
+}
+
+func TestClientIDFromContext(t *testing.T) {
+	assert.Equal(t, "", ClientIDFromContext(context.Background()))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(ClientIDMetadataKey, "dashboard"))
+	assert.Equal(t, "dashboard", ClientIDFromContext(ctx))
+
+	md, _ := metadata.FromOutgoingContext(WithForwardedClientID(ctx))
+	assert.Equal(t, []string{"dashboard"}, md.Get(ClientIDMetadataKey))
+}
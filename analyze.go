@@ -54,11 +54,29 @@ func CheckIndexIntegrity(path string, shardSize uint64) (*indexMetaInfo, error)
 	}
 	defer reader.Close()
 
+	return CheckIndexReaderIntegrity(reader, path, shardSize)
+}
+
+// CheckIndexReaderIntegrity is `CheckIndexIntegrity` through the `reader`
+// of an index already opened, at `path`.
+func CheckIndexReaderIntegrity(reader index.IndexReader, path string, shardSize uint64) (*indexMetaInfo, error) {
+	var err error
 	metaInfo := &indexMetaInfo{
 		HighestBlockNum: uint64(0),
 		LowestBlockNum:  uint64(math.MaxUint64),
 	}
 
+	metaInfo.DocCount, err = reader.DocCount()
+	if err != nil {
+		return nil, fmt.Errorf("getting doc count: %w", err)
+	}
+
+	metaInfo.Fields, err = reader.Fields()
+	if err != nil {
+		return nil, fmt.Errorf("getting fields: %w", err)
+	}
+	sort.Strings(metaInfo.Fields)
+
 	coll, err := getCollection(reader, "meta:blknum:")
 	if err != nil {
 		return nil, fmt.Errorf("getting meta block number meta ids: %w", err)
@@ -106,6 +124,8 @@ type indexMetaInfo struct {
 	LowestBlockNum  uint64
 	HighestBlockNum uint64
 	OrderedBlockNum []int
+	DocCount        uint64
+	Fields          []string
 }
 
 func (i *indexMetaInfo) Validate(expectedShardSize uint64, path string) MultiError {
@@ -38,28 +38,54 @@ import (
 
 type Config struct {
 	// dmesh configuration
-	ServiceVersion          string        // dmesh service version (v1)
-	TierLevel               uint32        // level of the search tier
-	GRPCListenAddr          string        // Address to listen for incoming gRPC requests
-	HTTPListenAddr          string        // Address to listen for incoming http requests
-	PublishInterval         time.Duration // longest duration a dmesh peer will not publish
-	EnableMovingTail        bool          // Enable moving t`ail, requires a relative --start-block (negative number)
-	IndexesStoreURL         string        // location of indexes to download/open/serve
-	IndexesPath             string        // location where to store the downloaded index files
-	ReadOnlyIndexesPaths    []string      // list of paths where to load indexes on start
-	ShardSize               uint64        // indexes shard size
-	StartBlock              int64         // Start at given block num, the initial sync and polling
-	StopBlock               uint64        // Stop before given block num, the initial sync and polling
-	BlockmetaAddr           string        // grpc address to blockmeta to establish negative start block
-	SyncFromStore           bool          // Download missing indexes from --indexes-store before starting
-	SyncMaxIndexes          int           // Maximum number of indexes to sync. On production, use a very large number.
-	IndicesDLThreads        int           // Number of indices files to download from the GS input store and decompress in parallel. In prod, use large value like 20.
-	NumQueryThreads         int           // Number of end-user query parallel threads to query blocks indexes
-	IndexPolling            bool          // Populate local indexes using indexes store polling.
-	WarmupFilepath          string        // Optional filename containing queries to warm-up the search
-	ShutdownDelay           time.Duration //On shutdown, time to wait before actually leaving, to try and drain connections
-	EnableEmptyResultsCache bool          // Enable roaring-bitmap-based empty results caching
-	MemcacheAddr            string        // Empty results cache's memcache server address
+	ServiceVersion                 string        // dmesh service version (v1)
+	TierLevel                      uint32        // level of the search tier
+	GRPCListenAddr                 string        // Address to listen for incoming gRPC requests
+	HTTPListenAddr                 string        // Address to listen for incoming http requests
+	PublishInterval                time.Duration // longest duration a dmesh peer will not publish
+	EnableMovingTail               bool          // Enable moving t`ail, requires a relative --start-block (negative number)
+	IndexesStoreURL                string        // location of indexes to download/open/serve
+	IndexesPath                    string        // location where to store the downloaded index files
+	ReadOnlyIndexesPaths           []string      // list of paths where to load indexes on start
+	StorageTiers                   []string      // Storage tiers as `<path>:<max_shards>`, newest shards first, the last one may omit `<max_shards>` to hold all the remaining shards
+	TierMigrationInterval          time.Duration // Interval between passes moving shards to their storage tier as the head moves
+	ShardSize                      uint64        // indexes shard size
+	StartBlock                     int64         // Start at given block num, the initial sync and polling
+	StopBlock                      uint64        // Stop before given block num, the initial sync and polling
+	BlockmetaAddr                  string        // grpc address to blockmeta to establish negative start block
+	SyncFromStore                  bool          // Download missing indexes from --indexes-store before starting
+	SyncMaxIndexes                 int           // Maximum number of indexes to sync. On production, use a very large number.
+	IndicesDLThreads               int           // Number of indices files to download from the GS input store and decompress in parallel. In prod, use large value like 20.
+	NumQueryThreads                int           // Number of end-user query parallel threads to query blocks indexes
+	IndexPolling                   bool          // Populate local indexes using indexes store polling.
+	WarmupFilepath                 string        // Optional filename containing queries to warm-up the search
+	EnableAutoWarmup               bool          // Record the queries served, and replay the most frequent and most expensive ones on boot and on newly polled, gap filled, reloaded or restored shards
+	AutoWarmupQueryCount           int           // Number of most frequent, and of most expensive, recorded queries to replay when warming up
+	AutoWarmupCPUBudget            float64       // Fraction of one CPU the auto warmup may use, alongside the queries being served
+	ShutdownDelay                  time.Duration //On shutdown, time to wait before actually leaving, to try and drain connections
+	ShutdownPropagationDelay       time.Duration // On shutdown, time for the routers to observe this archive is not ready anymore, new queries are rejected afterwards and in-flight ones get the `ShutdownDelay` to complete, 5s when 0
+	EnableEmptyResultsCache        bool          // Enable roaring-bitmap-based empty results caching
+	MemcacheAddr                   string        // Empty results cache's memcache server address
+	EmptyResultsCachePath          string        // When set, the empty results cache is persisted in a local database at that path instead of memcache
+	EmptyResultsCacheTTL           time.Duration // Time to live of the on-disk empty results cache entries, 0 for no expiration
+	EmptyResultsCacheMaxSize       uint64        // Maximum bytes of the on-disk empty results cache before evicting least recently used entries, 0 for unbounded
+	EmptyResultsCacheShareStoreURL string        // Optional store where on-disk empty results cache snapshots are shared, to seed replicas on boot
+	EmptyResultsCacheShareInterval time.Duration // Interval between exports of the on-disk empty results cache to the share store
+	MappingVersion                 string        // When set, refuse shards whose manifest was produced with a different mapping version
+	RequireShardManifest           bool          // Refuse shards uploaded without a manifest
+	AllowGaps                      bool          // Serve the shards following missing ones, holding the missing ones as gaps advertised to the router, instead of stopping at the first one
+	GapLookaheadShards             int           // Number of shards past a missing one polling looks for the next available one, before holding the missing ones as gaps, 10 when 0
+	GapRefillInterval              time.Duration // Interval between passes downloading the gaps that became available in --indexes-store
+	EnableLazyShardLoading         bool          // Download shards from --indexes-store when a query first touches them, instead of syncing them up front
+	LazyShardsDiskBudget           uint64        // Bytes of lazily downloaded shards kept on disk before evicting the least recently used ones, 0 for unbounded
+	LazyShardsPrefetchCount        int           // Number of shards to prefetch in the direction of a query when loading shards lazily
+	ShardResultsCacheMaxSize       uint64        // When non-zero, keep the matches of queries covering full shards in memory, up to approximately that many bytes
+	FieldTermsFiltersMaxSize       uint64        // Bytes of shard field terms filters kept in memory, read from disk when first needed, 0 for the default of 256 MiB
+	MaxConcurrentQueries           int           // Maximum number of queries running at once, others wait in the admission queue, 0 for unbounded
+	MaxConcurrentQueriesPerClient  int           // Maximum number of queries running at once for a single client (identified by the `x-search-client-id` gRPC metadata), 0 for unbounded
+	MaxQueryThreadsPerClient       int           // Maximum number of shard-scan threads shared by the running queries of a single client, 0 for unbounded
+	AdmissionQueueSize             int           // Maximum number of queries waiting for admission, past that they are rejected with ResourceExhausted
+	AdmissionQueueTimeout          time.Duration // Longest a query waits for admission before being rejected with ResourceExhausted, 0 to wait until canceled
 }
 
 type Modules struct {
@@ -103,8 +129,24 @@ func (a *App) Run() error {
 
 	var cache roarcache.Cache
 	if a.config.EnableEmptyResultsCache {
-		zlog.Info("setting up roar cache")
-		cache = roarcache.NewMemcache(a.config.MemcacheAddr, 30*24*time.Hour, a.config.ShardSize)
+		if a.config.EmptyResultsCachePath != "" {
+			zlog.Info("setting up on-disk roar cache", zap.String("path", a.config.EmptyResultsCachePath))
+			diskCache, err := roarcache.NewDisk(a.config.EmptyResultsCachePath, a.config.EmptyResultsCacheTTL, a.config.EmptyResultsCacheMaxSize, a.config.ShardSize)
+			if err != nil {
+				return fmt.Errorf("setting up on-disk roar cache: %w", err)
+			}
+			a.OnTerminated(func(_ error) { diskCache.Close() })
+
+			if a.config.EmptyResultsCacheShareStoreURL != "" {
+				if err := a.launchRoarCacheSharing(diskCache); err != nil {
+					return err
+				}
+			}
+			cache = diskCache
+		} else {
+			zlog.Info("setting up roar cache")
+			cache = roarcache.NewMemcache(a.config.MemcacheAddr, 30*24*time.Hour, a.config.ShardSize)
+		}
 	}
 
 	zlog.Info("creating search peer")
@@ -147,6 +189,27 @@ func (a *App) Run() error {
 		a.modules.Dmesh,
 		searchPeer,
 	)
+	indexPool.MappingVersion = a.config.MappingVersion
+	indexPool.RequireShardManifest = a.config.RequireShardManifest
+	indexPool.AllowGaps = a.config.AllowGaps
+	indexPool.GapLookaheadShards = a.config.GapLookaheadShards
+	if a.config.ShardResultsCacheMaxSize != 0 {
+		indexPool.EnableShardResultsCache(a.config.ShardResultsCacheMaxSize)
+	}
+	if a.config.FieldTermsFiltersMaxSize != 0 {
+		indexPool.SetFieldTermsFiltersMaxBytes(a.config.FieldTermsFiltersMaxSize)
+	}
+	if len(a.config.StorageTiers) != 0 {
+		if a.config.EnableLazyShardLoading {
+			return fmt.Errorf("storage tiers cannot be used with lazy shard loading")
+		}
+
+		tiers := archive.ParseStorageTiers(a.config.StorageTiers)
+		zlog.Info("enabling tiered storage", zap.Reflect("tiers", tiers))
+		if err := indexPool.EnableTieredStorage(tiers); err != nil {
+			return fmt.Errorf("enabling tiered storage: %w", err)
+		}
+	}
 
 	zlog.Info("cleaning on-disk indexes")
 	err = indexPool.CleanOnDiskIndexes(resolvedStartBlockNum, a.config.StopBlock)
@@ -154,18 +217,27 @@ func (a *App) Run() error {
 		return fmt.Errorf("cleaning on-disk indexes: %w", err)
 	}
 
-	if a.config.SyncFromStore {
-		zlog.Info("sync'ing from storage")
-		err := indexPool.SyncFromStorage(resolvedStartBlockNum, a.config.StopBlock, a.config.SyncMaxIndexes, a.config.IndicesDLThreads)
+	if a.config.EnableLazyShardLoading {
+		zlog.Info("scanning remote indexes for lazy loading", zap.Uint64("disk_budget", a.config.LazyShardsDiskBudget), zap.Int("prefetch_count", a.config.LazyShardsPrefetchCount))
+		indexPool.EnableLazyShardLoading(a.config.LazyShardsDiskBudget, a.config.LazyShardsPrefetchCount)
+		err = indexPool.ScanRemoteIndexes(resolvedStartBlockNum, a.config.StopBlock)
 		if err != nil {
-			return fmt.Errorf("syncing from storage: %w", err)
+			return fmt.Errorf("scanning remote indexes: %w", err)
+		}
+	} else {
+		if a.config.SyncFromStore {
+			zlog.Info("sync'ing from storage")
+			err := indexPool.SyncFromStorage(resolvedStartBlockNum, a.config.StopBlock, a.config.SyncMaxIndexes, a.config.IndicesDLThreads)
+			if err != nil {
+				return fmt.Errorf("syncing from storage: %w", err)
+			}
 		}
-	}
 
-	zlog.Info("loading on-disk indexes")
-	err = indexPool.ScanOnDiskIndexes(resolvedStartBlockNum)
-	if err != nil {
-		return fmt.Errorf("opening read-only indexes: %w", err)
+		zlog.Info("loading on-disk indexes")
+		err = indexPool.ScanOnDiskIndexes(resolvedStartBlockNum)
+		if err != nil {
+			return fmt.Errorf("opening read-only indexes: %w", err)
+		}
 	}
 
 	err = indexPool.SetLowestServeableBlockNum(resolvedStartBlockNum)
@@ -203,9 +275,37 @@ func (a *App) Run() error {
 		go indexPool.PollRemoteIndices(resolvedStartBlockNum, a.config.StopBlock)
 	}
 
+	if len(a.config.StorageTiers) != 0 {
+		go indexPool.LaunchTierMigrations(a.config.TierMigrationInterval)
+	}
+
+	if a.config.AllowGaps && !a.config.EnableLazyShardLoading {
+		go indexPool.LaunchGapRefills(a.config.GapRefillInterval)
+	}
+
 	zlog.Info("setting up archive backend")
 	archiveBackend := archive.NewBackend(indexPool, a.modules.Dmesh, searchPeer, a.config.GRPCListenAddr, a.config.HTTPListenAddr, a.config.ShutdownDelay)
 	archiveBackend.SetMaxQueryThreads(a.config.NumQueryThreads)
+	archiveBackend.SetShutdownPropagationDelay(a.config.ShutdownPropagationDelay)
+	if a.config.MaxConcurrentQueries != 0 || a.config.MaxConcurrentQueriesPerClient != 0 || a.config.MaxQueryThreadsPerClient != 0 {
+		archiveBackend.SetAdmissionController(search.NewAdmissionController(search.AdmissionConfig{
+			MaxConcurrentQueries:          a.config.MaxConcurrentQueries,
+			MaxConcurrentQueriesPerClient: a.config.MaxConcurrentQueriesPerClient,
+			MaxQueryThreadsPerClient:      a.config.MaxQueryThreadsPerClient,
+			MaxQueueSize:                  a.config.AdmissionQueueSize,
+			QueueTimeout:                  a.config.AdmissionQueueTimeout,
+		}))
+	}
+
+	if a.config.EnableAutoWarmup {
+		zlog.Info("enabling auto warmup", zap.Int("query_count", a.config.AutoWarmupQueryCount), zap.Float64("cpu_budget", a.config.AutoWarmupCPUBudget))
+		if err := archiveBackend.EnableAutoWarmup(a.config.AutoWarmupQueryCount, a.config.AutoWarmupCPUBudget); err != nil {
+			return fmt.Errorf("enabling auto warmup: %w", err)
+		}
+		if !indexPool.IsEmpty() {
+			archiveBackend.WarmupRecordedQueries(indexPool.GetLowestServeableBlockNum(), indexPool.LastReadOnlyIndexedBlock())
+		}
+	}
 
 	if a.config.WarmupFilepath != "" {
 		err := warmupSearch(a.config.WarmupFilepath, indexPool.GetLowestServeableBlockNum(), indexPool.LastReadOnlyIndexedBlock(), archiveBackend)
@@ -244,6 +344,30 @@ func (a *App) Run() error {
 	return nil
 }
 
+func (a *App) launchRoarCacheSharing(diskCache *roarcache.Disk) error {
+	shareStore, err := dstore.NewStore(a.config.EmptyResultsCacheShareStoreURL, "", "zstd", true)
+	if err != nil {
+		return fmt.Errorf("failed setting up roar cache share store: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("getting hostname to name roar cache snapshots: %w", err)
+	}
+
+	interval := a.config.EmptyResultsCacheShareInterval
+	if interval == 0 {
+		interval = time.Hour
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.OnTerminating(func(_ error) { cancel() })
+
+	zlog.Info("launching roar cache sharing", zap.String("share_store_url", a.config.EmptyResultsCacheShareStoreURL), zap.String("snapshot_name", hostname), zap.Duration("interval", interval))
+	go diskCache.LaunchSharing(ctx, shareStore, hostname, interval)
+	return nil
+}
+
 func (a *App) IsReady() bool {
 	if a.readinessProbe == nil {
 		return false
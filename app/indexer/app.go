@@ -45,6 +45,11 @@ type Config struct {
 	EnableUpload          bool   // Upload merged indexes to the --indexes-store
 	DeleteAfterUpload     bool   // Delete local indexes after uploading them
 	EnableIndexTruncation bool   // Enable index truncation, requires a relative --start-block (negative number)
+	EnableMappingDryRun   bool   // Map blocks from --start-block to --stop-block without writing any shard, and report documents statistics
+	DryRunOutputPath      string // File where the mapping dry-run JSON report is written, `-` or empty for stdout
+	DryRunTopTermsCount   int    // Number of top terms per field to include in the mapping dry-run report
+	MappingVersion        string // Version of the block mapper, recorded in the manifest uploaded with each shard
+	IndexerVersion        string // Version of the indexer, recorded in the manifest uploaded with each shard
 }
 
 type Modules struct {
@@ -71,9 +76,9 @@ func New(config *Config, modules *Modules) *App {
 }
 
 func (a *App) resolveStartBlock(ctx context.Context, dexer *indexer.Indexer) (targetStartBlock uint64, filesourceStartBlock uint64, previousIrreversibleID string, err error) {
-	if a.config.EnableBatchMode {
+	if a.config.EnableBatchMode || a.config.EnableMappingDryRun {
 		if a.config.StartBlock < 0 {
-			return 0, 0, "", fmt.Errorf("invalid negative start block in batch mode")
+			return 0, 0, "", fmt.Errorf("invalid negative start block in batch or dry-run mode")
 		}
 		targetStartBlock = uint64(a.config.StartBlock)
 	} else {
@@ -97,6 +102,10 @@ func (a *App) Run() error {
 
 	metrics.Register(metrics.IndexerMetricSet)
 
+	if a.config.EnableMappingDryRun && a.config.StopBlock == 0 {
+		return fmt.Errorf("mapping dry-run requires a stop block")
+	}
+
 	if err := search.ValidateRegistry(); err != nil {
 		return err
 	}
@@ -124,6 +133,8 @@ func (a *App) Run() error {
 
 	dexer.StopBlockNum = a.config.StopBlock
 	dexer.Verbose = a.config.IsVerbose
+	dexer.MappingVersion = a.config.MappingVersion
+	dexer.IndexerVersion = a.config.IndexerVersion
 
 	ctx, cancel := context.WithCancel(context.Background())
 	a.OnTerminating(func(_ error) { cancel() })
@@ -144,7 +155,15 @@ func (a *App) Run() error {
 		break
 	}
 
-	if a.config.EnableBatchMode {
+	if a.config.EnableMappingDryRun {
+		zlog.Info("setting up mapping dry-run pipeline",
+			zap.Uint64("target_start_block_num", targetStartBlockNum),
+			zap.Uint64("filesource_start_block_num", filesourceStartBlockNum),
+			zap.String("previous_irreversible_id,", previousIrreversibleID),
+			zap.String("output_path", a.config.DryRunOutputPath),
+		)
+		dexer.BuildDryRunPipeline(targetStartBlockNum, filesourceStartBlockNum, previousIrreversibleID, a.config.DryRunTopTermsCount, a.config.DryRunOutputPath)
+	} else if a.config.EnableBatchMode {
 		zlog.Info("setting up indexing batch pipeline",
 			zap.Uint64("target_start_block_num", targetStartBlockNum),
 			zap.Uint64("filesource_start_block_num", filesourceStartBlockNum),
@@ -160,7 +179,7 @@ func (a *App) Run() error {
 		dexer.BuildLivePipeline(targetStartBlockNum, filesourceStartBlockNum, previousIrreversibleID, a.config.EnableUpload, a.config.DeleteAfterUpload)
 	}
 
-	if a.config.EnableIndexTruncation {
+	if a.config.EnableIndexTruncation && !a.config.EnableMappingDryRun {
 		blockCount, err := getBlockCount(a.config.StartBlock)
 		if err != nil {
 			return fmt.Errorf("cannot setup moving tail: %w", err)
@@ -169,9 +188,11 @@ func (a *App) Run() error {
 		go truncator.Launch()
 	}
 
-	err = dexer.Bootstrap(targetStartBlockNum)
-	if err != nil {
-		return fmt.Errorf("failed to bootstrap indexer: %w", err)
+	if !a.config.EnableMappingDryRun {
+		err = dexer.Bootstrap(targetStartBlockNum)
+		if err != nil {
+			return fmt.Errorf("failed to bootstrap indexer: %w", err)
+		}
 	}
 
 	gs, err := dgrpc.NewInternalClient(a.config.GRPCListenAddr)
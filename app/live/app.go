@@ -35,21 +35,28 @@ import (
 )
 
 type Config struct {
-	ServiceVersion           string        // dmesh service version (v1)
-	TierLevel                uint32        // level of the search tier
-	GRPCListenAddr           string        // Address to listen for incoming gRPC requests
-	PublishInterval          time.Duration // longest duration a dmesh peer will not publish
-	BlockmetaAddr            string        // grpc address to blockmeta to decide if the chain is up-to-date
-	BlocksStoreURL           string        // Path to read blocks archives
-	BlockstreamAddr          string        // gRPC URL to reach a stream of blocks
-	HeadDelayTolerance       uint64        // Number of blocks above a backend's head we allow a request query to be served (Live & Router)
-	StartBlockDriftTolerance uint64        // Number of blocks behind LIB that the start block is allowed to be
-	ShutdownDelay            time.Duration // On shutdown, time to wait before actually leaving, to try and drain connections
-	LiveIndexesPath          string        // /tmp/live/indexes", "Location for live indexes (ideally a ramdisk)
-	TruncationThreshold      int           //number of available dmesh peers that should serve irreversible blocks before we truncate them from this backend's memory
-	RealtimeTolerance        time.Duration // longest delay to consider this service as real-time(ready) on initialization
-	HubChannelSize           int           // the number of blocks that can be sent in the hub channel before is reaches capacity
-	PreProcConcurrentThreads int
+	ServiceVersion                string        // dmesh service version (v1)
+	TierLevel                     uint32        // level of the search tier
+	GRPCListenAddr                string        // Address to listen for incoming gRPC requests
+	PublishInterval               time.Duration // longest duration a dmesh peer will not publish
+	BlockmetaAddr                 string        // grpc address to blockmeta to decide if the chain is up-to-date
+	BlocksStoreURL                string        // Path to read blocks archives
+	BlockstreamAddr               string        // gRPC URL to reach a stream of blocks
+	HeadDelayTolerance            uint64        // Number of blocks above a backend's head we allow a request query to be served (Live & Router)
+	StartBlockDriftTolerance      uint64        // Number of blocks behind LIB that the start block is allowed to be
+	ShutdownDelay                 time.Duration // On shutdown, time to wait before actually leaving, to try and drain connections
+	LiveIndexesPath               string        // /tmp/live/indexes", "Location for live indexes (ideally a ramdisk)
+	EnableWarmRestart             bool          // Keep a manifest of the live indexes, closed on shutdown, and reload those still in the canonical chain on start instead of indexing the reversible segment again
+	InMemoryIndexes               bool          // Keep the per-block live indexes in memory instead of writing them under LiveIndexesPath, cannot be used with EnableWarmRestart
+	EnableSharedQueries           bool          // Run identical forward queries on a single hub subscription, fanning the matches out to all their subscribers
+	TruncationThreshold           int           //number of available dmesh peers that should serve irreversible blocks before we truncate them from this backend's memory
+	RealtimeTolerance             time.Duration // longest delay to consider this service as real-time(ready) on initialization
+	HubChannelSize                int           // the number of blocks that can be sent in the hub channel before is reaches capacity
+	PreProcConcurrentThreads      int
+	MaxConcurrentQueries          int           // Maximum number of queries running at once, others wait in the admission queue, 0 for unbounded
+	MaxConcurrentQueriesPerClient int           // Maximum number of queries running at once for a single client (identified by the `x-search-client-id` gRPC metadata), 0 for unbounded
+	AdmissionQueueSize            int           // Maximum number of queries waiting for admission, past that they are rejected with ResourceExhausted
+	AdmissionQueueTimeout         time.Duration // Longest a query waits for admission before being rejected with ResourceExhausted, 0 to wait until canceled
 }
 
 type Modules struct {
@@ -84,6 +91,10 @@ func (a *App) Run() error {
 		return err
 	}
 
+	if a.config.InMemoryIndexes && a.config.EnableWarmRestart {
+		return fmt.Errorf("in-memory live indexes cannot be reloaded on restart, disable either of them")
+	}
+
 	zlog.Info("starting dmesh")
 	err := a.modules.Dmesh.Start(context.Background(), []string{
 		"/" + a.config.ServiceVersion + "/search",
@@ -92,10 +103,19 @@ func (a *App) Run() error {
 		return fmt.Errorf("unable to start dmesh client: %w", err)
 	}
 
-	zlog.Info("clearing working directory", zap.Reflect("working_directory", a.config.LiveIndexesPath))
-	err = os.RemoveAll(a.config.LiveIndexesPath)
-	if err != nil {
-		return fmt.Errorf("unable to clear working directory: %w", err)
+	var liveManifest *search.LiveManifest
+	if a.config.EnableWarmRestart {
+		zlog.Info("loading live indexes manifest", zap.String("working_directory", a.config.LiveIndexesPath))
+		liveManifest, err = search.LoadLiveManifest(a.config.LiveIndexesPath)
+		if err != nil {
+			return fmt.Errorf("unable to load live indexes manifest: %w", err)
+		}
+	} else {
+		zlog.Info("clearing working directory", zap.Reflect("working_directory", a.config.LiveIndexesPath))
+		err = os.RemoveAll(a.config.LiveIndexesPath)
+		if err != nil {
+			return fmt.Errorf("unable to clear working directory: %w", err)
+		}
 	}
 
 	blocksStore, err := dstore.NewDBinStore(a.config.BlocksStoreURL)
@@ -113,6 +133,20 @@ func (a *App) Run() error {
 	}
 
 	lb := livebackend.New(a.modules.Dmesh, searchPeer, a.config.HeadDelayTolerance, a.config.ShutdownDelay)
+	if a.config.InMemoryIndexes {
+		lb.EnableInMemoryIndexes()
+	}
+	if a.config.EnableSharedQueries {
+		lb.EnableSharedQueries()
+	}
+	if a.config.MaxConcurrentQueries != 0 || a.config.MaxConcurrentQueriesPerClient != 0 {
+		lb.SetAdmissionController(search.NewAdmissionController(search.AdmissionConfig{
+			MaxConcurrentQueries:          a.config.MaxConcurrentQueries,
+			MaxConcurrentQueriesPerClient: a.config.MaxConcurrentQueriesPerClient,
+			MaxQueueSize:                  a.config.AdmissionQueueSize,
+			QueueTimeout:                  a.config.AdmissionQueueTimeout,
+		}))
+	}
 
 	zlog.Info("setting up blockmeta")
 	blockMetaClient, err := pbblockmeta.NewClient(a.config.BlockmetaAddr)
@@ -145,6 +179,22 @@ func (a *App) Run() error {
 		zap.Uint64("start_lib_num", startLIB.Num()),
 	)
 
+	if liveManifest != nil {
+		restored, err := liveManifest.Reload(startLIB, func(blockID string) (bool, error) {
+			resp, err := blockMetaClient.ChainDiscriminatorClient().InLongestChain(context.Background(), &pbblockmeta.InLongestChainRequest{BlockID: blockID})
+			if err != nil {
+				return false, err
+			}
+			return resp.InLongestChain, nil
+		})
+		if err != nil {
+			zlog.Warn("cannot reload live indexes, indexing the reversible segment again", zap.Error(err))
+		} else {
+			zlog.Info("reloaded live indexes", zap.Int("block_count", len(restored)))
+		}
+		lb.EnableWarmRestart(liveManifest, restored)
+	}
+
 	zlog.Info("setting up subscription hub", zap.Uint64("start_block", startLIB.Num()))
 	err = lb.SetupSubscriptionHub(
 		startLIB,
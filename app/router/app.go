@@ -31,12 +31,16 @@ import (
 )
 
 type Config struct {
-	ServiceVersion     string // dmesh service version (v1)
-	BlockmetaAddr      string // Blockmeta endpoint is queried to validate cursors that are passed LIB and forked out
-	GRPCListenAddr     string // Address to listen for incoming gRPC requests
-	HeadDelayTolerance uint64 // Number of blocks above a backend's head we allow a request query to be served (Live & Router)
-	LibDelayTolerance  uint64 // Number of blocks above a backend's lib we allow a request query to be served (Live & Router)
-	EnableRetry        bool   // Enable the router's attempt to retry a backend search if there is an error. This could have adverse consequences when search through the live
+	ServiceVersion     string  // dmesh service version (v1)
+	BlockmetaAddr      string  // Blockmeta endpoint is queried to validate cursors that are passed LIB and forked out
+	GRPCListenAddr     string  // Address to listen for incoming gRPC requests
+	HTTPListenAddr     string  // When set, address to listen for incoming HTTP requests on the `/v1/search` JSON, NDJSON and Server-Sent Events gateway
+	HeadDelayTolerance uint64  // Number of blocks above a backend's head we allow a request query to be served (Live & Router)
+	LibDelayTolerance  uint64  // Number of blocks above a backend's lib we allow a request query to be served (Live & Router)
+	EnableRetry        bool    // Enable the router's attempt to retry a backend search if there is an error. This could have adverse consequences when search through the live
+	ResumeOnFailure    bool    // Retry a backend search failing after it sent matches on another backend, resuming at the block of the last one sent. Never done for reversible matches of the live, which could be on a fork
+	HedgingPercentile  float64 // When non-zero, backend queries of paginated queries are also sent to a second backend when the first one did not respond within that percentile (like 0.95) of the latest response times
+	SegmentPrefetch    int     // When non-zero, number of segments, planned after the one being queried, whose backend queries are started ahead of their turn
 }
 
 type Modules struct {
@@ -86,6 +90,26 @@ func (a *App) Run() error {
 
 	router := router.New(a.modules.Dmesh, a.config.HeadDelayTolerance, a.config.LibDelayTolerance, blockmetaCli, forksCli, a.config.EnableRetry)
 
+	if a.config.HTTPListenAddr != "" {
+		router.EnableHTTPGateway(a.config.HTTPListenAddr)
+	}
+
+	if a.config.ResumeOnFailure {
+		router.EnableResumeOnFailure()
+	}
+
+	if a.config.HedgingPercentile != 0 {
+		if err := router.EnableHedging(a.config.HedgingPercentile); err != nil {
+			return err
+		}
+	}
+
+	if a.config.SegmentPrefetch != 0 {
+		if err := router.EnableSegmentPrefetch(a.config.SegmentPrefetch); err != nil {
+			return err
+		}
+	}
+
 	a.OnTerminating(router.Shutdown)
 	router.OnTerminated(a.Shutdown)
 
@@ -0,0 +1,243 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/dfuse-io/derr"
+	"github.com/dfuse-io/logging"
+	"github.com/dfuse-io/search"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// The admin API is only served over HTTP: the archive's gRPC services are
+// generated from the `dfuse-io/pbgo` protobuf definitions shared by every
+// search component, which have no admin service for it to implement.
+
+type purgeEmptyResultsCacheResponse struct {
+	LowBlockNum  uint64 `json:"low_block_num"`
+	HighBlockNum uint64 `json:"high_block_num"`
+}
+
+// purgeEmptyResultsCacheHandler serves `POST /v1/admin/empty_results_cache/purge?low_block_num=X&high_block_num=Y`
+func (b *ArchiveBackend) purgeEmptyResultsCacheHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		lowBlockNum, highBlockNum, err := blockRangeParams(ctx, r)
+		if err != nil {
+			writeError(ctx, w, err)
+			return
+		}
+
+		logging.Logger(ctx, zlog).Info("admin request to purge empty results cache", zap.Uint64("low_block_num", lowBlockNum), zap.Uint64("high_block_num", highBlockNum))
+		if err := b.Pool.PurgeEmptyResultsCache(lowBlockNum, highBlockNum); err != nil {
+			writeError(ctx, w, derr.UnexpectedError(ctx, err))
+			return
+		}
+
+		writeJSON(ctx, w, &purgeEmptyResultsCacheResponse{
+			LowBlockNum:  lowBlockNum,
+			HighBlockNum: highBlockNum,
+		})
+	}
+}
+
+func blockRangeParams(ctx context.Context, r *http.Request) (lowBlockNum, highBlockNum uint64, err error) {
+	lowBlockNum, lowErr := strconv.ParseUint(r.FormValue("low_block_num"), 10, 64)
+	highBlockNum, highErr := strconv.ParseUint(r.FormValue("high_block_num"), 10, 64)
+	if lowErr != nil || highErr != nil || highBlockNum < lowBlockNum {
+		return 0, 0, derr.RequestValidationError(ctx, url.Values{
+			"low_block_num":  []string{"required, unsigned integer lower or equal to high_block_num"},
+			"high_block_num": []string{"required, unsigned integer greater or equal to low_block_num"},
+		})
+	}
+	return lowBlockNum, highBlockNum, nil
+}
+
+type listShardsResponse struct {
+	LowestServeableBlockNum uint64              `json:"lowest_serveable_block_num"`
+	Shards                  []*ShardInfo        `json:"shards"`
+	MissingRanges           []search.BlockRange `json:"missing_ranges"`
+}
+
+// listShardsHandler serves `GET /v1/admin/shards`
+func (b *ArchiveBackend) listShardsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(r.Context(), w, &listShardsResponse{
+			LowestServeableBlockNum: b.Pool.GetLowestServeableBlockNum(),
+			Shards:                  b.Pool.ListShards(),
+			MissingRanges:           b.Pool.MissingRanges(),
+		})
+	}
+}
+
+type listTiersResponse struct {
+	Tiers []*TierUsage `json:"tiers"`
+}
+
+// listTiersHandler serves `GET /v1/admin/tiers`
+func (b *ArchiveBackend) listTiersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(r.Context(), w, &listTiersResponse{
+			Tiers: b.Pool.TierUsage(),
+		})
+	}
+}
+
+type shardOperationResponse struct {
+	StartBlock uint64 `json:"start_block"`
+	Operation  string `json:"operation"`
+}
+
+// shardOperationHandler serves `POST /v1/admin/shards/{start_block}/reload`
+// and `POST /v1/admin/shards/{start_block}/evict`
+func (b *ArchiveBackend) shardOperationHandler(operation string, apply func(baseBlockNum uint64) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		zlogger := logging.Logger(ctx, zlog)
+
+		startBlock, err := strconv.ParseUint(mux.Vars(r)["start_block"], 10, 64)
+		if err != nil {
+			writeError(ctx, w, derr.RequestValidationError(ctx, url.Values{
+				"start_block": []string{"required, unsigned integer"},
+			}))
+			return
+		}
+
+		if b.shuttingDown.Load() {
+			writeError(ctx, w, derr.ServiceUnavailableError(ctx, nil, "archive"))
+			return
+		}
+
+		zlogger.Info("admin request on shard", zap.String("operation", operation), zap.Uint64("start_block", startBlock))
+		if err := apply(startBlock); err != nil {
+			zlogger.Warn("admin operation on shard failed", zap.String("operation", operation), zap.Uint64("start_block", startBlock), zap.Error(err))
+			writeError(ctx, w, shardError(ctx, err))
+			return
+		}
+		zlogger.Info("admin operation on shard done", zap.String("operation", operation), zap.Uint64("start_block", startBlock))
+
+		writeJSON(ctx, w, &shardOperationResponse{
+			StartBlock: startBlock,
+			Operation:  operation,
+		})
+	}
+}
+
+type checkShardIntegrityResponse struct {
+	StartBlock uint64      `json:"start_block"`
+	Valid      bool        `json:"valid"`
+	Errors     []string    `json:"errors,omitempty"`
+	MetaInfo   interface{} `json:"meta_info,omitempty"`
+}
+
+// checkShardIntegrityHandler serves `POST /v1/admin/shards/{start_block}/check`
+func (b *ArchiveBackend) checkShardIntegrityHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		startBlock, err := strconv.ParseUint(mux.Vars(r)["start_block"], 10, 64)
+		if err != nil {
+			writeError(ctx, w, derr.RequestValidationError(ctx, url.Values{
+				"start_block": []string{"required, unsigned integer"},
+			}))
+			return
+		}
+
+		metaInfo, err := b.Pool.CheckShardIntegrity(startBlock)
+		if errors.Is(err, ErrShardNotFound) || errors.Is(err, ErrShardNotLoaded) {
+			writeError(ctx, w, shardError(ctx, err))
+			return
+		}
+
+		response := &checkShardIntegrityResponse{
+			StartBlock: startBlock,
+			Valid:      err == nil,
+			MetaInfo:   metaInfo,
+		}
+
+		var multiErr search.MultiError
+		if errors.As(err, &multiErr) {
+			for _, e := range multiErr {
+				response.Errors = append(response.Errors, e.Error())
+			}
+		} else if err != nil {
+			response.Errors = []string{err.Error()}
+		}
+
+		if !response.Valid {
+			logging.Logger(ctx, zlog).Warn("shard integrity check failed", zap.Uint64("start_block", startBlock), zap.Strings("errors", response.Errors))
+		}
+
+		writeJSON(ctx, w, response)
+	}
+}
+
+type pollRemoteIndicesResponse struct {
+	RetrievedShards int    `json:"retrieved_shards"`
+	LastBlockNum    uint64 `json:"last_block_num"`
+}
+
+// pollRemoteIndicesHandler serves `POST /v1/admin/poll?low_block_num=X&high_block_num=Y`,
+// see `IndexPool.PollRemoteIndicesOnce`
+func (b *ArchiveBackend) pollRemoteIndicesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		zlogger := logging.Logger(ctx, zlog)
+
+		lowBlockNum, highBlockNum, err := blockRangeParams(ctx, r)
+		if err != nil {
+			writeError(ctx, w, err)
+			return
+		}
+
+		if b.shuttingDown.Load() {
+			writeError(ctx, w, derr.ServiceUnavailableError(ctx, nil, "archive"))
+			return
+		}
+
+		zlogger.Info("admin request to poll remote indices", zap.Uint64("low_block_num", lowBlockNum), zap.Uint64("high_block_num", highBlockNum))
+		count, err := b.Pool.PollRemoteIndicesOnce(lowBlockNum, highBlockNum)
+		zlogger.Info("admin poll of remote indices done", zap.Int("retrieved_shards", count), zap.Error(err))
+		if err != nil {
+			writeError(ctx, w, derr.UnexpectedError(ctx, err))
+			return
+		}
+
+		writeJSON(ctx, w, &pollRemoteIndicesResponse{
+			RetrievedShards: count,
+			LastBlockNum:    b.Pool.LastReadOnlyIndexedBlock(),
+		})
+	}
+}
+
+func shardError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrShardNotFound):
+		return derr.HTTPNotFoundError(ctx, err, derr.C("shard_not_found_error"), "The requested shard is not part of this archive.")
+	case errors.Is(err, ErrShardInUse):
+		return derr.HTTPConflictError(ctx, err, derr.C("shard_in_use_error"), "The requested shard is being queried, try again shortly.")
+	case errors.Is(err, ErrShardNotLoaded):
+		return derr.HTTPConflictError(ctx, err, derr.C("shard_not_loaded_error"), "The requested shard is not loaded, reload it first.")
+	}
+	return derr.UnexpectedError(ctx, err)
+}
@@ -49,6 +49,7 @@ type archiveQuery struct {
 	metrics        *search.QueryMetrics
 	zlog           *zap.Logger
 	ProcessedShard bool
+	StoppedAtGap   bool
 }
 
 func (b *ArchiveBackend) newArchiveQuery(
@@ -116,17 +117,29 @@ func (q *archiveQuery) run() {
 		return
 	}
 
-	if q.pool.emptyResultsCache != nil {
+	indexIterator.SetRequiredFieldTerms(q.bquery.RequiredFieldTerms())
+
+	var queryHash string
+	if q.pool.emptyResultsCache != nil || q.pool.shardResultsCache != nil {
 		hash, err := q.bquery.Hash()
 		if err != nil {
 			zlog.Warn("error getting bquery hash", zap.Error(err))
 		} else {
-			zlog.Debug("loading roaring", zap.String("raw_query", q.bquery.Raw), zap.String("hash", hash))
-			indexIterator.LoadRoaring(hash)
-			defer indexIterator.OptimizeAndPublishRoaring()
+			queryHash = hash
 		}
 	}
 
+	if q.pool.emptyResultsCache != nil && queryHash != "" {
+		zlog.Debug("loading roaring", zap.String("raw_query", q.bquery.Raw), zap.String("hash", queryHash))
+		indexIterator.LoadRoaring(queryHash)
+		defer indexIterator.OptimizeAndPublishRoaring()
+	}
+
+	var resultsCache *shardResultsCache
+	if queryHash != "" {
+		resultsCache = q.pool.shardResultsCache
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
@@ -155,6 +168,13 @@ IndexLoop:
 
 		index, skipIndex, releaseIndex := indexIterator.Next()
 		if index == nil {
+			if indexIterator.AtGap() {
+				// the caller resumes past the gap, elsewhere, keeping matches in order
+				q.zlog.Info("reached a shard missing from the pool, stopping before it", zap.Uint64("block_num", indexIterator.CurrentBase()))
+				q.StoppedAtGap = true
+				break
+			}
+
 			q.zlog.Debug("reached last index for query", zap.Uint64("base", indexIterator.CurrentBase()))
 			break
 		}
@@ -207,19 +227,66 @@ IndexLoop:
 				q.metrics.SearchedIndexesCount.Inc()
 			}
 
+			coversFullRange := index.RequestCoversFullRange(q.lowBlockNum, q.highBlockNum)
+			if resultsCache != nil && coversFullRange {
+				if matches, found := resultsCache.Get(queryHash, index.StartBlock, q.sortDesc); found {
+					statsAwareIndexReleaser()
+					qto.ReportShard(int(index.StartBlock), len(matches))
+					shardResult.resultChan <- &singleIndexResult{Matches: matches}
+					return nil
+				}
+			}
+
+			if q.pool.lazyShards != nil {
+				release, err := q.pool.lazyShards.Acquire(ctx, index, q.sortDesc)
+				if err != nil {
+					statsAwareIndexReleaser()
+					return fmt.Errorf("acquiring shard %d: %w", index.StartBlock, err)
+				}
+				defer release()
+			}
+
+			if q.pool.lazyShards == nil {
+				if err := q.pool.loadEvictedShard(index); err != nil {
+					statsAwareIndexReleaser()
+					return err
+				}
+			}
+
+			// holding the shard prevents admin operations from closing it under us
+			index.Lock.RLock()
+			if index.Index == nil || q.pool.isQuarantined(index.StartBlock) {
+				index.Lock.RUnlock()
+				statsAwareIndexReleaser()
+				return q.pool.shardUnavailableError(index)
+			}
+			releaseShard := func() {
+				index.Lock.RUnlock()
+				statsAwareIndexReleaser()
+			}
+
 			startTime := time.Now()
-			matches, err := search.RunSingleIndexQuery(ctx, q.sortDesc, q.lowBlockNum, q.highBlockNum, q.matchCollector, q.bquery, index, statsAwareIndexReleaser, q.metrics)
+			matches, err := search.RunSingleIndexQuery(ctx, q.sortDesc, q.lowBlockNum, q.highBlockNum, q.matchCollector, q.bquery, index, releaseShard, q.metrics)
 			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+
+				q.pool.suspectShard(index, err)
 				return err
 			}
 
 			qto.ReportShard(int(index.StartBlock), len(matches))
 
-			if len(matches) == 0 && index.RequestCoversFullRange(q.lowBlockNum, q.highBlockNum) {
+			if len(matches) == 0 && coversFullRange {
 				zlog.Debug("marking empty", zap.Uint64("start_bock", index.StartBlock))
 				indexIterator.MarkEmpty(index.StartBlock)
 			}
 
+			if resultsCache != nil && coversFullRange {
+				resultsCache.Put(queryHash, index.StartBlock, q.sortDesc, matches)
+			}
+
 			shardResult.resultChan <- &singleIndexResult{
 				Matches: matches,
 
@@ -0,0 +1,277 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+var queryLogSaveInterval = time.Minute
+
+// autoWarmupMaxPendingRanges bounds the ranges waiting to be warmed up,
+// the oldest one being dropped past it.
+var autoWarmupMaxPendingRanges = 64
+
+// warmShardFunc is overridden in tests
+var warmShardFunc = warmShard
+
+// autoWarmer replays the top queries of the query log against shards, to
+// pre-populate the OS page cache and the empty results cache. It runs a
+// single shard at a time, alongside the queries being served, and sleeps
+// between shards so it stays within `cpuBudget` (a fraction of one CPU).
+type autoWarmer struct {
+	backend    *ArchiveBackend
+	log        *queryLog
+	queryCount int
+	cpuBudget  float64
+
+	lock    sync.Mutex
+	pending []warmupRange
+	wake    chan struct{}
+}
+
+type warmupRange struct {
+	lowBlockNum, highBlockNum uint64
+}
+
+// EnableAutoWarmup records the queries served, and replays the
+// `queryCount` most frequent and most expensive ones on the ranges passed
+// to `WarmupRecordedQueries` and on every shard newly polled, filled in a
+// gap, reloaded or restored from quarantine.
+func (b *ArchiveBackend) EnableAutoWarmup(queryCount int, cpuBudget float64) error {
+	if cpuBudget <= 0 || cpuBudget > 1 {
+		return fmt.Errorf("invalid auto warmup cpu budget %f, expecting a fraction of one cpu, greater than 0 and up to 1", cpuBudget)
+	}
+
+	log, err := loadQueryLog(b.Pool.IndexesPath)
+	if err != nil {
+		return err
+	}
+
+	b.autoWarmer = &autoWarmer{
+		backend:    b,
+		log:        log,
+		queryCount: queryCount,
+		cpuBudget:  cpuBudget,
+		wake:       make(chan struct{}, 1),
+	}
+
+	b.Pool.onShardLoaded = func(shard *search.ShardIndex) {
+		b.WarmupRecordedQueries(shard.StartBlock, shard.EndBlock)
+	}
+
+	go b.autoWarmer.run()
+	return nil
+}
+
+// WarmupRecordedQueries schedules the warmup of the shards overlapping
+// `[lowBlockNum, highBlockNum]` with the top queries of the query log.
+func (b *ArchiveBackend) WarmupRecordedQueries(lowBlockNum, highBlockNum uint64) {
+	if b.autoWarmer == nil {
+		return
+	}
+
+	w := b.autoWarmer
+	w.schedule(warmupRange{lowBlockNum, highBlockNum})
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule merges `r` with the pending range it overlaps or touches, if
+// any, and otherwise queues it, dropping the oldest pending range when
+// `autoWarmupMaxPendingRanges` are already waiting.
+func (w *autoWarmer) schedule(r warmupRange) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for i, pending := range w.pending {
+		if pending.touches(r) {
+			w.pending[i] = pending.union(r)
+			return
+		}
+	}
+
+	if len(w.pending) >= autoWarmupMaxPendingRanges {
+		dropped := w.pending[0]
+		zlog.Debug("too many ranges waiting to be warmed up, dropping the oldest one", zap.Uint64("low_block_num", dropped.lowBlockNum), zap.Uint64("high_block_num", dropped.highBlockNum))
+		w.pending = w.pending[1:]
+	}
+	w.pending = append(w.pending, r)
+}
+
+func (r warmupRange) touches(other warmupRange) bool {
+	return (r.highBlockNum == math.MaxUint64 || other.lowBlockNum <= r.highBlockNum+1) &&
+		(other.highBlockNum == math.MaxUint64 || r.lowBlockNum <= other.highBlockNum+1)
+}
+
+func (r warmupRange) union(other warmupRange) warmupRange {
+	if other.lowBlockNum < r.lowBlockNum {
+		r.lowBlockNum = other.lowBlockNum
+	}
+	if other.highBlockNum > r.highBlockNum {
+		r.highBlockNum = other.highBlockNum
+	}
+	return r
+}
+
+func (w *autoWarmer) recordQuery(bquery *search.BleveQuery, cost time.Duration) {
+	hash, err := bquery.Hash()
+	if err != nil {
+		return
+	}
+	w.log.Record(hash, bquery.Raw, cost, time.Now())
+}
+
+func (w *autoWarmer) run() {
+	saveTicker := time.NewTicker(queryLogSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-w.backend.Terminating():
+			if err := w.log.save(); err != nil {
+				zlog.Warn("cannot save query log", zap.Error(err))
+			}
+			return
+		case <-saveTicker.C:
+			if err := w.log.save(); err != nil {
+				zlog.Warn("cannot save query log", zap.Error(err))
+			}
+		case <-w.wake:
+			for {
+				w.lock.Lock()
+				if len(w.pending) == 0 {
+					w.lock.Unlock()
+					break
+				}
+				r := w.pending[0]
+				w.pending = w.pending[1:]
+				w.lock.Unlock()
+
+				w.warmRange(r)
+			}
+		}
+	}
+}
+
+func (w *autoWarmer) warmRange(r warmupRange) {
+	top := w.log.Top(w.queryCount, time.Now())
+	if len(top) == 0 {
+		return
+	}
+
+	zlog.Info("warming up recorded queries", zap.Int("query_count", len(top)), zap.Uint64("low_block_num", r.lowBlockNum), zap.Uint64("high_block_num", r.highBlockNum))
+	start := time.Now()
+	for _, entry := range top {
+		if !w.warmQuery(entry, r) {
+			return
+		}
+	}
+	zlog.Info("recorded queries warmup completed", zap.Duration("duration", time.Since(start)))
+}
+
+// warmQuery returns false when the archive is shutting down.
+func (w *autoWarmer) warmQuery(entry queryLogEntry, r warmupRange) bool {
+	bquery, err := search.NewParsedQuery(entry.Query)
+	if err != nil {
+		zlog.Debug("cannot parse recorded query", zap.String("query", entry.Query), zap.Error(err))
+		return true
+	}
+
+	pool := w.backend.Pool
+	indexIterator, err := pool.GetIndexIterator(r.lowBlockNum, r.highBlockNum, false)
+	if err != nil {
+		zlog.Debug("cannot warm up range", zap.Error(err))
+		return true
+	}
+
+	if pool.emptyResultsCache != nil {
+		indexIterator.LoadRoaring(entry.Hash)
+		defer indexIterator.OptimizeAndPublishRoaring()
+	}
+
+	for {
+		index, skipIndex, releaseIndex := indexIterator.Next()
+		if index == nil {
+			return true
+		}
+		if skipIndex {
+			releaseIndex()
+			continue
+		}
+
+		if w.stopped() {
+			releaseIndex()
+			return false
+		}
+
+		start := time.Now()
+		count, err := warmShardFunc(index, bquery, releaseIndex)
+		if err != nil {
+			zlog.Debug("cannot warm up shard", zap.Uint64("start_block", index.StartBlock), zap.Error(err))
+		} else {
+			metrics.AutoWarmupShards.Inc()
+			if count == 0 && index.RequestCoversFullRange(r.lowBlockNum, r.highBlockNum) {
+				indexIterator.MarkEmpty(index.StartBlock)
+			}
+		}
+
+		w.throttle(time.Since(start))
+	}
+}
+
+// stopped tells if the archive is shutting down.
+func (w *autoWarmer) stopped() bool {
+	select {
+	case <-w.backend.Terminating():
+		return true
+	default:
+	}
+	return w.backend.shuttingDown.Load()
+}
+
+// throttle sleeps long enough, after spending `spent` warming up, to stay
+// within the cpu budget.
+func (w *autoWarmer) throttle(spent time.Duration) {
+	pause := time.Duration(float64(spent) * (1 - w.cpuBudget) / w.cpuBudget)
+	select {
+	case <-w.backend.Terminating():
+	case <-time.After(pause):
+	}
+}
+
+// warmShard runs `bquery` on a loaded shard and counts its matches.
+// Unloaded shards are not downloaded for the sake of warming them up.
+func warmShard(index *search.ShardIndex, bquery *search.BleveQuery, releaseIndex func()) (uint64, error) {
+	defer releaseIndex()
+
+	index.Lock.RLock()
+	defer index.Lock.RUnlock()
+
+	if index.Index == nil {
+		return 0, fmt.Errorf("shard not loaded")
+	}
+	return searcherCount(index, bquery)
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/shutter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestAutoWarmer_Schedule(t *testing.T) {
+	defer func(max int) { autoWarmupMaxPendingRanges = max }(autoWarmupMaxPendingRanges)
+	autoWarmupMaxPendingRanges = 2
+
+	tests := []struct {
+		name          string
+		ranges        []warmupRange
+		expectPending []warmupRange
+	}{
+		{
+			name:          "adjacent shards are merged",
+			ranges:        []warmupRange{{0, 9}, {10, 19}, {20, 29}},
+			expectPending: []warmupRange{{0, 29}},
+		},
+		{
+			name:          "overlapping ranges are merged",
+			ranges:        []warmupRange{{10, 19}, {0, 99}},
+			expectPending: []warmupRange{{0, 99}},
+		},
+		{
+			name:          "disjoint ranges are queued",
+			ranges:        []warmupRange{{0, 9}, {50, 59}},
+			expectPending: []warmupRange{{0, 9}, {50, 59}},
+		},
+		{
+			name:          "oldest range dropped when full",
+			ranges:        []warmupRange{{0, 9}, {50, 59}, {100, 109}},
+			expectPending: []warmupRange{{50, 59}, {100, 109}},
+		},
+		{
+			name:          "unbounded range",
+			ranges:        []warmupRange{{100, 1<<64 - 1}, {0, 99}},
+			expectPending: []warmupRange{{0, 1<<64 - 1}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &autoWarmer{}
+			for _, r := range test.ranges {
+				w.schedule(r)
+			}
+			assert.Equal(t, test.expectPending, w.pending)
+		})
+	}
+}
+
+func TestAutoWarmer_WarmsWhileServingQueries(t *testing.T) {
+	defer func(factory search.BleveQueryFactory) { search.GetBleveQueryFactory = factory }(search.GetBleveQueryFactory)
+	search.GetBleveQueryFactory = func(rawQuery string) *search.BleveQuery { return &search.BleveQuery{Raw: rawQuery} }
+	defer func(f func(*search.ShardIndex, *search.BleveQuery, func()) (uint64, error)) { warmShardFunc = f }(warmShardFunc)
+
+	warmed := make(chan uint64, 10)
+	warmShardFunc = func(index *search.ShardIndex, bquery *search.BleveQuery, releaseIndex func()) (uint64, error) {
+		defer releaseIndex()
+		warmed <- index.StartBlock
+		return 1, nil
+	}
+
+	pool := &IndexPool{
+		ShardSize: 10,
+		ReadPool:  []*search.ShardIndex{{StartBlock: 0, EndBlock: 9}, {StartBlock: 10, EndBlock: 19}},
+	}
+	backend := &ArchiveBackend{Shutter: shutter.New(), Pool: pool, shuttingDown: atomic.NewBool(false)}
+	backend.activeQueries.Store(1)
+
+	log, err := loadQueryLog("")
+	require.NoError(t, err)
+	log.Record("hash", "account:eoscanadacom", time.Millisecond, time.Now())
+
+	backend.autoWarmer = &autoWarmer{backend: backend, log: log, queryCount: 1, cpuBudget: 1, wake: make(chan struct{}, 1)}
+	pool.onShardLoaded = func(shard *search.ShardIndex) {
+		backend.WarmupRecordedQueries(shard.StartBlock, shard.EndBlock)
+	}
+	go backend.autoWarmer.run()
+	defer backend.Shutdown(nil)
+
+	pool.shardLoaded(pool.ReadPool[1])
+
+	select {
+	case startBlock := <-warmed:
+		assert.Equal(t, uint64(10), startBlock, "only the loaded shard is warmed up")
+	case <-time.After(time.Second):
+		t.Fatal("shard not warmed up while a query is being served")
+	}
+}
+
+func TestAutoWarmer_StopsWhenShuttingDown(t *testing.T) {
+	defer func(factory search.BleveQueryFactory) { search.GetBleveQueryFactory = factory }(search.GetBleveQueryFactory)
+	search.GetBleveQueryFactory = func(rawQuery string) *search.BleveQuery { return &search.BleveQuery{Raw: rawQuery} }
+	defer func(f func(*search.ShardIndex, *search.BleveQuery, func()) (uint64, error)) { warmShardFunc = f }(warmShardFunc)
+
+	var warmed int
+	warmShardFunc = func(index *search.ShardIndex, bquery *search.BleveQuery, releaseIndex func()) (uint64, error) {
+		defer releaseIndex()
+		warmed++
+		return 1, nil
+	}
+
+	pool := &IndexPool{
+		ShardSize: 10,
+		ReadPool:  []*search.ShardIndex{{StartBlock: 0, EndBlock: 9}, {StartBlock: 10, EndBlock: 19}},
+	}
+	backend := &ArchiveBackend{Shutter: shutter.New(), Pool: pool, shuttingDown: atomic.NewBool(true)}
+
+	w := &autoWarmer{backend: backend, queryCount: 1, cpuBudget: 1}
+	assert.False(t, w.warmQuery(queryLogEntry{Hash: "hash", Query: "account:eoscanadacom"}, warmupRange{0, 19}))
+	assert.Equal(t, 0, warmed)
+}
@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/dfuse-io/derr"
 	"github.com/dfuse-io/dgrpc"
 	"github.com/dfuse-io/dmesh"
 	dmeshClient "github.com/dfuse-io/dmesh/client"
@@ -34,6 +35,7 @@ import (
 	"github.com/gorilla/mux"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -51,6 +53,17 @@ type ArchiveBackend struct {
 	MaxQueryThreads int
 	shuttingDown    *atomic.Bool
 	shutdownDelay   time.Duration
+	admission       *search.AdmissionController
+	autoWarmer      *autoWarmer
+	activeQueries   atomic.Int64
+
+	// propagationDelay is how long routers take to observe the archive is
+	// not ready anymore, new queries are served until it elapses
+	propagationDelay time.Duration
+	// draining rejects new queries, interrupted is closed when in-flight
+	// queries did not complete within the `shutdownDelay`
+	draining    atomic.Bool
+	interrupted chan struct{}
 }
 
 func NewBackend(
@@ -77,6 +90,9 @@ func NewBackend(
 		matchCollector: matchCollector,
 		shuttingDown:   atomic.NewBool(false),
 		shutdownDelay:  shutdownDelay,
+		interrupted:    make(chan struct{}),
+
+		propagationDelay: defaultShutdownPropagationDelay,
 	}
 
 	return archive
@@ -86,6 +102,22 @@ func (b *ArchiveBackend) SetMaxQueryThreads(threads int) {
 	b.MaxQueryThreads = threads
 }
 
+// defaultShutdownPropagationDelay leaves routers time to observe, through
+// dmesh, that the archive is not ready anymore.
+var defaultShutdownPropagationDelay = 5 * time.Second
+
+// SetShutdownPropagationDelay overrides `defaultShutdownPropagationDelay`
+// when `delay` is not zero.
+func (b *ArchiveBackend) SetShutdownPropagationDelay(delay time.Duration) {
+	if delay != 0 {
+		b.propagationDelay = delay
+	}
+}
+
+func (b *ArchiveBackend) SetAdmissionController(admission *search.AdmissionController) {
+	b.admission = admission
+}
+
 // FIXME: are we *really* servicing some things through REST ?!  That
 // `indexed_fields` should be served via gRPC.. all those middlewares,
 // gracking, logging, etc.. wuuta
@@ -97,6 +129,17 @@ func (b *ArchiveBackend) startServer() {
 	// Metrics & health endpoints
 	metricsRouter.HandleFunc("/healthz", b.healthzHandler())
 
+	// Admin endpoints
+	adminRouter := router.PathPrefix("/v1/admin").Subrouter()
+	adminRouter.Use(search.OpenCensusMiddleware, search.NewLoggingMiddleware(zlog))
+	adminRouter.HandleFunc("/empty_results_cache/purge", b.purgeEmptyResultsCacheHandler()).Methods("POST")
+	adminRouter.HandleFunc("/shards", b.listShardsHandler()).Methods("GET")
+	adminRouter.HandleFunc("/tiers", b.listTiersHandler()).Methods("GET")
+	adminRouter.HandleFunc("/shards/{start_block:[0-9]+}/reload", b.shardOperationHandler("reload", b.Pool.ReloadShard)).Methods("POST")
+	adminRouter.HandleFunc("/shards/{start_block:[0-9]+}/evict", b.shardOperationHandler("evict", b.Pool.EvictShard)).Methods("POST")
+	adminRouter.HandleFunc("/shards/{start_block:[0-9]+}/check", b.checkShardIntegrityHandler()).Methods("POST")
+	adminRouter.HandleFunc("/poll", b.pollRemoteIndicesHandler()).Methods("POST")
+
 	// HTTP
 	b.httpServer = &http.Server{Addr: b.httpListenAddr, Handler: router}
 	go func() {
@@ -162,6 +205,18 @@ func (b *ArchiveBackend) StreamMatches(req *pbsearch.BackendRequest, stream pbse
 	ctx, cancel := context.WithCancel(stream.Context())
 	defer cancel()
 
+	if b.draining.Load() {
+		return derr.Statusf(codes.Unavailable, "archive is shutting down, not accepting new queries")
+	}
+
+	go func() {
+		select {
+		case <-b.interrupted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	if req.WithReversible {
 		return fmt.Errorf("archive backend does not support WithReversible == true")
 	}
@@ -186,19 +241,43 @@ func (b *ArchiveBackend) StreamMatches(req *pbsearch.BackendRequest, stream pbse
 		return err // status.New(codes.InvalidArgument, err.Error())
 	}
 
+	b.activeQueries.Inc()
+	defer b.activeQueries.Dec()
+
+	queryThreads := b.MaxQueryThreads
+	if b.admission != nil {
+		ticket, err := b.admission.Admit(ctx, search.ClientIDFromContext(ctx))
+		if err != nil {
+			zlogger.Info("query not admitted", zap.Error(err))
+			return err
+		}
+		defer ticket.Release()
+
+		queryThreads = ticket.QueryThreads(b.MaxQueryThreads)
+	}
+
 	metrics := search.NewQueryMetrics(zlogger, req.Descending, bquery.Raw, b.Pool.ShardSize, req.LowBlockNum, req.HighBlockNum)
 	defer metrics.Finalize()
 
 	pmetrics.ActiveQueryCount.Inc()
 	defer pmetrics.ActiveQueryCount.Dec()
 
+	if b.autoWarmer != nil {
+		start := time.Now()
+		defer func() { b.autoWarmer.recordQuery(bquery, time.Since(start)) }()
+	}
+
 	trailer := metadata.New(nil)
 	defer stream.SetTrailer(trailer)
 
 	// set the trailer as a default -1 in case we error out
 	trailer.Set("last-block-read", fmt.Sprint("-1"))
+	if b.Pool.AllowGaps {
+		trailer.Set(search.MissingRangesTrailerKey, search.FormatBlockRanges(b.Pool.MissingRanges()))
+	}
 
 	archiveQuery := b.newArchiveQuery(ctx, req.Descending, req.LowBlockNum, req.HighBlockNum, bquery, metrics)
+	archiveQuery.maxQueryThreads = queryThreads
 
 	first, _, irr, _, _, _ := b.SearchPeer.HeadBlockPointers()
 	if err := archiveQuery.checkBoundaries(first, irr); err != nil {
@@ -211,6 +290,9 @@ func (b *ArchiveBackend) StreamMatches(req *pbsearch.BackendRequest, stream pbse
 		select {
 		case err := <-archiveQuery.Errors:
 			if err != nil {
+				if b.isInterrupted() {
+					return derr.Statusf(codes.Unavailable, "archive is shutting down, query interrupted")
+				}
 				if ctx.Err() == context.Canceled {
 					// error is most likely not from us, but happened upstream
 					return nil
@@ -225,6 +307,11 @@ func (b *ArchiveBackend) StreamMatches(req *pbsearch.BackendRequest, stream pbse
 			if !ok {
 
 				if !archiveQuery.ProcessedShard {
+					if archiveQuery.StoppedAtGap {
+						// nothing read, the `last-block-read` trailer stays at -1
+						zlogger.Info("query starts in a shard missing from the pool")
+						return nil
+					}
 					return fmt.Errorf("search backend did not process any shard, potential block range routing issue advertising ranges we don't serve")
 				} else {
 					trailer.Set("last-block-read", fmt.Sprintf("%d", archiveQuery.LastBlockRead.Load()))
@@ -278,22 +365,20 @@ func (b *ArchiveBackend) shutdownHTTPServer() error { /* gracefully */
 }
 
 func (b *ArchiveBackend) stop() {
-	zlog.Info("cleaning up archive backend", zap.Duration("shutdown_delay", b.shutdownDelay))
-	// allow kube service the time to finish in-flight request before the service stops
-	// routing traffic
-	// We are probably on batch mode where no search peer exists, so don't publish it
-	if b.SearchPeer != nil {
-		b.SearchPeer.Locked(func() {
-			b.SearchPeer.Ready = false
-		})
-		err := b.dmeshClient.PublishNow(b.SearchPeer)
-		if err != nil {
-			zlog.Error("could not set search peer to not ready", zap.Error(err))
-		}
+	zlog.Info("cleaning up archive backend", zap.Duration("propagation_delay", b.propagationDelay), zap.Duration("shutdown_delay", b.shutdownDelay))
+	if err := b.Pool.SetNotReady(); err != nil {
+		zlog.Error("could not set search peer to not ready", zap.Error(err))
 	}
-
 	b.shuttingDown.Store(true)
-	time.Sleep(b.shutdownDelay)
+
+	// queries keep coming until routers see we are not ready anymore
+	time.Sleep(b.propagationDelay)
+
+	// from now on, routers retry new queries on another archive
+	b.draining.Store(true)
+	if !b.drainQueries(b.shutdownDelay) {
+		zlog.Warn("in-flight queries did not complete within shutdown delay, interrupted them", zap.Int64("active_queries", b.activeQueries.Load()))
+	}
 
 	// Graceful shutdown of HTTP server, drain connections, before closing indexes.
 	zlog.Info("gracefully shutting down http server, draining connections")
@@ -306,3 +391,30 @@ func (b *ArchiveBackend) stop() {
 		zlog.Error("error closing indexes", zap.Error(err))
 	}
 }
+
+var drainPollInterval = 100 * time.Millisecond
+
+// drainQueries waits for the in-flight queries to complete, at most
+// `timeout`, after which the remaining ones are interrupted with an
+// `Unavailable` error. It returns false when queries were interrupted.
+func (b *ArchiveBackend) drainQueries(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for b.activeQueries.Load() > 0 {
+		select {
+		case <-deadline:
+			close(b.interrupted)
+			return false
+		case <-time.After(drainPollInterval):
+		}
+	}
+	return true
+}
+
+func (b *ArchiveBackend) isInterrupted() bool {
+	select {
+	case <-b.interrupted:
+		return true
+	default:
+		return false
+	}
+}
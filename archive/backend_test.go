@@ -0,0 +1,89 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pbsearch "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestArchiveBackend_DrainQueries(t *testing.T) {
+	defer func(interval time.Duration) { drainPollInterval = interval }(drainPollInterval)
+	drainPollInterval = time.Millisecond
+
+	tests := []struct {
+		name              string
+		activeQueries     int64
+		completeAfter     time.Duration
+		expectDrained     bool
+		expectInterrupted bool
+	}{
+		{
+			name:          "no in-flight query",
+			expectDrained: true,
+		},
+		{
+			name:          "in-flight queries completing within the delay",
+			activeQueries: 2,
+			completeAfter: 10 * time.Millisecond,
+			expectDrained: true,
+		},
+		{
+			name:              "in-flight queries outliving the delay",
+			activeQueries:     1,
+			completeAfter:     time.Hour,
+			expectInterrupted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &ArchiveBackend{interrupted: make(chan struct{})}
+			b.activeQueries.Store(test.activeQueries)
+			if test.activeQueries > 0 {
+				time.AfterFunc(test.completeAfter, func() { b.activeQueries.Store(0) })
+			}
+
+			assert.Equal(t, test.expectDrained, b.drainQueries(50*time.Millisecond))
+			assert.Equal(t, test.expectInterrupted, b.isInterrupted())
+		})
+	}
+}
+
+func TestArchiveBackend_RejectsQueriesWhenDraining(t *testing.T) {
+	defer func(collector search.MatchCollector) { search.GetMatchCollector = collector }(search.GetMatchCollector)
+	search.GetMatchCollector = search.TestMatchCollector
+
+	b := &ArchiveBackend{interrupted: make(chan struct{})}
+	b.draining.Store(true)
+
+	client, cleanup := TestNewClient(t, b)
+	defer cleanup()
+
+	stream, err := client.StreamMatches(context.Background(), &pbsearch.BackendRequest{Query: "account:eoscanadacom", HighBlockNum: 10})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, int64(0), b.activeQueries.Load())
+}
@@ -0,0 +1,361 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/index"
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+const emptyResultsGenerationFilename = "empty-results-generation.json"
+
+// emptyResultsGenerationSaveInterval throttles saving the generation when
+// only shards are tracked, purges are always saved right away.
+var emptyResultsGenerationSaveInterval = 10 * time.Second
+
+// emptyResultsSegmentShards is the number of consecutive shards whose
+// empty bits share a bitmap, and so a cache key.
+const emptyResultsSegmentShards = 100
+
+// emptyResultsGeneration versions the keys of the empty results cache.
+//
+// The bitmap of each segment of shards is keyed on what the shards'
+// metadata says of their content, the tar checksum and mapping version
+// from their manifest, so every replica holding the same shards computes
+// the same key, and a reindexed shard never finds the bits of its
+// previous content. Shards without a manifest are keyed on the fields
+// they hold instead.
+//
+// Every purge of a block range requested by an operator starts a new
+// generation on top of that, the previous generation's bitmap being
+// carried over minus the bits of the purged range.
+type emptyResultsGeneration struct {
+	lock    sync.Mutex
+	path    string
+	dirty   bool
+	savedAt time.Time
+
+	// Generation chains the hashes of every purge, so replicas sharing a
+	// cache and having received the same purges agree on it, without
+	// keeping them all.
+	Generation         string             `json:"generation"`
+	PreviousGeneration string             `json:"previous_generation"`
+	LastPurge          *emptyResultsPurge `json:"last_purge"`
+
+	// ShardChecksums and ShardMappings are kept from the manifests of the
+	// downloaded shards, they are not found on disk afterwards.
+	ShardChecksums map[uint64]string `json:"shard_checksums"`
+	ShardMappings  map[uint64]string `json:"shard_mappings"`
+}
+
+type emptyResultsPurge struct {
+	LowBlockNum  uint64    `json:"low_block_num"`
+	HighBlockNum uint64    `json:"high_block_num"`
+	PurgedAt     time.Time `json:"purged_at"`
+}
+
+func loadEmptyResultsGeneration(indexesPath string) (*emptyResultsGeneration, error) {
+	gen := &emptyResultsGeneration{}
+	if indexesPath != "" {
+		gen.path = filepath.Join(indexesPath, emptyResultsGenerationFilename)
+		cnt, err := ioutil.ReadFile(gen.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading empty results generation %q: %w", gen.path, err)
+		}
+
+		if err == nil {
+			if err := json.Unmarshal(cnt, gen); err != nil {
+				return nil, fmt.Errorf("decoding empty results generation %q: %w", gen.path, err)
+			}
+		}
+	}
+
+	if gen.ShardChecksums == nil {
+		gen.ShardChecksums = map[uint64]string{}
+	}
+	if gen.ShardMappings == nil {
+		gen.ShardMappings = map[uint64]string{}
+	}
+
+	return gen, nil
+}
+
+// keys returns the cache key for `hash` on the shards of `segment` in the
+// current generation and, when there is one, in the previous generation
+// along with the purge separating them.
+func (g *emptyResultsGeneration) keys(hash, mappingVersion string, shardSize uint64, segment uint32) (current, previous string, purge *emptyResultsPurge) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	contents := g.segmentContents(shardSize, segment)
+	current = emptyResultsCacheKey(hash, mappingVersion, segment, contents, g.Generation)
+	if g.LastPurge == nil {
+		return current, "", nil
+	}
+
+	return current, emptyResultsCacheKey(hash, mappingVersion, segment, contents, g.PreviousGeneration), g.LastPurge
+}
+
+// segmentContents fingerprints the metadata of the shards of `segment`.
+func (g *emptyResultsGeneration) segmentContents(shardSize uint64, segment uint32) string {
+	h := sha256.New()
+	lowBlockNum := uint64(segment) * emptyResultsSegmentShards * shardSize
+	for i := uint64(0); i < emptyResultsSegmentShards; i++ {
+		baseBlockNum := lowBlockNum + i*shardSize
+		checksum, hasChecksum := g.ShardChecksums[baseBlockNum]
+		mapping, hasMapping := g.ShardMappings[baseBlockNum]
+		if hasChecksum || hasMapping {
+			fmt.Fprintf(h, "%d=%s/%s;", baseBlockNum, checksum, mapping)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func emptyResultsCacheKey(hash, mappingVersion string, segment uint32, contents, generation string) string {
+	key := hash
+	if mappingVersion != "" {
+		key += ":m=" + mappingVersion
+	}
+	key += fmt.Sprintf(":s=%d-%s", segment, contents)
+	if generation != "" {
+		key += ":g=" + generation
+	}
+	return key
+}
+
+func nextEmptyResultsGeneration(generation string, purge *emptyResultsPurge) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s;%d-%d", generation, purge.LowBlockNum, purge.HighBlockNum)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (g *emptyResultsGeneration) purge(lowBlockNum, highBlockNum uint64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	purge := &emptyResultsPurge{
+		LowBlockNum:  lowBlockNum,
+		HighBlockNum: highBlockNum,
+		PurgedAt:     time.Now(),
+	}
+
+	g.PreviousGeneration = g.Generation
+	g.Generation = nextEmptyResultsGeneration(g.Generation, purge)
+	g.LastPurge = purge
+
+	return g.save()
+}
+
+// recordShardContent records the `checksum` and `mappingVersion` of the
+// shard starting at `baseBlockNum`, as found in its manifest. An empty
+// `mappingVersion` leaves the mapping to be fingerprinted when the shard
+// is opened.
+func (g *emptyResultsGeneration) recordShardContent(baseBlockNum uint64, checksum, mappingVersion string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.ShardChecksums[baseBlockNum] = checksum
+	if mappingVersion != "" {
+		g.ShardMappings[baseBlockNum] = mappingVersion
+	} else {
+		delete(g.ShardMappings, baseBlockNum)
+	}
+	g.dirty = true
+
+	return g.saveThrottled()
+}
+
+// recordShardMapping records the `mapping` fingerprint of the shard
+// starting at `baseBlockNum`, unless its manifest gave a mapping version.
+func (g *emptyResultsGeneration) recordShardMapping(baseBlockNum uint64, mapping string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, found := g.ShardMappings[baseBlockNum]; found {
+		return nil
+	}
+
+	g.ShardMappings[baseBlockNum] = mapping
+	g.dirty = true
+
+	return g.saveThrottled()
+}
+
+func (g *emptyResultsGeneration) hasShardMapping(baseBlockNum uint64) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	_, found := g.ShardMappings[baseBlockNum]
+	return found
+}
+
+func (g *emptyResultsGeneration) saveThrottled() error {
+	if time.Since(g.savedAt) < emptyResultsGenerationSaveInterval {
+		return nil
+	}
+	return g.save()
+}
+
+func (g *emptyResultsGeneration) flush() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.flushLocked()
+}
+
+func (g *emptyResultsGeneration) flushLocked() error {
+	if !g.dirty {
+		return nil
+	}
+	return g.save()
+}
+
+func (g *emptyResultsGeneration) save() error {
+	if g.path == "" {
+		return nil
+	}
+
+	cnt, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("encoding empty results generation: %w", err)
+	}
+
+	tmpPath := g.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, cnt, 0644); err != nil {
+		return fmt.Errorf("writing empty results generation %q: %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, g.path); err != nil {
+		return err
+	}
+
+	g.dirty = false
+	g.savedAt = time.Now()
+	return nil
+}
+
+// shardMapping fingerprints the fields held by a shard, which change
+// along with the mapping it was indexed with.
+func shardMapping(idx index.Index) (string, error) {
+	reader, err := idx.Reader()
+	if err != nil {
+		return "", fmt.Errorf("getting reader: %w", err)
+	}
+	defer reader.Close()
+
+	fields, err := reader.Fields()
+	if err != nil {
+		return "", fmt.Errorf("getting fields: %w", err)
+	}
+	sort.Strings(fields)
+
+	h := sha256.New()
+	for _, field := range fields {
+		fmt.Fprintf(h, "%s;", field)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
+
+// PurgeEmptyResultsCache makes the empty results cache forget every bit
+// it holds for the shards overlapping `[lowBlockNum, highBlockNum]`, to be
+// used when those shards were reindexed.
+func (p *IndexPool) PurgeEmptyResultsCache(lowBlockNum, highBlockNum uint64) error {
+	if highBlockNum < lowBlockNum {
+		return fmt.Errorf("invalid purge range, high block %d is lower than low block %d", highBlockNum, lowBlockNum)
+	}
+
+	if p.emptyResultsGeneration == nil {
+		return fmt.Errorf("empty results cache generation not loaded")
+	}
+
+	zlog.Info("purging empty results cache", zap.Uint64("low_block_num", lowBlockNum), zap.Uint64("high_block_num", highBlockNum))
+	if err := p.emptyResultsGeneration.purge(lowBlockNum, highBlockNum); err != nil {
+		return err
+	}
+
+	metrics.RoarCachePurges.Inc()
+
+	if p.shardResultsCache != nil {
+		p.shardResultsCache.PurgeRange(lowBlockNum-lowBlockNum%p.ShardSize, highBlockNum)
+	}
+	return nil
+}
+
+// emptyResultsKeys returns the cache keys of the empty bits of `hash` on
+// the shards of `segment`, see `emptyResultsGeneration.keys`.
+func (p *IndexPool) emptyResultsKeys(hash string, segment uint32) (current, previous string, purge *emptyResultsPurge) {
+	if p.emptyResultsGeneration == nil {
+		return emptyResultsCacheKey(hash, p.MappingVersion, segment, "", ""), "", nil
+	}
+	return p.emptyResultsGeneration.keys(hash, p.MappingVersion, p.ShardSize, segment)
+}
+
+// trackShardContent records the content of the shard starting at
+// `baseBlockNum`, from its `manifest` when it has one, which keys the
+// empty results cache of its segment.
+func (p *IndexPool) trackShardContent(baseBlockNum uint64, checksum string, manifest *search.ShardManifest) error {
+	if p.emptyResultsGeneration == nil {
+		return nil
+	}
+
+	// a verified manifest has the same checksum as the downloaded tar
+	var mappingVersion string
+	if manifest != nil {
+		mappingVersion = manifest.MappingVersion
+	}
+	return p.emptyResultsGeneration.recordShardContent(baseBlockNum, checksum, mappingVersion)
+}
+
+func (p *IndexPool) flushEmptyResultsGeneration() {
+	if p.emptyResultsGeneration == nil {
+		return
+	}
+
+	if err := p.emptyResultsGeneration.flush(); err != nil {
+		zlog.Warn("cannot save empty results cache generation", zap.Error(err))
+	}
+}
+
+// trackShardMapping records the fields of the shard `shard`, keying the
+// empty results cache of its segment when its manifest gave no mapping
+// version.
+func (p *IndexPool) trackShardMapping(shard *search.ShardIndex) error {
+	if p.emptyResultsGeneration == nil || shard.Index == nil {
+		return nil
+	}
+
+	if p.emptyResultsGeneration.hasShardMapping(shard.StartBlock) {
+		return nil
+	}
+
+	mapping, err := shardMapping(shard.Index)
+	if err != nil {
+		return err
+	}
+	return p.emptyResultsGeneration.recordShardMapping(shard.StartBlock, "fields:"+mapping)
+}
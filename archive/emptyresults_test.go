@@ -0,0 +1,248 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/archive/roarcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mapRoarCache struct {
+	lock    sync.Mutex
+	entries map[string][]byte
+}
+
+func newMapRoarCache() *mapRoarCache {
+	return &mapRoarCache{entries: map[string][]byte{}}
+}
+
+func (c *mapRoarCache) Put(key string, roar *roaring.Bitmap) error {
+	cnt, err := roar.ToBytes()
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = cnt
+	return nil
+}
+
+func (c *mapRoarCache) Get(key string, roar *roaring.Bitmap) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cnt, found := c.entries[key]
+	if !found {
+		return roarcache.ErrCacheMiss
+	}
+	_, err := roar.FromBuffer(cnt)
+	return err
+}
+
+func (c *mapRoarCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+func TestEmptyResultsGeneration_Keys(t *testing.T) {
+	gen, err := loadEmptyResultsGeneration("")
+	require.NoError(t, err)
+
+	current, previous, purge := gen.keys("abc", "", 100, 0)
+	assert.Regexp(t, `^abc:s=0-[0-9a-f]{16}$`, current)
+	assert.Equal(t, "", previous)
+	assert.Nil(t, purge)
+
+	versioned, _, _ := gen.keys("abc", "v2", 100, 0)
+	assert.Regexp(t, `^abc:m=v2:s=0-[0-9a-f]{16}$`, versioned)
+
+	require.NoError(t, gen.purge(0, 99))
+	withA, previous, purge := gen.keys("abc", "", 100, 0)
+	assert.Regexp(t, `^abc:s=0-[0-9a-f]{16}:g=[0-9a-f]{16}$`, withA)
+	assert.Equal(t, current, previous)
+	assert.Equal(t, uint64(99), purge.HighBlockNum)
+
+	require.NoError(t, gen.purge(200, 299))
+	withAB, previous, _ := gen.keys("abc", "", 100, 0)
+	assert.NotEqual(t, withA, withAB)
+	assert.Equal(t, withA, previous)
+
+	replica, err := loadEmptyResultsGeneration("")
+	require.NoError(t, err)
+	require.NoError(t, replica.purge(0, 99))
+	require.NoError(t, replica.purge(200, 299))
+	replicaKey, _, _ := replica.keys("abc", "", 100, 0)
+	assert.Equal(t, withAB, replicaKey, "replicas having received the same purges agree on the generation")
+}
+
+func TestEmptyResultsGeneration_KeysFromShardContents(t *testing.T) {
+	gen, err := loadEmptyResultsGeneration("")
+	require.NoError(t, err)
+	replica, err := loadEmptyResultsGeneration("")
+	require.NoError(t, err)
+
+	segment0, _, _ := gen.keys("abc", "", 100, 0)
+	segment1, _, _ := gen.keys("abc", "", 100, 1)
+
+	require.NoError(t, gen.recordShardContent(100, "aa", "v1"))
+	changed0, _, _ := gen.keys("abc", "", 100, 0)
+	unchanged1, _, _ := gen.keys("abc", "", 100, 1)
+	assert.NotEqual(t, segment0, changed0)
+	assert.Equal(t, segment1, unchanged1, "only the segment holding the shard is keyed on it")
+
+	require.NoError(t, replica.recordShardContent(100, "aa", "v1"))
+	replicaKey, _, _ := replica.keys("abc", "", 100, 0)
+	assert.Equal(t, changed0, replicaKey, "replicas holding the same shards agree on the key")
+
+	require.NoError(t, replica.recordShardContent(100, "bb", "v1"))
+	reindexed, _, _ := replica.keys("abc", "", 100, 0)
+	assert.NotEqual(t, changed0, reindexed)
+
+	require.NoError(t, replica.recordShardContent(100, "aa", "v2"))
+	remapped, _, _ := replica.keys("abc", "", 100, 0)
+	assert.NotEqual(t, changed0, remapped)
+
+	require.NoError(t, gen.recordShardMapping(100, "fields:ff"))
+	assert.Equal(t, "v1", gen.ShardMappings[100], "the mapping version of the manifest is kept over the fields")
+
+	require.NoError(t, gen.recordShardContent(200, "cc", ""))
+	require.NoError(t, gen.recordShardMapping(200, "fields:ff"))
+	assert.Equal(t, "fields:ff", gen.ShardMappings[200])
+}
+
+func TestEmptyResultsGeneration_Persistence(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "empty-results-generation")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	gen, err := loadEmptyResultsGeneration(indexesPath)
+	require.NoError(t, err)
+
+	require.NoError(t, gen.recordShardContent(100, "aa", "v1"))
+	require.NoError(t, gen.purge(0, 99))
+	current, _, _ := gen.keys("abc", "", 100, 0)
+
+	reloaded, err := loadEmptyResultsGeneration(indexesPath)
+	require.NoError(t, err)
+
+	reloadedCurrent, _, _ := reloaded.keys("abc", "", 100, 0)
+	assert.Equal(t, current, reloadedCurrent)
+}
+
+func TestIndexIterator_RoaringSharedBetweenReplicas(t *testing.T) {
+	cache := newMapRoarCache()
+	newPool := func() *IndexPool {
+		generation, err := loadEmptyResultsGeneration("")
+		require.NoError(t, err)
+		return &IndexPool{ShardSize: 100, emptyResultsCache: cache, emptyResultsGeneration: generation}
+	}
+
+	pool := newPool()
+	require.NoError(t, pool.trackShardContent(100, "aa", &search.ShardManifest{MappingVersion: "v1"}))
+
+	it, err := pool.GetIndexIterator(0, 99999, false)
+	require.NoError(t, err)
+	it.LoadRoaring("abc")
+	it.MarkEmpty(100)
+	it.MarkEmpty(10000)
+	it.OptimizeAndPublishRoaring()
+	require.Eventually(t, func() bool { return cache.len() == 2 }, time.Second, 5*time.Millisecond, "one bitmap per segment")
+
+	tests := []struct {
+		name      string
+		checksum  string
+		manifest  *search.ShardManifest
+		expectHit bool
+	}{
+		{"fresh replica", "", nil, false},
+		{"same shard", "aa", &search.ShardManifest{MappingVersion: "v1"}, true},
+		{"reindexed shard", "bb", &search.ShardManifest{MappingVersion: "v1"}, false},
+		{"new mapping", "aa", &search.ShardManifest{MappingVersion: "v2"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replica := newPool()
+			if test.checksum != "" {
+				require.NoError(t, replica.trackShardContent(100, test.checksum, test.manifest))
+			}
+
+			it, err := replica.GetIndexIterator(0, 99999, false)
+			require.NoError(t, err)
+			it.LoadRoaring("abc")
+			assert.Equal(t, test.expectHit, it.containedInRoaring(100))
+			assert.True(t, it.containedInRoaring(10000), "the other segment is untouched")
+		})
+	}
+}
+
+func TestIndexIterator_LoadRoaringAfterPurge(t *testing.T) {
+	cache := newMapRoarCache()
+	generation, err := loadEmptyResultsGeneration("")
+	require.NoError(t, err)
+
+	pool := &IndexPool{
+		ShardSize:              100,
+		emptyResultsCache:      cache,
+		emptyResultsGeneration: generation,
+	}
+
+	it, err := pool.GetIndexIterator(0, 999, false)
+	require.NoError(t, err)
+	it.LoadRoaring("abc")
+	for _, base := range []uint64{0, 100, 200, 300} {
+		it.MarkEmpty(base)
+	}
+	it.OptimizeAndPublishRoaring()
+	require.Eventually(t, func() bool { return cache.len() == 1 }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, pool.PurgeEmptyResultsCache(150, 250))
+
+	it, err = pool.GetIndexIterator(0, 999, false)
+	require.NoError(t, err)
+	it.LoadRoaring("abc")
+	assert.True(t, it.containedInRoaring(0))
+	assert.Equal(t, []uint32{0, 3}, it.roar.ToArray())
+	assert.True(t, it.roarSegments[0].dirty, "carried over bitmap should be republished under the new generation")
+}
+
+func TestIndexIterator_LoadRoaringWithoutGeneration(t *testing.T) {
+	cache := newMapRoarCache()
+	pool := &IndexPool{ShardSize: 100, emptyResultsCache: cache}
+
+	it, err := pool.GetIndexIterator(0, 999, false)
+	require.NoError(t, err)
+	it.LoadRoaring("abc")
+	it.MarkEmpty(100)
+	it.OptimizeAndPublishRoaring()
+	require.Eventually(t, func() bool { return cache.len() == 1 }, time.Second, 5*time.Millisecond)
+
+	it, err = pool.GetIndexIterator(0, 999, false)
+	require.NoError(t, err)
+	it.LoadRoaring("abc")
+	assert.True(t, it.containedInRoaring(100))
+	assert.False(t, it.containedInRoaring(200))
+}
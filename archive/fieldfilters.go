@@ -0,0 +1,116 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+const defaultFieldTermsFiltersMaxBytes = 256 * 1024 * 1024
+
+// unreadableFilterBytes is what an entry remembering an unreadable filter
+// counts for, so it is not read again on every query.
+const unreadableFilterBytes = 64
+
+// fieldTermsFilters keeps the field terms filters of shards in memory,
+// reading them from disk the first time a query needs them. Entries are
+// evicted least recently used first when over `maxBytes`.
+type fieldTermsFilters struct {
+	maxBytes uint64
+
+	lock      sync.Mutex
+	entries   map[*search.FieldTermsFilterFile]*list.Element
+	lru       *list.List // front is most recently used
+	usedBytes uint64
+}
+
+type fieldTermsFilterEntry struct {
+	file      *search.FieldTermsFilterFile
+	filter    *search.FieldTermsFilter // nil when unreadable
+	sizeBytes uint64
+}
+
+func newFieldTermsFilters(maxBytes uint64) *fieldTermsFilters {
+	return &fieldTermsFilters{
+		maxBytes: maxBytes,
+		entries:  map[*search.FieldTermsFilterFile]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// SetFieldTermsFiltersMaxBytes bounds the memory held by the field terms
+// filters of shards, `defaultFieldTermsFiltersMaxBytes` otherwise.
+func (p *IndexPool) SetFieldTermsFiltersMaxBytes(maxBytes uint64) {
+	zlog.Info("bounding field terms filters memory", zap.Uint64("max_bytes", maxBytes))
+	p.fieldTermsFilters = newFieldTermsFilters(maxBytes)
+}
+
+// get returns the filter of `file`, reading it when not in memory. It
+// returns nil when the filter is unreadable or larger than `maxBytes`.
+func (f *fieldTermsFilters) get(file *search.FieldTermsFilterFile) *search.FieldTermsFilter {
+	f.lock.Lock()
+	if element, found := f.entries[file]; found {
+		f.lru.MoveToFront(element)
+		f.lock.Unlock()
+		return element.Value.(*fieldTermsFilterEntry).filter
+	}
+	f.lock.Unlock()
+
+	// concurrent queries may read the same filter, only one of them is kept
+	metrics.FieldTermsFilterLoads.Inc()
+	entry := &fieldTermsFilterEntry{file: file, sizeBytes: unreadableFilterBytes}
+	filter, err := file.Read()
+	if err != nil {
+		zlog.Warn("cannot read field terms filter, ignoring it", zap.String("path", file.Path), zap.Error(err))
+	} else {
+		entry.filter, entry.sizeBytes = filter, filter.SizeBytes()
+	}
+
+	if entry.sizeBytes > f.maxBytes {
+		return nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if element, found := f.entries[file]; found {
+		f.lru.MoveToFront(element)
+		return element.Value.(*fieldTermsFilterEntry).filter
+	}
+
+	f.entries[file] = f.lru.PushFront(entry)
+	f.usedBytes += entry.sizeBytes
+
+	for f.usedBytes > f.maxBytes {
+		f.removeElement(f.lru.Back())
+		metrics.FieldTermsFilterEvictions.Inc()
+	}
+	metrics.FieldTermsFiltersBytes.SetUint64(f.usedBytes)
+
+	return entry.filter
+}
+
+// removeElement must be called under lock.
+func (f *fieldTermsFilters) removeElement(element *list.Element) {
+	entry := element.Value.(*fieldTermsFilterEntry)
+	f.lru.Remove(element)
+	delete(f.entries, entry.file)
+	f.usedBytes -= entry.sizeBytes
+}
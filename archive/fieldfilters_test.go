@@ -0,0 +1,79 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldTermsFilters_Get(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fieldfilters")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFilter := func(name string, terms ...string) *search.FieldTermsFilterFile {
+		filter := search.NewFieldTermsFilter(1000, search.DefaultFieldTermsFilterFalsePositiveRate)
+		for _, term := range terms {
+			filter.Add("account", term)
+		}
+
+		file, err := os.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+		_, err = filter.WriteTo(file)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		return &search.FieldTermsFilterFile{Path: file.Name()}
+	}
+
+	first := writeFilter("first", "eosio")
+	second := writeFilter("second", "battlefield")
+	unreadable := &search.FieldTermsFilterFile{Path: filepath.Join(dir, "missing")}
+
+	filterBytes := search.NewFieldTermsFilter(1000, search.DefaultFieldTermsFilterFalsePositiveRate).SizeBytes()
+	filters := newFieldTermsFilters(filterBytes + unreadableFilterBytes)
+
+	filter := filters.get(first)
+	require.NotNil(t, filter)
+	assert.True(t, filter.MayContain("account", "eosio"))
+	assert.Nil(t, filters.get(unreadable))
+	assert.Equal(t, filterBytes+unreadableFilterBytes, filters.usedBytes)
+
+	// the least recently used filter is evicted past the budget
+	filters.get(unreadable)
+	require.NotNil(t, filters.get(second))
+	assert.Len(t, filters.entries, 2)
+	assert.NotContains(t, filters.entries, first)
+	assert.Contains(t, filters.entries, unreadable)
+	assert.Equal(t, filterBytes+unreadableFilterBytes, filters.usedBytes)
+
+	// evicted filters are read again when needed
+	filter = filters.get(first)
+	require.NotNil(t, filter)
+	assert.True(t, filter.MayContain("account", "eosio"))
+	assert.NotContains(t, filters.entries, second)
+
+	// filters larger than the budget are never kept
+	small := newFieldTermsFilters(filterBytes - 1)
+	assert.Nil(t, small.get(first))
+	assert.Len(t, small.entries, 0)
+}
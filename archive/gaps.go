@@ -0,0 +1,258 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+// The `ReadPool` is an interval map: its shards are sorted by block num,
+// but holes are allowed between them when `AllowGaps` is set. The shards
+// missing in those holes are tracked as gaps. Queries stop before reaching
+// one, and report them through the `search.MissingRangesTrailerKey`
+// trailer. They are filled once available in the indexes store, see
+// `LaunchGapRefills`, or by reloading them with `ReloadShard`.
+
+// addGaps holds the shards from `fromBlockNum` up to `toBlockNum`,
+// exclusively, as missing from the pool.
+func (p *IndexPool) addGaps(fromBlockNum, toBlockNum uint64) {
+	p.gapsLock.Lock()
+	defer p.gapsLock.Unlock()
+
+	if p.gaps == nil {
+		p.gaps = map[uint64]bool{}
+	}
+	for missing := fromBlockNum; missing < toBlockNum; missing += p.ShardSize {
+		if !p.gaps[missing] {
+			p.gaps[missing] = true
+			metrics.MissingShards.Inc()
+		}
+	}
+}
+
+// defaultGapLookaheadShards is used when `GapLookaheadShards` is not set.
+var defaultGapLookaheadShards = 10
+
+// skipMissingIndex holds as gaps the shards missing from the indexes store
+// starting at `baseBlockNum`, when one of the `GapLookaheadShards`
+// following ones is available, so polling resumes at it.
+func (p *IndexPool) skipMissingIndex(baseBlockNum uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	lookahead := p.GapLookaheadShards
+	if lookahead <= 0 {
+		lookahead = defaultGapLookaheadShards
+	}
+
+	for i := 1; i <= lookahead; i++ {
+		nextBlockNum := baseBlockNum + uint64(i)*p.ShardSize
+		found, err := p.indexesStore.FileExists(ctx, fmt.Sprintf("shards-%d/%010d.bleve.tar.zst", p.ShardSize, nextBlockNum))
+		if err != nil {
+			zlog.Debug("cannot look past missing index", zap.Uint64("base", baseBlockNum), zap.Error(err))
+			return
+		}
+		if !found {
+			continue
+		}
+
+		zlog.Warn("index missing from the indexes store while a following one is available, holding it as a gap", zap.Uint64("base", baseBlockNum), zap.Uint64("next_available", nextBlockNum))
+		p.readPoolLock.Lock()
+		p.addGaps(baseBlockNum, nextBlockNum)
+		p.readPoolLock.Unlock()
+		return
+	}
+}
+
+// LaunchGapRefills downloads, every `interval` (a minute by default), the
+// gaps that became available in the indexes store, until the pool is
+// closed.
+func (p *IndexPool) LaunchGapRefills(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	for !p.closing.Load() {
+		if filled := p.RefillGapsOnce(); filled > 0 {
+			zlog.Info("gaps filled from the indexes store", zap.Int("count", filled))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// RefillGapsOnce downloads the gaps available in the indexes store, and
+// returns how many were filled.
+func (p *IndexPool) RefillGapsOnce() (filled int) {
+	return p.refillGaps(0, math.MaxUint64)
+}
+
+// refillGaps downloads the gaps overlapping `[lowBlockNum, highBlockNum]`
+// available in the indexes store, and returns how many were filled.
+func (p *IndexPool) refillGaps(lowBlockNum, highBlockNum uint64) (filled int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, missing := range p.MissingRanges() {
+		for base := missing.Low; base <= missing.High; base += p.ShardSize {
+			if base+p.ShardSize-1 < lowBlockNum || base > highBlockNum {
+				continue
+			}
+			if p.closing.Load() {
+				return filled
+			}
+
+			found, err := p.indexesStore.FileExists(ctx, fmt.Sprintf("shards-%d/%010d.bleve.tar.zst", p.ShardSize, base))
+			if err != nil {
+				zlog.Debug("cannot look for missing index", zap.Uint64("base", base), zap.Error(err))
+				return filled
+			}
+			if !found {
+				continue
+			}
+
+			if err := p.reloads.do(base, func() error { return p.fillGap(base) }); err != nil {
+				zlog.Warn("cannot fill gap", zap.Uint64("base", base), zap.Error(err))
+				continue
+			}
+			filled++
+		}
+	}
+	return filled
+}
+
+// fillGap downloads a shard missing from the pool and inserts it in the
+// `ReadPool`, unless it was truncated meanwhile.
+func (p *IndexPool) fillGap(baseBlockNum uint64) error {
+	if err := p.downloadAndExtract(0, fmt.Sprintf("%010d", baseBlockNum)); err != nil {
+		return fmt.Errorf("downloading shard %d: %w", baseBlockNum, err)
+	}
+
+	idx, err := p.openReadOnly(baseBlockNum)
+	if err != nil {
+		if path := p.getReadOnlyIndexFilePath(baseBlockNum); p.isManagedPath(path) {
+			p.discardCorrupted(baseBlockNum, path, err)
+		}
+		return fmt.Errorf("opening shard %d: %w", baseBlockNum, err)
+	}
+
+	p.readPoolLock.Lock()
+	if !p.isGap(baseBlockNum) {
+		p.readPoolLock.Unlock()
+		_ = idx.Close()
+		return fmt.Errorf("shard %d is not missing anymore", baseBlockNum)
+	}
+
+	// a new slice, iterators hold snapshots of the current one
+	pos := sort.Search(len(p.ReadPool), func(i int) bool { return p.ReadPool[i].StartBlock > baseBlockNum })
+	readPool := make([]*search.ShardIndex, 0, len(p.ReadPool)+1)
+	readPool = append(readPool, p.ReadPool[:pos]...)
+	readPool = append(readPool, idx)
+	p.ReadPool = append(readPool, p.ReadPool[pos:]...)
+
+	p.clearGap(baseBlockNum)
+	p.readPoolLock.Unlock()
+
+	p.shardLoaded(idx)
+	return nil
+}
+
+// shardAt returns the shard of `readPool` holding `blockNum`, nil when
+// past its bounds or in a gap.
+func shardAt(readPool []*search.ShardIndex, shardSize, blockNum uint64) *search.ShardIndex {
+	pos := sort.Search(len(readPool), func(i int) bool { return readPool[i].StartBlock > blockNum }) - 1
+	if pos >= 0 && blockNum-readPool[pos].StartBlock < shardSize {
+		return readPool[pos]
+	}
+	return nil
+}
+
+// lastGap returns the base block num of the last gap, 0 when there are none.
+func (p *IndexPool) lastGap() (base uint64) {
+	p.gapsLock.Lock()
+	defer p.gapsLock.Unlock()
+
+	for missing := range p.gaps {
+		if missing > base {
+			base = missing
+		}
+	}
+	return base
+}
+
+// isGap tells if the shard holding `blockNum` is missing from the pool.
+func (p *IndexPool) isGap(blockNum uint64) bool {
+	p.gapsLock.Lock()
+	defer p.gapsLock.Unlock()
+
+	if len(p.gaps) == 0 {
+		return false
+	}
+	return p.gaps[blockNum-blockNum%p.ShardSize]
+}
+
+// clearGap is called once the shard at `baseBlockNum` is loaded.
+func (p *IndexPool) clearGap(baseBlockNum uint64) {
+	p.gapsLock.Lock()
+	defer p.gapsLock.Unlock()
+
+	if p.gaps[baseBlockNum] {
+		delete(p.gaps, baseBlockNum)
+		metrics.MissingShards.Dec()
+		zlog.Info("gap filled", zap.Uint64("base", baseBlockNum))
+	}
+}
+
+// clearGapsBelow forgets the gaps truncated from the pool.
+func (p *IndexPool) clearGapsBelow(blockNum uint64) {
+	p.gapsLock.Lock()
+	defer p.gapsLock.Unlock()
+
+	for missing := range p.gaps {
+		if missing < blockNum {
+			delete(p.gaps, missing)
+			metrics.MissingShards.Dec()
+		}
+	}
+}
+
+// MissingRanges returns the block ranges of the shards missing from the
+// pool, in order, with adjacent shards merged.
+func (p *IndexPool) MissingRanges() (out []search.BlockRange) {
+	p.gapsLock.Lock()
+	bases := make([]uint64, 0, len(p.gaps))
+	for base := range p.gaps {
+		bases = append(bases, base)
+	}
+	p.gapsLock.Unlock()
+
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	for _, base := range bases {
+		if len(out) > 0 && out[len(out)-1].High+1 == base {
+			out[len(out)-1].High = base + p.ShardSize - 1
+			continue
+		}
+		out = append(out, search.BlockRange{Low: base, High: base + p.ShardSize - 1})
+	}
+	return out
+}
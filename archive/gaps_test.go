@@ -0,0 +1,236 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexPool_MissingRanges(t *testing.T) {
+	pool := &IndexPool{ShardSize: 10}
+	assert.Nil(t, pool.MissingRanges())
+
+	pool.addGaps(50, 60)
+	pool.addGaps(10, 30)
+	pool.addGaps(70, 80)
+	assert.True(t, pool.isGap(20))
+	assert.True(t, pool.isGap(25))
+	assert.False(t, pool.isGap(30))
+
+	assert.Equal(t, []search.BlockRange{{Low: 10, High: 29}, {Low: 50, High: 59}, {Low: 70, High: 79}}, pool.MissingRanges())
+
+	pool.clearGap(20)
+	pool.clearGap(30)
+	assert.Equal(t, []search.BlockRange{{Low: 10, High: 19}, {Low: 50, High: 59}, {Low: 70, High: 79}}, pool.MissingRanges())
+
+	pool.clearGapsBelow(60)
+	assert.Equal(t, []search.BlockRange{{Low: 70, High: 79}}, pool.MissingRanges())
+}
+
+func TestIndexPool_skipMissingIndex(t *testing.T) {
+	tests := []struct {
+		name          string
+		lookahead     int
+		remoteFiles   []string
+		expectNext    uint64
+		expectMissing []search.BlockRange
+	}{
+		{
+			name:       "following shard not available yet",
+			expectNext: 10,
+		},
+		{
+			name:          "following shard available",
+			remoteFiles:   []string{"shards-10/0000000020.bleve.tar.zst"},
+			expectNext:    20,
+			expectMissing: []search.BlockRange{{Low: 10, High: 19}},
+		},
+		{
+			name:          "following shard within lookahead",
+			lookahead:     3,
+			remoteFiles:   []string{"shards-10/0000000040.bleve.tar.zst"},
+			expectNext:    40,
+			expectMissing: []search.BlockRange{{Low: 10, High: 39}},
+		},
+		{
+			name:        "following shard past lookahead",
+			lookahead:   2,
+			remoteFiles: []string{"shards-10/0000000040.bleve.tar.zst"},
+			expectNext:  10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := dstore.NewMockStore(nil)
+			for _, file := range test.remoteFiles {
+				store.SetFile(file, []byte("content"))
+			}
+
+			pool := &IndexPool{
+				ShardSize:          10,
+				AllowGaps:          true,
+				GapLookaheadShards: test.lookahead,
+				indexesStore:       store,
+				ReadPool:           []*search.ShardIndex{{StartBlock: 0, EndBlock: 9}},
+			}
+
+			pool.skipMissingIndex(10)
+
+			assert.Len(t, pool.ReadPool, 1, "gaps are not held in the read pool")
+			assert.Equal(t, test.expectNext, pool.nextReadOnlyIndexBlock())
+			assert.Equal(t, test.expectMissing, pool.MissingRanges())
+		})
+	}
+}
+
+func Test_shardAt(t *testing.T) {
+	readPool := []*search.ShardIndex{
+		{StartBlock: 0, EndBlock: 9},
+		{StartBlock: 10, EndBlock: 19},
+		{StartBlock: 40, EndBlock: 49},
+	}
+
+	tests := []struct {
+		blockNum    uint64
+		expectShard int
+	}{
+		{blockNum: 0, expectShard: 0},
+		{blockNum: 15, expectShard: 1},
+		{blockNum: 25, expectShard: -1},
+		{blockNum: 40, expectShard: 2},
+		{blockNum: 49, expectShard: 2},
+		{blockNum: 50, expectShard: -1},
+	}
+
+	for _, test := range tests {
+		shard := shardAt(readPool, 10, test.blockNum)
+		if test.expectShard == -1 {
+			assert.Nil(t, shard, "block %d", test.blockNum)
+			continue
+		}
+		assert.Equal(t, readPool[test.expectShard], shard, "block %d", test.blockNum)
+	}
+}
+
+func TestIndexIterator_AtGap(t *testing.T) {
+	pool := &IndexPool{
+		ShardSize: 10,
+		ReadPool: []*search.ShardIndex{
+			{StartBlock: 0, EndBlock: 9},
+			{StartBlock: 20, EndBlock: 29},
+		},
+	}
+	pool.addGaps(10, 20)
+
+	it, err := pool.GetIndexIterator(0, 29, false)
+	require.NoError(t, err)
+
+	idx, _, _ := it.Next()
+	require.NotNil(t, idx)
+	assert.Equal(t, uint64(0), idx.StartBlock)
+
+	idx, _, _ = it.Next()
+	assert.Nil(t, idx)
+	assert.True(t, it.AtGap())
+
+	it, err = pool.GetIndexIterator(20, 29, false)
+	require.NoError(t, err)
+	it.Next()
+	idx, _, _ = it.Next()
+	assert.Nil(t, idx)
+	assert.False(t, it.AtGap(), "end of range")
+}
+
+func TestIndexPool_RefillGapsOnce(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "gaps")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	store := dstore.NewMockStore(nil)
+	// available, but not a valid archive
+	store.SetFile("shards-10/0000000020.bleve.tar.zst", []byte("err"))
+
+	pool := &IndexPool{IndexesPath: indexesPath, ShardSize: 10, indexesStore: store}
+	pool.addGaps(10, 30)
+
+	assert.Equal(t, 0, pool.RefillGapsOnce())
+	assert.Equal(t, []search.BlockRange{{Low: 10, High: 29}}, pool.MissingRanges(), "still missing")
+}
+
+func TestIndexPool_PollRemoteIndicesOnce(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowGaps     bool
+		lowBlockNum   uint64
+		highBlockNum  uint64
+		expectNext    uint64
+		expectMissing []search.BlockRange
+	}{
+		{
+			name:         "range following the pool",
+			allowGaps:    true,
+			lowBlockNum:  10,
+			highBlockNum: 29,
+			expectNext:   10,
+		},
+		{
+			name:          "range past the pool with gaps",
+			allowGaps:     true,
+			lowBlockNum:   55,
+			highBlockNum:  69,
+			expectNext:    50,
+			expectMissing: []search.BlockRange{{Low: 10, High: 49}},
+		},
+		{
+			name:         "range past the pool without gaps",
+			lowBlockNum:  55,
+			highBlockNum: 69,
+			expectNext:   10,
+		},
+		{
+			name:         "range within the pool",
+			allowGaps:    true,
+			lowBlockNum:  0,
+			highBlockNum: 9,
+			expectNext:   10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := &IndexPool{
+				ShardSize:          10,
+				AllowGaps:          test.allowGaps,
+				GapLookaheadShards: 1,
+				indexesStore:       dstore.NewMockStore(nil),
+				ReadPool:           []*search.ShardIndex{{StartBlock: 0, EndBlock: 9}},
+			}
+
+			count, err := pool.PollRemoteIndicesOnce(test.lowBlockNum, test.highBlockNum)
+			require.NoError(t, err)
+			assert.Equal(t, 0, count, "nothing available in the indexes store")
+			assert.Equal(t, test.expectNext, pool.nextReadOnlyIndexBlock())
+			assert.Equal(t, test.expectMissing, pool.MissingRanges())
+		})
+	}
+}
@@ -24,17 +24,20 @@ import (
 	"github.com/dfuse-io/search/archive/roarcache"
 	"github.com/dfuse-io/search/metrics"
 	"go.uber.org/zap"
-	"google.golang.org/appengine/memcache"
 )
 
 type indexIterator struct {
 	pool *IndexPool
 
-	roar      *roaring.Bitmap
-	roarCache roarcache.Cache
-	roarKey   string
-	roarLock  sync.RWMutex
-	roarDirty bool
+	// roar holds the empty bits of every segment loaded so far, see
+	// `emptyResultsSegmentShards`
+	roar         *roaring.Bitmap
+	roarCache    roarcache.Cache
+	roarHash     string
+	roarSegments map[uint32]*roarSegment
+	roarLock     sync.RWMutex
+
+	requiredFieldTerms [][]search.FieldTerm
 
 	readPoolStartBlock uint64
 	readPoolSnapshot   []*search.ShardIndex
@@ -76,40 +79,107 @@ func (p *IndexPool) GetIndexIterator(lowBlockNum, highBlockNum uint64, sortDesc
 	return it, nil
 }
 
+type roarSegment struct {
+	key   string
+	dirty bool
+}
+
+// LoadRoaring enables skipping the indexes known to be empty for the query
+// `hash`, the bitmap of each segment of shards being loaded from the cache
+// when the iterator reaches it.
 func (it *indexIterator) LoadRoaring(hash string) {
+	it.roarLock.Lock()
+	defer it.roarLock.Unlock()
+
 	it.roar = roaring.New()
-	it.roarKey = hash
+	it.roarHash = hash
+	it.roarSegments = map[uint32]*roarSegment{}
+}
+
+// loadRoaringSegment merges the bitmap of `segment` in `it.roar`, when
+// not done already.
+func (it *indexIterator) loadRoaringSegment(segment uint32) {
+	it.roarLock.RLock()
+	_, loaded := it.roarSegments[segment]
+	it.roarLock.RUnlock()
+	if loaded {
+		return
+	}
+
+	key, previousKey, purge := it.pool.emptyResultsKeys(it.roarHash, segment)
+	seg := &roarSegment{key: key}
+
+	roar := roaring.New()
+	found := it.getRoaring(key, roar)
+	if !found && previousKey != "" {
+		// Carry over the previous generation, minus the bits of the range
+		// purged since, republishing it under the current generation.
+		if it.getRoaring(previousKey, roar) {
+			roar.RemoveRange(purge.LowBlockNum/it.shardSize, purge.HighBlockNum/it.shardSize+1)
+			seg.dirty = true
+			metrics.RoarCacheCarriedOver.Inc()
+			found = true
+		}
+	}
+
+	if found {
+		metrics.RoarCacheHit.Inc()
+	}
+
+	it.roarLock.Lock()
+	defer it.roarLock.Unlock()
+
+	if _, loaded := it.roarSegments[segment]; loaded {
+		return
+	}
+	it.roarSegments[segment] = seg
+	it.roar.Or(roar)
+}
 
-	err := it.roarCache.Get(it.roarKey, it.roar)
+func (it *indexIterator) getRoaring(key string, roar *roaring.Bitmap) bool {
+	err := it.roarCache.Get(key, roar)
 	if err != nil {
-		if err.Error() == memcache.ErrCacheMiss.Error() {
-			zlog.Debug("cache miss", zap.String("md5sum", it.roarKey))
+		if roarcache.IsCacheMiss(err) {
+			zlog.Debug("cache miss", zap.String("md5sum", key))
 			metrics.RoarCacheMiss.Inc()
-			return
+			return false
 		}
 		zlog.Error("failed getting roaring bitmap key from cache", zap.Error(err))
 		metrics.RoarCacheFail.Inc()
-		return
+		return false
 	}
-	metrics.RoarCacheHit.Inc()
-	return
+	return true
 }
 
 // OptimizeAndPublishRoaring does what it says.  It expects the
 // Iterator not to be used any more, as it writes to the
 // roaring.Bitmap.
 func (it *indexIterator) OptimizeAndPublishRoaring() {
-	if it.roar == nil || !it.roarDirty {
+	if it.roar == nil {
 		return
 	}
 
-	go func() {
-		zlog.Debug("saving roaring", zap.String("md5sum", it.roarKey))
-		it.roar.RunOptimize()
-		if err := it.roarCache.Put(it.roarKey, it.roar); err != nil {
-			zlog.Error("failed writing roaring bitmap to cache", zap.Error(err))
+	it.roarLock.RLock()
+	defer it.roarLock.RUnlock()
+
+	for segment, seg := range it.roarSegments {
+		if !seg.dirty {
+			continue
 		}
-	}()
+
+		low := uint64(segment) * emptyResultsSegmentShards
+		roar := roaring.New()
+		roar.AddRange(low, low+emptyResultsSegmentShards)
+		roar.And(it.roar)
+
+		go func(key string) {
+			zlog.Debug("saving roaring", zap.String("md5sum", key))
+			roar.RunOptimize()
+			if err := it.roarCache.Put(key, roar); err != nil {
+				zlog.Error("failed writing roaring bitmap to cache", zap.Error(err))
+			}
+		}(seg.key)
+	}
 }
 
 func (it *indexIterator) MarkEmpty(idxStartBlock uint64) {
@@ -117,19 +187,37 @@ func (it *indexIterator) MarkEmpty(idxStartBlock uint64) {
 		return
 	}
 
+	absoluteIndexNum := uint32(idxStartBlock / it.shardSize)
+	segment := absoluteIndexNum / emptyResultsSegmentShards
+	it.loadRoaringSegment(segment)
+
 	it.roarLock.Lock()
 	defer it.roarLock.Unlock()
 
-	absoluteIndexNum := uint32(idxStartBlock / it.shardSize)
 	//zlog.Debug("Adding to the bitmap", zap.Uint32("abs_index_num", absoluteIndexNum))
 	it.roar.Add(absoluteIndexNum)
-	it.roarDirty = true
+	it.roarSegments[segment].dirty = true
+}
+
+// SetRequiredFieldTerms enables skipping the indexes whose field terms
+// filter shows that the query cannot match in them.
+func (it *indexIterator) SetRequiredFieldTerms(groups [][]search.FieldTerm) {
+	it.requiredFieldTerms = groups
 }
 
 func (it *indexIterator) CurrentBase() uint64 {
 	return it.currentBlock
 }
 
+// AtGap tells if the iterator stopped at a shard missing from the pool,
+// before the end of its range.
+func (it *indexIterator) AtGap() bool {
+	if it.sortDesc && it.currentBlock < it.endBlock || !it.sortDesc && it.currentBlock > it.endBlock {
+		return false
+	}
+	return it.pool.isGap(it.currentBlock)
+}
+
 func noop() {}
 
 // Next returns the next iterator from the initial `startBlock`.
@@ -150,7 +238,7 @@ func (it *indexIterator) Next() (idx *search.ShardIndex, skipIndex bool, release
 
 	idx, release = it.current(it.currentBlock)
 	if idx != nil {
-		skipIndex = it.containedInRoaring(it.currentBlock)
+		skipIndex = it.containedInRoaring(it.currentBlock) || it.excludedByFieldTermsFilter(idx)
 
 		if it.sortDesc {
 			if idx.StartBlock == 0 {
@@ -171,10 +259,12 @@ func (it *indexIterator) containedInRoaring(currentBlock uint64) bool {
 		return false
 	}
 
+	absoluteIndexNum := uint32(currentBlock / it.shardSize)
+	it.loadRoaringSegment(absoluteIndexNum / emptyResultsSegmentShards)
+
 	it.roarLock.RLock()
 	defer it.roarLock.RUnlock()
 
-	absoluteIndexNum := uint32(currentBlock / it.shardSize)
 	if it.roar.Contains(absoluteIndexNum) {
 		metrics.RoarCacheHitIndexesSkipped.Inc()
 		return true
@@ -182,6 +272,29 @@ func (it *indexIterator) containedInRoaring(currentBlock uint64) bool {
 	return false
 }
 
+func (it *indexIterator) excludedByFieldTermsFilter(idx *search.ShardIndex) bool {
+	if len(it.requiredFieldTerms) == 0 {
+		return false
+	}
+
+	// lazily loaded shards get their filter set when downloaded
+	idx.Lock.RLock()
+	filterFile := idx.FieldTermsFilterFile
+	idx.Lock.RUnlock()
+
+	if filterFile == nil || it.pool.fieldTermsFilters == nil {
+		return false
+	}
+
+	filter := it.pool.fieldTermsFilters.get(filterFile)
+	if filter == nil || filter.MayMatch(it.requiredFieldTerms) {
+		return false
+	}
+
+	metrics.FieldTermsFilterIndexesSkipped.Inc()
+	return true
+}
+
 // current returns the index that contains the `currentBlock`, no matter which type or state
 // it is.
 func (it *indexIterator) current(currentBlock uint64) (idx *search.ShardIndex, releaseFunc func()) {
@@ -195,17 +308,13 @@ func (it *indexIterator) current(currentBlock uint64) (idx *search.ShardIndex, r
 	}
 
 	// Look into read-only indexes
-	readonlySliceIndex := (currentBlock - it.readPoolStartBlock) / p.ShardSize
-	if int(readonlySliceIndex) < len(it.readPoolSnapshot) {
-		idx := it.readPoolSnapshot[readonlySliceIndex]
+	if idx := shardAt(it.readPoolSnapshot, p.ShardSize, currentBlock); idx != nil {
 		return idx, noop
 	}
 
 	// Try to see if the real-time readPool has been updated in the mean time.
 	p.readPoolLock.RLock()
-	if len(p.ReadPool) > int(readonlySliceIndex) {
-		idx = p.ReadPool[readonlySliceIndex]
-	}
+	idx = shardAt(p.ReadPool, p.ShardSize, currentBlock)
 	p.readPoolLock.RUnlock()
 
 	if idx != nil {
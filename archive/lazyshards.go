@@ -0,0 +1,481 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+// lazyShards is used when the pool does not sync its shards up front. The
+// `ReadPool` is then filled with placeholder shards (without an opened
+// `Index`), which are downloaded and opened the first time a query touches
+// them. Shards downloaded in `IndexesPath` are kept in an LRU bounded by
+// `diskBudget` bytes, the least recently used ones are closed and removed
+// from disk when over budget.
+type lazyShards struct {
+	pool          *IndexPool
+	diskBudget    uint64
+	prefetchCount int
+
+	lock      sync.Mutex
+	entries   map[uint64]*lazyShard
+	lru       *list.List // of *lazyShard, most recently used at the front
+	usedBytes uint64
+}
+
+type lazyShard struct {
+	shard *search.ShardIndex
+
+	refCount  int
+	sizeBytes uint64
+	element   *list.Element // non-nil when on disk, and accounted for in the budget
+	removed   bool
+	corrupted bool // removed from disk once not in use, see `discard`
+
+	loading chan struct{} // non-nil while being downloaded and opened
+	loadErr error
+}
+
+func newLazyShards(pool *IndexPool, diskBudget uint64, prefetchCount int) *lazyShards {
+	return &lazyShards{
+		pool:          pool,
+		diskBudget:    diskBudget,
+		prefetchCount: prefetchCount,
+		entries:       map[uint64]*lazyShard{},
+		lru:           list.New(),
+	}
+}
+
+// EnableLazyShardLoading switches the pool to on-demand shard loading,
+// call `ScanRemoteIndexes` instead of `SyncFromStorage` and
+// `ScanOnDiskIndexes` afterwards.
+func (p *IndexPool) EnableLazyShardLoading(diskBudget uint64, prefetchCount int) {
+	p.lazyShards = newLazyShards(p, diskBudget, prefetchCount)
+}
+
+// ScanRemoteIndexes fills the `ReadPool` with placeholders for the longest
+// contiguous streak of shards found in the indexes store from `startBlock`.
+func (p *IndexPool) ScanRemoteIndexes(startBlock, stopBlock uint64) error {
+	if p.lazyShards == nil {
+		return fmt.Errorf("lazy shard loading is not enabled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	remote := map[uint64]bool{}
+	remotePathRE := regexp.MustCompile(`(\d{10})\.bleve\.tar\.zst$`)
+	err := p.indexesStore.Walk(ctx, fmt.Sprintf("shards-%d/", p.ShardSize), ".tmp", func(filename string) error {
+		match := remotePathRE.FindStringSubmatch(filename)
+		if match == nil {
+			return nil
+		}
+		remote[startBlockFromFileName(match[1])] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing remote indexes: %w", err)
+	}
+
+	var shards []*search.ShardIndex
+	for base := startBlock; stopBlock == 0 || base < stopBlock; base += p.ShardSize {
+		if !remote[base] {
+			break
+		}
+
+		shard, err := search.NewShardIndexWithAnalysisQueue(base, p.ShardSize, nil, p.buildWritableIndexFilePath, nil)
+		if err != nil {
+			return err
+		}
+		p.lazyShards.register(shard)
+		shards = append(shards, shard)
+	}
+
+	if len(shards) > 0 {
+		p.fillBoundariesFromManifest(ctx, shards[len(shards)-1])
+	}
+
+	p.readPoolLock.Lock()
+	p.AppendReadIndexes(shards...)
+	p.readPoolLock.Unlock()
+
+	zlog.Info("lazy shards scanned from remote storage",
+		zap.Int("remote_shard_count", len(shards)),
+		zap.Uint64("start_block", startBlock),
+		zap.Uint64("used_bytes", p.lazyShards.UsedBytes()),
+	)
+	return nil
+}
+
+// newLazyShard creates the placeholder of a shard newly available in the
+// indexes store, as found while polling.
+func (p *IndexPool) newLazyShard(ctx context.Context, baseBlockNum uint64) (*search.ShardIndex, error) {
+	shard, err := search.NewShardIndexWithAnalysisQueue(baseBlockNum, p.ShardSize, nil, p.buildWritableIndexFilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p.fillBoundariesFromManifest(ctx, shard)
+	p.lazyShards.register(shard)
+
+	return shard, nil
+}
+
+// fillBoundariesFromManifest sets the boundary ids and times of a placeholder
+// shard, so the archive can advertise its head without opening it.
+func (p *IndexPool) fillBoundariesFromManifest(ctx context.Context, shard *search.ShardIndex) {
+	reader, err := p.indexesStore.OpenObject(ctx, search.ShardManifestPath(p.ShardSize, shard.StartBlock))
+	if err != nil {
+		zlog.Debug("no manifest for lazy shard, boundaries ids unknown", zap.Uint64("base", shard.StartBlock), zap.Error(err))
+		return
+	}
+	defer reader.Close()
+
+	manifest, err := search.ReadShardManifest(reader)
+	if err != nil {
+		zlog.Warn("invalid manifest for lazy shard", zap.Uint64("base", shard.StartBlock), zap.Error(err))
+		return
+	}
+
+	shard.StartBlockID = manifest.StartBlockID
+	shard.StartBlockTime = manifest.StartBlockTime
+	shard.EndBlockID = manifest.EndBlockID
+	shard.EndBlockTime = manifest.EndBlockTime
+}
+
+func (l *lazyShards) register(shard *search.ShardIndex) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry := &lazyShard{shard: shard}
+	l.entries[shard.StartBlock] = entry
+
+	// shards left on disk by a previous run count towards the budget right away
+	path := l.pool.getReadOnlyIndexFilePath(shard.StartBlock)
+	if l.isBudgeted(path) {
+		if size, err := dirSize(path); err == nil {
+			l.track(entry, size)
+		}
+	}
+}
+
+// Acquire ensures the shard is downloaded and opened, and prevents its
+// eviction until `release` is called. Shards following this one in the
+// query's direction are prefetched in the background.
+func (l *lazyShards) Acquire(ctx context.Context, shard *search.ShardIndex, sortDesc bool) (release func(), err error) {
+	l.lock.Lock()
+	entry, found := l.entries[shard.StartBlock]
+	if !found {
+		// shard opened outside of lazy loading, nothing to manage
+		l.lock.Unlock()
+		return noop, nil
+	}
+
+	entry.refCount++
+	for entry.shard.Index == nil {
+		loading := l.startLoad(entry)
+		l.lock.Unlock()
+
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			l.lock.Lock()
+			entry.refCount--
+			l.lock.Unlock()
+			return nil, ctx.Err()
+		}
+
+		l.lock.Lock()
+		if entry.shard.Index == nil {
+			err := entry.loadErr
+			if err == nil {
+				err = fmt.Errorf("shard %d removed while loading", shard.StartBlock)
+			}
+			entry.refCount--
+			l.lock.Unlock()
+			return nil, err
+		}
+	}
+
+	if entry.element != nil {
+		l.lru.MoveToFront(entry.element)
+	}
+	l.lock.Unlock()
+
+	l.prefetch(shard.StartBlock, sortDesc)
+
+	return doneOnce(func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		entry.refCount--
+		if entry.removed && entry.refCount == 0 {
+			l.unload(entry, true)
+			return
+		}
+		if entry.corrupted && entry.refCount == 0 {
+			l.unload(entry, false)
+			entry.corrupted = false
+		}
+		l.evictOverBudget()
+	}), nil
+}
+
+// startLoad must be called under lock.
+func (l *lazyShards) startLoad(entry *lazyShard) chan struct{} {
+	if entry.loading == nil {
+		entry.loading = make(chan struct{})
+		entry.loadErr = nil
+		go l.load(entry)
+	}
+	return entry.loading
+}
+
+func (l *lazyShards) load(entry *lazyShard) {
+	baseBlockNum := entry.shard.StartBlock
+	path := l.pool.getReadOnlyIndexFilePath(baseBlockNum)
+
+	var opened *search.ShardIndex
+	var size uint64
+	err := func() error {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			t0 := time.Now()
+			if err := l.pool.downloadAndExtract(0, fmt.Sprintf("%010d", baseBlockNum)); err != nil {
+				return fmt.Errorf("downloading lazy shard: %w", err)
+			}
+			metrics.LazyShardDownloads.Inc()
+			zlog.Debug("lazy shard downloaded", zap.Uint64("base", baseBlockNum), zap.Duration("timing", time.Since(t0)))
+		}
+
+		var err error
+		opened, err = l.pool.openReadOnly(baseBlockNum)
+		if err != nil {
+			if l.isBudgeted(path) {
+				l.pool.discardCorrupted(baseBlockNum, path, err)
+			}
+			return fmt.Errorf("opening lazy shard: %w", err)
+		}
+
+		if l.isBudgeted(path) {
+			size, err = dirSize(path)
+			if err != nil {
+				zlog.Warn("cannot compute lazy shard size", zap.String("path", path), zap.Error(err))
+			}
+		}
+		return nil
+	}()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err == nil {
+		entry.shard.Lock.Lock()
+		entry.shard.Index = opened.Index
+		entry.shard.FieldTermsFilterFile = opened.FieldTermsFilterFile
+		entry.shard.StartBlockID = opened.StartBlockID
+		entry.shard.StartBlockTime = opened.StartBlockTime
+		entry.shard.EndBlockID = opened.EndBlockID
+		entry.shard.EndBlockTime = opened.EndBlockTime
+		entry.shard.Lock.Unlock()
+
+		if l.isBudgeted(path) {
+			l.track(entry, size)
+		}
+	} else {
+		zlog.Warn("cannot load lazy shard", zap.Uint64("base", baseBlockNum), zap.Error(err))
+	}
+
+	entry.loadErr = err
+	close(entry.loading)
+	entry.loading = nil
+
+	if entry.removed && entry.refCount == 0 {
+		l.unload(entry, true)
+		return
+	}
+
+	l.evictOverBudget()
+}
+
+func (l *lazyShards) prefetch(startBlock uint64, sortDesc bool) {
+	if l.prefetchCount <= 0 {
+		return
+	}
+
+	pool := l.pool
+	pool.readPoolLock.RLock()
+	readPool := pool.ReadPool
+	lowest := pool.LowestServeableBlockNum
+	pool.readPoolLock.RUnlock()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for i := 1; i <= l.prefetchCount; i++ {
+		offset := uint64(i) * pool.ShardSize
+		var base uint64
+		if sortDesc {
+			if startBlock < lowest+offset {
+				return
+			}
+			base = startBlock - offset
+		} else {
+			base = startBlock + offset
+		}
+
+		shard := shardAt(readPool, pool.ShardSize, base)
+		if shard == nil {
+			return
+		}
+
+		entry, found := l.entries[shard.StartBlock]
+		if !found || entry.removed || entry.shard.Index != nil || entry.loading != nil {
+			continue
+		}
+
+		zlog.Debug("prefetching lazy shard", zap.Uint64("base", base))
+		l.startLoad(entry)
+	}
+}
+
+// remove forgets about a truncated shard, closing it and deleting it from
+// disk as soon as it is not in use anymore.
+func (l *lazyShards) remove(shard *search.ShardIndex) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry, found := l.entries[shard.StartBlock]
+	if !found {
+		return
+	}
+
+	delete(l.entries, shard.StartBlock)
+	entry.removed = true
+	if entry.refCount == 0 && entry.loading == nil {
+		l.unload(entry, true)
+	}
+}
+
+// evictOverBudget must be called under lock.
+func (l *lazyShards) evictOverBudget() {
+	if l.diskBudget == 0 {
+		return
+	}
+
+	element := l.lru.Back()
+	for l.usedBytes > l.diskBudget && element != nil {
+		entry := element.Value.(*lazyShard)
+		element = element.Prev()
+
+		if entry.refCount > 0 || entry.loading != nil {
+			continue
+		}
+
+		zlog.Debug("evicting lazy shard", zap.Uint64("base", entry.shard.StartBlock), zap.Uint64("size_bytes", entry.sizeBytes), zap.Uint64("used_bytes", l.usedBytes))
+		l.unload(entry, false)
+		metrics.LazyShardEvictions.Inc()
+	}
+}
+
+// unload closes the shard's index, if opened, and deletes it from disk. It
+// must be called under lock, on an entry that is not in use.
+func (l *lazyShards) unload(entry *lazyShard, removed bool) {
+	entry.shard.Lock.Lock()
+	if entry.shard.Index != nil {
+		if err := entry.shard.Close(); err != nil {
+			zlog.Warn("error closing lazy shard", zap.Uint64("base", entry.shard.StartBlock), zap.Error(err))
+		}
+		if !removed {
+			entry.shard.Index = nil
+		}
+	}
+	entry.shard.Lock.Unlock()
+
+	if entry.element != nil {
+		l.lru.Remove(entry.element)
+		entry.element = nil
+		l.usedBytes -= entry.sizeBytes
+		entry.sizeBytes = 0
+		metrics.LazyShardsOnDiskBytes.SetUint64(l.usedBytes)
+
+		l.pool.deleteIndex(entry.shard)
+	}
+}
+
+// track must be called under lock.
+func (l *lazyShards) track(entry *lazyShard, size uint64) {
+	if entry.element != nil {
+		l.usedBytes -= entry.sizeBytes
+		l.lru.Remove(entry.element)
+	}
+
+	entry.sizeBytes = size
+	entry.element = l.lru.PushFront(entry)
+	l.usedBytes += size
+	metrics.LazyShardsOnDiskBytes.SetUint64(l.usedBytes)
+}
+
+// isBudgeted tells if the shard at `path` was downloaded by us and can be
+// evicted. Shards found in `ReadOnlyIndexesPaths` are never evicted.
+func (l *lazyShards) isBudgeted(path string) bool {
+	return l.pool.inIndexesPath(path)
+}
+
+func (l *lazyShards) UsedBytes() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.usedBytes
+}
+
+func (l *lazyShards) closeAll() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, entry := range l.entries {
+		entry.shard.Lock.Lock()
+		if entry.shard.Index != nil {
+			if err := entry.shard.Close(); err != nil {
+				entry.shard.Lock.Unlock()
+				return err
+			}
+		}
+		entry.shard.Lock.Unlock()
+	}
+	return nil
+}
+
+func dirSize(path string) (size uint64, err error) {
+	err = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return
+}
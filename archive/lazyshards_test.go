@@ -0,0 +1,121 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lazyShards_evictOverBudget(t *testing.T) {
+	tests := []struct {
+		name          string
+		diskBudget    uint64
+		inUse         []uint64
+		expectOnDisk  []uint64
+		expectedBytes uint64
+	}{
+		{
+			name:          "within budget",
+			diskBudget:    300,
+			expectOnDisk:  []uint64{0, 10, 20},
+			expectedBytes: 300,
+		},
+		{
+			name:          "evicts least recently used",
+			diskBudget:    250,
+			expectOnDisk:  []uint64{10, 20},
+			expectedBytes: 200,
+		},
+		{
+			name:          "skips shards in use",
+			diskBudget:    200,
+			inUse:         []uint64{0},
+			expectOnDisk:  []uint64{0, 20},
+			expectedBytes: 200,
+		},
+		{
+			name:          "unbounded",
+			diskBudget:    0,
+			expectOnDisk:  []uint64{0, 10, 20},
+			expectedBytes: 300,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indexesPath, err := ioutil.TempDir("", "lazyshards")
+			require.NoError(t, err)
+			defer os.RemoveAll(indexesPath)
+
+			pool := &IndexPool{IndexesPath: indexesPath, ShardSize: 10}
+			pool.EnableLazyShardLoading(test.diskBudget, 0)
+
+			for _, base := range []uint64{0, 10, 20} {
+				writeTestShard(t, indexesPath, base, 100)
+				pool.lazyShards.register(&search.ShardIndex{StartBlock: base, EndBlock: base + 9})
+			}
+			for _, base := range test.inUse {
+				pool.lazyShards.entries[base].refCount++
+			}
+
+			pool.lazyShards.lock.Lock()
+			pool.lazyShards.evictOverBudget()
+			pool.lazyShards.lock.Unlock()
+
+			var onDisk []uint64
+			for _, base := range []uint64{0, 10, 20} {
+				if _, err := os.Stat(filepath.Join(indexesPath, fmt.Sprintf("%010d.bleve", base))); err == nil {
+					onDisk = append(onDisk, base)
+				}
+			}
+			assert.Equal(t, test.expectOnDisk, onDisk)
+			assert.Equal(t, test.expectedBytes, pool.lazyShards.UsedBytes())
+		})
+	}
+}
+
+func Test_lazyShards_remove(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "lazyshards")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	pool := &IndexPool{IndexesPath: indexesPath, ShardSize: 10}
+	pool.EnableLazyShardLoading(0, 0)
+
+	writeTestShard(t, indexesPath, 0, 100)
+	shard := &search.ShardIndex{StartBlock: 0, EndBlock: 9}
+	pool.lazyShards.register(shard)
+
+	pool.lazyShards.remove(shard)
+
+	_, err = os.Stat(filepath.Join(indexesPath, "0000000000.bleve"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, uint64(0), pool.lazyShards.UsedBytes())
+	assert.Len(t, pool.lazyShards.entries, 0)
+}
+
+func writeTestShard(t *testing.T, indexesPath string, base uint64, size int) {
+	shardPath := filepath.Join(indexesPath, fmt.Sprintf("%010d.bleve", base))
+	require.NoError(t, os.MkdirAll(shardPath, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(shardPath, "root.bolt"), make([]byte, size), 0644))
+}
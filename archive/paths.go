@@ -27,7 +27,7 @@ func (p *IndexPool) listAllReadOnlyIndexes() ([]string, map[string]bool, error)
 		return nil, nil, err
 	}
 
-	for _, readOnlyPath := range p.ReadOnlyIndexesPaths {
+	for _, readOnlyPath := range append(p.tierIndexesPaths(), p.ReadOnlyIndexesPaths...) {
 		more, err := filepath.Glob(filepath.Join(readOnlyPath, "??????????.bleve"))
 		if err != nil {
 			zlog.Warn("failed listing files in read-only path, continuing", zap.String("path", readOnlyPath), zap.Error(err))
@@ -17,13 +17,17 @@ package archive
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,6 +38,7 @@ import (
 	"github.com/dfuse-io/dstore"
 	"github.com/dfuse-io/search"
 	"github.com/dfuse-io/search/archive/roarcache"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -42,7 +47,7 @@ type IndexPool struct {
 	IndexesPath          string   //local path where indices are stored on disk
 	ShardSize            uint64
 
-	ready bool
+	ready atomic.Bool
 
 	SearchPeer  *dmesh.SearchPeer
 	dmeshClient dmeshClient.Client
@@ -56,33 +61,94 @@ type IndexPool struct {
 	ReadPool        []*search.ShardIndex
 	PerQueryThreads int // Each end-user query will parallelize sub-queries on 15K+ indices
 
-	emptyResultsCache roarcache.Cache
+	// pollLock serializes appending polled indexes to the `ReadPool`
+	pollLock sync.Mutex
+
+	emptyResultsCache      roarcache.Cache
+	emptyResultsGeneration *emptyResultsGeneration
+
+	// MappingVersion, when set, is the only mapping version accepted from shard manifests
+	MappingVersion string
+	// RequireShardManifest refuses shards uploaded without a manifest
+	RequireShardManifest bool
+	// AllowGaps holds shards past missing ones, instead of stopping at the first one, see `addGaps`
+	AllowGaps bool
+	// GapLookaheadShards is how far past a shard missing from the indexes store polling looks for the next one, see `skipMissingIndex`
+	GapLookaheadShards int
+
+	// shardResultsCache is nil unless enabled, see `EnableShardResultsCache`
+	shardResultsCache *shardResultsCache
+
+	// fieldTermsFilters are read on demand, bounded in memory, see `SetFieldTermsFiltersMaxBytes`
+	fieldTermsFilters *fieldTermsFilters
+
+	// lazyShards is nil unless shards are loaded on-demand, see `EnableLazyShardLoading`
+	lazyShards *lazyShards
+
+	// quarantined are the shards that failed to open or are corrupted,
+	// being restored from the indexes store, see `QuarantineShard`
+	quarantineLock sync.Mutex
+	quarantined    map[uint64]*quarantinedShard
+	// integrityChecks are the last checks of shards that failed to be searched
+	integrityChecks map[uint64]time.Time
+	closing         atomic.Bool
+	// withdrawn is set once readiness is withdrawn on shutdown, see `SetNotReady`
+	readyLock sync.Mutex
+	withdrawn atomic.Bool
+
+	// reloads deduplicates the concurrent reloads of a shard, see `reloadShard`
+	reloads shardReloads
+
+	// onShardLoaded, when set, is called with every shard newly polled,
+	// filled in a gap, or downloaded again, see `shardLoaded`
+	onShardLoaded func(shard *search.ShardIndex)
+
+	// tiers are empty unless shards are placed by age, see `EnableTieredStorage`
+	tiers []StorageTier
+
+	// gaps are the base block nums of the shards missing from the pool
+	gapsLock sync.Mutex
+	gaps     map[uint64]bool
 }
 
 var numberOfPoolInitWorkers = 16 // During process bootstrap - AVOID too high value - there is contention
 var numberOfAnalysisWorkers = 2  // Only used for indexing and merging (not for read-only)
 
 func NewIndexPool(indexesPath string, readOnlyIndexesPaths []string, shardSize uint64, indexesStore dstore.Store, cache roarcache.Cache, dmeshClient dmeshClient.Client, searchPeer *dmesh.SearchPeer) (*IndexPool, error) {
+	generation, err := loadEmptyResultsGeneration(indexesPath)
+	if err != nil {
+		return nil, err
+	}
+
 	pool := &IndexPool{
-		IndexesPath:          indexesPath,
-		ReadOnlyIndexesPaths: readOnlyIndexesPaths,
-		ShardSize:            shardSize,
-		indexesStore:         indexesStore,
-		emptyResultsCache:    cache,
-		dmeshClient:          dmeshClient,
-		SearchPeer:           searchPeer,
+		IndexesPath:            indexesPath,
+		ReadOnlyIndexesPaths:   readOnlyIndexesPaths,
+		ShardSize:              shardSize,
+		indexesStore:           indexesStore,
+		emptyResultsCache:      cache,
+		emptyResultsGeneration: generation,
+		dmeshClient:            dmeshClient,
+		SearchPeer:             searchPeer,
+		fieldTermsFilters:      newFieldTermsFilters(defaultFieldTermsFiltersMaxBytes),
 	}
 	return pool, nil
 }
 
 func (p *IndexPool) IsReady() bool {
-	return p.ready
+	return p.ready.Load()
 }
 
 // SetReady marks the process as ready, meaning it has crossed the "close
 // to real-time" threshold.
 func (p *IndexPool) SetReady() error {
-	// TODO: implement a Ready = false when shutting down, like in the `live`.
+	p.readyLock.Lock()
+	defer p.readyLock.Unlock()
+
+	if p.withdrawn.Load() {
+		zlog.Info("not setting ready, the archive is shutting down")
+		return nil
+	}
+
 	p.SearchPeer.Locked(func() {
 		p.SearchPeer.Ready = true
 	})
@@ -91,13 +157,42 @@ func (p *IndexPool) SetReady() error {
 		return err
 	}
 
-	p.ready = true
+	p.ready.Store(true)
 
 	return nil
 }
+
+// SetNotReady withdraws the readiness published by `SetReady`, so routers
+// stop sending queries here, like the `live` does when shutting down. The
+// pool stops polling and never sets itself ready again.
+func (p *IndexPool) SetNotReady() error {
+	p.readyLock.Lock()
+	defer p.readyLock.Unlock()
+
+	p.withdrawn.Store(true)
+	p.ready.Store(false)
+
+	// We are probably on batch mode where no search peer exists, so don't publish it
+	if p.SearchPeer == nil {
+		return nil
+	}
+
+	p.SearchPeer.Locked(func() {
+		p.SearchPeer.Ready = false
+	})
+	return p.dmeshClient.PublishNow(p.SearchPeer)
+}
 func (p *IndexPool) IsEmpty() bool {
 	return len(p.ReadPool) == 0
 }
+
+// pollRetryInterval is the pause before polling again for an index file
+// that is not available yet
+var pollRetryInterval = 5 * time.Second
+
+// PollRemoteIndices retrieves the shards following the last one of the
+// pool as they get available in the indexes store, setting the pool ready
+// after the first one, until readiness is withdrawn, see `SetNotReady`.
 func (p *IndexPool) PollRemoteIndices(startBlockNum, stopBlockNum uint64) {
 	startIndexingAt := startBlockNum
 	lastIndexLoaded := p.LastReadOnlyIndexedBlock()
@@ -111,52 +206,87 @@ func (p *IndexPool) PollRemoteIndices(startBlockNum, stopBlockNum uint64) {
 	}
 	zlog.Info("polling indexes from remote storage", zap.Uint64("base_block_num", startIndexingAt))
 
-	for {
-		indexStartBlockNum := p.nextReadOnlyIndexBlock()
-		// We may need to starting syncing a later index for a middle tier
-		if indexStartBlockNum == 0 {
-			indexStartBlockNum = startBlockNum
-		}
-
-		indexBaseFile := fmt.Sprintf("%010d", indexStartBlockNum)
-
+	for !p.withdrawn.Load() {
 		// we could parallelize this, but probably not useful, since they will
 		// be produced as we go by indexers
-		idx, err := p.retrieveIndexFile(indexStartBlockNum, indexBaseFile)
+		idx, err := p.pollNextIndex(startBlockNum)
 		if err != nil {
 			if err.Error() != "index file is not available" {
-				zlog.Info("cannot retrieve next index file, retrying in 5 seconds",
-					zap.String("basefile", indexBaseFile),
+				zlog.Info("cannot retrieve next index file, retrying",
+					zap.Duration("retry_in", pollRetryInterval),
 					zap.Error(err))
 			}
-			time.Sleep(5 * time.Second)
+			time.Sleep(pollRetryInterval)
 			continue
 		}
 
-		if searchPeer := p.SearchPeer; searchPeer != nil {
-			searchPeer.Locked(func() {
-				searchPeer.IrrBlock = idx.EndBlock
-				searchPeer.IrrBlockID = idx.EndBlockID
-				searchPeer.HeadBlock = idx.EndBlock
-				searchPeer.HeadBlockID = idx.EndBlockID
-			})
-			err = p.dmeshClient.PublishNow(searchPeer)
-			if err != nil {
-				zlog.Warn("unable to publisher search peer", zap.Error(err))
-				continue
-			}
+		if err := p.publishIndexedHead(idx); err != nil {
+			zlog.Warn("unable to publisher search peer", zap.Error(err))
+			continue
 		}
 
-		headBlockNumber.SetUint64(idx.EndBlock)
-
 		zlog.Info("index file successfully retrieved",
-			zap.String("basefile", indexBaseFile),
 			zap.Uint64("start_block", idx.StartBlock))
 
 		if !p.IsReady() {
 			p.SetReady()
 		}
 	}
+	zlog.Info("stopped polling indexes from remote storage, the archive is shutting down")
+}
+
+// pollNextIndex retrieves the index following the last one of the pool,
+// or starting at `startBlockNum` when the pool is empty.
+func (p *IndexPool) pollNextIndex(startBlockNum uint64) (*search.ShardIndex, error) {
+	p.pollLock.Lock()
+	defer p.pollLock.Unlock()
+
+	indexStartBlockNum := p.nextReadOnlyIndexBlock()
+	// We may need to starting syncing a later index for a middle tier
+	if indexStartBlockNum == 0 {
+		indexStartBlockNum = startBlockNum
+	}
+
+	indexBaseFile := fmt.Sprintf("%010d", indexStartBlockNum)
+	idx, err := p.retrieveIndexFile(indexStartBlockNum, indexBaseFile)
+	if err != nil {
+		if err.Error() != "index file is not available" {
+			return nil, fmt.Errorf("basefile %s: %w", indexBaseFile, err)
+		}
+		if p.AllowGaps && p.lazyShards == nil {
+			p.skipMissingIndex(indexStartBlockNum)
+		}
+		return nil, err
+	}
+
+	p.shardLoaded(idx)
+	return idx, nil
+}
+
+// shardLoaded notifies `onShardLoaded`, when set, of a shard newly polled,
+// filled in a gap, or downloaded again, like a reloaded or a restored
+// quarantined shard.
+func (p *IndexPool) shardLoaded(shard *search.ShardIndex) {
+	if p.onShardLoaded != nil {
+		p.onShardLoaded(shard)
+	}
+}
+
+func (p *IndexPool) publishIndexedHead(idx *search.ShardIndex) error {
+	if searchPeer := p.SearchPeer; searchPeer != nil {
+		searchPeer.Locked(func() {
+			searchPeer.IrrBlock = idx.EndBlock
+			searchPeer.IrrBlockID = idx.EndBlockID
+			searchPeer.HeadBlock = idx.EndBlock
+			searchPeer.HeadBlockID = idx.EndBlockID
+		})
+		if err := p.dmeshClient.PublishNow(searchPeer); err != nil {
+			return err
+		}
+	}
+
+	headBlockNumber.SetUint64(idx.EndBlock)
+	return nil
 }
 
 func (p *IndexPool) retrieveIndexFile(indexStartBlockNum uint64, indexBaseFile string) (*search.ShardIndex, error) {
@@ -181,6 +311,20 @@ func (p *IndexPool) retrieveIndexFile(indexStartBlockNum uint64, indexBaseFile s
 	}
 	// TODO: can someone delete it right at this moment?
 
+	if p.lazyShards != nil {
+		idx, err := p.newLazyShard(ctx, indexStartBlockNum)
+		if err != nil {
+			return nil, fmt.Errorf("error creating lazy shard: %s", err)
+		}
+
+		p.readPoolLock.Lock()
+		p.AppendReadIndexes(idx)
+		p.readPoolLock.Unlock()
+
+		zlog.Debug("appended lazy index file", zap.String("index_path", indexPath), zap.Uint64("base", idx.StartBlock))
+		return idx, nil
+	}
+
 	err = p.downloadAndExtract(0, indexBaseFile)
 	if err != nil {
 		return nil, fmt.Errorf("error downloading and extracting index file: %s", err)
@@ -188,6 +332,9 @@ func (p *IndexPool) retrieveIndexFile(indexStartBlockNum uint64, indexBaseFile s
 
 	idx, err := p.openReadOnly(indexStartBlockNum)
 	if err != nil {
+		if path := p.getReadOnlyIndexFilePath(indexStartBlockNum); p.isManagedPath(path) {
+			p.discardCorrupted(indexStartBlockNum, path, err)
+		}
 		return nil, fmt.Errorf("error opening and reading next index file from disk: %s", err)
 	}
 
@@ -219,6 +366,9 @@ func (p *IndexPool) nextReadOnlyIndexBlock() uint64 {
 		return 0
 	}
 	lastIndexShard := p.ReadPool[len(p.ReadPool)-1]
+	if lastGap := p.lastGap(); lastGap > lastIndexShard.StartBlock {
+		return lastGap + p.ShardSize
+	}
 	return (lastIndexShard.StartBlock + p.ShardSize)
 }
 
@@ -241,6 +391,7 @@ func (p *IndexPool) SyncFromStorage(startBlock, stopBlock uint64, maxIndexes int
 	}
 
 	zlog.Info("sync from storage done", zap.Int("downloaded_indexes", totalDownloads))
+	p.flushEmptyResultsGeneration()
 
 	return nil
 }
@@ -259,7 +410,10 @@ func (p *IndexPool) syncFromStoragePass(startBlock, stopBlock uint64, maxIndexes
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	remote, err := p.indexesStore.ListFiles(ctx, fmt.Sprintf("shards-%d/", p.ShardSize), ".tmp", maxIndexes+int(startBlock/p.ShardSize))
+	// The limit counts every listed file, and each shard archive is listed
+	// along with its `.manifest.json` sidecar, so twice as many files are
+	// needed to reach the same number of shards.
+	remote, err := p.indexesStore.ListFiles(ctx, fmt.Sprintf("shards-%d/", p.ShardSize), ".tmp", 2*(maxIndexes+int(startBlock/p.ShardSize)))
 	if err != nil {
 		return 0, err
 	}
@@ -271,6 +425,10 @@ func (p *IndexPool) syncFromStoragePass(startBlock, stopBlock uint64, maxIndexes
 
 	count := 0
 	for _, file := range remote {
+		if strings.HasSuffix(file, search.ShardManifestSuffix) {
+			continue
+		}
+
 		match := remotePathRE.FindStringSubmatch(file)
 		if match == nil {
 			zlog.Info("Skipping non-index file in remote storage", zap.String("file", file))
@@ -333,7 +491,7 @@ func (p *IndexPool) syncFromStoragePass(startBlock, stopBlock uint64, maxIndexes
 		if eg.Stop() {
 			break
 		}
-		if downloadStopBlock != 0 && startBlockFromFileName(fl) >= downloadStopBlock {
+		if !p.AllowGaps && downloadStopBlock != 0 && startBlockFromFileName(fl) >= downloadStopBlock {
 			zlog.Info("Not downloading remote index because it would create an hole", zap.String("filename", fl))
 			break
 		}
@@ -355,6 +513,24 @@ func (p *IndexPool) syncFromStoragePass(startBlock, stopBlock uint64, maxIndexes
 }
 
 func (p *IndexPool) downloadAndExtract(index int, baseFile string) error {
+	dlPath := filepath.Join(p.IndexesPath, baseFile+"-dl.bleve")
+	finalPath := filepath.Join(p.IndexesPath, baseFile+".bleve")
+
+	if err := p.downloadAndExtractTo(index, baseFile, dlPath); err != nil {
+		return err
+	}
+
+	level := zap.DebugLevel
+	if index%50 == 0 {
+		level = zap.InfoLevel
+	}
+	zlog.Check(level, "swapping index from download to read-only index path").Write(zap.String("src", dlPath), zap.String("dst", finalPath))
+	return os.Rename(dlPath, finalPath)
+}
+
+// downloadAndExtractTo downloads the shard `baseFile` and extracts it at
+// `dlPath`, once verified against its manifest.
+func (p *IndexPool) downloadAndExtractTo(index int, baseFile string, dlPath string) error {
 	src := fmt.Sprintf("shards-%d/%s.bleve.tar.zst", p.ShardSize, baseFile)
 
 	level := zap.DebugLevel
@@ -373,10 +549,9 @@ func (p *IndexPool) downloadAndExtract(index int, baseFile string) error {
 	}
 	defer reader.Close()
 
-	tr := tar.NewReader(reader)
-
-	dlPath := filepath.Join(p.IndexesPath, baseFile+"-dl.bleve")
-	finalPath := filepath.Join(p.IndexesPath, baseFile+".bleve")
+	checksum := sha256.New()
+	teeReader := io.TeeReader(reader, checksum)
+	tr := tar.NewReader(teeReader)
 
 	_ = os.RemoveAll(dlPath)
 
@@ -417,8 +592,57 @@ func (p *IndexPool) downloadAndExtract(index int, baseFile string) error {
 		}
 	}
 
-	zlog.Check(level, "swapping index from download to read-only index path").Write(zap.String("src", dlPath), zap.String("dst", finalPath))
-	return os.Rename(dlPath, finalPath)
+	// drain the tar's trailing padding so the checksum covers the whole stream
+	if _, err := io.Copy(ioutil.Discard, teeReader); err != nil {
+		return fmt.Errorf("failed draining tar.zst index=%d, base=%s: %s", index, baseFile, err)
+	}
+
+	baseBlockNum := startBlockFromFileName(baseFile)
+	tarChecksum := hex.EncodeToString(checksum.Sum(nil))
+	manifest, err := p.verifyShardManifest(ctx, baseBlockNum, tarChecksum)
+	if err != nil {
+		_ = os.RemoveAll(dlPath)
+		return fmt.Errorf("shard manifest verification failed, index=%d, base=%s: %w", index, baseFile, err)
+	}
+
+	if err := p.trackShardContent(baseBlockNum, tarChecksum, manifest); err != nil {
+		zlog.Warn("cannot track shard content for the empty results cache", zap.String("base", baseFile), zap.Error(err))
+	}
+
+	return nil
+}
+
+func (p *IndexPool) verifyShardManifest(ctx context.Context, baseBlockNum uint64, tarChecksum string) (*search.ShardManifest, error) {
+	manifestPath := search.ShardManifestPath(p.ShardSize, baseBlockNum)
+
+	found, err := p.indexesStore.FileExists(ctx, manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("checking existence of manifest %q: %s", manifestPath, err)
+	}
+
+	if !found {
+		if p.RequireShardManifest {
+			return nil, fmt.Errorf("manifest %q not found", manifestPath)
+		}
+		zlog.Debug("no manifest for shard, skipping verification", zap.String("manifest_path", manifestPath))
+		return nil, nil
+	}
+
+	reader, err := p.indexesStore.OpenObject(ctx, manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening manifest %q: %s", manifestPath, err)
+	}
+	defer reader.Close()
+
+	manifest, err := search.ReadShardManifest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := manifest.Verify(p.ShardSize, baseBlockNum, p.MappingVersion, tarChecksum); err != nil {
+		return nil, err
+	}
+	return manifest, nil
 }
 
 func (p *IndexPool) CleanOnDiskIndexes(startBlock, stopBlock uint64) error {
@@ -436,21 +660,26 @@ func (p *IndexPool) CleanOnDiskIndexes(startBlock, stopBlock uint64) error {
 		}
 
 		if indexFileBaseBlockNum < startBlock || (stopBlock != 0 && indexFileBaseBlockNum >= stopBlock) {
-			fullPath := filepath.Join(p.IndexesPath, baseFile+".bleve")
-
-			err := os.RemoveAll(fullPath)
-			zlog.Info("cleaning up on disk index that is before start block or >= stop block",
-				zap.String("path", fullPath),
-				zap.Uint64("start_block", startBlock),
-				zap.Uint64("stop_block", stopBlock),
-				zap.Error(err))
+			for _, fullPath := range p.managedIndexFilePaths(indexFileBaseBlockNum) {
+				if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+					continue
+				}
 
+				err := os.RemoveAll(fullPath)
+				zlog.Info("cleaning up on disk index that is before start block or >= stop block",
+					zap.String("path", fullPath),
+					zap.Uint64("start_block", startBlock),
+					zap.Uint64("stop_block", stopBlock),
+					zap.Error(err))
+			}
 		}
 	}
 	return nil
 }
 
 func (p *IndexPool) ScanOnDiskIndexes(startBlock uint64) error {
+	p.removeStrayMigrations()
+
 	indexes, _, err := p.listAllReadOnlyIndexes()
 	if err != nil {
 		return err
@@ -486,6 +715,13 @@ func (p *IndexPool) ScanOnDiskIndexes(startBlock uint64) error {
 		}
 	}()
 
+	if p.AllowGaps && len(indexes) > 0 && startBlock%p.ShardSize == 0 {
+		if first := startBlockFromFileName(indexes[0]); first > startBlock {
+			zlog.Warn("first index on disk is past the start block, holding the missing ones as gaps", zap.Uint64("start_block", startBlock), zap.Uint64("first_index", first))
+			p.addGaps(startBlock, first)
+		}
+	}
+
 	eg := llerrgroup.New(numberOfPoolInitWorkers)
 	var previousIndex uint64
 
@@ -495,7 +731,13 @@ func (p *IndexPool) ScanOnDiskIndexes(startBlock uint64) error {
 			return err
 		}
 
-		if previousIndex != 0 && previousIndex+p.ShardSize != indexFileBaseBlockNum {
+		if previousIndex != 0 && previousIndex+p.ShardSize != indexFileBaseBlockNum && p.AllowGaps {
+			zlog.Warn("non-contiguous indexes on disk, holding the missing ones as gaps",
+				zap.Uint64("previous_index", previousIndex),
+				zap.Uint64("current_index", indexFileBaseBlockNum),
+			)
+			p.addGaps(previousIndex+p.ShardSize, indexFileBaseBlockNum)
+		} else if previousIndex != 0 && previousIndex+p.ShardSize != indexFileBaseBlockNum {
 			zlog.Info("non-contiguous indexes on disk",
 				zap.Int("number_of_indexes", len(indexes)),
 				zap.Any("indexes", indexes),
@@ -518,12 +760,23 @@ func (p *IndexPool) ScanOnDiskIndexes(startBlock uint64) error {
 		eg.Go(func() error {
 			idx, err := p.openReadOnly(indexFileBaseBlockNum)
 			if err != nil {
-				zlog.Error("unable to open read only indexes",
+				zlog.Error("unable to open read only indexes, quarantining it",
 					zap.Uint64("idx_start_block", indexFileBaseBlockNum),
 					zap.Error(err),
 				)
-				close(indexReady)
-				return err
+
+				// keep the pool contiguous with an unloaded shard, restored in the background
+				placeholder, placeholderErr := search.NewShardIndexWithAnalysisQueue(indexFileBaseBlockNum, p.ShardSize, nil, p.buildWritableIndexFilePath, nil)
+				if placeholderErr != nil {
+					close(indexReady)
+					return placeholderErr
+				}
+				// boundaries ids from the manifest, so we never advertise an empty head id
+				p.fillBoundariesFromManifest(context.Background(), placeholder)
+				p.QuarantineShard(placeholder, err)
+
+				indexReady <- placeholder
+				return nil
 			}
 
 			statsMap := idx.StatsMap()
@@ -550,18 +803,26 @@ func (p *IndexPool) ScanOnDiskIndexes(startBlock uint64) error {
 
 	<-indexesReadyDone
 
+	p.flushEmptyResultsGeneration()
 	return nil
 }
 
+// getReadOnlyIndexFilePath returns where the shard at `baseBlockNum` is
+// served from. A copy in `IndexesPath`, like a restored quarantined shard,
+// shadows the ones of the tiers and of the read-only indexes paths.
 func (p *IndexPool) getReadOnlyIndexFilePath(baseBlockNum uint64) string {
 	basePath := fmt.Sprintf("%010d.bleve", baseBlockNum)
-	for _, path := range p.ReadOnlyIndexesPaths {
+	fullPath := filepath.Join(p.IndexesPath, basePath)
+	if _, err := os.Stat(fullPath); err == nil {
+		return fullPath
+	}
+	for _, path := range append(p.tierIndexesPaths(), p.ReadOnlyIndexesPaths...) {
 		fullPath := filepath.Join(path, basePath)
 		if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
 			return fullPath
 		}
 	}
-	return filepath.Join(p.IndexesPath, basePath)
+	return fullPath
 }
 
 func (p *IndexPool) buildWritableIndexFilePath(baseBlockNum uint64, suffix string) string {
@@ -573,7 +834,10 @@ func (p *IndexPool) buildWritableIndexFilePath(baseBlockNum uint64, suffix strin
 }
 
 func (p *IndexPool) openReadOnly(baseBlockNum uint64) (*search.ShardIndex, error) {
-	path := p.getReadOnlyIndexFilePath(baseBlockNum)
+	return p.openReadOnlyAt(baseBlockNum, p.getReadOnlyIndexFilePath(baseBlockNum))
+}
+
+func (p *IndexPool) openReadOnlyAt(baseBlockNum uint64, path string) (*search.ShardIndex, error) {
 	idxer, err := scorch.NewScorch("data", map[string]interface{}{
 		"forceSegmentType":    "zap",
 		"forceSegmentVersion": 14,
@@ -591,10 +855,33 @@ func (p *IndexPool) openReadOnly(baseBlockNum uint64) (*search.ShardIndex, error
 
 	// TODO: Warm up before adding?
 
-	return search.NewShardIndexWithAnalysisQueue(baseBlockNum, p.ShardSize, idxer, p.buildWritableIndexFilePath, nil)
+	shard, err := search.NewShardIndexWithAnalysisQueue(baseBlockNum, p.ShardSize, idxer, p.buildWritableIndexFilePath, nil)
+	if err != nil {
+		_ = idxer.Close()
+		return nil, err
+	}
+
+	if err := p.trackShardMapping(shard); err != nil {
+		zlog.Warn("cannot track shard mapping for the empty results cache", zap.Uint64("base", baseBlockNum), zap.Error(err))
+	}
+
+	// a missing or unreadable filter only means the shard will never be skipped by it
+	shard.FieldTermsFilterFile, err = search.LocateFieldTermsFilterFile(path)
+	if err != nil {
+		zlog.Warn("cannot locate field terms filter, ignoring it", zap.String("path", path), zap.Error(err))
+	}
+
+	return shard, nil
 }
 
 func (p *IndexPool) CloseIndexes() (err error) {
+	p.closing.Store(true)
+	p.flushEmptyResultsGeneration()
+
+	if p.lazyShards != nil {
+		return p.lazyShards.closeAll()
+	}
+
 	for _, idx := range p.ReadPool {
 		idx.Lock.Lock()
 		defer idx.Lock.Unlock()
@@ -612,21 +899,34 @@ func (p *IndexPool) CloseIndexes() (err error) {
 
 // LastReadOnlyIndexedBlock returns the block inclusively (999)
 func (p *IndexPool) LastReadOnlyIndexedBlock() uint64 {
-	if len(p.ReadPool) == 0 {
+	idx := p.lastAdvertisedIndex()
+	if idx == nil {
 		return 0
 	}
-	idx := p.ReadPool[len(p.ReadPool)-1]
 	return idx.EndBlock
 }
 
 func (p *IndexPool) LastReadOnlyIndexedBlockID() string {
-	if len(p.ReadPool) == 0 {
+	idx := p.lastAdvertisedIndex()
+	if idx == nil {
 		return ""
 	}
-	idx := p.ReadPool[len(p.ReadPool)-1]
 	return idx.EndBlockID
 }
 
+// lastAdvertisedIndex skips the trailing quarantined shards whose end block
+// id is unknown, they are advertised once restored.
+func (p *IndexPool) lastAdvertisedIndex() *search.ShardIndex {
+	for i := len(p.ReadPool) - 1; i >= 0; i-- {
+		idx := p.ReadPool[i]
+		if idx.EndBlockID == "" && p.isQuarantined(idx.StartBlock) {
+			continue
+		}
+		return idx
+	}
+	return nil
+}
+
 func (p *IndexPool) AppendReadIndexes(idx ...*search.ShardIndex) {
 	p.ReadPool = append(p.ReadPool, idx...)
 }
@@ -644,7 +944,11 @@ func (p *IndexPool) SetLowestServeableBlockNum(startBlockNum uint64) error {
 		return nil
 	}
 
-	// ensure that an index starts exactly on that serveableBlockNum
+	// ensure that an index, or a gap, starts exactly on that serveableBlockNum
+	if startBlockNum%p.ShardSize == 0 && p.isGap(startBlockNum) {
+		p.LowestServeableBlockNum = startBlockNum
+		return nil
+	}
 	for _, idx := range p.ReadPool {
 		if idx.StartBlock == startBlockNum {
 			p.LowestServeableBlockNum = startBlockNum
@@ -670,6 +974,7 @@ func (p *IndexPool) truncateBelow(blockNum uint64) {
 	p.readPoolLock.Lock()
 	defer p.readPoolLock.Unlock()
 
+	p.clearGapsBelow(blockNum)
 	for index, idx := range p.ReadPool {
 		if idx.StartBlock >= blockNum {
 			// index is above the block num
@@ -682,6 +987,11 @@ func (p *IndexPool) truncateBelow(blockNum uint64) {
 		}
 		// index is below the blockNum should truncate it
 		indexToRemove := idx
+		if p.lazyShards != nil {
+			p.lazyShards.remove(indexToRemove)
+			continue
+		}
+
 		go func() {
 			zlog.Info("truncating index", zap.Uint64("idx_start_block", indexToRemove.StartBlock))
 
@@ -700,10 +1010,18 @@ func (p *IndexPool) truncateBelow(blockNum uint64) {
 }
 
 func (p *IndexPool) deleteIndex(idx *search.ShardIndex) {
-	baseFile := fmt.Sprintf("%010d", idx.StartBlock)
-	fullPath := filepath.Join(p.IndexesPath, baseFile+".bleve")
-	err := os.RemoveAll(fullPath)
-	zlog.Info("removed on disk index",
-		zap.String("path", fullPath),
-		zap.Error(err))
+	if p.shardResultsCache != nil {
+		p.shardResultsCache.PurgeRange(idx.StartBlock, idx.StartBlock)
+	}
+
+	for _, fullPath := range p.managedIndexFilePaths(idx.StartBlock) {
+		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+			continue
+		}
+
+		err := os.RemoveAll(fullPath)
+		zlog.Info("removed on disk index",
+			zap.String("path", fullPath),
+			zap.Error(err))
+	}
 }
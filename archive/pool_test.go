@@ -16,9 +16,14 @@ package archive
 
 import (
 	"testing"
+	"time"
 
+	"github.com/dfuse-io/dmesh"
+	dmeshClient "github.com/dfuse-io/dmesh/client"
+	"github.com/dfuse-io/dstore"
 	"github.com/dfuse-io/search"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_nextReadOnlyIndexBlock(t *testing.T) {
@@ -106,3 +111,40 @@ func TestIndexPool_getLowestThresholdBlock(t *testing.T) {
 		})
 	}
 }
+
+func TestIndexPool_PollRemoteIndicesStopsWhenNotReady(t *testing.T) {
+	defer func(interval time.Duration) { pollRetryInterval = interval }(pollRetryInterval)
+	pollRetryInterval = time.Millisecond
+
+	mesh, err := dmeshClient.New("local://")
+	require.NoError(t, err)
+
+	searchPeer := dmesh.NewSearchArchivePeer("v1", "archive:9000", false, true, 10, 1, time.Second)
+	pool := &IndexPool{
+		ShardSize:    10,
+		indexesStore: dstore.NewMockStore(nil),
+		dmeshClient:  mesh,
+		SearchPeer:   searchPeer,
+		ReadPool:     []*search.ShardIndex{{StartBlock: 0, EndBlock: 9}},
+	}
+	require.NoError(t, pool.SetReady())
+
+	polling := make(chan struct{})
+	go func() {
+		defer close(polling)
+		pool.PollRemoteIndices(0, 0)
+	}()
+
+	// shutting down while polling
+	require.NoError(t, pool.SetNotReady())
+
+	select {
+	case <-polling:
+	case <-time.After(time.Second):
+		t.Fatal("polling did not stop once not ready")
+	}
+
+	require.NoError(t, pool.SetReady())
+	assert.False(t, pool.IsReady(), "readiness is not published again once withdrawn")
+	assert.False(t, searchPeer.Ready)
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dfuse-io/derr"
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+var quarantineRetryDelay = 5 * time.Second
+var quarantineMaxRetryDelay = time.Minute
+var shardIntegrityCheckInterval = time.Minute
+
+type quarantinedShard struct {
+	cause error
+	since time.Time
+}
+
+// QuarantineShard takes out of service a shard that failed to open or is
+// corrupted, and restores it in the background from the indexes store.
+// Meanwhile, only the queries touching it fail, with an `Unavailable`
+// error naming the shard. Lazy shards are instead removed from disk once
+// not in use, and downloaded again by the next query touching them.
+func (p *IndexPool) QuarantineShard(shard *search.ShardIndex, cause error) {
+	if p.lazyShards != nil {
+		zlog.Warn("quarantining corrupted lazy shard, it will be downloaded again", zap.Uint64("base", shard.StartBlock), zap.Error(cause))
+		metrics.ShardQuarantines.Inc()
+		p.lazyShards.discard(shard)
+		return
+	}
+
+	p.quarantineLock.Lock()
+	if _, found := p.quarantined[shard.StartBlock]; found {
+		p.quarantineLock.Unlock()
+		return
+	}
+	if p.quarantined == nil {
+		p.quarantined = map[uint64]*quarantinedShard{}
+	}
+	p.quarantined[shard.StartBlock] = &quarantinedShard{cause: cause, since: time.Now()}
+	p.quarantineLock.Unlock()
+
+	zlog.Warn("quarantining corrupted shard", zap.Uint64("base", shard.StartBlock), zap.Error(cause))
+	metrics.ShardQuarantines.Inc()
+	metrics.QuarantinedShards.Inc()
+
+	go p.restoreShard(shard, quarantineRetryDelay)
+}
+
+// suspectShard checks, in the background, the integrity of a shard that
+// failed to be searched, and quarantines it only when the check fails.
+// Most search failures come from the query itself, so a shard is checked
+// at most once per `shardIntegrityCheckInterval`.
+func (p *IndexPool) suspectShard(shard *search.ShardIndex, cause error) {
+	p.quarantineLock.Lock()
+	_, quarantined := p.quarantined[shard.StartBlock]
+	if quarantined || time.Since(p.integrityChecks[shard.StartBlock]) < shardIntegrityCheckInterval {
+		p.quarantineLock.Unlock()
+		return
+	}
+	if p.integrityChecks == nil {
+		p.integrityChecks = map[uint64]time.Time{}
+	}
+	p.integrityChecks[shard.StartBlock] = time.Now()
+	p.quarantineLock.Unlock()
+
+	go func() {
+		if p.lazyShards != nil {
+			release, err := p.lazyShards.Acquire(context.Background(), shard, false)
+			if err != nil {
+				zlog.Warn("cannot acquire lazy shard to check its integrity", zap.Uint64("base", shard.StartBlock), zap.Error(err))
+				return
+			}
+			defer release()
+		}
+
+		_, err := p.checkShardIntegrity(shard)
+		if err == nil || errors.Is(err, ErrShardNotLoaded) {
+			zlog.Info("shard failed to be searched but is not corrupted", zap.Uint64("base", shard.StartBlock), zap.NamedError("cause", cause))
+			return
+		}
+
+		p.QuarantineShard(shard, fmt.Errorf("%s, integrity check: %w", cause, err))
+	}()
+}
+
+// restoreShard downloads a quarantined shard again, in `IndexesPath` even
+// when it was served from a read-only indexes path.
+func (p *IndexPool) restoreShard(shard *search.ShardIndex, delay time.Duration) {
+	for attempt := 1; !p.closing.Load(); attempt++ {
+		err := p.reloads.do(shard.StartBlock, func() error {
+			return p.downloadShard(shard)
+		})
+		if err == nil {
+			p.quarantineLock.Lock()
+			quarantined := p.quarantined[shard.StartBlock]
+			delete(p.quarantined, shard.StartBlock)
+			p.quarantineLock.Unlock()
+
+			zlog.Info("quarantined shard restored", zap.Uint64("base", shard.StartBlock), zap.Int("attempt", attempt), zap.Duration("quarantined_for", time.Since(quarantined.since)))
+			metrics.ShardRestores.Inc()
+			metrics.QuarantinedShards.Dec()
+
+			if p.LastReadOnlyIndexedBlock() == shard.EndBlock {
+				if err := p.publishIndexedHead(shard); err != nil {
+					zlog.Warn("unable to publish search peer", zap.Error(err))
+				}
+			}
+			return
+		}
+
+		zlog.Warn("cannot restore quarantined shard, retrying", zap.Uint64("base", shard.StartBlock), zap.Int("attempt", attempt), zap.Duration("retry_in", delay), zap.Error(err))
+		time.Sleep(delay)
+		if delay *= 2; delay > quarantineMaxRetryDelay {
+			delay = quarantineMaxRetryDelay
+		}
+	}
+}
+
+// shardUnavailableError is the error of queries reaching an unloaded shard.
+func (p *IndexPool) shardUnavailableError(shard *search.ShardIndex) error {
+	p.quarantineLock.Lock()
+	quarantined := p.quarantined[shard.StartBlock]
+	p.quarantineLock.Unlock()
+
+	if quarantined != nil {
+		return derr.Statusf(codes.Unavailable, "shard %d-%d is quarantined since %s (%s), it is being restored, retry shortly", shard.StartBlock, shard.EndBlock, quarantined.since.Format(time.RFC3339), quarantined.cause)
+	}
+	return derr.Statusf(codes.Unavailable, "shard %d-%d is not loaded, it was evicted", shard.StartBlock, shard.EndBlock)
+}
+
+func (p *IndexPool) isQuarantined(baseBlockNum uint64) bool {
+	p.quarantineLock.Lock()
+	defer p.quarantineLock.Unlock()
+
+	_, found := p.quarantined[baseBlockNum]
+	return found
+}
+
+// discardCorrupted removes from disk a shard that cannot be opened, so it
+// is downloaded again instead of failing every time.
+func (p *IndexPool) discardCorrupted(baseBlockNum uint64, path string, cause error) {
+	zlog.Warn("removing corrupted shard from disk, it will be downloaded again", zap.Uint64("base", baseBlockNum), zap.String("path", path), zap.Error(cause))
+	metrics.ShardQuarantines.Inc()
+
+	if err := os.RemoveAll(path); err != nil {
+		zlog.Warn("cannot remove corrupted shard", zap.String("path", path), zap.Error(err))
+	}
+}
+
+// discard removes a corrupted lazy shard from disk as soon as it is not in
+// use anymore.
+func (l *lazyShards) discard(shard *search.ShardIndex) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry, found := l.entries[shard.StartBlock]
+	if !found {
+		return
+	}
+
+	entry.corrupted = true
+	if entry.refCount == 0 && entry.loading == nil {
+		l.unload(entry, false)
+		entry.corrupted = false
+	}
+}
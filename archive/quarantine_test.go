@@ -0,0 +1,147 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIndexPool_ScanOnDiskIndexes_QuarantinesCorruptedShard(t *testing.T) {
+	defer func(delay time.Duration) { quarantineRetryDelay = delay }(quarantineRetryDelay)
+	quarantineRetryDelay = time.Millisecond
+
+	indexesPath, err := ioutil.TempDir("", "quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	// not a valid bleve index, and not available from the store either
+	writeTestShard(t, indexesPath, 0, 100)
+	store := dstore.NewMockStore(nil)
+	store.SetFile("shards-10/0000000000.bleve.tar.zst", []byte("err"))
+
+	pool := &IndexPool{IndexesPath: indexesPath, ShardSize: 10, indexesStore: store}
+	defer pool.closing.Store(true)
+
+	require.NoError(t, pool.ScanOnDiskIndexes(0))
+
+	require.Len(t, pool.ReadPool, 1, "corrupted shard keeps its place in the pool")
+	pool.ReadPool[0].Lock.RLock()
+	assert.Nil(t, pool.ReadPool[0].Index)
+	pool.ReadPool[0].Lock.RUnlock()
+	assert.True(t, pool.isQuarantined(0))
+
+	err = pool.shardUnavailableError(pool.ReadPool[0])
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), "shard 0-9 is quarantined")
+
+	// quarantining again is a noop while being restored
+	pool.QuarantineShard(pool.ReadPool[0], fmt.Errorf("searcher failed"))
+	pool.quarantineLock.Lock()
+	assert.Len(t, pool.quarantined, 1)
+	pool.quarantineLock.Unlock()
+}
+
+func Test_lazyShards_discard(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	pool := &IndexPool{IndexesPath: indexesPath, ShardSize: 10}
+	pool.EnableLazyShardLoading(0, 0)
+
+	writeTestShard(t, indexesPath, 0, 100)
+	shard := &search.ShardIndex{StartBlock: 0, EndBlock: 9}
+	pool.lazyShards.register(shard)
+
+	entry := pool.lazyShards.entries[0]
+	entry.refCount++
+	pool.QuarantineShard(shard, fmt.Errorf("searcher failed"))
+
+	shardPath := filepath.Join(indexesPath, "0000000000.bleve")
+	_, err = os.Stat(shardPath)
+	assert.NoError(t, err, "kept on disk while in use")
+	assert.True(t, entry.corrupted)
+
+	pool.lazyShards.lock.Lock()
+	entry.refCount--
+	pool.lazyShards.lock.Unlock()
+	pool.QuarantineShard(shard, fmt.Errorf("searcher failed"))
+
+	_, err = os.Stat(shardPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.False(t, entry.corrupted)
+	assert.Len(t, pool.lazyShards.entries, 1, "downloaded again by the next query")
+}
+
+func TestIndexPool_suspectShard_Throttled(t *testing.T) {
+	pool := &IndexPool{ShardSize: 10}
+	shard := &search.ShardIndex{StartBlock: 0, EndBlock: 9}
+
+	pool.suspectShard(shard, fmt.Errorf("running searcher: too many clauses"))
+	pool.quarantineLock.Lock()
+	checkedAt := pool.integrityChecks[0]
+	pool.quarantineLock.Unlock()
+	require.False(t, checkedAt.IsZero())
+
+	pool.suspectShard(shard, fmt.Errorf("running searcher: too many clauses"))
+	pool.quarantineLock.Lock()
+	assert.Equal(t, checkedAt, pool.integrityChecks[0], "checked at most once per interval")
+	pool.quarantineLock.Unlock()
+
+	// an unloaded shard cannot be checked, so it is never quarantined
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, pool.isQuarantined(0))
+}
+
+func TestIndexPool_getReadOnlyIndexFilePath_RestoredShadowsReadOnly(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "quarantine")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+	readOnlyPath, err := ioutil.TempDir("", "quarantine-ro")
+	require.NoError(t, err)
+	defer os.RemoveAll(readOnlyPath)
+
+	pool := &IndexPool{IndexesPath: indexesPath, ReadOnlyIndexesPaths: []string{readOnlyPath}, ShardSize: 10}
+
+	writeTestShard(t, readOnlyPath, 0, 100)
+	assert.Equal(t, filepath.Join(readOnlyPath, "0000000000.bleve"), pool.getReadOnlyIndexFilePath(0))
+
+	writeTestShard(t, indexesPath, 0, 100)
+	assert.Equal(t, filepath.Join(indexesPath, "0000000000.bleve"), pool.getReadOnlyIndexFilePath(0))
+}
+
+func TestIndexPool_LastReadOnlyIndexedBlockID_SkipsUnknownQuarantined(t *testing.T) {
+	pool := &IndexPool{ShardSize: 10}
+	pool.ReadPool = []*search.ShardIndex{
+		{StartBlock: 0, EndBlock: 9, EndBlockID: "00000009a"},
+		{StartBlock: 10, EndBlock: 19},
+	}
+	pool.quarantined = map[uint64]*quarantinedShard{10: {cause: fmt.Errorf("cannot open"), since: time.Now()}}
+
+	assert.Equal(t, uint64(9), pool.LastReadOnlyIndexedBlock())
+	assert.Equal(t, "00000009a", pool.LastReadOnlyIndexedBlockID())
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const queryLogFilename = "query-log.json"
+
+var queryLogMaxEntries = 1000
+var queryLogHalfLife = 6 * time.Hour
+
+// queryLog is a rolling record of the queries served, by query hash. Their
+// count and cost (seconds spent serving them) decay by half every
+// `queryLogHalfLife`, so the top queries follow the recent traffic. It is
+// persisted in `IndexesPath` to warm up the archive on the next boot.
+type queryLog struct {
+	lock sync.Mutex
+	path string
+
+	Entries map[string]*queryLogEntry `json:"entries"`
+}
+
+type queryLogEntry struct {
+	Hash     string    `json:"-"`
+	Query    string    `json:"query"`
+	Count    float64   `json:"count"`
+	Cost     float64   `json:"cost"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func loadQueryLog(indexesPath string) (*queryLog, error) {
+	log := &queryLog{
+		Entries: map[string]*queryLogEntry{},
+	}
+	if indexesPath == "" {
+		return log, nil
+	}
+
+	log.path = filepath.Join(indexesPath, queryLogFilename)
+	cnt, err := ioutil.ReadFile(log.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return log, nil
+		}
+		return nil, fmt.Errorf("reading query log %q: %w", log.path, err)
+	}
+
+	if err := json.Unmarshal(cnt, log); err != nil {
+		return nil, fmt.Errorf("decoding query log %q: %w", log.path, err)
+	}
+	if log.Entries == nil {
+		log.Entries = map[string]*queryLogEntry{}
+	}
+	for hash, entry := range log.Entries {
+		entry.Hash = hash
+	}
+
+	return log, nil
+}
+
+func (e *queryLogEntry) decay(now time.Time) {
+	if elapsed := now.Sub(e.LastSeen); elapsed > 0 {
+		factor := math.Pow(0.5, elapsed.Seconds()/queryLogHalfLife.Seconds())
+		e.Count *= factor
+		e.Cost *= factor
+	}
+	e.LastSeen = now
+}
+
+func (l *queryLog) Record(hash, query string, cost time.Duration, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry, found := l.Entries[hash]
+	if !found {
+		if len(l.Entries) >= queryLogMaxEntries {
+			l.evictLeastUsed(now)
+		}
+		entry = &queryLogEntry{Hash: hash, Query: query, LastSeen: now}
+		l.Entries[hash] = entry
+	}
+
+	entry.decay(now)
+	entry.Count++
+	entry.Cost += cost.Seconds()
+}
+
+// evictLeastUsed must be called under lock.
+func (l *queryLog) evictLeastUsed(now time.Time) {
+	var leastUsed *queryLogEntry
+	for _, entry := range l.Entries {
+		entry.decay(now)
+		if leastUsed == nil || entry.Count < leastUsed.Count {
+			leastUsed = entry
+		}
+	}
+	if leastUsed != nil {
+		delete(l.Entries, leastUsed.Hash)
+	}
+}
+
+// Top returns the `count` most frequent queries, followed by those of the
+// `count` most expensive ones not already in.
+func (l *queryLog) Top(count int, now time.Time) (out []queryLogEntry) {
+	l.lock.Lock()
+	entries := make([]queryLogEntry, 0, len(l.Entries))
+	for _, entry := range l.Entries {
+		entry.decay(now)
+		entries = append(entries, *entry)
+	}
+	l.lock.Unlock()
+
+	// stable order on ties
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Hash < entries[j].Hash })
+
+	seen := map[string]bool{}
+	add := func(less func(i, j int) bool) {
+		sort.SliceStable(entries, less)
+		for i := 0; i < count && i < len(entries); i++ {
+			if !seen[entries[i].Hash] {
+				seen[entries[i].Hash] = true
+				out = append(out, entries[i])
+			}
+		}
+	}
+
+	add(func(i, j int) bool { return entries[i].Count > entries[j].Count })
+	add(func(i, j int) bool { return entries[i].Cost > entries[j].Cost })
+	return out
+}
+
+func (l *queryLog) save() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.path == "" {
+		return nil
+	}
+
+	cnt, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encoding query log: %w", err)
+	}
+
+	tmpPath := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, cnt, 0644); err != nil {
+		return fmt.Errorf("writing query log %q: %w", tmpPath, err)
+	}
+
+	return os.Rename(tmpPath, l.path)
+}
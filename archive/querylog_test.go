@@ -0,0 +1,138 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_Top(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type record struct {
+		hash string
+		cost time.Duration
+		at   time.Duration
+	}
+
+	tests := []struct {
+		name     string
+		records  []record
+		count    int
+		expected []string
+	}{
+		{
+			name:     "empty",
+			count:    2,
+			expected: nil,
+		},
+		{
+			name: "most frequent then most expensive",
+			records: []record{
+				{"a", time.Millisecond, 0},
+				{"a", time.Millisecond, 0},
+				{"b", time.Millisecond, 0},
+				{"c", time.Second, 0},
+			},
+			count:    1,
+			expected: []string{"a", "c"},
+		},
+		{
+			name: "no duplicates",
+			records: []record{
+				{"a", time.Second, 0},
+				{"a", time.Second, 0},
+				{"b", time.Millisecond, 0},
+			},
+			count:    1,
+			expected: []string{"a"},
+		},
+		{
+			name: "old queries decay",
+			records: []record{
+				{"a", time.Millisecond, 0},
+				{"a", time.Millisecond, 0},
+				{"a", time.Millisecond, 0},
+				{"b", time.Millisecond, 2 * queryLogHalfLife},
+				{"b", time.Millisecond, 2 * queryLogHalfLife},
+			},
+			count:    1,
+			expected: []string{"b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log, err := loadQueryLog("")
+			require.NoError(t, err)
+
+			var last time.Duration
+			for _, r := range test.records {
+				log.Record(r.hash, "query "+r.hash, r.cost, now.Add(r.at))
+				last = r.at
+			}
+
+			var hashes []string
+			for _, entry := range log.Top(test.count, now.Add(last)) {
+				hashes = append(hashes, entry.Hash)
+			}
+			assert.Equal(t, test.expected, hashes)
+		})
+	}
+}
+
+func TestQueryLog_EvictsLeastUsed(t *testing.T) {
+	defer func(max int) { queryLogMaxEntries = max }(queryLogMaxEntries)
+	queryLogMaxEntries = 2
+
+	now := time.Now()
+	log, err := loadQueryLog("")
+	require.NoError(t, err)
+
+	log.Record("a", "a", 0, now)
+	log.Record("a", "a", 0, now)
+	log.Record("b", "b", 0, now)
+	log.Record("c", "c", 0, now)
+
+	assert.Len(t, log.Entries, 2)
+	assert.Contains(t, log.Entries, "a")
+	assert.Contains(t, log.Entries, "c")
+}
+
+func TestQueryLog_Persistence(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "querylog")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	now := time.Now()
+	log, err := loadQueryLog(indexesPath)
+	require.NoError(t, err)
+	log.Record("a", "account:eoscanadacom", time.Second, now)
+	require.NoError(t, log.save())
+
+	reloaded, err := loadQueryLog(indexesPath)
+	require.NoError(t, err)
+	require.Contains(t, reloaded.Entries, "a")
+	assert.Equal(t, "a", reloaded.Entries["a"].Hash)
+	assert.Equal(t, "account:eoscanadacom", reloaded.Entries["a"].Query)
+	assert.Equal(t, 1.0, reloaded.Entries["a"].Count)
+	assert.Equal(t, 1.0, reloaded.Entries["a"].Cost)
+}
@@ -22,30 +22,12 @@ import (
 
 	"go.opencensus.io/trace"
 
-	stackdriverPropagation "contrib.go.opencensus.io/exporter/stackdriver/propagation"
-
 	"github.com/dfuse-io/derr"
 	"github.com/dfuse-io/logging"
-	"go.opencensus.io/plugin/ochttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-func openCensusMiddleware(next http.Handler) http.Handler {
-	return &ochttp.Handler{
-		Handler:     next,
-		Propagation: &stackdriverPropagation.HTTPFormat{},
-	}
-}
-
-func loggingMiddleware(next http.Handler) http.Handler {
-	return &logging.Handler{
-		Next:        next,
-		Propagation: &stackdriverPropagation.HTTPFormat{},
-		RootLogger:  zlog,
-	}
-}
-
 func trackingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		zlogger := logging.Logger(r.Context(), zlog)
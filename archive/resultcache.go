@@ -0,0 +1,143 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+// estimatedMatchOverheadBytes approximates the memory held by a single
+// match, on top of its transaction ID prefix. Matches are chain-specific,
+// so the cache size is an estimate, not an exact accounting.
+const estimatedMatchOverheadBytes = 64
+
+// shardResultsCache keeps the matches of a query on a full shard, so that
+// queries re-run over the same immutable shards do not hit the index
+// again. Entries are evicted least recently used first when over
+// `maxBytes`, and dropped when their shard goes away.
+type shardResultsCache struct {
+	maxBytes uint64
+
+	lock      sync.Mutex
+	entries   map[shardResultsKey]*list.Element
+	lru       *list.List // front is most recently used
+	usedBytes uint64
+}
+
+type shardResultsKey struct {
+	queryHash  string
+	startBlock uint64
+	sortDesc   bool
+}
+
+type shardResultsEntry struct {
+	key       shardResultsKey
+	matches   []search.SearchMatch
+	sizeBytes uint64
+}
+
+func newShardResultsCache(maxBytes uint64) *shardResultsCache {
+	return &shardResultsCache{
+		maxBytes: maxBytes,
+		entries:  map[shardResultsKey]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// EnableShardResultsCache keeps the matches of full shard queries in
+// memory, bounded to approximately `maxBytes`.
+func (p *IndexPool) EnableShardResultsCache(maxBytes uint64) {
+	zlog.Info("enabling shard results cache", zap.Uint64("max_bytes", maxBytes))
+	p.shardResultsCache = newShardResultsCache(maxBytes)
+}
+
+func (c *shardResultsCache) Get(queryHash string, startBlock uint64, sortDesc bool) (matches []search.SearchMatch, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[shardResultsKey{queryHash, startBlock, sortDesc}]
+	if !found {
+		metrics.ShardResultsCacheMiss.Inc()
+		return nil, false
+	}
+
+	metrics.ShardResultsCacheHit.Inc()
+	c.lru.MoveToFront(element)
+	return element.Value.(*shardResultsEntry).matches, true
+}
+
+// Put assumes `matches` are not modified anymore once cached, they are
+// shared by every query hitting the entry.
+func (c *shardResultsCache) Put(queryHash string, startBlock uint64, sortDesc bool, matches []search.SearchMatch) {
+	entry := &shardResultsEntry{
+		key:       shardResultsKey{queryHash, startBlock, sortDesc},
+		matches:   matches,
+		sizeBytes: estimateMatchesBytes(matches),
+	}
+	if entry.sizeBytes > c.maxBytes {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, found := c.entries[entry.key]; found {
+		c.removeElement(element)
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.usedBytes += entry.sizeBytes
+
+	for c.usedBytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+		metrics.ShardResultsCacheEvictions.Inc()
+	}
+	metrics.ShardResultsCacheBytes.SetUint64(c.usedBytes)
+}
+
+// PurgeRange drops the entries of every shard starting within
+// `[lowBlockNum, highBlockNum]`.
+func (c *shardResultsCache) PurgeRange(lowBlockNum, highBlockNum uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, element := range c.entries {
+		if key.startBlock >= lowBlockNum && key.startBlock <= highBlockNum {
+			c.removeElement(element)
+		}
+	}
+	metrics.ShardResultsCacheBytes.SetUint64(c.usedBytes)
+}
+
+// removeElement must be called under lock.
+func (c *shardResultsCache) removeElement(element *list.Element) {
+	entry := element.Value.(*shardResultsEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.usedBytes -= entry.sizeBytes
+}
+
+func estimateMatchesBytes(matches []search.SearchMatch) (size uint64) {
+	for _, match := range matches {
+		size += estimatedMatchOverheadBytes + uint64(len(match.TransactionIDPrefix()))
+	}
+	// even an empty result holds a slot in the cache
+	return size + estimatedMatchOverheadBytes
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	pbsearch "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+)
+
+type cachedTestMatch struct {
+	blockNum uint64
+	trxID    string
+}
+
+func (m *cachedTestMatch) BlockNum() uint64            { return m.blockNum }
+func (m *cachedTestMatch) TransactionIDPrefix() string { return m.trxID }
+func (m *cachedTestMatch) GetIndex() uint64            { return 0 }
+func (m *cachedTestMatch) SetIndex(index uint64)       {}
+func (m *cachedTestMatch) FillProtoSpecific(match *pbsearch.SearchMatch, blk *bstream.Block) error {
+	return nil
+}
+
+func testMatches(trxIDs ...string) (out []search.SearchMatch) {
+	for i, trxID := range trxIDs {
+		out = append(out, &cachedTestMatch{blockNum: uint64(i), trxID: trxID})
+	}
+	return
+}
+
+func TestShardResultsCache(t *testing.T) {
+	entrySize := estimateMatchesBytes(testMatches("aaaaaaaa"))
+
+	tests := []struct {
+		name       string
+		maxBytes   uint64
+		run        func(c *shardResultsCache)
+		expectKeys []shardResultsKey
+		expectMiss []shardResultsKey
+	}{
+		{
+			name:     "keyed by query, shard and direction",
+			maxBytes: 10 * entrySize,
+			run: func(c *shardResultsCache) {
+				c.Put("q1", 0, false, testMatches("aaaaaaaa"))
+				c.Put("q1", 100, false, testMatches("bbbbbbbb"))
+			},
+			expectKeys: []shardResultsKey{{"q1", 0, false}, {"q1", 100, false}},
+			expectMiss: []shardResultsKey{{"q2", 0, false}, {"q1", 0, true}},
+		},
+		{
+			name:     "evicts least recently used over size",
+			maxBytes: 2 * entrySize,
+			run: func(c *shardResultsCache) {
+				c.Put("q1", 0, false, testMatches("aaaaaaaa"))
+				c.Put("q1", 100, false, testMatches("bbbbbbbb"))
+				c.Get("q1", 0, false)
+				c.Put("q1", 200, false, testMatches("cccccccc"))
+			},
+			expectKeys: []shardResultsKey{{"q1", 0, false}, {"q1", 200, false}},
+			expectMiss: []shardResultsKey{{"q1", 100, false}},
+		},
+		{
+			name:     "entry larger than cache is not kept",
+			maxBytes: entrySize,
+			run: func(c *shardResultsCache) {
+				c.Put("q1", 0, false, testMatches("aaaaaaaa", "bbbbbbbb"))
+			},
+			expectMiss: []shardResultsKey{{"q1", 0, false}},
+		},
+		{
+			name:     "purged with the shard",
+			maxBytes: 10 * entrySize,
+			run: func(c *shardResultsCache) {
+				c.Put("q1", 0, false, testMatches("aaaaaaaa"))
+				c.Put("q1", 100, false, testMatches("bbbbbbbb"))
+				c.Put("q2", 100, true, testMatches("bbbbbbbb"))
+				c.PurgeRange(100, 199)
+			},
+			expectKeys: []shardResultsKey{{"q1", 0, false}},
+			expectMiss: []shardResultsKey{{"q1", 100, false}, {"q2", 100, true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newShardResultsCache(test.maxBytes)
+			test.run(c)
+
+			for _, key := range test.expectKeys {
+				_, found := c.Get(key.queryHash, key.startBlock, key.sortDesc)
+				assert.True(t, found, "expected %v to be cached", key)
+			}
+			for _, key := range test.expectMiss {
+				_, found := c.Get(key.queryHash, key.startBlock, key.sortDesc)
+				assert.False(t, found, "expected %v not to be cached", key)
+			}
+			assert.Equal(t, uint64(len(test.expectKeys))*entrySize, c.usedBytes)
+		})
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package roarcache
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dfuse-io/dstore"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var diskBucket = []byte("roar")
+
+// Disk is a `Cache` persisted in an embedded bolt database. Entries expire
+// after `ttl`, and the least recently used ones are evicted whenever the sum
+// of the stored bitmaps goes over `maxBytes`.
+//
+// Each value is stored as an 8 bytes big-endian unix timestamp of its
+// insertion, followed by the serialized bitmap.
+type Disk struct {
+	db *bolt.DB
+
+	shardSize uint64
+	ttl       time.Duration
+	maxBytes  uint64
+
+	lock      sync.Mutex
+	lru       *list.List // of *diskEntry, most recently used at the front
+	entries   map[string]*list.Element
+	usedBytes uint64
+}
+
+type diskEntry struct {
+	key  string
+	size uint64
+}
+
+func NewDisk(path string, ttl time.Duration, maxBytes uint64, shardSize uint64) (*Disk, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening roar cache database %q: %w", path, err)
+	}
+
+	c := &Disk{
+		db:        db,
+		shardSize: shardSize,
+		ttl:       ttl,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		entries:   map[string]*list.Element{},
+	}
+
+	if err := c.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load rebuilds the LRU from the database, ordered by insertion time since
+// access times are not persisted. Expired entries are dropped on the way.
+func (c *Disk) load() error {
+	type loadedEntry struct {
+		key       string
+		size      uint64
+		createdAt int64
+	}
+
+	var loaded []*loadedEntry
+	var expired [][]byte
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(diskBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			if c.isExpired(v) {
+				expired = append(expired, append([]byte{}, k...))
+				return nil
+			}
+
+			loaded = append(loaded, &loadedEntry{
+				key:       string(k),
+				size:      uint64(len(v)),
+				createdAt: int64(binary.BigEndian.Uint64(v[:8])),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("loading roar cache database: %w", err)
+	}
+
+	if err := c.deleteKeys(expired); err != nil {
+		return err
+	}
+
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].createdAt < loaded[j].createdAt })
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, entry := range loaded {
+		c.touch(entry.key, entry.size)
+	}
+
+	zlog.Info("roar cache loaded from disk", zap.Int("entry_count", len(loaded)), zap.Int("expired_count", len(expired)), zap.Uint64("used_bytes", c.usedBytes))
+	return c.evictOverBudget()
+}
+
+func (c *Disk) Put(key string, roar *roaring.Bitmap) error {
+	cnt, err := roar.ToBytes()
+	if err != nil {
+		return err
+	}
+
+	return c.put(c.computeKey(key), time.Now(), cnt)
+}
+
+func (c *Disk) put(dbKey string, createdAt time.Time, bitmap []byte) error {
+	value := make([]byte, 8+len(bitmap))
+	binary.BigEndian.PutUint64(value[:8], uint64(createdAt.Unix()))
+	copy(value[8:], bitmap)
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(diskBucket).Put([]byte(dbKey), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.touch(dbKey, uint64(len(value)))
+	return c.evictOverBudget()
+}
+
+func (c *Disk) Get(key string, roar *roaring.Bitmap) error {
+	dbKey := c.computeKey(key)
+
+	var value []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(diskBucket).Get([]byte(dbKey)); v != nil {
+			// bolt's memory is only valid within the transaction
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		return ErrCacheMiss
+	}
+
+	if c.isExpired(value) {
+		c.lock.Lock()
+		c.forget(dbKey)
+		c.lock.Unlock()
+
+		if err := c.deleteKeys([][]byte{[]byte(dbKey)}); err != nil {
+			return err
+		}
+		return ErrCacheMiss
+	}
+
+	if _, err := roar.FromBuffer(value[8:]); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if element, found := c.entries[dbKey]; found {
+		c.lru.MoveToFront(element)
+	}
+	c.lock.Unlock()
+
+	return nil
+}
+
+func (c *Disk) Close() error {
+	return c.db.Close()
+}
+
+func (c *Disk) UsedBytes() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.usedBytes
+}
+
+func (c *Disk) computeKey(key string) string {
+	return fmt.Sprintf("rc:%d:%s", c.shardSize, key)
+}
+
+// isExpired also holds for values too short to carry their creation time,
+// those are corrupted.
+func (c *Disk) isExpired(value []byte) bool {
+	if len(value) < 8 {
+		return true
+	}
+	if c.ttl == 0 {
+		return false
+	}
+
+	createdAt := time.Unix(int64(binary.BigEndian.Uint64(value[:8])), 0)
+	return time.Since(createdAt) > c.ttl
+}
+
+// touch must be called under lock.
+func (c *Disk) touch(dbKey string, size uint64) {
+	if element, found := c.entries[dbKey]; found {
+		entry := element.Value.(*diskEntry)
+		c.usedBytes -= entry.size
+		entry.size = size
+		c.usedBytes += size
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[dbKey] = c.lru.PushFront(&diskEntry{key: dbKey, size: size})
+	c.usedBytes += size
+}
+
+// forget must be called under lock.
+func (c *Disk) forget(dbKey string) {
+	element, found := c.entries[dbKey]
+	if !found {
+		return
+	}
+
+	c.usedBytes -= element.Value.(*diskEntry).size
+	c.lru.Remove(element)
+	delete(c.entries, dbKey)
+}
+
+// evictOverBudget must be called under lock.
+func (c *Disk) evictOverBudget() error {
+	if c.maxBytes == 0 || c.usedBytes <= c.maxBytes {
+		return nil
+	}
+
+	var evicted [][]byte
+	for c.usedBytes > c.maxBytes && c.lru.Len() > 0 {
+		entry := c.lru.Back().Value.(*diskEntry)
+		c.forget(entry.key)
+		evicted = append(evicted, []byte(entry.key))
+	}
+
+	zlog.Debug("evicting roar cache entries", zap.Int("evicted_count", len(evicted)), zap.Uint64("used_bytes", c.usedBytes))
+	return c.deleteKeys(evicted)
+}
+
+func (c *Disk) deleteKeys(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(diskBucket)
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Export writes a snapshot of all the entries to `shareStore` as
+// `<name>.roarcache`, so that other replicas can `Seed` from it.
+func (c *Disk) Export(ctx context.Context, shareStore dstore.Store, name string) error {
+	pipeRead, pipeWrite := io.Pipe()
+	go func() {
+		writer := bufio.NewWriter(pipeWrite)
+		err := c.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(diskBucket).ForEach(func(k, v []byte) error {
+				if c.isExpired(v) {
+					return nil
+				}
+				return writeSnapshotRecord(writer, k, v)
+			})
+		})
+		if err == nil {
+			err = writer.Flush()
+		}
+		pipeWrite.CloseWithError(err)
+	}()
+
+	if err := shareStore.WriteObject(ctx, name+".roarcache", pipeRead); err != nil {
+		pipeRead.CloseWithError(err)
+		return fmt.Errorf("writing roar cache snapshot: %w", err)
+	}
+	return nil
+}
+
+// Seed imports the entries of all the snapshots found in `shareStore`,
+// keeping the local version of entries already present.
+func (c *Disk) Seed(ctx context.Context, shareStore dstore.Store) error {
+	var snapshots []string
+	err := shareStore.Walk(ctx, "", ".tmp", func(filename string) error {
+		if strings.HasSuffix(filename, ".roarcache") {
+			snapshots = append(snapshots, filename)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing roar cache snapshots: %w", err)
+	}
+
+	for _, snapshot := range snapshots {
+		count, err := c.seedFrom(ctx, shareStore, snapshot)
+		if err != nil {
+			zlog.Warn("cannot seed roar cache from snapshot, skipping", zap.String("snapshot", snapshot), zap.Error(err))
+			continue
+		}
+		zlog.Info("roar cache seeded from snapshot", zap.String("snapshot", snapshot), zap.Int("imported_count", count))
+	}
+
+	return nil
+}
+
+func (c *Disk) seedFrom(ctx context.Context, shareStore dstore.Store, snapshot string) (count int, err error) {
+	reader, err := shareStore.OpenObject(ctx, snapshot)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	bufReader := bufio.NewReader(reader)
+	for {
+		key, value, err := readSnapshotRecord(bufReader)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if c.isExpired(value) {
+			continue
+		}
+
+		c.lock.Lock()
+		_, found := c.entries[string(key)]
+		c.lock.Unlock()
+		if found {
+			continue
+		}
+
+		createdAt := time.Unix(int64(binary.BigEndian.Uint64(value[:8])), 0)
+		if err := c.put(string(key), createdAt, value[8:]); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// LaunchSharing seeds the cache from `shareStore`, then periodically exports
+// it there, until `ctx` is done.
+func (c *Disk) LaunchSharing(ctx context.Context, shareStore dstore.Store, name string, interval time.Duration) {
+	if err := c.Seed(ctx, shareStore); err != nil {
+		zlog.Warn("cannot seed roar cache", zap.Error(err))
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Export(ctx, shareStore, name); err != nil {
+				zlog.Warn("cannot export roar cache", zap.Error(err))
+			}
+		}
+	}
+}
+
+func writeSnapshotRecord(w io.Writer, key, value []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(value)))
+
+	for _, chunk := range [][]byte{header, key, value} {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSnapshotRecord(r io.Reader) (key, value []byte, err error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	key = make([]byte, binary.BigEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, nil, fmt.Errorf("reading key: %w", err)
+	}
+
+	value = make([]byte, binary.BigEndian.Uint32(header[4:]))
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, nil, fmt.Errorf("reading value: %w", err)
+	}
+
+	return key, value, nil
+}
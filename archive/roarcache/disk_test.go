@@ -0,0 +1,151 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package roarcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dfuse-io/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestDisk(t *testing.T, dir string, ttl time.Duration, maxBytes uint64) *Disk {
+	cache, err := NewDisk(filepath.Join(dir, "roar.db"), ttl, maxBytes, 100)
+	require.NoError(t, err)
+	return cache
+}
+
+func TestDisk_PutGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roarcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := newTestDisk(t, dir, 0, 0)
+	require.NoError(t, cache.Put("hash1", roaring.BitmapOf(1, 2, 3)))
+
+	roar := roaring.New()
+	require.NoError(t, cache.Get("hash1", roar))
+	assert.Equal(t, []uint32{1, 2, 3}, roar.ToArray())
+
+	assert.True(t, IsCacheMiss(cache.Get("hash2", roaring.New())))
+
+	// persisted across restarts
+	require.NoError(t, cache.Close())
+	cache = newTestDisk(t, dir, 0, 0)
+	defer cache.Close()
+
+	roar = roaring.New()
+	require.NoError(t, cache.Get("hash1", roar))
+	assert.Equal(t, []uint32{1, 2, 3}, roar.ToArray())
+}
+
+func TestDisk_Expiration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roarcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := newTestDisk(t, dir, time.Hour, 0)
+	defer cache.Close()
+
+	require.NoError(t, cache.put(cache.computeKey("old"), time.Now().Add(-2*time.Hour), mustBytes(t, roaring.BitmapOf(1))))
+	require.NoError(t, cache.Put("new", roaring.BitmapOf(1)))
+
+	assert.True(t, IsCacheMiss(cache.Get("old", roaring.New())))
+	assert.NoError(t, cache.Get("new", roaring.New()))
+}
+
+func TestDisk_Eviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roarcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	entrySize := uint64(8 + len(mustBytes(t, roaring.BitmapOf(1))))
+	cache := newTestDisk(t, dir, 0, 2*entrySize)
+	defer cache.Close()
+
+	require.NoError(t, cache.Put("a", roaring.BitmapOf(1)))
+	require.NoError(t, cache.Put("b", roaring.BitmapOf(1)))
+	require.NoError(t, cache.Get("a", roaring.New())) // `b` becomes the least recently used
+	require.NoError(t, cache.Put("c", roaring.BitmapOf(1)))
+
+	assert.NoError(t, cache.Get("a", roaring.New()))
+	assert.True(t, IsCacheMiss(cache.Get("b", roaring.New())))
+	assert.NoError(t, cache.Get("c", roaring.New()))
+	assert.Equal(t, 2*entrySize, cache.UsedBytes())
+}
+
+func TestDisk_ExportSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roarcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	shareStore, err := dstore.NewLocalStore(filepath.Join(dir, "share"), "", "", true)
+	require.NoError(t, err)
+
+	source := newTestDisk(t, filepath.Join(dir), 0, 0)
+	defer source.Close()
+	require.NoError(t, source.Put("hash1", roaring.BitmapOf(4, 5)))
+	require.NoError(t, source.Export(context.Background(), shareStore, "replica-1"))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "other"), 0755))
+	seeded := newTestDisk(t, filepath.Join(dir, "other"), 0, 0)
+	defer seeded.Close()
+	require.NoError(t, seeded.Seed(context.Background(), shareStore))
+
+	roar := roaring.New()
+	require.NoError(t, seeded.Get("hash1", roar))
+	assert.Equal(t, []uint32{4, 5}, roar.ToArray())
+}
+
+func TestDisk_ExportSkipsTruncatedValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roarcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	shareStore, err := dstore.NewLocalStore(filepath.Join(dir, "share"), "", "", true)
+	require.NoError(t, err)
+
+	source := newTestDisk(t, filepath.Join(dir), time.Hour, 0)
+	defer source.Close()
+	require.NoError(t, source.Put("hash1", roaring.BitmapOf(4, 5)))
+	require.NoError(t, source.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(diskBucket).Put([]byte(source.computeKey("truncated")), []byte{0, 1, 2})
+	}))
+
+	require.NoError(t, source.Export(context.Background(), shareStore, "replica-1"))
+	assert.True(t, IsCacheMiss(source.Get("truncated", roaring.New())))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "other"), 0755))
+	seeded := newTestDisk(t, filepath.Join(dir, "other"), time.Hour, 0)
+	defer seeded.Close()
+	require.NoError(t, seeded.Seed(context.Background(), shareStore))
+
+	assert.NoError(t, seeded.Get("hash1", roaring.New()))
+	assert.True(t, IsCacheMiss(seeded.Get("truncated", roaring.New())))
+}
+
+func mustBytes(t *testing.T, roar *roaring.Bitmap) []byte {
+	cnt, err := roar.ToBytes()
+	require.NoError(t, err)
+	return cnt
+}
@@ -15,6 +15,7 @@
 package roarcache
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -27,6 +28,14 @@ type Cache interface {
 	Get(key string, roar *roaring.Bitmap) error
 }
 
+// ErrCacheMiss is returned by `Get` when the key is not found, it carries
+// the same message as the memcache client's own cache miss error.
+var ErrCacheMiss = errors.New("memcache: cache miss")
+
+func IsCacheMiss(err error) bool {
+	return err != nil && err.Error() == ErrCacheMiss.Error()
+}
+
 type Memcache struct {
 	client *mcache.Client
 
@@ -0,0 +1,384 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dfuse-io/derr"
+	"github.com/dfuse-io/search"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+)
+
+var ErrShardNotFound = errors.New("shard not found")
+var ErrShardInUse = errors.New("shard in use")
+var ErrShardNotLoaded = errors.New("shard not loaded")
+
+type ShardInfo struct {
+	StartBlock  uint64 `json:"start_block"`
+	EndBlock    uint64 `json:"end_block"`
+	EndBlockID  string `json:"end_block_id,omitempty"`
+	Path        string `json:"path"`
+	SizeBytes   uint64 `json:"size_bytes"`
+	Loaded      bool   `json:"loaded"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+// ListShards returns the shards of the read pool, in order. Shards not
+// on disk, like lazy shards never queried or evicted shards, have a zero
+// size.
+func (p *IndexPool) ListShards() []*ShardInfo {
+	p.readPoolLock.RLock()
+	readPool := p.ReadPool
+	p.readPoolLock.RUnlock()
+
+	out := make([]*ShardInfo, len(readPool))
+	for i, shard := range readPool {
+		shard.Lock.RLock()
+		info := &ShardInfo{
+			StartBlock: shard.StartBlock,
+			EndBlock:   shard.EndBlock,
+			EndBlockID: shard.EndBlockID,
+			Path:       p.getReadOnlyIndexFilePath(shard.StartBlock),
+			Loaded:     shard.Index != nil,
+		}
+		shard.Lock.RUnlock()
+		info.Quarantined = p.isQuarantined(info.StartBlock)
+
+		if size, err := dirSize(info.Path); err == nil {
+			info.SizeBytes = size
+		}
+		out[i] = info
+	}
+	return out
+}
+
+func (p *IndexPool) findShard(baseBlockNum uint64) (*search.ShardIndex, error) {
+	p.readPoolLock.RLock()
+	defer p.readPoolLock.RUnlock()
+
+	if baseBlockNum < p.LowestServeableBlockNum || baseBlockNum%p.ShardSize != 0 {
+		return nil, fmt.Errorf("%w: %d", ErrShardNotFound, baseBlockNum)
+	}
+
+	shard := shardAt(p.ReadPool, p.ShardSize, baseBlockNum)
+	if shard == nil {
+		return nil, fmt.Errorf("%w: %d", ErrShardNotFound, baseBlockNum)
+	}
+	return shard, nil
+}
+
+// EvictShard closes a shard and removes it from disk, it stays in the read
+// pool so its neighbours are unaffected. Queries wait for it to be closed,
+// and the next one reaching it downloads it again, see `loadEvictedShard`.
+// Lazy shards are simply downloaded again by the next query touching them,
+// and are not evicted while being queried.
+func (p *IndexPool) EvictShard(baseBlockNum uint64) error {
+	shard, err := p.findShard(baseBlockNum)
+	if err != nil {
+		return err
+	}
+
+	if p.lazyShards != nil {
+		return p.lazyShards.evict(shard)
+	}
+
+	shard.Lock.Lock()
+	defer shard.Lock.Unlock()
+
+	return p.unloadShard(shard)
+}
+
+// ReloadShard downloads a shard again from the indexes store and reopens
+// it. Queries keep reading the current one during the download, and only
+// wait for it to be swapped. A shard served from one of the
+// `ReadOnlyIndexesPaths` is only reopened. When the download fails, the
+// shard is left as it was. Reloading a gap fills it.
+func (p *IndexPool) ReloadShard(baseBlockNum uint64) error {
+	if baseBlockNum%p.ShardSize == 0 && p.isGap(baseBlockNum) {
+		return p.reloads.do(baseBlockNum, func() error {
+			return p.fillGap(baseBlockNum)
+		})
+	}
+
+	shard, err := p.findShard(baseBlockNum)
+	if err != nil {
+		return err
+	}
+
+	if p.lazyShards != nil {
+		return p.lazyShards.reload(shard)
+	}
+
+	return p.reloadShard(shard)
+}
+
+// shardReloads deduplicates the concurrent reloads of a shard, like an
+// admin reload and the queries reaching an evicted shard.
+type shardReloads struct {
+	lock    sync.Mutex
+	running map[uint64]*shardReload
+}
+
+type shardReload struct {
+	done chan struct{}
+	err  error
+}
+
+func (r *shardReloads) do(baseBlockNum uint64, reload func() error) error {
+	r.lock.Lock()
+	if running := r.running[baseBlockNum]; running != nil {
+		r.lock.Unlock()
+		<-running.done
+		return running.err
+	}
+
+	if r.running == nil {
+		r.running = map[uint64]*shardReload{}
+	}
+	running := &shardReload{done: make(chan struct{})}
+	r.running[baseBlockNum] = running
+	r.lock.Unlock()
+
+	running.err = reload()
+
+	r.lock.Lock()
+	delete(r.running, baseBlockNum)
+	r.lock.Unlock()
+	close(running.done)
+
+	return running.err
+}
+
+func (p *IndexPool) reloadShard(shard *search.ShardIndex) error {
+	return p.reloads.do(shard.StartBlock, func() error {
+		if !p.isManagedPath(p.getReadOnlyIndexFilePath(shard.StartBlock)) {
+			return p.swapShard(shard, "")
+		}
+		return p.downloadShard(shard)
+	})
+}
+
+// downloadShard downloads a shard from the indexes store and swaps it with
+// the current one. The download lands in `IndexesPath`, where it shadows
+// the copy of a read-only indexes path, see `getReadOnlyIndexFilePath`.
+func (p *IndexPool) downloadShard(shard *search.ShardIndex) error {
+	baseBlockNum := shard.StartBlock
+	reloadPath := p.buildWritableIndexFilePath(baseBlockNum, "reload")
+	defer os.RemoveAll(reloadPath)
+
+	if err := p.downloadAndExtractTo(0, fmt.Sprintf("%010d", baseBlockNum), reloadPath); err != nil {
+		return fmt.Errorf("downloading shard %d: %w", baseBlockNum, err)
+	}
+
+	if err := p.swapShard(shard, reloadPath); err != nil {
+		return err
+	}
+
+	p.shardLoaded(shard)
+	return nil
+}
+
+// swapShard closes `shard` and reopens it, from `reloadPath` when set,
+// which replaces the shard on disk.
+func (p *IndexPool) swapShard(shard *search.ShardIndex, reloadPath string) error {
+	baseBlockNum := shard.StartBlock
+
+	shard.Lock.Lock()
+	defer shard.Lock.Unlock()
+
+	if err := p.unloadShard(shard); err != nil {
+		return err
+	}
+
+	path := p.getReadOnlyIndexFilePath(baseBlockNum)
+	if reloadPath != "" {
+		path = p.buildWritableIndexFilePath(baseBlockNum, "")
+		if err := os.Rename(reloadPath, path); err != nil {
+			return fmt.Errorf("swapping shard %d: %w", baseBlockNum, err)
+		}
+	}
+
+	opened, err := p.openReadOnlyAt(baseBlockNum, path)
+	if err != nil {
+		return fmt.Errorf("opening shard %d: %w", baseBlockNum, err)
+	}
+
+	shard.Index = opened.Index
+	shard.FieldTermsFilterFile = opened.FieldTermsFilterFile
+	shard.StartBlockID, shard.StartBlockTime = opened.StartBlockID, opened.StartBlockTime
+	shard.EndBlockID, shard.EndBlockTime = opened.EndBlockID, opened.EndBlockTime
+	return nil
+}
+
+// loadEvictedShard reloads, for the query reaching it, a shard that was
+// evicted or failed to be reloaded. Quarantined shards are restored in the
+// background instead.
+func (p *IndexPool) loadEvictedShard(shard *search.ShardIndex) error {
+	shard.Lock.RLock()
+	loaded := shard.Index != nil
+	shard.Lock.RUnlock()
+
+	if loaded || p.isQuarantined(shard.StartBlock) {
+		return nil
+	}
+
+	zlog.Info("reloading evicted shard reached by a query", zap.Uint64("base", shard.StartBlock))
+	if err := p.reloadShard(shard); err != nil {
+		return derr.Statusf(codes.Unavailable, "shard %d-%d is not loaded and cannot be reloaded: %s", shard.StartBlock, shard.EndBlock, err)
+	}
+	return nil
+}
+
+// unloadShard must be called with the shard locked.
+func (p *IndexPool) unloadShard(shard *search.ShardIndex) error {
+	if err := shard.Close(); err != nil {
+		return fmt.Errorf("closing shard %d: %w", shard.StartBlock, err)
+	}
+	shard.Index = nil
+
+	if p.isManagedPath(p.getReadOnlyIndexFilePath(shard.StartBlock)) {
+		p.deleteIndex(shard)
+	} else if p.shardResultsCache != nil {
+		p.shardResultsCache.PurgeRange(shard.StartBlock, shard.StartBlock)
+	}
+	return nil
+}
+
+// CheckShardIntegrity runs `search.CheckIndexIntegrity` through the reader
+// of a loaded shard, which cannot be evicted or reloaded meanwhile.
+func (p *IndexPool) CheckShardIntegrity(baseBlockNum uint64) (info interface{}, err error) {
+	shard, err := p.findShard(baseBlockNum)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.checkShardIntegrity(shard)
+}
+
+func (p *IndexPool) checkShardIntegrity(shard *search.ShardIndex) (info interface{}, err error) {
+	baseBlockNum := shard.StartBlock
+
+	shard.Lock.RLock()
+	defer shard.Lock.RUnlock()
+
+	if shard.Index == nil {
+		return nil, fmt.Errorf("%w: %d", ErrShardNotLoaded, baseBlockNum)
+	}
+
+	reader, err := shard.Index.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("getting reader of shard %d: %w", baseBlockNum, err)
+	}
+	defer reader.Close()
+
+	metaInfo, err := search.CheckIndexReaderIntegrity(reader, p.getReadOnlyIndexFilePath(baseBlockNum), p.ShardSize)
+	if metaInfo == nil {
+		return nil, err
+	}
+	return metaInfo, err
+}
+
+// PollRemoteIndicesOnce retrieves the shards of `[lowBlockNum,
+// highBlockNum]` available in the indexes store and missing from the pool:
+// the gaps of that range first, then the shards following the last one of
+// the pool, up to the one containing `highBlockNum`. When gaps are
+// allowed and the pool ends before `lowBlockNum`, the shards in between
+// are held as gaps, filled by the gap refills, so polling starts right at
+// `lowBlockNum`. Otherwise the pool is kept contiguous and polling starts
+// after its last shard. It returns the number of shards added to the pool.
+func (p *IndexPool) PollRemoteIndicesOnce(lowBlockNum, highBlockNum uint64) (count int, err error) {
+	count = p.refillGaps(lowBlockNum, highBlockNum)
+
+	lowBaseBlockNum := lowBlockNum - lowBlockNum%p.ShardSize
+	if next := p.nextReadOnlyIndexBlock(); next != 0 && next < lowBaseBlockNum && p.AllowGaps && p.lazyShards == nil {
+		zlog.Info("holding shards before the polled range as gaps", zap.Uint64("from_block_num", next), zap.Uint64("to_block_num", lowBaseBlockNum))
+		p.readPoolLock.Lock()
+		p.addGaps(next, lowBaseBlockNum)
+		p.readPoolLock.Unlock()
+	}
+
+	for {
+		next := p.nextReadOnlyIndexBlock()
+		if next == 0 {
+			next = lowBaseBlockNum
+		}
+		if next > highBlockNum {
+			return count, nil
+		}
+
+		idx, err := p.pollNextIndex(lowBaseBlockNum)
+		if err != nil {
+			if err.Error() == "index file is not available" {
+				return count, nil
+			}
+			return count, err
+		}
+
+		if err := p.publishIndexedHead(idx); err != nil {
+			zlog.Warn("unable to publisher search peer", zap.Error(err))
+		}
+		count++
+	}
+}
+
+func (p *IndexPool) inIndexesPath(path string) bool {
+	return strings.HasPrefix(path, filepath.Clean(p.IndexesPath)+string(filepath.Separator))
+}
+
+// evict unloads a shard that is not being queried.
+func (l *lazyShards) evict(shard *search.ShardIndex) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry, found := l.entries[shard.StartBlock]
+	if !found {
+		return fmt.Errorf("%w: %d", ErrShardNotFound, shard.StartBlock)
+	}
+	if entry.refCount > 0 || entry.loading != nil {
+		return fmt.Errorf("%w: %d", ErrShardInUse, shard.StartBlock)
+	}
+
+	l.unload(entry, false)
+	return nil
+}
+
+// reload evicts a shard that is not being queried, and loads it again.
+func (l *lazyShards) reload(shard *search.ShardIndex) error {
+	if err := l.evict(shard); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	entry, found := l.entries[shard.StartBlock]
+	if !found {
+		l.lock.Unlock()
+		return fmt.Errorf("%w: %d", ErrShardNotFound, shard.StartBlock)
+	}
+	loading := l.startLoad(entry)
+	l.lock.Unlock()
+
+	<-loading
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return entry.loadErr
+}
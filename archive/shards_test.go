@@ -0,0 +1,156 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexPool_findShard(t *testing.T) {
+	pool := &IndexPool{
+		ShardSize:               10,
+		LowestServeableBlockNum: 20,
+		ReadPool: []*search.ShardIndex{
+			{StartBlock: 20, EndBlock: 29},
+			{StartBlock: 30, EndBlock: 39},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		base        uint64
+		expectError error
+	}{
+		{name: "first shard", base: 20},
+		{name: "last shard", base: 30},
+		{name: "below pool", base: 10, expectError: ErrShardNotFound},
+		{name: "above pool", base: 40, expectError: ErrShardNotFound},
+		{name: "not a shard boundary", base: 25, expectError: ErrShardNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shard, err := pool.findShard(test.base)
+			if test.expectError != nil {
+				assert.True(t, errors.Is(err, test.expectError))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.base, shard.StartBlock)
+		})
+	}
+}
+
+func TestIndexPool_EvictShard(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "shards")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	writeTestShard(t, indexesPath, 0, 100)
+	writeTestShard(t, indexesPath, 10, 100)
+
+	pool := &IndexPool{
+		IndexesPath: indexesPath,
+		ShardSize:   10,
+		ReadPool: []*search.ShardIndex{
+			{StartBlock: 0, EndBlock: 9},
+			{StartBlock: 10, EndBlock: 19},
+		},
+	}
+
+	require.NoError(t, pool.EvictShard(0))
+
+	_, err = os.Stat(filepath.Join(indexesPath, "0000000000.bleve"))
+	assert.True(t, os.IsNotExist(err))
+
+	shards := pool.ListShards()
+	require.Len(t, shards, 2, "evicted shard stays in the pool")
+	assert.Equal(t, uint64(0), shards[0].SizeBytes)
+	assert.Equal(t, uint64(100), shards[1].SizeBytes)
+
+	_, err = pool.CheckShardIntegrity(0)
+	assert.True(t, errors.Is(err, ErrShardNotLoaded))
+}
+
+func Test_shardReloads(t *testing.T) {
+	var reloads shardReloads
+
+	calls := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	firstErr := make(chan error, 1)
+
+	go func() {
+		firstErr <- reloads.do(10, func() error {
+			calls++
+			close(started)
+			<-release
+			return errShardReloadTest
+		})
+	}()
+	<-started
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+
+	err := reloads.do(10, func() error {
+		calls++
+		return nil
+	})
+	assert.Equal(t, errShardReloadTest, err, "a reload joins the one running")
+	assert.Equal(t, errShardReloadTest, <-firstErr)
+	assert.Equal(t, 1, calls)
+	assert.Len(t, reloads.running, 0)
+
+	require.NoError(t, reloads.do(10, func() error { return nil }), "a later reload runs again")
+}
+
+var errShardReloadTest = errors.New("reload failed")
+
+func Test_lazyShards_evict(t *testing.T) {
+	indexesPath, err := ioutil.TempDir("", "shards")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexesPath)
+
+	pool := &IndexPool{IndexesPath: indexesPath, ShardSize: 10}
+	pool.EnableLazyShardLoading(0, 0)
+
+	writeTestShard(t, indexesPath, 0, 100)
+	shard := &search.ShardIndex{StartBlock: 0, EndBlock: 9}
+	pool.lazyShards.register(shard)
+	pool.ReadPool = []*search.ShardIndex{shard}
+
+	pool.lazyShards.entries[0].refCount++
+	assert.True(t, errors.Is(pool.EvictShard(0), ErrShardInUse))
+
+	pool.lazyShards.entries[0].refCount--
+	require.NoError(t, pool.EvictShard(0))
+
+	_, err = os.Stat(filepath.Join(indexesPath, "0000000000.bleve"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, uint64(0), pool.lazyShards.UsedBytes())
+	assert.Len(t, pool.lazyShards.entries, 1, "evicted lazy shard can be loaded again")
+}
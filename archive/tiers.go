@@ -0,0 +1,352 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+type StorageTier struct {
+	Path      string // directory holding the shards of the tier
+	MaxShards int    // number of shards placed on the tier, 0 for all the remaining ones
+}
+
+type TierUsage struct {
+	Path      string `json:"path"`
+	MaxShards int    `json:"max_shards"`
+	Shards    int    `json:"shards"`
+	SizeBytes uint64 `json:"size_bytes"`
+}
+
+// ParseStorageTiers parses tiers specified as `<path>:<max_shards>`, or as
+// `<path>` alone for a tier holding all the remaining shards.
+func ParseStorageTiers(specs []string) (out []StorageTier) {
+	for _, spec := range specs {
+		tier := StorageTier{Path: spec}
+		if pos := strings.LastIndex(spec, ":"); pos != -1 {
+			if maxShards, err := strconv.Atoi(spec[pos+1:]); err == nil {
+				tier.Path = spec[:pos]
+				tier.MaxShards = maxShards
+			}
+		}
+		out = append(out, tier)
+	}
+	return out
+}
+
+// EnableTieredStorage places the shards on the given tiers by age: the
+// `MaxShards` newest ones on the first tier, the following ones on the
+// second tier, and so on. Shards past the last tier stay where they are.
+// Tier paths are scanned on start like the `ReadOnlyIndexesPaths`, but
+// the pool owns their shards. Call it before `ScanOnDiskIndexes`, and run
+// `LaunchTierMigrations` to move shards as the head moves.
+func (p *IndexPool) EnableTieredStorage(tiers []StorageTier) error {
+	if p.lazyShards != nil {
+		return fmt.Errorf("tiered storage cannot be used with lazy shard loading")
+	}
+	if len(tiers) == 0 {
+		return fmt.Errorf("tiered storage requires at least one tier")
+	}
+
+	tiers = append([]StorageTier(nil), tiers...)
+	for i, tier := range tiers {
+		if tier.Path == "" {
+			return fmt.Errorf("tier %d has no path", i)
+		}
+		if tier.MaxShards < 0 || (tier.MaxShards == 0 && i != len(tiers)-1) {
+			return fmt.Errorf("tier %q: invalid max shards %d, only the last tier can hold all the remaining shards", tier.Path, tier.MaxShards)
+		}
+		if err := os.MkdirAll(tier.Path, 0755); err != nil {
+			return fmt.Errorf("creating tier %q: %w", tier.Path, err)
+		}
+
+		tiers[i].Path = filepath.Clean(tier.Path)
+	}
+
+	p.tiers = tiers
+	return nil
+}
+
+// LaunchTierMigrations moves, every `interval` (a minute by default), the
+// shards not on their tier anymore, until the pool is closed.
+func (p *IndexPool) LaunchTierMigrations(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	for !p.closing.Load() {
+		moved := p.MigrateTiersOnce()
+		if moved > 0 {
+			zlog.Info("shards migrated between storage tiers", zap.Int("count", moved))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// MigrateTiersOnce moves the shards not on their tier anymore, and returns
+// how many were moved. A shard is copied to its new tier, then swapped in
+// under its lock, so queries running on it only wait for the swap.
+func (p *IndexPool) MigrateTiersOnce() (moved int) {
+	if len(p.tiers) == 0 {
+		return 0
+	}
+
+	p.readPoolLock.RLock()
+	readPool := p.ReadPool
+	p.readPoolLock.RUnlock()
+
+	for i, shard := range readPool {
+		if p.closing.Load() {
+			break
+		}
+
+		tier := p.tierFor(len(readPool) - 1 - i)
+		if tier == nil {
+			continue
+		}
+
+		current := p.getReadOnlyIndexFilePath(shard.StartBlock)
+		if !p.isManagedPath(current) || filepath.Dir(current) == tier.Path {
+			continue
+		}
+		if _, err := os.Stat(current); err != nil {
+			// evicted or quarantined, it will be placed once reloaded
+			continue
+		}
+
+		start := time.Now()
+		if err := p.migrateShard(shard, current, tier.Path); err != nil {
+			zlog.Warn("cannot migrate shard to its storage tier", zap.Uint64("base", shard.StartBlock), zap.String("tier", tier.Path), zap.Error(err))
+			metrics.TierMigrationFailures.Inc()
+			continue
+		}
+
+		zlog.Debug("shard migrated to its storage tier", zap.Uint64("base", shard.StartBlock), zap.String("from", current), zap.String("tier", tier.Path), zap.Duration("duration", time.Since(start)))
+		metrics.TierMigrations.Inc()
+		moved++
+	}
+
+	for _, usage := range p.TierUsage() {
+		metrics.TierShards.SetInt(usage.Shards, usage.Path)
+		metrics.TierBytes.SetUint64(usage.SizeBytes, usage.Path)
+	}
+
+	return moved
+}
+
+// tierFor returns the tier of the shard at `age`, 0 being the newest
+// shard, or nil when past the last tier.
+func (p *IndexPool) tierFor(age int) *StorageTier {
+	for i := range p.tiers {
+		tier := &p.tiers[i]
+		if tier.MaxShards == 0 || age < tier.MaxShards {
+			return tier
+		}
+		age -= tier.MaxShards
+	}
+	return nil
+}
+
+// migrateShard copies the shard at `fromPath` to `tierPath`, swaps it in
+// and removes the source. A shard already on `tierPath`, left by a
+// migration interrupted before removing its source, is only verified by
+// being opened, and then swapped in.
+func (p *IndexPool) migrateShard(shard *search.ShardIndex, fromPath, tierPath string) error {
+	baseFile := fmt.Sprintf("%010d", shard.StartBlock)
+	tmpPath := filepath.Join(tierPath, baseFile+migratingSuffix)
+	finalPath := filepath.Join(tierPath, baseFile+".bleve")
+
+	if _, err := os.Stat(finalPath); err == nil {
+		zlog.Info("shard already copied to its storage tier, verifying it", zap.Uint64("base", shard.StartBlock), zap.String("path", finalPath))
+	} else {
+		_ = os.RemoveAll(tmpPath)
+		if err := copyDir(fromPath, tmpPath); err != nil {
+			_ = os.RemoveAll(tmpPath)
+			return fmt.Errorf("copying %q: %w", fromPath, err)
+		}
+		if err := os.Rename(tmpPath, finalPath); err != nil {
+			_ = os.RemoveAll(tmpPath)
+			return fmt.Errorf("renaming %q: %w", tmpPath, err)
+		}
+	}
+
+	shard.Lock.Lock()
+	defer shard.Lock.Unlock()
+
+	if current, err := p.findShard(shard.StartBlock); err != nil || current != shard || shard.Index == nil {
+		// truncated, evicted or quarantined while being copied
+		_ = os.RemoveAll(finalPath)
+		return fmt.Errorf("shard changed while being copied")
+	}
+
+	opened, err := p.openReadOnlyAt(shard.StartBlock, finalPath)
+	if err != nil {
+		_ = os.RemoveAll(finalPath)
+		return fmt.Errorf("opening %q: %w", finalPath, err)
+	}
+
+	if err := shard.Close(); err != nil {
+		_ = opened.Close()
+		_ = os.RemoveAll(finalPath)
+		return fmt.Errorf("closing %q: %w", fromPath, err)
+	}
+	shard.Index = opened.Index
+	shard.FieldTermsFilterFile = opened.FieldTermsFilterFile
+
+	if err := os.RemoveAll(fromPath); err != nil {
+		zlog.Warn("cannot remove migrated shard", zap.String("path", fromPath), zap.Error(err))
+	}
+	return nil
+}
+
+const migratingSuffix = "-migrating.bleve"
+
+// removeStrayMigrations removes the copies left on the tiers by migrations
+// interrupted before their rename.
+func (p *IndexPool) removeStrayMigrations() {
+	for _, tier := range p.tiers {
+		strays, err := filepath.Glob(filepath.Join(tier.Path, "??????????"+migratingSuffix))
+		if err != nil {
+			zlog.Warn("failed listing files in tier path", zap.String("path", tier.Path), zap.Error(err))
+			continue
+		}
+		for _, stray := range strays {
+			zlog.Info("removing interrupted shard migration", zap.String("path", stray))
+			if err := os.RemoveAll(stray); err != nil {
+				zlog.Warn("cannot remove interrupted shard migration", zap.String("path", stray), zap.Error(err))
+			}
+		}
+	}
+}
+
+// tierIndexesPaths returns the tier paths other than `IndexesPath`, where
+// the pool also finds its shards.
+func (p *IndexPool) tierIndexesPaths() (out []string) {
+	for _, tier := range p.tiers {
+		if tier.Path != filepath.Clean(p.IndexesPath) {
+			out = append(out, tier.Path)
+		}
+	}
+	return out
+}
+
+// TierUsage returns the number of shards and bytes on each tier.
+func (p *IndexPool) TierUsage() []*TierUsage {
+	out := make([]*TierUsage, len(p.tiers))
+	for i, tier := range p.tiers {
+		usage := &TierUsage{Path: tier.Path, MaxShards: tier.MaxShards}
+		shards, err := filepath.Glob(filepath.Join(tier.Path, "??????????.bleve"))
+		if err != nil {
+			zlog.Warn("failed listing files in tier path", zap.String("path", tier.Path), zap.Error(err))
+		}
+		for _, shard := range shards {
+			usage.Shards++
+			if size, err := dirSize(shard); err == nil {
+				usage.SizeBytes += size
+			}
+		}
+		out[i] = usage
+	}
+	return out
+}
+
+// isManagedPath tells if the shard at `path` belongs to the pool, which can
+// remove it and download it again, as opposed to shards found in the
+// `ReadOnlyIndexesPaths`.
+func (p *IndexPool) isManagedPath(path string) bool {
+	if p.inIndexesPath(path) {
+		return true
+	}
+	for _, tier := range p.tiers {
+		if filepath.Dir(path) == tier.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// managedIndexFilePaths returns where the pool may hold the shard at
+// `baseBlockNum`.
+func (p *IndexPool) managedIndexFilePaths(baseBlockNum uint64) (out []string) {
+	basePath := fmt.Sprintf("%010d.bleve", baseBlockNum)
+	out = append(out, filepath.Join(p.IndexesPath, basePath))
+	for _, tier := range p.tiers {
+		if path := filepath.Join(tier.Path, basePath); !containsPath(out, path) {
+			out = append(out, path)
+		}
+	}
+	return out
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, candidate := range paths {
+		if filepath.Clean(candidate) == path {
+			return true
+		}
+	}
+	return false
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
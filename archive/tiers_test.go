@@ -0,0 +1,161 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStorageTiers(t *testing.T) {
+	assert.Equal(t, []StorageTier{
+		{Path: "/mnt/ssd", MaxShards: 100},
+		{Path: "/mnt/c:old", MaxShards: 0},
+		{Path: "/mnt/hdd", MaxShards: 0},
+	}, ParseStorageTiers([]string{"/mnt/ssd:100", "/mnt/c:old", "/mnt/hdd"}))
+}
+
+func TestIndexPool_tierFor(t *testing.T) {
+	pool := &IndexPool{tiers: []StorageTier{
+		{Path: "/ssd", MaxShards: 2},
+		{Path: "/sata", MaxShards: 3},
+	}}
+
+	tests := []struct {
+		age      int
+		expected string
+	}{
+		{0, "/ssd"},
+		{1, "/ssd"},
+		{2, "/sata"},
+		{4, "/sata"},
+		{5, ""},
+	}
+
+	for _, test := range tests {
+		tier := pool.tierFor(test.age)
+		if test.expected == "" {
+			assert.Nil(t, tier, "age %d", test.age)
+			continue
+		}
+		require.NotNil(t, tier, "age %d", test.age)
+		assert.Equal(t, test.expected, tier.Path, "age %d", test.age)
+	}
+
+	pool.tiers = append(pool.tiers, StorageTier{Path: "/hdd"})
+	assert.Equal(t, "/hdd", pool.tierFor(1000).Path)
+}
+
+func TestIndexPool_EnableTieredStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "tiers")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	indexesPath := filepath.Join(root, "indexes")
+	pool := &IndexPool{IndexesPath: indexesPath}
+
+	err = pool.EnableTieredStorage([]StorageTier{{Path: indexesPath}, {Path: filepath.Join(root, "hdd")}})
+	assert.Error(t, err, "only the last tier can be unbounded")
+
+	tiers := []StorageTier{{Path: indexesPath, MaxShards: 1}, {Path: filepath.Join(root, "hdd") + "/"}}
+	require.NoError(t, pool.EnableTieredStorage(tiers))
+	assert.Equal(t, filepath.Join(root, "hdd")+"/", tiers[1].Path, "caller tiers untouched")
+	assert.Nil(t, pool.ReadOnlyIndexesPaths)
+	assert.Equal(t, []string{filepath.Join(root, "hdd")}, pool.tierIndexesPaths())
+
+	writeTestShard(t, indexesPath, 0, 100)
+	writeTestShard(t, indexesPath, 10, 50)
+	writeTestShard(t, filepath.Join(root, "hdd"), 20, 10)
+
+	usage := pool.TierUsage()
+	require.Len(t, usage, 2)
+	assert.Equal(t, &TierUsage{Path: indexesPath, MaxShards: 1, Shards: 2, SizeBytes: 150}, usage[0])
+	assert.Equal(t, &TierUsage{Path: filepath.Join(root, "hdd"), Shards: 1, SizeBytes: 10}, usage[1])
+
+	assert.True(t, pool.isManagedPath(filepath.Join(root, "hdd", "0000000020.bleve")))
+	assert.False(t, pool.isManagedPath(filepath.Join(root, "other", "0000000020.bleve")))
+}
+
+func TestIndexPool_MigrateTiersOnce_SkipsUnloadedShard(t *testing.T) {
+	root, err := ioutil.TempDir("", "tiers")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	indexesPath := filepath.Join(root, "indexes")
+	hddPath := filepath.Join(root, "hdd")
+	pool := &IndexPool{
+		IndexesPath: indexesPath,
+		ShardSize:   10,
+		ReadPool: []*search.ShardIndex{
+			{StartBlock: 0, EndBlock: 9},
+			{StartBlock: 10, EndBlock: 19},
+		},
+	}
+	require.NoError(t, pool.EnableTieredStorage([]StorageTier{{Path: indexesPath, MaxShards: 1}, {Path: hddPath}}))
+
+	writeTestShard(t, indexesPath, 0, 100)
+	writeTestShard(t, indexesPath, 10, 100)
+
+	assert.Equal(t, 0, pool.MigrateTiersOnce())
+
+	_, err = os.Stat(filepath.Join(indexesPath, "0000000000.bleve"))
+	assert.NoError(t, err, "shard left in place")
+
+	matches, err := filepath.Glob(filepath.Join(hddPath, "*"))
+	require.NoError(t, err)
+	assert.Len(t, matches, 0, "copy cleaned up")
+}
+
+func TestIndexPool_ScanOnDiskIndexes_RemovesStrayMigrations(t *testing.T) {
+	root, err := ioutil.TempDir("", "tiers")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	indexesPath := filepath.Join(root, "indexes")
+	hddPath := filepath.Join(root, "hdd")
+	pool := &IndexPool{IndexesPath: indexesPath, ShardSize: 10}
+	require.NoError(t, pool.EnableTieredStorage([]StorageTier{{Path: indexesPath, MaxShards: 1}, {Path: hddPath}}))
+
+	strayPath := filepath.Join(hddPath, "0000000000-migrating.bleve")
+	require.NoError(t, os.MkdirAll(strayPath, 0755))
+
+	require.NoError(t, pool.ScanOnDiskIndexes(0))
+
+	_, err = os.Stat(strayPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, pool.ReadPool, 0)
+}
+
+func Test_copyDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "tiers")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	writeTestShard(t, root, 0, 100)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "0000000000.bleve", "store"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "0000000000.bleve", "store", "segment.zap"), []byte("segment"), 0644))
+
+	require.NoError(t, copyDir(filepath.Join(root, "0000000000.bleve"), filepath.Join(root, "copy")))
+
+	size, err := dirSize(filepath.Join(root, "copy"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(107), size)
+}
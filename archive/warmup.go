@@ -49,19 +49,11 @@ func (b *ArchiveBackend) WarmUpArchive(ctx context.Context, low, high uint64, bq
 		eg.Go(func() error {
 
 			defer releaseIndex()
-			reader, err := index.Reader()
+			count, err := searcherCount(index, bquery)
 			if err != nil {
-				return fmt.Errorf("getting reader: %s", err)
+				return err
 			}
-			defer reader.Close()
 
-			searcher, err := bquery.BleveQuery().Searcher(reader, nil, bsearch.SearcherOptions{})
-			if err != nil {
-				return fmt.Errorf("running searcher: %s", err)
-			}
-			defer searcher.Close()
-
-			count := searcher.Count()
 			zlog.Debug("searcher count in index", zap.Uint64("start_block", index.StartBlock), zap.Uint64("count", count))
 			counter.Add(count)
 			return nil
@@ -74,3 +66,19 @@ func (b *ArchiveBackend) WarmUpArchive(ctx context.Context, low, high uint64, bq
 	zlog.Info("warmup query returned results", zap.Uint64("counter", counter.Load()), zap.String("query", bquery.Raw))
 	return nil
 }
+
+func searcherCount(index *search.ShardIndex, bquery *search.BleveQuery) (uint64, error) {
+	reader, err := index.Reader()
+	if err != nil {
+		return 0, fmt.Errorf("getting reader: %s", err)
+	}
+	defer reader.Close()
+
+	searcher, err := bquery.BleveQuery().Searcher(reader, nil, bsearch.SearcherOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("running searcher: %s", err)
+	}
+	defer searcher.Close()
+
+	return searcher.Count(), nil
+}
@@ -92,6 +92,12 @@ func (q *BleveQuery) BleveQuery() query.Query {
 	return q.query
 }
 
+// RequiredFieldTerms returns the `field:term` groups that a shard needs to
+// contain for this query to possibly match in it, see `RequiredFieldTerms`.
+func (q *BleveQuery) RequiredFieldTerms() [][]FieldTerm {
+	return RequiredFieldTerms(q.query)
+}
+
 func (q *BleveQuery) Validate() error {
 	if q.Validator == nil {
 		return nil
@@ -0,0 +1,82 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MissingRangesTrailerKey is the gRPC trailer through which an archive
+// backend advertises the block ranges it does not hold, between its tail
+// and its irreversible block. Its queries stop before reaching them.
+const MissingRangesTrailerKey = "missing-ranges"
+
+// SkippedRangesTrailerKey is the gRPC trailer through which the router
+// reports the block ranges of a query no backend could serve.
+const SkippedRangesTrailerKey = "skipped-ranges"
+
+// BlockRange is an inclusive range of blocks.
+type BlockRange struct {
+	Low  uint64 `json:"low_block_num"`
+	High uint64 `json:"high_block_num"`
+}
+
+func (r BlockRange) Contains(blockNum uint64) bool {
+	return blockNum >= r.Low && blockNum <= r.High
+}
+
+func (r BlockRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+// FormatBlockRanges encodes ranges as `low-high` pairs separated by commas.
+func FormatBlockRanges(ranges []BlockRange) string {
+	out := make([]string, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.String()
+	}
+	return strings.Join(out, ",")
+}
+
+// ParseBlockRanges decodes ranges encoded by `FormatBlockRanges`.
+func ParseBlockRanges(in string) (out []BlockRange, err error) {
+	if in == "" {
+		return nil, nil
+	}
+
+	for _, chunk := range strings.Split(in, ",") {
+		parts := strings.Split(chunk, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid block range %q, expecting `low-high`", chunk)
+		}
+
+		low, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block range %q low block num: %w", chunk, err)
+		}
+		high, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block range %q high block num: %w", chunk, err)
+		}
+		if low > high {
+			return nil, fmt.Errorf("invalid block range %q, low block num is higher than high block num", chunk)
+		}
+
+		out = append(out, BlockRange{Low: low, High: high})
+	}
+	return out, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlockRanges(t *testing.T) {
+	tests := []struct {
+		in          string
+		expected    []BlockRange
+		expectError bool
+	}{
+		{in: "", expected: nil},
+		{in: "100-199", expected: []BlockRange{{100, 199}}},
+		{in: "100-199,300-300", expected: []BlockRange{{100, 199}, {300, 300}}},
+		{in: "100", expectError: true},
+		{in: "a-199", expectError: true},
+		{in: "199-100", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			ranges, err := ParseBlockRanges(test.in)
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, ranges)
+			assert.Equal(t, test.in, FormatBlockRanges(ranges))
+		})
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/index/scorch"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// FieldTermsFilterFilename is the file, within a shard's directory, holding
+// the bloom filter of all the `field:term` pairs indexed in that shard. Being
+// part of the shard directory, it travels inside the shard archive.
+const FieldTermsFilterFilename = "fieldterms.filter"
+
+const DefaultFieldTermsFilterFalsePositiveRate = 0.01
+
+var fieldTermsFilterMagic = [4]byte{'s', 'f', 't', '1'}
+
+// FieldTermsFilter is a bloom filter of `field:term` pairs. A negative
+// answer from `MayContain` guarantees the pair is not in the shard.
+type FieldTermsFilter struct {
+	hashCount uint32
+	bitCount  uint64
+	bits      []uint64
+}
+
+func NewFieldTermsFilter(expectedCount uint64, falsePositiveRate float64) *FieldTermsFilter {
+	if expectedCount == 0 {
+		expectedCount = 1
+	}
+
+	bitCount := uint64(math.Ceil(-float64(expectedCount) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if bitCount < 64 {
+		bitCount = 64
+	}
+
+	hashCount := uint32(math.Round(float64(bitCount) / float64(expectedCount) * math.Ln2))
+	if hashCount < 1 {
+		hashCount = 1
+	}
+
+	return &FieldTermsFilter{
+		hashCount: hashCount,
+		bitCount:  bitCount,
+		bits:      make([]uint64, (bitCount+63)/64),
+	}
+}
+
+// SizeBytes is the memory held by the filter's bits.
+func (f *FieldTermsFilter) SizeBytes() uint64 {
+	return uint64(len(f.bits)) * 8
+}
+
+func (f *FieldTermsFilter) Add(field, term string) {
+	h1, h2 := fieldTermHashes(field, term)
+	for i := uint64(0); i < uint64(f.hashCount); i++ {
+		pos := (h1 + i*h2) % f.bitCount
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (f *FieldTermsFilter) MayContain(field, term string) bool {
+	h1, h2 := fieldTermHashes(field, term)
+	for i := uint64(0); i < uint64(f.hashCount); i++ {
+		pos := (h1 + i*h2) % f.bitCount
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MayMatch returns false when the shard cannot possibly match a query
+// requiring each of the `groups` to have at least one of its terms
+// present, as returned by `RequiredFieldTerms`.
+func (f *FieldTermsFilter) MayMatch(groups [][]FieldTerm) bool {
+	for _, group := range groups {
+		groupMayMatch := false
+		for _, fieldTerm := range group {
+			if f.MayContain(fieldTerm.Field, fieldTerm.Term) {
+				groupMayMatch = true
+				break
+			}
+		}
+
+		if !groupMayMatch {
+			return false
+		}
+	}
+	return true
+}
+
+func fieldTermHashes(field, term string) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write([]byte(field))
+	h1.Write([]byte{0})
+	h1.Write([]byte(term))
+
+	h2 := fnv.New64()
+	h2.Write([]byte(term))
+	h2.Write([]byte{0})
+	h2.Write([]byte(field))
+
+	// an even second hash could cycle through a subset of the bits only
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+func (f *FieldTermsFilter) WriteTo(w io.Writer) (n int64, err error) {
+	header := make([]byte, 16)
+	copy(header[0:4], fieldTermsFilterMagic[:])
+	binary.LittleEndian.PutUint32(header[4:8], f.hashCount)
+	binary.LittleEndian.PutUint64(header[8:16], f.bitCount)
+
+	written, err := w.Write(header)
+	n += int64(written)
+	if err != nil {
+		return n, err
+	}
+
+	word := make([]byte, 8)
+	for _, bits := range f.bits {
+		binary.LittleEndian.PutUint64(word, bits)
+		written, err = w.Write(word)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func ReadFieldTermsFilter(r io.Reader) (*FieldTermsFilter, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	if string(header[0:4]) != string(fieldTermsFilterMagic[:]) {
+		return nil, fmt.Errorf("invalid field terms filter magic %q", header[0:4])
+	}
+
+	f := &FieldTermsFilter{
+		hashCount: binary.LittleEndian.Uint32(header[4:8]),
+		bitCount:  binary.LittleEndian.Uint64(header[8:16]),
+	}
+	if f.hashCount == 0 || f.bitCount == 0 {
+		return nil, fmt.Errorf("invalid field terms filter, hash count: %d, bit count: %d", f.hashCount, f.bitCount)
+	}
+
+	f.bits = make([]uint64, (f.bitCount+63)/64)
+	word := make([]byte, 8)
+	for i := range f.bits {
+		if _, err := io.ReadFull(r, word); err != nil {
+			return nil, fmt.Errorf("reading bits: %w", err)
+		}
+		f.bits[i] = binary.LittleEndian.Uint64(word)
+	}
+
+	return f, nil
+}
+
+// BuildFieldTermsFilter walks the term dictionary of every field (except
+// `_id`) of the index and adds each `field:term` pair to a new filter.
+func BuildFieldTermsFilter(reader index.IndexReader, falsePositiveRate float64) (*FieldTermsFilter, error) {
+	fields, err := reader.Fields()
+	if err != nil {
+		return nil, fmt.Errorf("getting fields: %w", err)
+	}
+
+	var fieldsToIndex []string
+	for _, field := range fields {
+		if field != "_id" {
+			fieldsToIndex = append(fieldsToIndex, field)
+		}
+	}
+
+	var termCount uint64
+	err = visitFieldTerms(reader, fieldsToIndex, func(field, term string) { termCount++ })
+	if err != nil {
+		return nil, err
+	}
+
+	filter := NewFieldTermsFilter(termCount, falsePositiveRate)
+	err = visitFieldTerms(reader, fieldsToIndex, filter.Add)
+	if err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func visitFieldTerms(reader index.IndexReader, fields []string, visitor func(field, term string)) error {
+	for _, field := range fields {
+		dict, err := reader.FieldDict(field)
+		if err != nil {
+			return fmt.Errorf("getting field dict %q: %w", field, err)
+		}
+
+		entry, err := dict.Next()
+		for err == nil && entry != nil {
+			visitor(field, entry.Term)
+			entry, err = dict.Next()
+		}
+		dict.Close()
+
+		if err != nil {
+			return fmt.Errorf("iterating field dict %q: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// WriteFieldTermsFilterFile builds the field terms filter of the read-only
+// index found at `indexPath` and writes it within that same directory.
+func WriteFieldTermsFilterFile(indexPath string, falsePositiveRate float64) error {
+	idx, err := scorch.NewScorch("data", map[string]interface{}{
+		"forceSegmentType":    "zap",
+		"forceSegmentVersion": 14,
+		"read_only":           true,
+		"path":                indexPath,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("new scorch: %s", err)
+	}
+
+	if err = idx.Open(); err != nil {
+		return fmt.Errorf("open index: %s", err)
+	}
+	defer idx.Close()
+
+	reader, err := idx.Reader()
+	if err != nil {
+		return fmt.Errorf("getting reader: %s", err)
+	}
+	defer reader.Close()
+
+	filter, err := BuildFieldTermsFilter(reader, falsePositiveRate)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filepath.Join(indexPath, FieldTermsFilterFilename))
+	if err != nil {
+		return fmt.Errorf("creating field terms filter file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	if _, err := filter.WriteTo(writer); err != nil {
+		return fmt.Errorf("writing field terms filter file: %w", err)
+	}
+
+	return writer.Flush()
+}
+
+// FieldTermsFilterFile locates the field terms filter of an opened shard,
+// which is only read when needed, see `Read`. Each opening of a shard gets
+// its own, so a filter cached for a previous opening is never reused.
+type FieldTermsFilterFile struct {
+	Path string
+}
+
+// LocateFieldTermsFilterFile returns nil, without error, when the index at
+// `indexPath` was produced without a field terms filter.
+func LocateFieldTermsFilterFile(indexPath string) (*FieldTermsFilterFile, error) {
+	path := filepath.Join(indexPath, FieldTermsFilterFilename)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("checking field terms filter file: %w", err)
+	}
+	return &FieldTermsFilterFile{Path: path}, nil
+}
+
+func (f *FieldTermsFilterFile) Read() (*FieldTermsFilter, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("opening field terms filter file: %w", err)
+	}
+	defer file.Close()
+
+	return ReadFieldTermsFilter(bufio.NewReader(file))
+}
+
+type FieldTerm struct {
+	Field string
+	Term  string
+}
+
+// RequiredFieldTerms extracts, from a bleve query, groups of `field:term`
+// pairs where at least one pair of each group needs to be present in a
+// shard for the query to possibly match in it. Any construct that cannot be
+// reasoned about (negations, ranges, etc.) simply adds no constraint.
+func RequiredFieldTerms(q query.Query) [][]FieldTerm {
+	switch q := q.(type) {
+	case *query.TermQuery:
+		return [][]FieldTerm{{{Field: q.Field(), Term: q.Term}}}
+
+	case *query.BoolFieldQuery:
+		term := "F"
+		if q.Bool {
+			term = "T"
+		}
+		return [][]FieldTerm{{{Field: q.Field(), Term: term}}}
+
+	case *query.ConjunctionQuery:
+		var groups [][]FieldTerm
+		for _, conjunct := range q.Conjuncts {
+			groups = append(groups, RequiredFieldTerms(conjunct)...)
+		}
+		return groups
+
+	case *query.DisjunctionQuery:
+		if q.Min > 1 {
+			return nil
+		}
+
+		var group []FieldTerm
+		for _, disjunct := range q.Disjuncts {
+			subGroups := RequiredFieldTerms(disjunct)
+			if len(subGroups) != 1 {
+				// either unconstrained, or a conjunction we cannot flatten
+				return nil
+			}
+			group = append(group, subGroups[0]...)
+		}
+
+		if len(group) == 0 {
+			return nil
+		}
+		return [][]FieldTerm{group}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dfuse-io/search/querylang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldTermsFilter_ReadWrite(t *testing.T) {
+	filter := NewFieldTermsFilter(3, DefaultFieldTermsFilterFalsePositiveRate)
+	filter.Add("account", "eosio")
+	filter.Add("action", "transfer")
+	filter.Add("notif", "T")
+
+	buf := bytes.NewBuffer(nil)
+	_, err := filter.WriteTo(buf)
+	require.NoError(t, err)
+
+	read, err := ReadFieldTermsFilter(buf)
+	require.NoError(t, err)
+	assert.Equal(t, filter, read)
+
+	assert.True(t, read.MayContain("account", "eosio"))
+	assert.True(t, read.MayContain("action", "transfer"))
+	assert.True(t, read.MayContain("notif", "T"))
+	assert.False(t, read.MayContain("account", "transfer"))
+}
+
+func TestFieldTermsFilter_MayMatch(t *testing.T) {
+	filter := NewFieldTermsFilter(3, DefaultFieldTermsFilterFalsePositiveRate)
+	filter.Add("account", "eosio")
+	filter.Add("action", "transfer")
+	filter.Add("notif", "F")
+
+	tests := []struct {
+		query  string
+		expect bool
+	}{
+		{`account:eosio`, true},
+		{`account:battlefield`, false},
+		{`account:eosio action:transfer`, true},
+		{`account:eosio action:issue`, false},
+		{`(account:battlefield OR account:eosio) action:transfer`, true},
+		{`(account:battlefield OR account:eosio.token)`, false},
+		{`account:eosio -action:issue`, true},
+		{`-account:battlefield`, true},
+		{`notif:false`, true},
+		{`notif:true`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			ast, err := querylang.Parse(test.query)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expect, filter.MayMatch(RequiredFieldTerms(ast.ToBleve())))
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/golang/protobuf/ptypes"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"google.golang.org/grpc/metadata"
+)
+
+// HeartbeatIntervalMetadataKey is the gRPC metadata key through which a
+// client asks a streaming query for a heartbeat every interval (a Go
+// duration, like `5s`), even when nothing matches. The router forwards it
+// to the backends.
+const HeartbeatIntervalMetadataKey = "x-search-heartbeat-interval"
+
+// Heartbeat is carried, as a `google.protobuf.Struct`, in the chain
+// specific field of heartbeat matches. Their block num and cursor are the
+// last block read by the query, which clients compare to the chain head
+// and LIB to tell a stalled stream from a quiet one.
+type Heartbeat struct {
+	HeadBlockNum uint64
+	HeadBlockID  string
+	LIBNum       uint64
+	LIBID        string
+}
+
+// HeartbeatIntervalFromContext returns the heartbeat interval found in the
+// incoming gRPC metadata of `ctx`, 0 when none was asked for.
+func HeartbeatIntervalFromContext(ctx context.Context) (time.Duration, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0, nil
+	}
+
+	values := md.Get(HeartbeatIntervalMetadataKey)
+	if len(values) == 0 {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(values[0])
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid %s metadata %q, expecting a positive duration like `5s`", HeartbeatIntervalMetadataKey, values[0])
+	}
+	return interval, nil
+}
+
+// WithForwardedHeartbeatInterval propagates the heartbeat interval of the
+// incoming gRPC metadata of `ctx` to its outgoing metadata.
+func WithForwardedHeartbeatInterval(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	if values := md.Get(HeartbeatIntervalMetadataKey); len(values) > 0 {
+		return metadata.AppendToOutgoingContext(ctx, HeartbeatIntervalMetadataKey, values[0])
+	}
+	return ctx
+}
+
+// NewHeartbeatMatch returns a heartbeat match for a query that last read
+// the block `blockNum` (`blockID`), 0 when it read none yet.
+func NewHeartbeatMatch(blockNum uint64, blockID string, heartbeat *Heartbeat) (*pb.SearchMatch, error) {
+	chainSpecific, err := ptypes.MarshalAny(&structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			"heartbeat":      {Kind: &structpb.Value_BoolValue{BoolValue: true}},
+			"head_block_num": {Kind: &structpb.Value_NumberValue{NumberValue: float64(heartbeat.HeadBlockNum)}},
+			"head_block_id":  {Kind: &structpb.Value_StringValue{StringValue: heartbeat.HeadBlockID}},
+			"lib_num":        {Kind: &structpb.Value_NumberValue{NumberValue: float64(heartbeat.LIBNum)}},
+			"lib_id":         {Kind: &structpb.Value_StringValue{StringValue: heartbeat.LIBID}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	match := &pb.SearchMatch{
+		BlockNum:      blockNum,
+		IrrBlockNum:   heartbeat.LIBNum,
+		ChainSpecific: chainSpecific,
+	}
+	if blockNum != 0 {
+		match.Cursor = NewCursor(blockNum, blockID, "")
+	}
+	return match, nil
+}
+
+// HeartbeatFromMatch returns the heartbeat carried by `match`, or false
+// when it is not a heartbeat match.
+func HeartbeatFromMatch(match *pb.SearchMatch) (*Heartbeat, bool) {
+	if match.TrxIdPrefix != "" || match.ChainSpecific == nil || !ptypes.Is(match.ChainSpecific, &structpb.Struct{}) {
+		return nil, false
+	}
+
+	payload := &structpb.Struct{}
+	if err := ptypes.UnmarshalAny(match.ChainSpecific, payload); err != nil {
+		return nil, false
+	}
+	if !payload.Fields["heartbeat"].GetBoolValue() {
+		return nil, false
+	}
+
+	return &Heartbeat{
+		HeadBlockNum: uint64(payload.Fields["head_block_num"].GetNumberValue()),
+		HeadBlockID:  payload.Fields["head_block_id"].GetStringValue(),
+		LIBNum:       uint64(payload.Fields["lib_num"].GetNumberValue()),
+		LIBID:        payload.Fields["lib_id"].GetStringValue(),
+	}, true
+}
+
+// IsHeartbeat tells if `match` is a heartbeat, which carries no match and
+// is not subject to the range, cursor and limit of the query.
+func IsHeartbeat(match *pb.SearchMatch) bool {
+	_, ok := HeartbeatFromMatch(match)
+	return ok
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestHeartbeatMatch(t *testing.T) {
+	heartbeat := &Heartbeat{HeadBlockNum: 12, HeadBlockID: "0000000ca", LIBNum: 10, LIBID: "0000000aa"}
+
+	match, err := NewHeartbeatMatch(11, "0000000ba", heartbeat)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), match.BlockNum)
+	assert.Equal(t, uint64(10), match.IrrBlockNum)
+	assert.Equal(t, "1:11:0000000ba:", match.Cursor)
+
+	out, ok := HeartbeatFromMatch(match)
+	require.True(t, ok)
+	assert.Equal(t, heartbeat, out)
+
+	assert.False(t, IsHeartbeat(&pb.SearchMatch{TrxIdPrefix: "a", BlockNum: 11}))
+}
+
+func TestHeartbeatIntervalFromContext(t *testing.T) {
+	tests := []struct {
+		name           string
+		md             metadata.MD
+		expectInterval time.Duration
+		expectError    bool
+	}{
+		{name: "no metadata"},
+		{name: "no interval", md: metadata.Pairs("other", "1s")},
+		{name: "interval", md: metadata.Pairs(HeartbeatIntervalMetadataKey, "5s"), expectInterval: 5 * time.Second},
+		{name: "invalid", md: metadata.Pairs(HeartbeatIntervalMetadataKey, "5"), expectError: true},
+		{name: "negative", md: metadata.Pairs(HeartbeatIntervalMetadataKey, "-1s"), expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, test.md)
+			}
+
+			interval, err := HeartbeatIntervalFromContext(ctx)
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectInterval, interval)
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"net/http"
+
+	stackdriverPropagation "contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"github.com/dfuse-io/logging"
+	"go.opencensus.io/plugin/ochttp"
+	"go.uber.org/zap"
+)
+
+// OpenCensusMiddleware traces the HTTP requests, propagating the
+// Stackdriver trace context.
+func OpenCensusMiddleware(next http.Handler) http.Handler {
+	return &ochttp.Handler{
+		Handler:     next,
+		Propagation: &stackdriverPropagation.HTTPFormat{},
+	}
+}
+
+// NewLoggingMiddleware attaches to the HTTP requests' context a logger,
+// derived from `rootLogger`, carrying their trace.
+func NewLoggingMiddleware(rootLogger *zap.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return &logging.Handler{
+			Next:        next,
+			Propagation: &stackdriverPropagation.HTTPFormat{},
+			RootLogger:  rootLogger,
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexer
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/document"
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	"github.com/dfuse-io/search"
+	"go.uber.org/zap"
+)
+
+// maxTrackedTermsPerField bounds the memory used to compute the cardinality
+// of a single field. Past that count, new terms are not tracked anymore and
+// the reported cardinality is a lower bound.
+const maxTrackedTermsPerField = 100000
+
+const defaultDryRunTopTermsCount = 10
+
+// maxReportedBlocks bounds the number of blocks listed in the report, only
+// those with the most documents are kept.
+const maxReportedBlocks = 100
+
+// DryRun runs blocks through the `BlockMapper` exactly like the batch
+// pipeline would, but instead of writing shards, it accumulates statistics
+// about the produced documents. It is meant to evaluate the effect of
+// a mapper change before paying for a full reindex.
+type DryRun struct {
+	mapper        search.BlockMapper
+	stopBlockNum  uint64
+	shardSize     uint64
+	topTermsCount int
+	outputPath    string
+
+	stats  *MappingStats
+	fields map[string]*fieldTermsTracker
+	blocks blockDocumentCounts // min-heap of the blocks with the most documents
+}
+
+type MappingStats struct {
+	// Error is set when the dry-run stopped before `HighBlockNum` reached
+	// the stop block, the statistics then only cover part of the range.
+	Error string `json:"error,omitempty"`
+
+	LowBlockNum              uint64                 `json:"low_block_num"`
+	HighBlockNum             uint64                 `json:"high_block_num"`
+	BlockCount               uint64                 `json:"block_count"`
+	DocumentCount            uint64                 `json:"document_count"`
+	MaxDocumentsPerBlock     uint64                 `json:"max_documents_per_block"`
+	AverageDocumentsPerBlock float64                `json:"average_documents_per_block"`
+	DocumentsPerBlock        []*BlockDocumentCount  `json:"documents_per_block"` // the `maxReportedBlocks` blocks with the most documents, in decreasing order
+	Fields                   map[string]*FieldStats `json:"fields"`
+	MappingErrorCount        uint64                 `json:"mapping_error_count"`
+	MappingErrors            []*MappingError        `json:"mapping_errors"`
+	EstimatedIndexBytes      uint64                 `json:"estimated_index_bytes"`
+	EstimatedShardBytes      uint64                 `json:"estimated_shard_bytes"`
+	ShardSize                uint64                 `json:"shard_size"`
+}
+
+type BlockDocumentCount struct {
+	BlockNum      uint64 `json:"block_num"`
+	BlockID       string `json:"block_id"`
+	DocumentCount uint64 `json:"document_count"`
+}
+
+type FieldStats struct {
+	DocumentCount     uint64       `json:"document_count"`
+	Cardinality       uint64       `json:"cardinality"`
+	CardinalityCapped bool         `json:"cardinality_capped,omitempty"`
+	TopTerms          []*TermCount `json:"top_terms"`
+}
+
+type TermCount struct {
+	Term  string `json:"term"`
+	Count uint64 `json:"count"`
+}
+
+type MappingError struct {
+	BlockNum uint64 `json:"block_num"`
+	BlockID  string `json:"block_id"`
+	Error    string `json:"error"`
+}
+
+type fieldTermsTracker struct {
+	documentCount uint64
+	capped        bool
+	terms         map[string]uint64
+}
+
+func newDryRun(mapper search.BlockMapper, stopBlockNum, shardSize uint64, topTermsCount int, outputPath string) *DryRun {
+	if topTermsCount <= 0 {
+		topTermsCount = defaultDryRunTopTermsCount
+	}
+
+	return &DryRun{
+		mapper:        mapper,
+		stopBlockNum:  stopBlockNum,
+		shardSize:     shardSize,
+		topTermsCount: topTermsCount,
+		outputPath:    outputPath,
+		stats: &MappingStats{
+			ShardSize: shardSize,
+		},
+		fields: map[string]*fieldTermsTracker{},
+	}
+}
+
+func (i *Indexer) BuildDryRunPipeline(targetStartBlockNum, fileSourceStartBlockNum uint64, previousIrreversibleID string, topTermsCount int, outputPath string) {
+	zlog.Info("building mapping dry-run pipeline", zap.Uint64("target_start_block_num", targetStartBlockNum), zap.Uint64("file_source_start_block_num", fileSourceStartBlockNum), zap.Uint64("stop_block_num", i.StopBlockNum))
+	if err := i.blockMapper.Validate(); err != nil {
+		zlog.Panic(err.Error())
+	}
+
+	dryRun := newDryRun(i.blockMapper, i.StopBlockNum, i.shardSize, topTermsCount, outputPath)
+
+	handler := bstream.HandlerFunc(func(blk *bstream.Block, obj interface{}) error {
+		i.setReady()
+		return dryRun.ProcessBlock(blk, obj)
+	})
+
+	gate := bstream.NewBlockNumGate(targetStartBlockNum, bstream.GateInclusive, handler, bstream.GateOptionWithLogger(zlog))
+	gate.MaxHoldOff = 0
+
+	options := []forkable.Option{
+		forkable.WithLogger(zlog),
+		forkable.WithFilters(forkable.StepIrreversible),
+	}
+
+	if previousIrreversibleID != "" {
+		options = append(options, forkable.WithInclusiveLIB(bstream.NewBlockRef(previousIrreversibleID, fileSourceStartBlockNum)))
+	}
+
+	forkableHandler := forkable.New(gate, options...)
+
+	// Mapping is NOT done in the file source preprocessor, a mapping
+	// error there would stop the source, we want to record it instead.
+	var preprocessor bstream.PreprocessFunc
+	if i.blockFilter != nil {
+		preprocessor = bstream.PreprocessFunc(func(blk *bstream.Block) (interface{}, error) {
+			if err := i.blockFilter(blk); err != nil {
+				return nil, fmt.Errorf("block filter: %w", err)
+			}
+			return nil, nil
+		})
+	}
+
+	fs := bstream.NewFileSource(
+		i.blocksStore,
+		fileSourceStartBlockNum,
+		2,
+		preprocessor,
+		forkableHandler,
+		bstream.FileSourceWithLogger(zlog),
+	)
+
+	i.source = fs
+	i.dryRun = dryRun
+}
+
+func (d *DryRun) ProcessBlock(blk *bstream.Block, objWrap interface{}) error {
+	obj := objWrap.(*forkable.ForkableObject)
+	if obj.Step != forkable.StepIrreversible {
+		return fmt.Errorf("unsupported step in dry-run pipeline: %s", obj.Step)
+	}
+
+	if d.stopBlockNum != 0 && blk.Num() > d.stopBlockNum {
+		return CompletedError
+	}
+
+	preprocessedObj, err := search.AsPreprocessBlock(d.mapper)(blk)
+	if err != nil {
+		d.recordMappingError(blk, err)
+	} else {
+		d.recordDocuments(blk.Num(), blk.ID(), preprocessedObj.([]*document.Document))
+	}
+
+	if blk.Num()%1000 == 0 {
+		zlog.Info("mapping dry-run progress",
+			zap.Stringer("block", blk),
+			zap.Uint64("block_count", d.stats.BlockCount),
+			zap.Uint64("document_count", d.stats.DocumentCount),
+			zap.Uint64("mapping_error_count", d.stats.MappingErrorCount),
+		)
+	}
+
+	if d.stopBlockNum != 0 && blk.Num() == d.stopBlockNum {
+		return CompletedError
+	}
+
+	return nil
+}
+
+func (d *DryRun) recordBlock(blockNum uint64) {
+	if d.stats.BlockCount == 0 || blockNum < d.stats.LowBlockNum {
+		d.stats.LowBlockNum = blockNum
+	}
+	if blockNum > d.stats.HighBlockNum {
+		d.stats.HighBlockNum = blockNum
+	}
+	d.stats.BlockCount++
+}
+
+func (d *DryRun) recordMappingError(blk *bstream.Block, err error) {
+	zlog.Debug("mapping error", zap.Stringer("block", blk), zap.Error(err))
+
+	d.recordBlock(blk.Num())
+	d.stats.MappingErrorCount++
+	d.stats.MappingErrors = append(d.stats.MappingErrors, &MappingError{
+		BlockNum: blk.Num(),
+		BlockID:  blk.ID(),
+		Error:    err.Error(),
+	})
+}
+
+func (d *DryRun) recordDocuments(blockNum uint64, blockID string, docs []*document.Document) {
+	d.recordBlock(blockNum)
+
+	docCount := uint64(len(docs))
+	d.stats.DocumentCount += docCount
+	if docCount > d.stats.MaxDocumentsPerBlock {
+		d.stats.MaxDocumentsPerBlock = docCount
+	}
+	d.recordBlockDocumentCount(&BlockDocumentCount{
+		BlockNum:      blockNum,
+		BlockID:       blockID,
+		DocumentCount: docCount,
+	})
+
+	for _, doc := range docs {
+		// Rough estimate of the raw bytes that end up in the index, it does not
+		// account for bleve's own encoding, but is good enough to compare mappers.
+		d.stats.EstimatedIndexBytes += uint64(len(doc.ID))
+
+		seenFields := map[string]bool{}
+		for _, field := range doc.Fields {
+			name := field.Name()
+			term := fieldTerm(field)
+			d.stats.EstimatedIndexBytes += uint64(len(name) + len(term))
+
+			tracker, found := d.fields[name]
+			if !found {
+				tracker = &fieldTermsTracker{terms: map[string]uint64{}}
+				d.fields[name] = tracker
+			}
+
+			if !seenFields[name] {
+				seenFields[name] = true
+				tracker.documentCount++
+			}
+
+			if _, tracked := tracker.terms[term]; tracked || len(tracker.terms) < maxTrackedTermsPerField {
+				tracker.terms[term]++
+			} else {
+				tracker.capped = true
+			}
+		}
+	}
+}
+
+func (d *DryRun) recordBlockDocumentCount(count *BlockDocumentCount) {
+	if len(d.blocks) < maxReportedBlocks {
+		heap.Push(&d.blocks, count)
+		return
+	}
+	if count.DocumentCount > d.blocks[0].DocumentCount {
+		d.blocks[0] = count
+		heap.Fix(&d.blocks, 0)
+	}
+}
+
+// Stats finalizes and returns the statistics accumulated so far.
+func (d *DryRun) Stats() *MappingStats {
+	stats := d.stats
+	stats.DocumentsPerBlock = append([]*BlockDocumentCount(nil), d.blocks...)
+	sort.Slice(stats.DocumentsPerBlock, func(i, j int) bool {
+		if stats.DocumentsPerBlock[i].DocumentCount == stats.DocumentsPerBlock[j].DocumentCount {
+			return stats.DocumentsPerBlock[i].BlockNum < stats.DocumentsPerBlock[j].BlockNum
+		}
+		return stats.DocumentsPerBlock[i].DocumentCount > stats.DocumentsPerBlock[j].DocumentCount
+	})
+
+	if stats.BlockCount > 0 {
+		stats.AverageDocumentsPerBlock = float64(stats.DocumentCount) / float64(stats.BlockCount)
+		stats.EstimatedShardBytes = stats.EstimatedIndexBytes * d.shardSize / stats.BlockCount
+	}
+
+	stats.Fields = map[string]*FieldStats{}
+	for name, tracker := range d.fields {
+		stats.Fields[name] = &FieldStats{
+			DocumentCount:     tracker.documentCount,
+			Cardinality:       uint64(len(tracker.terms)),
+			CardinalityCapped: tracker.capped,
+			TopTerms:          topTerms(tracker.terms, d.topTermsCount),
+		}
+	}
+
+	return stats
+}
+
+func (d *DryRun) WriteReport(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d.Stats())
+}
+
+// writeReportFile writes the report, flagged with `failure` when the
+// dry-run did not complete.
+func (d *DryRun) writeReportFile(failure error) error {
+	if failure != nil {
+		d.stats.Error = failure.Error()
+	}
+
+	if d.outputPath == "" || d.outputPath == "-" {
+		return d.WriteReport(os.Stdout)
+	}
+
+	f, err := os.Create(d.outputPath)
+	if err != nil {
+		return fmt.Errorf("creating dry-run report file %q: %w", d.outputPath, err)
+	}
+	defer f.Close()
+
+	if err := d.WriteReport(f); err != nil {
+		return fmt.Errorf("writing dry-run report file %q: %w", d.outputPath, err)
+	}
+	return nil
+}
+
+type blockDocumentCounts []*BlockDocumentCount
+
+func (h blockDocumentCounts) Len() int { return len(h) }
+func (h blockDocumentCounts) Less(i, j int) bool {
+	return h[i].DocumentCount < h[j].DocumentCount
+}
+func (h blockDocumentCounts) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *blockDocumentCounts) Push(x interface{}) { *h = append(*h, x.(*BlockDocumentCount)) }
+func (h *blockDocumentCounts) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func topTerms(terms map[string]uint64, count int) []*TermCount {
+	out := make([]*TermCount, 0, len(terms))
+	for term, termCount := range terms {
+		out = append(out, &TermCount{Term: term, Count: termCount})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count == out[j].Count {
+			return out[i].Term < out[j].Term
+		}
+		return out[i].Count > out[j].Count
+	})
+
+	if len(out) > count {
+		out = out[:count]
+	}
+	return out
+}
+
+// fieldTerm returns the value of the field as it would be searched
+// for in a query, rather than its raw encoded form.
+func fieldTerm(field document.Field) string {
+	switch f := field.(type) {
+	case *document.NumericField:
+		if num, err := f.Number(); err == nil {
+			return strconv.FormatFloat(num, 'f', -1, 64)
+		}
+	case *document.BooleanField:
+		if b, err := f.Boolean(); err == nil {
+			return strconv.FormatBool(b)
+		}
+	case *document.DateTimeField:
+		if dt, err := f.DateTime(); err == nil {
+			return dt.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return string(field.Value())
+}
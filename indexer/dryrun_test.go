@@ -0,0 +1,187 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve/document"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun_recordDocuments(t *testing.T) {
+	newDoc := func(id string, fields map[string]string) *document.Document {
+		doc := document.NewDocument(id)
+		for name, value := range fields {
+			doc.AddField(document.NewTextField(name, nil, []byte(value)))
+		}
+		return doc
+	}
+
+	tests := []struct {
+		name            string
+		topTermsCount   int
+		blocks          map[uint64][]*document.Document
+		expectBlocks    uint64
+		expectDocs      uint64
+		expectMaxDocs   uint64
+		expectFields    map[string]*FieldStats
+		expectLowBlock  uint64
+		expectHighBlock uint64
+	}{
+		{
+			name:          "empty blocks",
+			topTermsCount: 2,
+			blocks: map[uint64][]*document.Document{
+				10: nil,
+				11: nil,
+			},
+			expectBlocks:    2,
+			expectFields:    map[string]*FieldStats{},
+			expectLowBlock:  10,
+			expectHighBlock: 11,
+		},
+		{
+			name:          "counts terms per field",
+			topTermsCount: 2,
+			blocks: map[uint64][]*document.Document{
+				10: {
+					newDoc("a", map[string]string{"account": "eosio", "action": "transfer"}),
+					newDoc("b", map[string]string{"account": "eosio.token", "action": "transfer"}),
+				},
+				11: {
+					newDoc("c", map[string]string{"account": "eosio", "action": "issue"}),
+				},
+				12: {
+					newDoc("d", map[string]string{"account": "battlefield"}),
+				},
+			},
+			expectBlocks:  3,
+			expectDocs:    4,
+			expectMaxDocs: 2,
+			expectFields: map[string]*FieldStats{
+				"account": {
+					DocumentCount: 4,
+					Cardinality:   3,
+					TopTerms:      []*TermCount{{Term: "eosio", Count: 2}, {Term: "battlefield", Count: 1}},
+				},
+				"action": {
+					DocumentCount: 3,
+					Cardinality:   2,
+					TopTerms:      []*TermCount{{Term: "transfer", Count: 2}, {Term: "issue", Count: 1}},
+				},
+			},
+			expectLowBlock:  10,
+			expectHighBlock: 12,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dryRun := newDryRun(nil, 0, 100, test.topTermsCount, "")
+			for blockNum, docs := range test.blocks {
+				dryRun.recordDocuments(blockNum, "", docs)
+			}
+
+			stats := dryRun.Stats()
+			assert.Equal(t, test.expectBlocks, stats.BlockCount)
+			assert.Equal(t, test.expectDocs, stats.DocumentCount)
+			assert.Equal(t, test.expectMaxDocs, stats.MaxDocumentsPerBlock)
+			assert.Equal(t, test.expectFields, stats.Fields)
+			assert.Equal(t, test.expectLowBlock, stats.LowBlockNum)
+			assert.Equal(t, test.expectHighBlock, stats.HighBlockNum)
+
+			buf := bytes.NewBuffer(nil)
+			require.NoError(t, dryRun.WriteReport(buf))
+			assert.True(t, json.Valid(buf.Bytes()))
+		})
+	}
+}
+
+func TestDryRun_documentsPerBlockBounded(t *testing.T) {
+	dryRun := newDryRun(nil, 0, 100, 0, "")
+	for blockNum := uint64(1); blockNum <= maxReportedBlocks*2; blockNum++ {
+		docs := make([]*document.Document, blockNum%(maxReportedBlocks+7))
+		for i := range docs {
+			docs[i] = document.NewDocument("")
+		}
+		dryRun.recordDocuments(blockNum, "", docs)
+	}
+
+	stats := dryRun.Stats()
+	assert.Equal(t, uint64(maxReportedBlocks*2), stats.BlockCount)
+	require.Len(t, stats.DocumentsPerBlock, maxReportedBlocks)
+	assert.Equal(t, stats.MaxDocumentsPerBlock, stats.DocumentsPerBlock[0].DocumentCount)
+	for i := 1; i < len(stats.DocumentsPerBlock); i++ {
+		assert.True(t, stats.DocumentsPerBlock[i-1].DocumentCount >= stats.DocumentsPerBlock[i].DocumentCount)
+	}
+}
+
+func TestDryRun_writeReportFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		failure     error
+		expectError string
+	}{
+		{name: "completed"},
+		{name: "failed", failure: errors.New("blocks store unreachable"), expectError: "blocks store unreachable"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dryrun")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			outputPath := filepath.Join(dir, "report.json")
+			dryRun := newDryRun(nil, 0, 100, 0, outputPath)
+			dryRun.recordDocuments(10, "", nil)
+			require.NoError(t, dryRun.writeReportFile(test.failure))
+
+			content, err := ioutil.ReadFile(outputPath)
+			require.NoError(t, err)
+
+			stats := &MappingStats{}
+			require.NoError(t, json.Unmarshal(content, stats))
+			assert.Equal(t, test.expectError, stats.Error)
+			assert.Equal(t, uint64(1), stats.BlockCount)
+		})
+	}
+}
+
+func TestDryRun_fieldTerm(t *testing.T) {
+	tests := []struct {
+		name   string
+		field  document.Field
+		expect string
+	}{
+		{"text", document.NewTextField("account", nil, []byte("eosio")), "eosio"},
+		{"numeric", document.NewNumericField("amount", nil, 12.5), "12.5"},
+		{"boolean", document.NewBooleanField("notif", nil, true), "true"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, fieldTerm(test.field))
+		})
+	}
+}
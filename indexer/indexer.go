@@ -45,6 +45,7 @@ type Indexer struct {
 	shardSize     uint64
 
 	pipeline *Pipeline
+	dryRun   *DryRun
 	source   bstream.Source
 
 	indexesStore    dstore.Store
@@ -57,6 +58,10 @@ type Indexer struct {
 	writePath            string
 	Verbose              bool
 
+	// recorded in the manifest uploaded along each shard
+	MappingVersion string
+	IndexerVersion string
+
 	ready        bool
 	shuttingDown *atomic.Bool
 
@@ -246,7 +251,7 @@ func (i *Indexer) Launch() {
 		zlog.Info("shutting down indexer's source") // TODO: triple check that we want to shutdown the source. PART OF A MERGE where intent is not clear.
 		i.source.Shutdown(e)
 		zlog.Info("shutting down indexer", zap.Error(e))
-		i.cleanup()
+		i.cleanup(e)
 	})
 
 	i.serveHealthz()
@@ -267,12 +272,21 @@ func (i *Indexer) Launch() {
 	return
 }
 
-func (i *Indexer) cleanup() {
+func (i *Indexer) cleanup(err error) {
 	zlog.Info("cleaning up indexer")
 	i.shuttingDown.Store(true)
 
-	zlog.Info("waiting on uploads")
-	i.pipeline.WaitOnUploads()
+	if i.pipeline != nil {
+		zlog.Info("waiting on uploads")
+		i.pipeline.WaitOnUploads()
+	}
+
+	if i.dryRun != nil {
+		zlog.Info("writing mapping dry-run report", zap.Error(err))
+		if err := i.dryRun.writeReportFile(err); err != nil {
+			zlog.Error("cannot write mapping dry-run report", zap.Error(err))
+		}
+	}
 
 	zlog.Sync()
 	zlog.Info("indexer shutdown complete")
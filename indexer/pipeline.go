@@ -332,19 +332,26 @@ func (p *Pipeline) prepareBackgroundUpload(idx *search.ShardIndex) {
 	}
 	zlog.Info("offline index builder closed", zap.Duration("timing", time.Since(t0)))
 
-	// TODO: Analyze the result.
-
-	if _, err := search.CheckIndexIntegrity(finalPath, p.shardSize); err != nil {
+	metaInfo, err := search.CheckIndexIntegrity(finalPath, p.shardSize)
+	if err != nil {
 		propagateError("index integrity failed", err)
 		return
 	}
 
+	t0 = time.Now()
+	if err := search.WriteFieldTermsFilterFile(finalPath, search.DefaultFieldTermsFilterFalsePositiveRate); err != nil {
+		propagateError("cannot write field terms filter", err)
+		return
+	}
+	zlog.Info("field terms filter written", zap.Duration("timing", time.Since(t0)))
+
 	buildingPath := idx.WritablePath("building")
 
 	_ = os.RemoveAll(buildingPath)
 
 	if p.enableUpload {
-		if err := p.Upload(idx.StartBlock, finalPath); err != nil {
+		manifest := search.NewShardManifest(p.shardSize, metaInfo, p.indexer.MappingVersion, p.indexer.IndexerVersion)
+		if err := p.Upload(idx.StartBlock, finalPath, manifest); err != nil {
 			propagateError(fmt.Sprintf("upload failed, base: %d", idx.StartBlock), err)
 			return
 		}
@@ -20,6 +20,7 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/dfuse-io/search"
 	"go.uber.org/zap"
 )
 
@@ -84,6 +85,13 @@ func (t *Truncator) attemptTruncation() error {
 			if err != nil {
 				return fmt.Errorf("error deleting gstore index file %d - %q", fileStartBlock, filePath)
 			}
+
+			manifestPath := search.ShardManifestPath(t.indexer.shardSize, fileStartBlock)
+			if exists, _ := t.indexer.indexesStore.FileExists(ctx, manifestPath); exists {
+				if err := t.indexer.indexesStore.DeleteObject(ctx, manifestPath); err != nil {
+					return fmt.Errorf("error deleting gstore manifest file %d - %q", fileStartBlock, manifestPath)
+				}
+			}
 		}
 	}
 	return nil
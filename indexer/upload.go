@@ -16,7 +16,11 @@ package indexer
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -24,6 +28,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/dfuse-io/search"
 	"go.uber.org/zap"
 )
 
@@ -34,12 +39,32 @@ func startBlockFromFileName(filename string) uint64 {
 
 var walkIndexfileFunc = walkIndexfile
 
-func (p *Pipeline) Upload(baseIndex uint64, indexPath string) (err error) {
+// Upload writes the index archive to the indexes store. Its manifest, when
+// provided, is written first, the archive only lists shards by their tar so
+// it never sees one without its manifest. The tar is built twice, once to
+// compute the checksum of the manifest, its entries don't change in between.
+func (p *Pipeline) Upload(baseIndex uint64, indexPath string, manifest *search.ShardManifest) (err error) {
 	dstoreOperationTimeout := 90 * time.Second
 	hardOperationTimeout := 100 * time.Second // Protecting ourselves against dstore misbehaving
 
 	destinationPath := fmt.Sprintf("shards-%d/%010d.bleve.tar.zst", p.shardSize, baseIndex)
 
+	if manifest != nil {
+		checksum := sha256.New()
+		tw := tar.NewWriter(checksum)
+		if err := walkIndexfileFunc(indexPath+"/", tw); err != nil {
+			return fmt.Errorf("creating archive for checksum: %s", err)
+		}
+		if err := tw.Close(); err != nil {
+			return fmt.Errorf(".tar.zst close for checksum: base %d: %s", baseIndex, err)
+		}
+
+		manifest.TarChecksum = hex.EncodeToString(checksum.Sum(nil))
+		if err := p.uploadManifest(baseIndex, manifest, dstoreOperationTimeout); err != nil {
+			return err
+		}
+	}
+
 	zlog.Info("upload: index", zap.Uint64("base", baseIndex), zap.String("destination_path", destinationPath))
 
 	pipeRead, pipeWrite := io.Pipe()
@@ -82,6 +107,25 @@ func (p *Pipeline) Upload(baseIndex uint64, indexPath string) (err error) {
 	return nil
 }
 
+func (p *Pipeline) uploadManifest(baseIndex uint64, manifest *search.ShardManifest, timeout time.Duration) error {
+	destinationPath := search.ShardManifestPath(p.shardSize, baseIndex)
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("marshalling manifest: base %d: %s", baseIndex, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := p.indexesStore.WriteObject(ctx, destinationPath, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("writing manifest to storage: base %d: %s", baseIndex, err)
+	}
+
+	zlog.Info("manifest upload done", zap.Uint64("base", baseIndex), zap.String("destination_path", destinationPath))
+	return nil
+}
+
 // reads an index file on disk and copies it to an io.Writer
 func walkIndexfile(indexPath string, tw *tar.Writer) error {
 	return filepath.Walk(indexPath+"/", func(path string, info os.FileInfo, inErr error) error {
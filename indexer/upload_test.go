@@ -17,12 +17,17 @@ package indexer
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/dfuse-io/dstore"
+	"github.com/dfuse-io/search"
 	"github.com/magiconair/properties/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -53,6 +58,50 @@ func TestPipeline_Upload(t *testing.T) {
 		return nil
 	}
 
-	err := pipe.Upload(0, "")
+	err := pipe.Upload(0, "", nil)
 	assert.Equal(t, fmt.Errorf("writing to google storage: context canceled"), err)
 }
+
+func TestPipeline_UploadManifest(t *testing.T) {
+	defer func(walk func(indexPath string, tw *tar.Writer) error) { walkIndexfileFunc = walk }(walkIndexfileFunc)
+	walkIndexfileFunc = walkIndexfile
+
+	indexPath, err := ioutil.TempDir("", "upload")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexPath)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(indexPath, "index_meta.json"), []byte(`{"storage":"scorch"}`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(indexPath, "000000000001.zap"), []byte("segment content"), 0644))
+
+	var written []string
+	var store *dstore.MockStore
+	store = dstore.NewMockStore(func(base string, f io.Reader) error {
+		content, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		written = append(written, base)
+		store.SetFile(base, content)
+		return nil
+	})
+	pipe := &Pipeline{indexesStore: store, shardSize: 100}
+
+	manifest := &search.ShardManifest{ShardSize: 100, StartBlock: 200, EndBlock: 299}
+	require.NoError(t, pipe.Upload(200, indexPath, manifest))
+
+	// the manifest is visible before its shard
+	assert.Equal(t, []string{"shards-100/0000000200.manifest.json", "shards-100/0000000200.bleve.tar.zst"}, written)
+
+	reader, err := store.OpenObject(context.Background(), "shards-100/0000000200.bleve.tar.zst")
+	require.NoError(t, err)
+	checksum := sha256.New()
+	_, err = io.Copy(checksum, reader)
+	require.NoError(t, err)
+
+	reader, err = store.OpenObject(context.Background(), search.ShardManifestPath(100, 200))
+	require.NoError(t, err)
+	downloaded, err := search.ReadShardManifest(reader)
+	require.NoError(t, err)
+
+	require.NoError(t, downloaded.Verify(100, 200, "", hex.EncodeToString(checksum.Sum(nil))))
+}
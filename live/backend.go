@@ -20,6 +20,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/bstream/hub"
 	"github.com/dfuse-io/derr"
 	"github.com/dfuse-io/dgrpc"
@@ -43,12 +44,29 @@ type LiveBackend struct {
 	startBlock               uint64 // block at which the live router starts live-indexing, upon boot.
 	nextTierBackendsBlockNum *atomic.Uint64
 	hub                      *hub.SubscriptionHub
+	preIndexer               *search.PreIndexer
 	tailManager              *TailManager
 	matchCollector           search.MatchCollector
 	searchPeer               *dmesh.SearchPeer
 	dmeshClient              dmeshClient.SearchClient
 	shutdownDelay            time.Duration
 	headDelayTolerance       uint64
+	admission                *search.AdmissionController
+
+	// liveManifest is nil unless the live indexes are persisted, see `EnableWarmRestart`
+	liveManifest   *search.LiveManifest
+	restoredBlocks []*bstream.PreprocessedBlock
+
+	inMemoryIndexes bool
+
+	// sharedQueries is nil unless forward queries are deduplicated, see `EnableSharedQueries`
+	sharedQueries *sharedQueries
+
+	// activeQueries read the live indexes, they are drained before closing
+	// them on shutdown, see `drainQueries`
+	activeQueries atomic.Int64
+	draining      atomic.Bool
+	interrupted   chan struct{}
 }
 
 func New(dmeshClient dmeshClient.SearchClient, searchPeer *dmesh.SearchPeer, headDelayTolerance uint64, shutdownDelay time.Duration) *LiveBackend {
@@ -65,6 +83,7 @@ func New(dmeshClient dmeshClient.SearchClient, searchPeer *dmesh.SearchPeer, hea
 		searchPeer:               searchPeer, // local reversible peer
 		headDelayTolerance:       headDelayTolerance,
 		shutdownDelay:            shutdownDelay,
+		interrupted:              make(chan struct{}),
 	}
 
 	live.OnTerminating(func(e error) {
@@ -74,6 +93,31 @@ func New(dmeshClient dmeshClient.SearchClient, searchPeer *dmesh.SearchPeer, hea
 	return live
 }
 
+func (b *LiveBackend) SetAdmissionController(admission *search.AdmissionController) {
+	b.admission = admission
+}
+
+// EnableWarmRestart records the live indexes in `manifest`, closing them
+// cleanly on shutdown so the next process can reload them. When not empty,
+// `restored` are the blocks reloaded from it, from the start block up, the
+// subscription hub resumes after them.
+func (b *LiveBackend) EnableWarmRestart(manifest *search.LiveManifest, restored []*bstream.PreprocessedBlock) {
+	b.liveManifest = manifest
+	b.restoredBlocks = restored
+}
+
+// EnableInMemoryIndexes keeps the per-block indexes in memory instead of
+// writing them under the live indexes path, see `PreIndexer.EnableInMemoryIndexes`.
+func (b *LiveBackend) EnableInMemoryIndexes() {
+	b.inMemoryIndexes = true
+}
+
+// EnableSharedQueries runs identical forward queries on a single hub
+// subscription, fanning the matches out to all their subscribers.
+func (b *LiveBackend) EnableSharedQueries() {
+	b.sharedQueries = newSharedQueries()
+}
+
 func (b *LiveBackend) startServer(listenAddr string) {
 	// gRPC
 	lis, err := net.Listen("tcp", listenAddr)
@@ -131,6 +175,58 @@ func (b *LiveBackend) stop() {
 
 	zlog.Info("shutting down live search, setting ready flag to false", zap.Duration("shutdown_delay", b.shutdownDelay))
 	time.Sleep(b.shutdownDelay)
+
+	// from now on, routers retry new queries elsewhere
+	b.draining.Store(true)
+	drained := b.drainQueries(b.shutdownDelay)
+	if !drained {
+		zlog.Warn("in-flight queries did not complete after being interrupted", zap.Int64("active_queries", b.activeQueries.Load()))
+	}
+
+	if b.preIndexer != nil {
+		defer b.preIndexer.Close()
+	}
+
+	if b.liveManifest != nil && b.tailManager != nil {
+		if !drained {
+			zlog.Warn("not closing live indexes still being read, they will be indexed again on restart")
+			return
+		}
+
+		zlog.Info("closing live indexes for a warm restart")
+		if err := b.liveManifest.Close(b.tailManager.BufferedIndexes()); err != nil {
+			zlog.Warn("cannot close live indexes, they will be indexed again on restart", zap.Error(err))
+		}
+	}
+}
+
+var drainPollInterval = 100 * time.Millisecond
+
+// drainInterruptedTimeout is how long interrupted queries get to return.
+var drainInterruptedTimeout = 5 * time.Second
+
+// drainQueries waits for the in-flight queries to complete, at most
+// `timeout`, after which the remaining ones are interrupted. It returns
+// false when some are still running after being interrupted.
+func (b *LiveBackend) drainQueries(timeout time.Duration) bool {
+	if b.waitQueries(timeout) {
+		return true
+	}
+
+	close(b.interrupted)
+	return b.waitQueries(drainInterruptedTimeout)
+}
+
+func (b *LiveBackend) waitQueries(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for b.activeQueries.Load() > 0 {
+		select {
+		case <-deadline:
+			return false
+		case <-time.After(drainPollInterval):
+		}
+	}
+	return true
 }
 
 // Backend.StreamMatches gRPC implementation
@@ -140,6 +236,18 @@ func (b *LiveBackend) StreamMatches(req *pb.BackendRequest, stream pb.Backend_St
 
 	zlogger := logging.Logger(ctx, zlog)
 
+	if b.draining.Load() {
+		return derr.Statusf(codes.Unavailable, "live is shutting down, not accepting new queries")
+	}
+
+	go func() {
+		select {
+		case <-b.interrupted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	zlogger.Debug("starting live backend query", zap.Reflect("request", req))
 	bquery, err := search.NewParsedQuery(req.Query)
 	if err != nil {
@@ -149,6 +257,18 @@ func (b *LiveBackend) StreamMatches(req *pb.BackendRequest, stream pb.Backend_St
 		return err
 	}
 
+	b.activeQueries.Inc()
+	defer b.activeQueries.Dec()
+
+	if b.admission != nil {
+		ticket, err := b.admission.Admit(ctx, search.ClientIDFromContext(ctx))
+		if err != nil {
+			zlogger.Info("query not admitted", zap.Error(err))
+			return err
+		}
+		defer ticket.Release()
+	}
+
 	// Incoming request's LowBlockNum and HighBlockNum are absolute,
 
 	// DMESH: TODO: Handle the flag to indicate we should actually stop at HEAD instead of going
@@ -162,7 +282,22 @@ func (b *LiveBackend) StreamMatches(req *pb.BackendRequest, stream pb.Backend_St
 	// set the trailer as a default -1 in case we error out
 	trailer.Set("last-block-read", fmt.Sprint("-1"))
 
+	heartbeatInterval, err := search.HeartbeatIntervalFromContext(ctx)
+	if err != nil {
+		return derr.Statusf(codes.InvalidArgument, "%s", err)
+	}
+
 	liveQuery := b.newLiveQuery(ctx, req, bquery)
+	liveQuery.heartbeatInterval = heartbeatInterval
+	if b.sharedQueries != nil && !req.Descending {
+		shared, err := b.sharedQueries.subscribe(bquery, req.WithReversible)
+		if err != nil {
+			zlogger.Warn("cannot share live query, evaluating it on its own", zap.Error(err))
+		} else {
+			liveQuery.shared = shared
+			defer b.sharedQueries.unsubscribe(shared)
+		}
+	}
 
 	lib := b.tailManager.CurrentLIB()
 	if err := liveQuery.run(lib, b.headDelayTolerance, stream.Send); err != nil {
@@ -0,0 +1,89 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package live
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveBackend_DrainQueries(t *testing.T) {
+	defer func(interval time.Duration) { drainPollInterval = interval }(drainPollInterval)
+	drainPollInterval = time.Millisecond
+	defer func(timeout time.Duration) { drainInterruptedTimeout = timeout }(drainInterruptedTimeout)
+	drainInterruptedTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name                string
+		activeQueries       int64
+		completeOnInterrupt bool
+		completeAfter       time.Duration
+		expectDrained       bool
+		expectInterrupted   bool
+	}{
+		{
+			name:          "no in-flight query",
+			expectDrained: true,
+		},
+		{
+			name:          "in-flight queries completing within the delay",
+			activeQueries: 2,
+			completeAfter: 10 * time.Millisecond,
+			expectDrained: true,
+		},
+		{
+			name:                "in-flight queries returning once interrupted",
+			activeQueries:       1,
+			completeAfter:       time.Hour,
+			completeOnInterrupt: true,
+			expectDrained:       true,
+			expectInterrupted:   true,
+		},
+		{
+			name:              "in-flight queries still running once interrupted",
+			activeQueries:     1,
+			completeAfter:     time.Hour,
+			expectInterrupted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &LiveBackend{interrupted: make(chan struct{})}
+			b.activeQueries.Store(test.activeQueries)
+			if test.activeQueries > 0 {
+				timer := time.AfterFunc(test.completeAfter, func() { b.activeQueries.Store(0) })
+				defer timer.Stop()
+			}
+			if test.completeOnInterrupt {
+				go func() {
+					<-b.interrupted
+					b.activeQueries.Store(0)
+				}()
+			}
+
+			assert.Equal(t, test.expectDrained, b.drainQueries(20*time.Millisecond))
+
+			select {
+			case <-b.interrupted:
+				assert.True(t, test.expectInterrupted, "interrupted")
+			default:
+				assert.False(t, test.expectInterrupted, "not interrupted")
+			}
+		})
+	}
+}
@@ -18,9 +18,9 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/dfuse-io/bstream"
-	"github.com/dfuse-io/bstream/forkable"
 	"github.com/dfuse-io/derr"
 	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
 	"github.com/dfuse-io/search"
@@ -59,22 +59,6 @@ type IndexedBlock struct {
 // 		lowBlockNum:   lowBlockNum,
 // 	}
 // }
-func (q *LiveQuery) processBlocks(backwardBlocks []*IndexedBlock) (err error) {
-	// Flip block direction, and pipe the refs
-	for i := len(backwardBlocks) - 1; i >= 0; i-- {
-		idxBlk := backwardBlocks[i]
-		if idxBlk.Blk.Num() < q.Request.LowBlockNum || idxBlk.Blk.Num() > q.Request.HighBlockNum {
-			zlog.Warn("curiously going over a block out of request bounds", zap.Uint64("idx_blk_num", idxBlk.Blk.Num()))
-			continue
-		}
-		err = q.ProcessSingleBlocks(q.Ctx, idxBlk, q.MatchCollector, q.IncomingMatches)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-
-}
 func (q *LiveQuery) ProcessSingleBlocks(ctx context.Context, indexedBlock *IndexedBlock, matchCollector search.MatchCollector, incomingMatches chan *pb.SearchMatch) (err error) {
 	// Flip block direction, and pipe the refs
 	idx := indexedBlock.Idx
@@ -111,94 +95,102 @@ func (q *LiveQuery) ProcessSingleBlocks(ctx context.Context, indexedBlock *Index
 
 }
 
-func (q *LiveQuery) runBackwardQuery(firstBlockRef bstream.BlockRef) (err error) {
+// backwardHeadPollInterval is how often a backward query checks if the head
+// reached its high block num, when it was asked for a block within the head
+// delay tolerance.
+var backwardHeadPollInterval = 100 * time.Millisecond
 
-	handler := q.setupBackwardPipeline(firstBlockRef)
-
-	source, err := q.sourceFromBlockNumFunc(firstBlockRef.Num(), handler)
+// runBackwardQuery walks the buffer of the hub from the high block num down
+// to the low one, following the previous block ids, so only the block being
+// queried is held and results are sent as soon as the first block is.
+func (q *LiveQuery) runBackwardQuery(firstBlockRef bstream.BlockRef) (err error) {
+	// keeps the blocks we walk down to from being truncated
+	release, err := q.tailLockFunc(firstBlockRef.Num())
 	if err != nil {
-		return fmt.Errorf("backward query failed to obtain hub source: %s", err)
+		return fmt.Errorf("backward query failed to lock buffer tail: %s", err)
 	}
+	defer release()
 
-	source.Run()
-
-	if err := source.Err(); err != nil {
-		if err != search.ErrEndOfRange /* in tandem with the bstream.Handler below */ {
-			return err
-		}
-	}
-	// TODO remove this debugging computation
-	var backBlockNums []uint64
-	for _, blk := range q.backwardBlocks {
-		backBlockNums = append(backBlockNums, blk.Blk.Num())
+	top, err := q.backwardTopBlock()
+	if err != nil {
+		return err
 	}
-	zlog.Debug("blocks found after running backward query", zap.Uint64("req_high_block_num", q.Request.HighBlockNum), zap.Uint64("req_low_block_num", q.Request.LowBlockNum), zap.Any("backward_block_nums", backBlockNums))
-
-	return q.processBlocks(q.backwardBlocks)
-}
 
-func (q *LiveQuery) setupBackwardPipeline(firstBlockRef bstream.BlockRef) *forkable.Forkable {
-	handler := bstream.HandlerFunc(func(blk *bstream.Block, obj interface{}) error {
+	zlog.Debug("walking buffer backward", zap.Uint64("req_high_block_num", q.Request.HighBlockNum), zap.Uint64("req_low_block_num", q.Request.LowBlockNum), zap.Stringer("top_block", top))
+	return q.walkBackward(top, func(preprocBlk *bstream.PreprocessedBlock) error {
 		if q.isAggregatorDone() {
 			return derr.Status(codes.Canceled, "context canceled")
 		}
 
-		fObj := obj.(*forkable.ForkableObject)
-
-		if fObj.Step == forkable.StepUndo {
-			if len(q.backwardBlocks) == 0 {
-				return nil
-			}
+		return q.ProcessSingleBlocks(q.Ctx, &IndexedBlock{
+			Blk: preprocBlk.Block,
+			Idx: preprocBlk.Obj.(*search.SingleIndex),
+		}, q.MatchCollector, q.IncomingMatches)
+	})
+}
 
-			q.backwardBlocks = q.backwardBlocks[:len(q.backwardBlocks)-1]
-			return nil
+// backwardTopBlock returns the block at which the query starts walking down.
+// It is the block of the cursor when the query resumes from it, otherwise
+// the block at the high block num on the chain of the current head, which
+// it waits for when the head is still below.
+func (q *LiveQuery) backwardTopBlock() (bstream.BlockRef, error) {
+	if q.Request.NavigateFromBlockID != "" && q.Request.NavigateFromBlockNum == q.Request.HighBlockNum {
+		if blk := q.buffer.GetByID(q.Request.NavigateFromBlockID); blk != nil {
+			return blk, nil
 		}
-		if fObj.Step != forkable.StepNew {
-			panic("this handler only supports Undo and New steps")
+		zlog.Debug("cursor block not in buffer, walking down from the head", zap.String("navigate_from_block_id", q.Request.NavigateFromBlockID))
+	}
+
+	for {
+		_, _, _, _, headNum, headID := q.searchPeer.HeadBlockPointers()
+		if headNum >= q.Request.HighBlockNum {
+			head := q.buffer.GetByID(headID)
+			if head == nil {
+				return nil, fmt.Errorf("head block %s not in buffer", bstream.NewBlockRef(headID, headNum))
+			}
+			return head, nil
 		}
 
-		idx := fObj.Obj.(*search.SingleIndex)
+		select {
+		case <-q.Ctx.Done():
+			return nil, derr.Status(codes.Canceled, "context canceled")
+		case <-time.After(backwardHeadPollInterval):
+		}
+	}
+}
 
-		q.backwardBlocks = append(q.backwardBlocks, &IndexedBlock{
-			Blk: blk,
-			Idx: idx,
-		})
-		if blk.Num() >= q.Request.HighBlockNum {
-			return search.ErrEndOfRange
+// walkBackward calls `process` for each block of the chain of `top`, from
+// the high block num down to the low block num of the request. When the
+// low block num is below the start of the buffer, it stops at the lowest
+// block in it, the router continues below `LastBlockRead` from the archive.
+func (q *LiveQuery) walkBackward(top bstream.BlockRef, process func(preprocBlk *bstream.PreprocessedBlock) error) error {
+	blk := top
+	for {
+		preprocBlk, ok := blk.(*bstream.PreprocessedBlock)
+		if !ok {
+			return fmt.Errorf("block %s in buffer was not preprocessed", blk)
 		}
 
-		return nil
-	})
+		if blk.Num() <= q.Request.HighBlockNum {
+			if err := process(preprocBlk); err != nil {
+				return err
+			}
+		}
 
-	postForkGate := bstream.NewBlockNumGate(q.Request.LowBlockNum, bstream.GateInclusive, handler)
+		if blk.Num() <= q.Request.LowBlockNum {
+			return nil
+		}
 
-	if firstBlockRef.ID() == "" && firstBlockRef.Num() != bstream.GetProtocolFirstStreamableBlock {
-		zlog.Debug("firstBlockRef ID is not set on a live search call, this may affect performance of this search", zap.Uint64("first_block_ref_num", firstBlockRef.Num()))
-	}
-	options := []forkable.Option{
-		forkable.WithInclusiveLIB(firstBlockRef),
-		forkable.WithFilters(forkable.StepNew | forkable.StepUndo),
-	}
+		previousID := preprocBlk.Block.PreviousID()
+		previous := q.buffer.GetByID(previousID)
+		if previous == nil {
+			if blk.Num() > q.Request.HighBlockNum {
+				return fmt.Errorf("block %s, previous of %s, not in buffer, it was truncated", bstream.NewBlockRef(previousID, blk.Num()-1), blk)
+			}
 
-	if q.Request.NavigateFromBlockID != "" {
-		// TODO: WARN: if we set this (as we are navigating forks), it
-		// means WE POSSIBLY CAN RECEIVE BLOCKS WITH A LOWER BLOCK NUM
-		// than our lower boundary, especially since the effect of a
-		// cursor is to make the `lowBlockNum` equal to the
-		// cursorBlockNum..  This means that the `Router` needs to be
-		// indulgent with its bound checks when processing the reply
-		// from a `live backend` w/ ascending query & withReversible
-		//
-		// NOTE: the blockNumGate above should be fine, and always be
-		// triggered, even though previous blocks are sent after,
-		// because if the user was provided with a cursor, it meant
-		// that that particular block had a match, which we should
-		// also have in this situation, therefore tripping the
-		// `blockNumGate`.
-		options = append(options, forkable.EnsureBlockFlows(bstream.NewBlockRef(q.Request.NavigateFromBlockID, q.Request.NavigateFromBlockNum)))
+			zlog.Info("low block num below the buffer, stopping backward walk at its lowest block", zap.Uint64("req_low_block_num", q.Request.LowBlockNum), zap.Stringer("last_block_read", blk))
+			return nil
+		}
+		blk = previous
 	}
-	forkableHandler := forkable.New(postForkGate, options...)
-
-	return forkableHandler
-
 }
@@ -0,0 +1,110 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package live
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/dmesh"
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveQuery_WalkBackward(t *testing.T) {
+	testForkBlk := func(id, previousID string) *bstream.PreprocessedBlock {
+		return &bstream.PreprocessedBlock{Block: bstream.TestBlock(id, previousID)}
+	}
+
+	tests := []struct {
+		name          string
+		head          bstream.BlockRef
+		request       *pb.BackendRequest
+		expectBlocks  []string
+		expectedError bool
+	}{
+		{
+			name:         "from head chain",
+			head:         bstream.NewBlockRef("00000005a", 5),
+			request:      &pb.BackendRequest{LowBlockNum: 2, HighBlockNum: 4, Descending: true},
+			expectBlocks: []string{"00000004a", "00000003a", "00000002a"},
+		},
+		{
+			name:         "from head chain on a fork",
+			head:         bstream.NewBlockRef("00000005b", 5),
+			request:      &pb.BackendRequest{LowBlockNum: 3, HighBlockNum: 5, Descending: true},
+			expectBlocks: []string{"00000005b", "00000004b", "00000003a"},
+		},
+		{
+			name:         "from cursor block on a fork",
+			head:         bstream.NewBlockRef("00000005a", 5),
+			request:      &pb.BackendRequest{LowBlockNum: 3, HighBlockNum: 4, Descending: true, NavigateFromBlockID: "00000004b", NavigateFromBlockNum: 4},
+			expectBlocks: []string{"00000004b", "00000003a"},
+		},
+		{
+			name:         "low block truncated",
+			head:         bstream.NewBlockRef("00000005a", 5),
+			request:      &pb.BackendRequest{LowBlockNum: 1, HighBlockNum: 3, Descending: true},
+			expectBlocks: []string{"00000003a", "00000002a"},
+		},
+		{
+			name:          "high block truncated",
+			head:          bstream.NewBlockRef("00000005a", 5),
+			request:       &pb.BackendRequest{LowBlockNum: 1, HighBlockNum: 1, Descending: true},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := bstream.NewBuffer("test backward", zlog)
+			for _, blk := range []*bstream.PreprocessedBlock{
+				testBlk(2), testBlk(3), testBlk(4),
+				testForkBlk("00000004b", "00000003a"),
+				testBlk(5),
+				testForkBlk("00000005b", "00000004b"),
+			} {
+				buffer.AppendHead(blk)
+			}
+
+			searchPeer := &dmesh.SearchPeer{BlockRangeData: dmesh.NewTestBlockRangeData(2, 3, test.head.Num())}
+			searchPeer.HeadBlockID = test.head.ID()
+
+			q := &LiveQuery{
+				Ctx:        context.Background(),
+				Request:    test.request,
+				searchPeer: searchPeer,
+				buffer:     buffer,
+			}
+
+			top, err := q.backwardTopBlock()
+			require.NoError(t, err)
+
+			var ids []string
+			err = q.walkBackward(top, func(preprocBlk *bstream.PreprocessedBlock) error {
+				ids = append(ids, preprocBlk.ID())
+				return nil
+			})
+			if test.expectedError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, test.expectBlocks, ids)
+		})
+	}
+}
@@ -23,7 +23,9 @@ import (
 	"github.com/dfuse-io/bstream/forkable"
 	"github.com/dfuse-io/derr"
 	"github.com/dfuse-io/logging"
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
 	"github.com/dfuse-io/search"
+	"github.com/golang/protobuf/proto"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -79,28 +81,90 @@ func (q *LiveQuery) runForwardQuery(firstLIBRef bstream.BlockRef) (err error) {
 	// If there WAS a stalled block, the qRange's `low` boundary needs to be updated
 	// to 1+ the LIB ID retrieved from `blockmeta`.
 
+	if q.shared != nil {
+		if seq, joined := q.shared.join(firstLIBRef, q.sharedPipeline()); joined {
+			return forwardQueryError(q.readSharedSteps(seq))
+		}
+		q.zlog.Debug("cannot join shared live query from its start block, running it on its own", zap.Stringer("start_block", firstLIBRef))
+	}
+
 	src, err := q.setupForwardPipeline(firstLIBRef)
 	if err != nil {
 		return fmt.Errorf("fail to setup forward pipeline: %s", err)
 	}
 	src.Run()
 
-	if err = src.Err(); err != nil {
-		if err == context.Canceled {
+	return forwardQueryError(src.Err())
+}
+
+func forwardQueryError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == context.Canceled {
+		return derr.Status(codes.Canceled, "context canceled")
+	}
+	if st, ok := status.FromError(err); ok {
+		if st.Code() == codes.Canceled {
+			return nil
+		}
+	}
+	// TODO: does caller handle that properly? or is it simply the end of the loop here and we
+	// continue successfully in the caller's hands?
+	if err != search.ErrEndOfRange {
+		return err
+	}
+	return nil
+}
+
+func (q *LiveQuery) sharedPipeline() *sharedPipeline {
+	return &sharedPipeline{
+		newSource: func(startBlockNum uint64, h bstream.Handler) (bstream.Source, error) {
+			src, err := q.sourceFromBlockNumFunc(startBlockNum, h)
+			if err != nil {
+				return nil, err
+			}
+			return src, nil
+		},
+		evaluate: q.evaluateBlock,
+		headID: func() string {
+			_, _, _, _, _, headID := q.searchPeer.HeadBlockPointers()
+			return headID
+		},
+	}
+}
+
+// readSharedSteps processes the steps of the shared query from `seq`, as
+// `ForwardProcessBlock` does for the blocks of a query run on its own.
+func (q *LiveQuery) readSharedSteps(seq int) error {
+	gateOpen := false
+	for ; ; seq++ {
+		step, err := q.shared.next(q.Ctx, q.aggregatorDone, seq)
+		if err != nil {
+			return err
+		}
+		if step == nil {
 			return derr.Status(codes.Canceled, "context canceled")
 		}
-		if st, ok := status.FromError(err); ok {
-			if st.Code() == codes.Canceled {
-				return nil
+
+		if !gateOpen {
+			if step.block.Num() < q.Request.LowBlockNum {
+				continue
 			}
+			gateOpen = true
+		}
+
+		if q.Request.LiveMarkerInterval > 0 && step.live {
+			q.LiveMarkerReached = true
+		}
+
+		if err := q.checkForwardBlock(step.block); err != nil {
+			return err
 		}
-		// TODO: does caller handle that properly? or is it simply the end of the loop here and we
-		// continue successfully in the caller's hands?
-		if err != search.ErrEndOfRange {
+		if err := q.processStep(step.block, step.step, step.matches); err != nil {
 			return err
 		}
 	}
-	return nil
 }
 
 func (q *LiveQuery) setupForwardPipeline(libRef bstream.BlockRef) (bstream.Source, error) {
@@ -128,11 +192,12 @@ func (q *LiveQuery) setupForwardPipeline(libRef bstream.BlockRef) (bstream.Sourc
 
 func (q *LiveQuery) checkLiveMarkerFunc(h bstream.Handler) bstream.Handler {
 	return bstream.HandlerFunc(func(blk *bstream.Block, obj interface{}) error {
-		// TODO: make sure we handle the `withReversible == false` case, and `headBlockGetter()`
-		// will actually return the IRR when `withReversible = false`.
+		// Blocks are seen here before the forkable, so even when not `withReversible`,
+		// the irreversible blocks it sends are live once the head went through.
 		// TODO: test these cases
 		if !q.LiveMarkerReached {
-			if q.isBlockOnHead(blk) {
+			_, _, _, _, _, headID := q.searchPeer.HeadBlockPointers()
+			if blk.ID() == headID {
 				q.LiveMarkerReached = true
 			}
 		}
@@ -150,18 +215,14 @@ func (q *LiveQuery) isBlockOnHead(blk *bstream.Block) bool {
 }
 
 func (q *LiveQuery) ForwardProcessBlock(blk *bstream.Block, obj interface{}) error {
-	if q.isAggregatorDone() {
-		return derr.Status(codes.Canceled, "context canceled")
-	}
-
-	if blk.Num() > q.Request.HighBlockNum {
-		return search.ErrEndOfRange
+	if err := q.checkForwardBlock(blk); err != nil {
+		return err
 	}
 
 	fObj := obj.(*forkable.ForkableObject)
 	idx := fObj.Obj.(*search.SingleIndex)
 
-	matches, err := search.RunSingleIndexQuery(q.Ctx, false, 0, math.MaxUint64, q.MatchCollector, q.BleveQuery, idx.Index, func() {}, nil)
+	matches, err := q.evaluateBlock(q.Ctx, blk, idx)
 	if err != nil {
 		if err == context.Canceled {
 			return derr.Status(codes.Canceled, "context canceled")
@@ -170,18 +231,43 @@ func (q *LiveQuery) ForwardProcessBlock(blk *bstream.Block, obj interface{}) err
 		return fmt.Errorf("failed running single-index query")
 	}
 
+	return q.processStep(blk, fObj.Step, matches)
+}
+
+func (q *LiveQuery) checkForwardBlock(blk *bstream.Block) error {
+	if q.isAggregatorDone() {
+		return derr.Status(codes.Canceled, "context canceled")
+	}
+
+	if blk.Num() > q.Request.HighBlockNum {
+		return search.ErrEndOfRange
+	}
+	return nil
+}
+
+// processStep sends the `matches` of `blk` to the aggregator, and tells
+// whether the query reached the end of its range.
+func (q *LiveQuery) processStep(blk *bstream.Block, step forkable.StepType, matches []*pb.SearchMatch) error {
 	q.LastBlockRead = blk.Num()
 
 	irrBlockNum := blk.LIBNum()
-	if fObj.Step == forkable.StepIrreversible {
+	if step == forkable.StepIrreversible {
 		irrBlockNum = blk.Num()
 	}
 
-	err = q.ProcessMatches(matches, blk, irrBlockNum, fObj.Step)
+	err := q.ProcessMatches(matches, blk, irrBlockNum, step)
 	if err != nil {
 		return err
 	}
 
+	// only once its matches are sent, heartbeats would otherwise carry a
+	// cursor past matches not sent yet
+	if step == forkable.StepUndo {
+		q.lastBlock.Store(bstream.NewBlockRef(blk.PreviousID(), blk.Num()-1))
+	} else {
+		q.lastBlock.Store(bstream.NewBlockRef(blk.ID(), blk.Num()))
+	}
+
 	if q.Request.StopAtVirtualHead && q.isBlockOnHead(blk) {
 		return search.ErrEndOfRange
 	}
@@ -198,12 +284,33 @@ func (q *LiveQuery) ForwardProcessBlock(blk *bstream.Block, obj interface{}) err
 	return nil
 }
 
-func (q *LiveQuery) ProcessMatches(matches []search.SearchMatch, blk *bstream.Block, irrBlockNum uint64, step forkable.StepType) error {
-	for _, match := range matches {
-		matchProto, err := liveSearchMatchToProto(blk, irrBlockNum, step == forkable.StepUndo, match)
+// evaluateBlock returns the matches of `blk`, without their irreversible
+// block num and undo flag which are set for each subscriber.
+func (q *LiveQuery) evaluateBlock(ctx context.Context, blk *bstream.Block, idx *search.SingleIndex) ([]*pb.SearchMatch, error) {
+	matches, err := search.RunSingleIndexQuery(ctx, false, 0, math.MaxUint64, q.MatchCollector, q.BleveQuery, idx.Index, func() {}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*pb.SearchMatch, len(matches))
+	for i, match := range matches {
+		out[i], err = liveSearchMatchToProto(blk, 0, false, match)
 		if err != nil {
-			return fmt.Errorf("unable to create search match proto: %s", err)
+			return nil, fmt.Errorf("unable to create search match proto: %s", err)
+		}
+	}
+	return out, nil
+}
+
+func (q *LiveQuery) ProcessMatches(matches []*pb.SearchMatch, blk *bstream.Block, irrBlockNum uint64, step forkable.StepType) error {
+	for _, match := range matches {
+		matchProto := match
+		if q.shared != nil {
+			// other subscribers of the query got the same matches
+			matchProto = proto.Clone(match).(*pb.SearchMatch)
 		}
+		matchProto.IrrBlockNum = irrBlockNum
+		matchProto.Undo = step == forkable.StepUndo
 
 		select {
 		case <-q.aggregatorDone:
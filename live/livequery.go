@@ -17,6 +17,9 @@ package live
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/bstream/hub"
@@ -33,6 +36,8 @@ type LiveQuery struct {
 	Ctx context.Context
 
 	sourceFromBlockNumFunc func(startBlockNum uint64, handler bstream.Handler) (*hub.HubSource, error)
+	buffer                 *bstream.Buffer
+	tailLockFunc           func(startBlockNum uint64) (releaseFunc func(), err error)
 	MatchCollector         search.MatchCollector
 
 	Request    *pb.BackendRequest
@@ -47,13 +52,17 @@ type LiveQuery struct {
 	// fwd only
 	LiveMarkerReached          bool
 	LiveMarkerLastSentBlockNum uint64
-	// backward only
-	backwardBlocks []*IndexedBlock
+	heartbeatInterval          time.Duration // 0 when no heartbeat was asked for
+	lastBlock                  atomic.Value  // bstream.BlockRef of the chain as last seen by the query, read by heartbeats
+	// shared is nil unless forward queries are deduplicated, see `sharedQueries`
+	shared *sharedQuery
 }
 
 func (b *LiveBackend) newLiveQuery(ctx context.Context, request *pb.BackendRequest, bquery *search.BleveQuery) *LiveQuery {
 	q := &LiveQuery{
 		sourceFromBlockNumFunc: b.hub.NewHubSourceFromBlockNum,
+		buffer:                 b.tailManager.buffer,
+		tailLockFunc:           b.tailManager.TailLock,
 		MatchCollector:         b.matchCollector,
 		searchPeer:             b.searchPeer,
 		Ctx:                    ctx,
@@ -113,7 +122,10 @@ func (q *LiveQuery) run(irreversibleStartBlock bstream.BlockRef, headDelayTolera
 		}
 
 	} else {
-		if err := q.runForwardQuery(irreversibleStartBlock); err != nil {
+		stopHeartbeats := q.launchHeartbeats()
+		err := q.runForwardQuery(irreversibleStartBlock)
+		stopHeartbeats()
+		if err != nil {
 			// don't decorate, or else you risk fiddling with the OutOfRange error
 			return err
 		}
@@ -145,6 +157,14 @@ func (q *LiveQuery) launchAggregator(streamSend func(*pb.SearchMatch) error) {
 				return
 			}
 
+			if search.IsHeartbeat(match) {
+				if err := streamSend(match); err != nil {
+					q.zlog.Debug("failed sending heartbeat, connection closed?", zap.Error(err))
+					return
+				}
+				continue
+			}
+
 			if match.BlockNum > q.Request.HighBlockNum {
 				q.aggregatorError = fmt.Errorf("received result (%d) over the requested high block num (%d)", match.BlockNum, q.Request.HighBlockNum)
 				return
@@ -165,6 +185,75 @@ func (q *LiveQuery) launchAggregator(streamSend func(*pb.SearchMatch) error) {
 	}
 }
 
+// launchHeartbeats sends a heartbeat match every `heartbeatInterval`, until
+// the returned func is called. Heartbeats do not depend on blocks flowing
+// through the query, so a quiet query still gets them, while a stalled one
+// shows a head moving away from the last block read.
+func (q *LiveQuery) launchHeartbeats() (stop func()) {
+	if q.heartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(q.heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-q.Ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			match, err := q.heartbeatMatch()
+			if err != nil {
+				q.zlog.Warn("unable to create heartbeat match", zap.Error(err))
+				continue
+			}
+
+			select {
+			case <-done:
+				return
+			case <-q.Ctx.Done():
+				return
+			case <-q.aggregatorDone:
+				return
+			case q.IncomingMatches <- match:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (q *LiveQuery) heartbeatMatch() (*pb.SearchMatch, error) {
+	_, _, irrNum, irrID, headNum, headID := q.searchPeer.HeadBlockPointers()
+	heartbeat := &search.Heartbeat{
+		HeadBlockNum: headNum,
+		HeadBlockID:  headID,
+		LIBNum:       irrNum,
+		LIBID:        irrID,
+	}
+
+	var blockNum uint64
+	var blockID string
+	if ref, ok := q.lastBlock.Load().(bstream.BlockRef); ok {
+		blockNum, blockID = ref.Num(), ref.ID()
+	}
+
+	return search.NewHeartbeatMatch(blockNum, blockID, heartbeat)
+}
+
 func (q *LiveQuery) isAggregatorDone() bool {
 	select {
 	case <-q.aggregatorDone:
@@ -0,0 +1,81 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package live
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	"github.com/dfuse-io/dmesh"
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveQuery_launchHeartbeats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := &LiveQuery{
+		Ctx:               ctx,
+		zlog:              zlog,
+		searchPeer:        &dmesh.SearchPeer{BlockRangeData: dmesh.NewTestBlockRangeData(1, 3, 5)},
+		Request:           &pb.BackendRequest{LowBlockNum: 1, HighBlockNum: 10},
+		IncomingMatches:   make(chan *pb.SearchMatch),
+		aggregatorDone:    make(chan struct{}),
+		heartbeatInterval: time.Millisecond,
+	}
+
+	stopHeartbeats := q.launchHeartbeats()
+	defer stopHeartbeats()
+
+	blk := bstream.TestBlock("00000002a", "00000001a")
+	processed := make(chan error, 1)
+	go func() {
+		processed <- q.processStep(blk, forkable.StepNew, []*pb.SearchMatch{{TrxIdPrefix: "a", BlockNum: 2}})
+	}()
+
+	// a heartbeat is made while the match of block 2 waits to be read
+	time.Sleep(20 * time.Millisecond)
+
+	var matchReceived bool
+	for !matchReceived {
+		match := <-q.IncomingMatches
+		if _, ok := search.HeartbeatFromMatch(match); !ok {
+			assert.Equal(t, "a", match.TrxIdPrefix)
+			matchReceived = true
+			continue
+		}
+		assert.Empty(t, match.Cursor, "heartbeat made before the matches of block 2 are sent cannot point at it")
+	}
+
+	match := <-q.IncomingMatches
+	_, ok := search.HeartbeatFromMatch(match)
+	require.True(t, ok)
+	assert.Empty(t, match.Cursor, "heartbeat made while the matches of block 2 were being sent cannot point at it")
+	require.NoError(t, <-processed)
+
+	for {
+		match := <-q.IncomingMatches
+		if match.BlockNum == 2 {
+			assert.Equal(t, search.NewCursor(2, "00000002a", ""), match.Cursor)
+			break
+		}
+	}
+}
@@ -36,6 +36,12 @@ func (b *LiveBackend) SetupSubscriptionHub(startBlock bstream.BlockRef, blockFil
 	}
 
 	p := search.NewPreIndexer(blockMapper, liveIndexesPath)
+	if b.liveManifest != nil {
+		p.SetManifest(b.liveManifest)
+	}
+	if b.inMemoryIndexes {
+		p.EnableInMemoryIndexes(preProcConcurrentThreads)
+	}
 
 	// this indexes the block directly from the live source (relayer) and the file source (100-blocks)... it happens before the
 	// realtime tolerance... ouch
@@ -69,8 +75,26 @@ func (b *LiveBackend) SetupSubscriptionHub(startBlock bstream.BlockRef, blockFil
 	logger := zlog.Named("hub")
 	buffer := bstream.NewBuffer("archive-hub", logger)
 	tailManager := NewTailManager(b.dmeshClient.Peers, b.dmeshClient, b.searchPeer, buffer, 300, truncationThreshold, startBlock)
+
+	hubStartBlockNum := startBlock.Num()
+	if len(b.restoredBlocks) != 0 {
+		for _, blk := range b.restoredBlocks {
+			buffer.AppendHead(blk)
+		}
+
+		head := b.restoredBlocks[len(b.restoredBlocks)-1]
+		hubStartBlockNum = head.Num() + 1
+		zlog.Info("resuming after reloaded live indexes", zap.Int("block_count", len(b.restoredBlocks)), zap.Stringer("head", head))
+
+		b.searchPeer.Locked(func() {
+			b.searchPeer.HeadBlock = head.Num()
+			b.searchPeer.HeadBlockID = head.ID()
+		})
+		b.restoredBlocks = nil
+	}
+
 	subscriptionHub, err := hub.NewSubscriptionHub(
-		startBlock.Num(), // condition it needs to be 2 or greater
+		hubStartBlockNum, // condition it needs to be 2 or greater
 		buffer,
 		tailManager.TailLock,
 		fileSourceFactory,
@@ -90,6 +114,7 @@ func (b *LiveBackend) SetupSubscriptionHub(startBlock bstream.BlockRef, blockFil
 
 	b.tailManager = tailManager
 	b.hub = subscriptionHub
+	b.preIndexer = p
 	zlog.Info("setting realtime tolerance on subscriptionHub", zap.Duration("realtime_tolerance", realtimeTolerance))
 
 	go subscriptionHub.Launch()
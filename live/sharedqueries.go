@@ -0,0 +1,322 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package live
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	"github.com/dfuse-io/derr"
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
+	"google.golang.org/grpc/codes"
+)
+
+// sharedQueryMaxBlocks is the number of steps kept for each shared query,
+// subscribers lagging further behind fail with `errSharedQueryLagging`.
+var sharedQueryMaxBlocks = 1000
+
+var errSharedQueryLagging = derr.Status(codes.Unavailable, "live query fell behind the other subscribers of the same query")
+
+var errSharedQueryEnded = errors.New("shared live query source ended")
+
+// sharedQueries deduplicates the active forward queries by their canonical
+// query hash and reversibility. Identical queries share a single hub
+// source, forkable and evaluation per block, see `sharedQuery`.
+type sharedQueries struct {
+	lock    sync.Mutex
+	queries map[string]*sharedQuery
+}
+
+func newSharedQueries() *sharedQueries {
+	return &sharedQueries{
+		queries: map[string]*sharedQuery{},
+	}
+}
+
+// sharedQuery runs one hub source and forkable for all the subscribers of
+// a forward query, evaluating it once per block. The resulting steps are
+// kept in a bounded log which each subscriber reads at its own pace, with
+// its own range gating, so a slow one does not hold the others back.
+type sharedQuery struct {
+	key            string
+	withReversible bool
+	subscribers    int // guarded by `sharedQueries.lock`
+
+	lock          sync.Mutex
+	started       bool
+	startBlockNum uint64
+	src           bstream.Source
+	cancel        context.CancelFunc
+	steps         []*sharedStep
+	firstStep     int // sequence number of `steps[0]`
+	liveReached   bool
+	done          bool
+	err           error
+	updated       chan struct{} // closed and replaced when a step is added or the query ends
+}
+
+type sharedStep struct {
+	block   *bstream.Block
+	step    forkable.StepType
+	matches []*pb.SearchMatch
+
+	// live is true once the head block went through the source, before
+	// the forkable, see `LiveQuery.checkLiveMarkerFunc`
+	live  bool
+	reads int
+}
+
+// sharedPipeline is provided by each subscriber, the first one to join a
+// shared query runs it.
+type sharedPipeline struct {
+	newSource func(startBlockNum uint64, h bstream.Handler) (bstream.Source, error)
+	evaluate  func(ctx context.Context, blk *bstream.Block, idx *search.SingleIndex) ([]*pb.SearchMatch, error)
+	headID    func() string
+}
+
+func (s *sharedQueries) subscribe(bquery *search.BleveQuery, withReversible bool) (*sharedQuery, error) {
+	hash, err := bquery.Hash()
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s:%t", hash, withReversible)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	query := s.queries[key]
+	if query == nil || query.ended() {
+		query = &sharedQuery{
+			key:            key,
+			withReversible: withReversible,
+			updated:        make(chan struct{}),
+		}
+		s.queries[key] = query
+		metrics.SharedLiveQueries.Inc()
+	}
+	query.subscribers++
+
+	return query, nil
+}
+
+// unsubscribe stops the source of `query` once its last subscriber left.
+func (s *sharedQueries) unsubscribe(query *sharedQuery) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	query.subscribers--
+	if query.subscribers > 0 {
+		return
+	}
+
+	if s.queries[query.key] == query {
+		delete(s.queries, query.key)
+	}
+	metrics.SharedLiveQueries.Dec()
+	query.stop()
+}
+
+// join returns the sequence number of the first step at or above
+// `startBlock`, starting the source there for the first subscriber. It
+// returns false when those steps are not, or no longer, in the log, the
+// subscriber then runs its own pipeline.
+func (q *sharedQuery) join(startBlock bstream.BlockRef, pipeline *sharedPipeline) (int, bool) {
+	q.lock.Lock()
+	if !q.started {
+		q.started = true
+		q.startBlockNum = startBlock.Num()
+		q.lock.Unlock()
+
+		q.start(startBlock, pipeline)
+		return 0, true
+	}
+	defer q.lock.Unlock()
+
+	if q.done || startBlock.Num() < q.startBlockNum {
+		return 0, false
+	}
+
+	for i, step := range q.steps {
+		if step.block.Num() < startBlock.Num() {
+			continue
+		}
+		if i == 0 && q.firstStep > 0 && step.block.Num() > startBlock.Num() {
+			return 0, false
+		}
+		return q.firstStep + i, true
+	}
+	return q.firstStep + len(q.steps), true
+}
+
+func (q *sharedQuery) start(startBlock bstream.BlockRef, pipeline *sharedPipeline) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	options := []forkable.Option{
+		forkable.WithInclusiveLIB(startBlock),
+	}
+	if q.withReversible {
+		options = append(options, forkable.WithFilters(forkable.StepNew|forkable.StepUndo))
+	} else {
+		options = append(options, forkable.WithFilters(forkable.StepIrreversible))
+	}
+
+	forkableHandler := forkable.New(bstream.HandlerFunc(func(blk *bstream.Block, obj interface{}) error {
+		return q.processBlock(ctx, pipeline.evaluate, blk, obj)
+	}), options...)
+
+	src, err := pipeline.newSource(startBlock.Num(), q.checkHeadFunc(pipeline.headID, forkableHandler))
+	if err != nil {
+		cancel()
+		q.end(err)
+		return
+	}
+
+	q.lock.Lock()
+	q.src = src
+	q.cancel = cancel
+	stopped := q.done
+	q.lock.Unlock()
+
+	if stopped {
+		cancel()
+		return
+	}
+
+	go func() {
+		src.Run()
+		q.end(src.Err())
+	}()
+}
+
+func (q *sharedQuery) checkHeadFunc(headID func() string, h bstream.Handler) bstream.Handler {
+	return bstream.HandlerFunc(func(blk *bstream.Block, obj interface{}) error {
+		q.lock.Lock()
+		if !q.liveReached && blk.ID() == headID() {
+			q.liveReached = true
+		}
+		q.lock.Unlock()
+
+		return h.ProcessBlock(blk, obj)
+	})
+}
+
+func (q *sharedQuery) processBlock(ctx context.Context, evaluate func(ctx context.Context, blk *bstream.Block, idx *search.SingleIndex) ([]*pb.SearchMatch, error), blk *bstream.Block, obj interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fObj := obj.(*forkable.ForkableObject)
+	matches, err := evaluate(ctx, blk, fObj.Obj.(*search.SingleIndex))
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.steps = append(q.steps, &sharedStep{
+		block:   blk,
+		step:    fObj.Step,
+		matches: matches,
+		live:    q.liveReached,
+	})
+	for len(q.steps) > sharedQueryMaxBlocks {
+		q.steps[0] = nil
+		q.steps = q.steps[1:]
+		q.firstStep++
+	}
+
+	close(q.updated)
+	q.updated = make(chan struct{})
+	return nil
+}
+
+// next returns the step `seq`, waiting for it to be evaluated. It returns
+// a nil step once `done` is closed.
+func (q *sharedQuery) next(ctx context.Context, done <-chan struct{}, seq int) (*sharedStep, error) {
+	for {
+		q.lock.Lock()
+		if seq < q.firstStep {
+			q.lock.Unlock()
+			return nil, errSharedQueryLagging
+		}
+		if i := seq - q.firstStep; i < len(q.steps) {
+			step := q.steps[i]
+			step.reads++
+			if step.reads > 1 {
+				metrics.SharedLiveQueryHits.Inc()
+			}
+			q.lock.Unlock()
+			return step, nil
+		}
+		if q.done {
+			err := q.err
+			q.lock.Unlock()
+			return nil, err
+		}
+		updated := q.updated
+		q.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-done:
+			return nil, nil
+		case <-updated:
+		}
+	}
+}
+
+func (q *sharedQuery) end(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.done {
+		return
+	}
+	if err == nil {
+		err = errSharedQueryEnded
+	}
+	q.done = true
+	q.err = err
+	close(q.updated)
+}
+
+func (q *sharedQuery) ended() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.done
+}
+
+func (q *sharedQuery) stop() {
+	q.end(context.Canceled)
+
+	q.lock.Lock()
+	src, cancel := q.src, q.cancel
+	q.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if src != nil {
+		src.Shutdown(context.Canceled)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package live
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+func TestSharedQueries_Subscribe(t *testing.T) {
+	shared := newSharedQueries()
+
+	parse := func(raw string) *search.BleveQuery {
+		bquery := &search.BleveQuery{Raw: raw}
+		require.NoError(t, bquery.Parse())
+		return bquery
+	}
+
+	first, err := shared.subscribe(parse("account:eoscanadacom"), false)
+	require.NoError(t, err)
+	second, err := shared.subscribe(parse("account:eoscanadacom"), false)
+	require.NoError(t, err)
+	reversible, err := shared.subscribe(parse("account:eoscanadacom"), true)
+	require.NoError(t, err)
+	other, err := shared.subscribe(parse("account:eosio"), false)
+	require.NoError(t, err)
+
+	assert.True(t, first == second)
+	assert.False(t, first == reversible)
+	assert.False(t, first == other)
+	assert.Len(t, shared.queries, 3)
+
+	shared.unsubscribe(first)
+	shared.unsubscribe(reversible)
+	shared.unsubscribe(other)
+	assert.Len(t, shared.queries, 1)
+
+	shared.unsubscribe(second)
+	assert.Len(t, shared.queries, 0)
+}
+
+func TestSharedQueries_SubscribeReplacesEnded(t *testing.T) {
+	shared := newSharedQueries()
+	bquery := &search.BleveQuery{Raw: "account:eoscanadacom"}
+	require.NoError(t, bquery.Parse())
+
+	first, err := shared.subscribe(bquery, false)
+	require.NoError(t, err)
+	first.end(errSharedQueryEnded)
+
+	second, err := shared.subscribe(bquery, false)
+	require.NoError(t, err)
+	assert.False(t, first == second)
+
+	shared.unsubscribe(first)
+	assert.Len(t, shared.queries, 1)
+	shared.unsubscribe(second)
+	assert.Len(t, shared.queries, 0)
+}
+
+type testSharedPipeline struct {
+	*sharedPipeline
+	sources     chan *bstream.TestSource
+	evaluations atomic.Int32
+}
+
+func newTestSharedPipeline() *testSharedPipeline {
+	p := &testSharedPipeline{sources: make(chan *bstream.TestSource, 1)}
+	p.sharedPipeline = &sharedPipeline{
+		newSource: func(startBlockNum uint64, h bstream.Handler) (bstream.Source, error) {
+			src := bstream.NewTestSource(h)
+			src.StartBlockNum = startBlockNum
+			p.sources <- src
+			return src, nil
+		},
+		evaluate: func(ctx context.Context, blk *bstream.Block, idx *search.SingleIndex) ([]*pb.SearchMatch, error) {
+			p.evaluations.Inc()
+			return []*pb.SearchMatch{{BlockNum: blk.Num()}}, nil
+		},
+		headID: func() string { return "00000003a" },
+	}
+	return p
+}
+
+func (p *testSharedPipeline) push(t *testing.T, src *bstream.TestSource, blocks ...*bstream.Block) {
+	for _, blk := range blocks {
+		require.NoError(t, src.Push(blk, &search.SingleIndex{}))
+	}
+}
+
+func TestSharedQuery_FanOut(t *testing.T) {
+	pipeline := newTestSharedPipeline()
+	query := &sharedQuery{withReversible: true, updated: make(chan struct{})}
+
+	seq, joined := query.join(bstream.NewBlockRef("00000001a", 1), pipeline.sharedPipeline)
+	require.True(t, joined)
+	assert.Equal(t, 0, seq)
+
+	src := <-pipeline.sources
+	assert.Equal(t, uint64(1), src.StartBlockNum)
+	pipeline.push(t, src,
+		bstream.TestBlock("00000001a", "00000000a"),
+		bstream.TestBlock("00000002a", "00000001a"),
+	)
+
+	laterSeq, joined := query.join(bstream.NewBlockRef("00000002a", 2), pipeline.sharedPipeline)
+	require.True(t, joined)
+	assert.Equal(t, 1, laterSeq)
+
+	pipeline.push(t, src, bstream.TestBlock("00000003a", "00000002a"))
+
+	read := func(seq int, count int) (blockNums []uint64, live []bool) {
+		for i := 0; i < count; i++ {
+			step, err := query.next(context.Background(), nil, seq+i)
+			require.NoError(t, err)
+			require.Len(t, step.matches, 1)
+			assert.Equal(t, forkable.StepNew, step.step)
+			blockNums = append(blockNums, step.matches[0].BlockNum)
+			live = append(live, step.live)
+		}
+		return
+	}
+
+	blockNums, live := read(seq, 3)
+	assert.Equal(t, []uint64{1, 2, 3}, blockNums)
+	assert.Equal(t, []bool{false, false, true}, live)
+
+	blockNums, _ = read(laterSeq, 2)
+	assert.Equal(t, []uint64{2, 3}, blockNums)
+
+	assert.Equal(t, int32(3), pipeline.evaluations.Load())
+	assert.Len(t, pipeline.sources, 0, "single source")
+
+	_, joined = query.join(bstream.NewBlockRef("00000000a", 0), pipeline.sharedPipeline)
+	assert.False(t, joined, "below the start block")
+
+	query.stop()
+	select {
+	case <-src.Terminated():
+	case <-time.After(time.Second):
+		t.Fatal("source not shut down")
+	}
+
+	_, err := query.next(context.Background(), nil, seq+3)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSharedQuery_Lagging(t *testing.T) {
+	defer func(maxBlocks int) { sharedQueryMaxBlocks = maxBlocks }(sharedQueryMaxBlocks)
+	sharedQueryMaxBlocks = 2
+
+	pipeline := newTestSharedPipeline()
+	query := &sharedQuery{withReversible: true, updated: make(chan struct{})}
+	defer query.stop()
+
+	seq, joined := query.join(bstream.NewBlockRef("00000001a", 1), pipeline.sharedPipeline)
+	require.True(t, joined)
+
+	src := <-pipeline.sources
+	pipeline.push(t, src,
+		bstream.TestBlock("00000001a", "00000000a"),
+		bstream.TestBlock("00000002a", "00000001a"),
+		bstream.TestBlock("00000003a", "00000002a"),
+	)
+
+	_, err := query.next(context.Background(), nil, seq)
+	assert.Equal(t, errSharedQueryLagging, err)
+
+	step, err := query.next(context.Background(), nil, seq+1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), step.block.Num())
+
+	_, joined = query.join(bstream.NewBlockRef("00000001a", 1), pipeline.sharedPipeline)
+	assert.False(t, joined, "steps no longer in the log")
+
+	seq, joined = query.join(bstream.NewBlockRef("00000002a", 2), pipeline.sharedPipeline)
+	assert.True(t, joined)
+	assert.Equal(t, 1, seq)
+}
+
+func TestSharedQuery_NextDone(t *testing.T) {
+	query := &sharedQuery{updated: make(chan struct{})}
+
+	done := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(done) })
+
+	step, err := query.next(context.Background(), done, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, step)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = query.next(ctx, nil, 0)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -179,6 +179,17 @@ func (t *TailManager) attemptTruncation() {
 	}
 }
 
+// BufferedIndexes returns the indexes of the blocks in the buffer.
+func (t *TailManager) BufferedIndexes() (out []*search.SingleIndex) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, ref := range t.buffer.AllBlocks() {
+		out = append(out, ref.(*bstream.PreprocessedBlock).Obj.(*search.SingleIndex))
+	}
+	return out
+}
+
 func (t *TailManager) truncateBelow(blockNum uint64) {
 	refs := t.buffer.TruncateTail(blockNum - 1)
 
@@ -0,0 +1,342 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/blevesearch/bleve/index"
+	"github.com/dfuse-io/bstream"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+const liveManifestFilename = "manifest.json"
+
+// LiveManifest records the per-block indexes written by the `PreIndexer`,
+// keyed by block id, along with their block, so that a restarting live
+// backend can reload the reversible segment instead of indexing it again.
+//
+// Live indexes are written without syncing them to disk, so the manifest
+// is only trusted when the previous process closed them, see `Close`. The
+// blocks are thus only recorded in memory while running, the manifest is
+// written once on `Close`.
+type LiveManifest struct {
+	path string
+	lock sync.Mutex
+
+	Clean  bool                          `json:"clean"`
+	Blocks map[string]*LiveManifestEntry `json:"blocks"`
+
+	// closed ignores the indexes written past `Close`
+	closed bool
+}
+
+type LiveManifestEntry struct {
+	Num        uint64 `json:"num"`
+	PreviousID string `json:"previous_id"`
+	IndexPath  string `json:"index_path"` // relative to the live indexes path, the block is in `<index_path>.block`
+}
+
+// LoadLiveManifest reads the manifest of `liveIndexesPath`, an empty one is
+// returned when there is none.
+func LoadLiveManifest(liveIndexesPath string) (*LiveManifest, error) {
+	manifest := &LiveManifest{
+		path:   liveIndexesPath,
+		Blocks: map[string]*LiveManifestEntry{},
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(liveIndexesPath, liveManifestFilename))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading live manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(content, manifest); err != nil {
+		zlog.Warn("discarding unreadable live manifest", zap.Error(err))
+		return &LiveManifest{path: liveIndexesPath, Blocks: map[string]*LiveManifestEntry{}}, nil
+	}
+	if manifest.Blocks == nil {
+		manifest.Blocks = map[string]*LiveManifestEntry{}
+	}
+	return manifest, nil
+}
+
+// Reload reopens the indexes of the chain going from `lib` to the highest
+// block recorded that `inLongestChain` reports as canonical, ordered from
+// `lib` up. Everything else is deleted. Nothing is reloaded when the
+// previous process did not close the manifest, or when the chain does not
+// reach down to `lib`, the live indexes path is then cleared.
+func (m *LiveManifest) Reload(lib bstream.BlockRef, inLongestChain func(blockID string) (bool, error)) (out []*bstream.PreprocessedBlock, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	defer func() {
+		if len(out) == 0 {
+			m.reset()
+		}
+	}()
+
+	if !m.Clean {
+		if len(m.Blocks) != 0 {
+			zlog.Info("live indexes were not closed cleanly, discarding them", zap.Int("block_count", len(m.Blocks)))
+		}
+		return nil, nil
+	}
+
+	chain, err := m.canonicalChain(lib, inLongestChain)
+	if err != nil || chain == nil {
+		return nil, err
+	}
+
+	for _, blockID := range chain {
+		preprocBlock, err := m.open(blockID)
+		if err != nil {
+			for _, opened := range out {
+				opened.Obj.(*SingleIndex).Close()
+			}
+			return nil, fmt.Errorf("reopening live index of block %s: %w", blockID, err)
+		}
+		out = append(out, preprocBlock)
+	}
+
+	kept := map[string]*LiveManifestEntry{}
+	for _, blockID := range chain {
+		kept[blockID] = m.Blocks[blockID]
+	}
+	for blockID, entry := range m.Blocks {
+		if kept[blockID] == nil {
+			m.removeFiles(entry)
+		}
+	}
+	m.removeUnknownFiles(kept)
+
+	m.Blocks = kept
+	m.Clean = false
+	if err := m.save(); err != nil {
+		zlog.Warn("cannot save live manifest", zap.Error(err))
+	}
+
+	return out, nil
+}
+
+// canonicalChain returns the block ids from `lib` to the highest canonical
+// block recorded, nil when they do not form a chain.
+func (m *LiveManifest) canonicalChain(lib bstream.BlockRef, inLongestChain func(blockID string) (bool, error)) ([]string, error) {
+	var candidates []string
+	for blockID, entry := range m.Blocks {
+		if entry.Num >= lib.Num() {
+			candidates = append(candidates, blockID)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return m.Blocks[candidates[i]].Num > m.Blocks[candidates[j]].Num
+	})
+
+	head := ""
+	for _, blockID := range candidates {
+		canonical, err := inLongestChain(blockID)
+		if err != nil {
+			return nil, fmt.Errorf("checking if block %s is in the longest chain: %w", blockID, err)
+		}
+		if canonical {
+			head = blockID
+			break
+		}
+	}
+	if head == "" {
+		zlog.Info("no live index recorded in the longest chain above lib", zap.Stringer("lib", lib))
+		return nil, nil
+	}
+
+	var chain []string
+	for blockID := head; ; {
+		entry := m.Blocks[blockID]
+		if entry == nil || entry.Num < lib.Num() {
+			zlog.Info("live indexes recorded do not reach down to lib", zap.Stringer("lib", lib), zap.String("missing_block_id", blockID))
+			return nil, nil
+		}
+
+		chain = append([]string{blockID}, chain...)
+		if blockID == lib.ID() {
+			return chain, nil
+		}
+		blockID = entry.PreviousID
+	}
+}
+
+func (m *LiveManifest) open(blockID string) (*bstream.PreprocessedBlock, error) {
+	entry := m.Blocks[blockID]
+	path := filepath.Join(m.path, entry.IndexPath)
+
+	content, err := ioutil.ReadFile(path + ".block")
+	if err != nil {
+		return nil, err
+	}
+	blk, err := bstream.BlockFromBytes(content)
+	if err != nil {
+		return nil, err
+	}
+
+	analysisQueue := index.NewAnalysisQueue(1)
+	defer analysisQueue.Close()
+
+	idxer, err := openLiveScorch(path, analysisQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &SingleIndex{
+		Index:    idxer,
+		blockID:  blockID,
+		path:     path,
+		manifest: m,
+	}
+	return &bstream.PreprocessedBlock{Block: blk, Obj: idx}, nil
+}
+
+// add records the index of `blk`, written at `indexPath`.
+func (m *LiveManifest) add(blk *bstream.Block, indexPath string) error {
+	blockProto, err := blk.ToProto()
+	if err != nil {
+		return err
+	}
+	content, err := proto.Marshal(blockProto)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(indexPath+".block", content, 0644); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	m.Blocks[blk.ID()] = &LiveManifestEntry{
+		Num:        blk.Num(),
+		PreviousID: blk.PreviousID(),
+		IndexPath:  filepath.Base(indexPath),
+	}
+	return nil
+}
+
+// remove forgets about the index of `blockID` deleted from `indexPath`, a
+// block indexed again since then stays recorded.
+func (m *LiveManifest) remove(blockID string, indexPath string) {
+	if err := os.Remove(indexPath + ".block"); err != nil && !os.IsNotExist(err) {
+		zlog.Warn("error removing live index block", zap.Error(err))
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := m.Blocks[blockID]
+	if entry == nil || entry.IndexPath != filepath.Base(indexPath) {
+		return
+	}
+
+	delete(m.Blocks, blockID)
+}
+
+// Close marks the manifest as trustworthy for the next process, once the
+// `indexes` it records are closed. Indexes written afterwards are not
+// recorded anymore.
+func (m *LiveManifest) Close(indexes []*SingleIndex) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.closed = true
+	for _, idx := range indexes {
+		if err := idx.Close(); err != nil {
+			return fmt.Errorf("closing live index of block %s: %w", idx.blockID, err)
+		}
+	}
+
+	m.Clean = true
+	return m.save()
+}
+
+func (m *LiveManifest) save() error {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.path, 0755); err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(m.path, liveManifestFilename+".tmp")
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(m.path, liveManifestFilename))
+}
+
+func (m *LiveManifest) reset() {
+	if err := os.RemoveAll(m.path); err != nil {
+		zlog.Warn("cannot clear live indexes path", zap.String("path", m.path), zap.Error(err))
+	}
+
+	m.Blocks = map[string]*LiveManifestEntry{}
+	m.Clean = false
+	if err := m.save(); err != nil {
+		zlog.Warn("cannot save live manifest", zap.Error(err))
+	}
+}
+
+func (m *LiveManifest) removeFiles(entry *LiveManifestEntry) {
+	path := filepath.Join(m.path, entry.IndexPath)
+	if err := os.RemoveAll(path); err != nil {
+		zlog.Warn("error removing live index", zap.String("path", path), zap.Error(err))
+	}
+	_ = os.Remove(path + ".block")
+}
+
+// removeUnknownFiles deletes the indexes written but not recorded, by a
+// process that stopped right after writing them.
+func (m *LiveManifest) removeUnknownFiles(known map[string]*LiveManifestEntry) {
+	knownPaths := map[string]bool{}
+	for _, entry := range known {
+		knownPaths[entry.IndexPath] = true
+		knownPaths[entry.IndexPath+".block"] = true
+	}
+
+	files, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		zlog.Warn("cannot list live indexes path", zap.String("path", m.path), zap.Error(err))
+		return
+	}
+	for _, file := range files {
+		if file.Name() == liveManifestFilename || knownPaths[file.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(m.path, file.Name())); err != nil {
+			zlog.Warn("error removing unknown live index", zap.String("name", file.Name()), zap.Error(err))
+		}
+	}
+}
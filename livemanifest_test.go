@@ -0,0 +1,158 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveManifest_Reload(t *testing.T) {
+	blocks := []*bstream.Block{
+		bstream.TestBlock("00000001a", "00000000a"),
+		bstream.TestBlock("00000002a", "00000001a"),
+		bstream.TestBlock("00000003a", "00000002a"),
+		bstream.TestBlock("00000004a", "00000003a"),
+		bstream.TestBlock("00000004b", "00000003a"),
+		bstream.TestBlock("00000005b", "00000004b"),
+	}
+
+	tests := []struct {
+		name          string
+		notClean      bool
+		lib           bstream.BlockRef
+		canonical     []string
+		expectBlocks  []string
+		expectRemoved []string
+	}{
+		{
+			name:          "canonical chain from lib",
+			lib:           bstream.NewBlockRef("00000002a", 2),
+			canonical:     []string{"00000001a", "00000002a", "00000003a", "00000004a"},
+			expectBlocks:  []string{"00000002a", "00000003a", "00000004a"},
+			expectRemoved: []string{"00000001a", "00000004b", "00000005b"},
+		},
+		{
+			name:          "canonical chain on a fork recorded",
+			lib:           bstream.NewBlockRef("00000003a", 3),
+			canonical:     []string{"00000003a", "00000004b", "00000005b"},
+			expectBlocks:  []string{"00000003a", "00000004b", "00000005b"},
+			expectRemoved: []string{"00000001a", "00000002a", "00000004a"},
+		},
+		{
+			name:      "chain not reaching lib",
+			lib:       bstream.NewBlockRef("00000002z", 2),
+			canonical: []string{"00000003a", "00000004a"},
+		},
+		{
+			name:      "not closed cleanly",
+			notClean:  true,
+			lib:       bstream.NewBlockRef("00000002a", 2),
+			canonical: []string{"00000002a", "00000003a", "00000004a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "livemanifest")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			manifest, err := LoadLiveManifest(dir)
+			require.NoError(t, err)
+
+			preIndexer := &PreIndexer{liveIndexesPath: dir, manifest: manifest}
+			var indexes []*SingleIndex
+			paths := map[string]string{}
+			for _, blk := range blocks {
+				idx, analysisQueue, err := preIndexer.openLiveIndex(blk.Num(), blk.ID())
+				require.NoError(t, err)
+				analysisQueue.Close()
+				require.NoError(t, manifest.add(blk, idx.path))
+
+				indexes = append(indexes, idx)
+				paths[blk.ID()] = idx.path
+			}
+
+			if test.notClean {
+				for _, idx := range indexes {
+					require.NoError(t, idx.Close())
+				}
+			} else {
+				require.NoError(t, manifest.Close(indexes))
+			}
+
+			reloaded, err := LoadLiveManifest(dir)
+			require.NoError(t, err)
+
+			out, err := reloaded.Reload(test.lib, func(blockID string) (bool, error) {
+				for _, canonical := range test.canonical {
+					if canonical == blockID {
+						return true, nil
+					}
+				}
+				return false, nil
+			})
+			require.NoError(t, err)
+
+			var ids []string
+			for _, preprocBlock := range out {
+				ids = append(ids, preprocBlock.ID())
+				assert.Equal(t, preprocBlock.ID(), preprocBlock.Obj.(*SingleIndex).blockID)
+				require.NoError(t, preprocBlock.Obj.(*SingleIndex).Close())
+			}
+			assert.Equal(t, test.expectBlocks, ids)
+			assert.Len(t, reloaded.Blocks, len(test.expectBlocks))
+			assert.False(t, reloaded.Clean)
+
+			for _, blockID := range test.expectRemoved {
+				_, err := os.Stat(paths[blockID])
+				assert.True(t, os.IsNotExist(err), "index of block %s should be removed", blockID)
+			}
+		})
+	}
+}
+
+func TestLiveManifest_WrittenOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livemanifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest, err := LoadLiveManifest(dir)
+	require.NoError(t, err)
+
+	preIndexer := &PreIndexer{liveIndexesPath: dir, manifest: manifest}
+	blk := bstream.TestBlock("00000001a", "00000000a")
+	idx, analysisQueue, err := preIndexer.openLiveIndex(blk.Num(), blk.ID())
+	require.NoError(t, err)
+	analysisQueue.Close()
+	require.NoError(t, manifest.add(blk, idx.path))
+
+	_, err = os.Stat(filepath.Join(dir, liveManifestFilename))
+	assert.True(t, os.IsNotExist(err), "not written for every block")
+
+	require.NoError(t, manifest.Close([]*SingleIndex{idx}))
+
+	reloaded, err := LoadLiveManifest(dir)
+	require.NoError(t, err)
+	assert.True(t, reloaded.Clean)
+	assert.Len(t, reloaded.Blocks, 1)
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ShardManifest is uploaded by the indexer as a JSON sidecar next to
+// each `.bleve.tar.zst` shard archive. It describes the shard's content
+// so that the archive can refuse corrupted or incompatible shards
+// before opening them.
+type ShardManifest struct {
+	ShardSize      uint64    `json:"shard_size"`
+	StartBlock     uint64    `json:"start_block"`
+	StartBlockID   string    `json:"start_block_id"`
+	StartBlockTime time.Time `json:"start_block_time"`
+	EndBlock       uint64    `json:"end_block"`
+	EndBlockID     string    `json:"end_block_id"`
+	EndBlockTime   time.Time `json:"end_block_time"`
+	DocCount       uint64    `json:"doc_count"`
+	Fields         []string  `json:"fields"`
+	MappingVersion string    `json:"mapping_version"`
+	IndexerVersion string    `json:"indexer_version"`
+
+	// TarChecksum is the hex encoded sha256 of the uncompressed tar stream
+	TarChecksum string `json:"tar_checksum"`
+}
+
+// ShardManifestSuffix ends the name of every shard manifest in the
+// indexes store.
+const ShardManifestSuffix = ".manifest.json"
+
+func ShardManifestPath(shardSize, baseBlockNum uint64) string {
+	return fmt.Sprintf("shards-%d/%010d%s", shardSize, baseBlockNum, ShardManifestSuffix)
+}
+
+func NewShardManifest(shardSize uint64, info *indexMetaInfo, mappingVersion, indexerVersion string) *ShardManifest {
+	manifest := &ShardManifest{
+		ShardSize:      shardSize,
+		DocCount:       info.DocCount,
+		Fields:         info.Fields,
+		MappingVersion: mappingVersion,
+		IndexerVersion: indexerVersion,
+	}
+
+	if info.StartBlock != nil {
+		manifest.StartBlock = info.StartBlock.Num
+		manifest.StartBlockID = info.StartBlock.ID
+		manifest.StartBlockTime = info.StartBlock.Time
+	}
+
+	if info.EndBlock != nil {
+		manifest.EndBlock = info.EndBlock.Num
+		manifest.EndBlockID = info.EndBlock.ID
+		manifest.EndBlockTime = info.EndBlock.Time
+	}
+
+	return manifest
+}
+
+func ReadShardManifest(r io.Reader) (*ShardManifest, error) {
+	manifest := &ShardManifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("decoding shard manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// Verify checks the manifest against what the caller expects of the shard. An
+// empty `mappingVersion` skips the mapping compatibility check.
+func (m *ShardManifest) Verify(shardSize, baseBlockNum uint64, mappingVersion, tarChecksum string) error {
+	if m.ShardSize != shardSize {
+		return fmt.Errorf("shard size mismatch, manifest: %d, expected: %d", m.ShardSize, shardSize)
+	}
+
+	// the first shard of a chain may start at the protocol's first streamable block
+	if m.StartBlock/shardSize*shardSize != baseBlockNum {
+		return fmt.Errorf("start block mismatch, manifest: %d, expected shard base: %d", m.StartBlock, baseBlockNum)
+	}
+
+	if m.EndBlock != baseBlockNum+shardSize-1 {
+		return fmt.Errorf("end block mismatch, manifest: %d, expected: %d", m.EndBlock, baseBlockNum+shardSize-1)
+	}
+
+	if mappingVersion != "" && m.MappingVersion != mappingVersion {
+		return fmt.Errorf("incompatible mapping version, manifest: %q, expected: %q", m.MappingVersion, mappingVersion)
+	}
+
+	if m.TarChecksum != tarChecksum {
+		return fmt.Errorf("tar checksum mismatch, manifest: %s, actual: %s", m.TarChecksum, tarChecksum)
+	}
+
+	return nil
+}
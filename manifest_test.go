@@ -0,0 +1,78 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardManifest_Verify(t *testing.T) {
+	manifest := &ShardManifest{
+		ShardSize:      100,
+		StartBlock:     200,
+		EndBlock:       299,
+		MappingVersion: "v2",
+		TarChecksum:    "abc",
+	}
+
+	tests := []struct {
+		name           string
+		shardSize      uint64
+		baseBlockNum   uint64
+		mappingVersion string
+		tarChecksum    string
+		expectErr      bool
+	}{
+		{"valid", 100, 200, "v2", "abc", false},
+		{"valid without mapping check", 100, 200, "", "abc", false},
+		{"shard size mismatch", 50, 200, "v2", "abc", true},
+		{"start block mismatch", 100, 300, "v2", "abc", true},
+		{"mapping version mismatch", 100, 200, "v3", "abc", true},
+		{"checksum mismatch", 100, 200, "v2", "def", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := manifest.Verify(test.shardSize, test.baseBlockNum, test.mappingVersion, test.tarChecksum)
+			if test.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReadShardManifest(t *testing.T) {
+	manifest := NewShardManifest(100, &indexMetaInfo{
+		StartBlock: &BoundaryBlockInfo{Num: 1, ID: "00000001a"},
+		EndBlock:   &BoundaryBlockInfo{Num: 99, ID: "00000063a"},
+		DocCount:   12,
+		Fields:     []string{"account", "action"},
+	}, "v1", "v0.0.2")
+
+	content, err := json.Marshal(manifest)
+	require.NoError(t, err)
+
+	read, err := ReadShardManifest(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, manifest, read)
+	assert.NoError(t, read.Verify(100, 0, "v1", ""))
+}
@@ -35,9 +35,15 @@ func Register(sets ...*dmetrics.Set) {
 var CommonMetricSet = dmetrics.NewSet()
 var ActiveQueryCount = CommonMetricSet.NewGauge("active_query_count")
 var TailBlockNumber = CommonMetricSet.NewGauge("tail_block_number", "Current %s (from Dmesh)")
+var AdmissionActiveQueries = CommonMetricSet.NewGauge("admission_active_queries", "Number of queries admitted and running")
+var AdmissionQueuedQueries = CommonMetricSet.NewGauge("admission_queued_queries", "Number of queries waiting in the admission queue")
+var AdmissionQueueWait = CommonMetricSet.NewHistogram("admission_queue_wait", "Time spent by queries in the admission queue")
+var AdmissionRejections = CommonMetricSet.NewCounterVec("total_admission_rejections", []string{"reason"}, "Number of queries rejected by admission control")
 
 // LiveResolver
 var LiveMetricSet = dmetrics.NewSet()
+var SharedLiveQueries = LiveMetricSet.NewGauge("shared_live_queries", "Number of distinct forward queries sharing a single hub subscription for all their subscribers")
+var SharedLiveQueryHits = LiveMetricSet.NewCounter("total_shared_live_query_hits", "Number of blocks whose matches were read by more than one subscriber of the same query")
 
 // ForkResolver
 var ForkResolverMetricSet = dmetrics.NewSet()
@@ -50,6 +56,28 @@ var IndexesScanned = ArchiveMetricsSet.NewCounter("total_indexes_scanned", "Numb
 var RoarCacheMiss = ArchiveMetricsSet.NewCounter("roar_cache_misses", "Number of roar cache miss")
 var RoarCacheHit = ArchiveMetricsSet.NewCounter("roar_cache_hits", "Number of roar cache hits")
 var RoarCacheFail = ArchiveMetricsSet.NewCounter("roar_cache_failures", "Number of roar cache lookup failures")
+var RoarCachePurges = ArchiveMetricsSet.NewCounter("total_roar_cache_purges", "Number of block ranges purged from the roar cache, starting a new cache generation")
+var RoarCacheCarriedOver = ArchiveMetricsSet.NewCounter("total_roar_cache_carried_over", "Number of roar cache entries carried over from the previous cache generation, without their purged bits")
+var LazyShardsOnDiskBytes = ArchiveMetricsSet.NewGauge("lazy_shards_on_disk_bytes", "Bytes used on disk by lazily downloaded shards")
+var LazyShardDownloads = ArchiveMetricsSet.NewCounter("total_lazy_shard_downloads", "Number of shards downloaded on-demand")
+var LazyShardEvictions = ArchiveMetricsSet.NewCounter("total_lazy_shard_evictions", "Number of lazily downloaded shards evicted from disk to stay within the disk budget")
+var ShardResultsCacheHit = ArchiveMetricsSet.NewCounter("shard_results_cache_hits", "Number of shard queries served from the shard results cache")
+var ShardResultsCacheMiss = ArchiveMetricsSet.NewCounter("shard_results_cache_misses", "Number of shard queries not found in the shard results cache")
+var ShardResultsCacheEvictions = ArchiveMetricsSet.NewCounter("total_shard_results_cache_evictions", "Number of shard results evicted to stay within the shard results cache size")
+var ShardResultsCacheBytes = ArchiveMetricsSet.NewGauge("shard_results_cache_bytes", "Estimated bytes held by the shard results cache")
+var ShardQuarantines = ArchiveMetricsSet.NewCounter("total_shard_quarantines", "Number of shards taken out of service because they failed to open or to be searched")
+var QuarantinedShards = ArchiveMetricsSet.NewGauge("quarantined_shards", "Number of shards currently quarantined, waiting to be restored from the indexes store")
+var ShardRestores = ArchiveMetricsSet.NewCounter("total_shard_restores", "Number of quarantined shards restored from the indexes store")
+var AutoWarmupShards = ArchiveMetricsSet.NewCounter("total_auto_warmup_shards", "Number of shards warmed up with a recorded query")
+var TierMigrations = ArchiveMetricsSet.NewCounter("total_tier_migrations", "Number of shards moved to another storage tier")
+var TierMigrationFailures = ArchiveMetricsSet.NewCounter("total_tier_migration_failures", "Number of shards that failed to be moved to another storage tier")
+var TierShards = ArchiveMetricsSet.NewGaugeVec("tier_shards", []string{"tier"}, "Number of shards on a storage tier")
+var TierBytes = ArchiveMetricsSet.NewGaugeVec("tier_bytes", []string{"tier"}, "Bytes used on disk by the shards of a storage tier")
+var MissingShards = ArchiveMetricsSet.NewGauge("missing_shards", "Number of shards missing from the pool, held as gaps")
+var FieldTermsFiltersBytes = ArchiveMetricsSet.NewGauge("field_terms_filters_bytes", "Bytes held in memory by the field terms filters of shards")
+var FieldTermsFilterLoads = ArchiveMetricsSet.NewCounter("total_field_terms_filter_loads", "Number of field terms filters read from disk")
+var FieldTermsFilterEvictions = ArchiveMetricsSet.NewCounter("total_field_terms_filter_evictions", "Number of field terms filters evicted from memory to stay within their memory budget")
+var FieldTermsFilterIndexesSkipped = ArchiveMetricsSet.NewCounter("total_indexes_skipped_because_of_field_terms_filter", "Number of indexes that were skipped because their field terms filter showed a given query cannot match in that index")
 
 // Indexer
 var IndexerMetricSet = dmetrics.NewSet()
@@ -62,6 +90,16 @@ var RouterMetricSet = dmetrics.NewSet()
 var InflightRequestCount = RouterMetricSet.NewGauge("inflight_request_count")
 var ErrorRequestCount = RouterMetricSet.NewCounter("error_request_count")
 var TotalRequestCount = RouterMetricSet.NewCounter("total_request_count")
+var DeadlineExceededRequestCount = RouterMetricSet.NewCounter("deadline_exceeded_request_count", "Number of requests stopped by their deadline or time budget, returning a cursor to resume from")
 var ErrorBackendCount = RouterMetricSet.NewCounter("error_backend_count")
+var SkippedRangesCount = RouterMetricSet.NewCounter("total_skipped_ranges", "Number of block ranges skipped by queries because no backend holds them")
 var FullContiguousBlockRange = RouterMetricSet.NewGauge("full_contiguous_block_range")
 var IRRBlockNumber = RouterMetricSet.NewGauge("irr_block_number", "Current %s (from Dmesh)")
+var PeerFirstResultLatency = RouterMetricSet.NewGaugeVec("peer_first_result_latency_seconds", []string{"addr"}, "Moving average of the time a backend takes to send its first result")
+var PeerInflightQueries = RouterMetricSet.NewGaugeVec("peer_inflight_queries", []string{"addr"}, "Number of backend queries in flight on a backend")
+var PeerErrorRate = RouterMetricSet.NewGaugeVec("peer_error_rate", []string{"addr"}, "Moving average of the ratio of failed backend queries on a backend")
+var HedgedBackendQueries = RouterMetricSet.NewCounter("total_hedged_backend_queries", "Number of backend queries sent to a second backend because the first one was slow to respond")
+var HedgedBackendQueryWins = RouterMetricSet.NewCounter("total_hedged_backend_query_wins", "Number of hedged backend queries where the second backend responded first")
+var PrefetchedSegments = RouterMetricSet.NewCounter("total_prefetched_segments", "Number of backend queries started ahead of their turn")
+var CanceledPrefetchedSegments = RouterMetricSet.NewCounter("total_canceled_prefetched_segments", "Number of backend queries started ahead of their turn and canceled before it, their segment being replanned or not needed anymore")
+var PeerEjections = RouterMetricSet.NewCounterVec("total_peer_ejections", []string{"addr"}, "Number of times a backend was ejected from the planner after failing repeatedly")
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	_ "github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/document"
 	"github.com/blevesearch/bleve/index"
 	"github.com/blevesearch/bleve/index/scorch"
 	"github.com/dfuse-io/bstream"
@@ -33,6 +34,9 @@ type SingleIndex struct {
 	blockID string
 	lock    sync.RWMutex
 	path    string
+
+	// manifest is nil unless the live indexes are persisted, see `LiveManifest`
+	manifest *LiveManifest
 }
 
 func (i *SingleIndex) GetIndex() index.Index {
@@ -43,15 +47,27 @@ func (i *SingleIndex) Delete() {
 	if err := i.Index.Close(); err != nil {
 		zlog.Warn("error closing index, chances it'll leak!", zap.Error(err))
 	}
+	if i.path == "" {
+		return
+	}
 	if err := os.RemoveAll(i.path); err != nil {
 		zlog.Warn("error removing index, watch your disk", zap.Error(err))
 	}
+	if i.manifest != nil {
+		i.manifest.remove(i.blockID, i.path)
+	}
 }
 
 //PreIndexer is a bstream Preprocessor that returns the bleve object instead from a bstream.block
 type PreIndexer struct {
 	mapper          BlockMapper
 	liveIndexesPath string
+	manifest        *LiveManifest
+
+	// analysisQueue is shared by the in-memory indexes, nil unless enabled, see `EnableInMemoryIndexes`
+	analysisQueue *index.AnalysisQueue
+	analysisLock  sync.RWMutex
+	closed        bool
 }
 
 func NewPreIndexer(blockMapper BlockMapper, liveIndexesPath string) *PreIndexer {
@@ -65,12 +81,45 @@ func NewPreIndexer(blockMapper BlockMapper, liveIndexesPath string) *PreIndexer
 	}
 }
 
+// SetManifest records every index written in `manifest`, so they can be
+// reloaded on restart.
+func (i *PreIndexer) SetManifest(manifest *LiveManifest) {
+	i.manifest = manifest
+}
+
+// EnableInMemoryIndexes keeps the per-block indexes in memory instead of
+// writing them under the live indexes path, their documents are analyzed
+// by `analysisWorkers` workers shared by all blocks.
+func (i *PreIndexer) EnableInMemoryIndexes(analysisWorkers int) {
+	if analysisWorkers < 1 {
+		analysisWorkers = 1
+	}
+	i.analysisQueue = index.NewAnalysisQueue(analysisWorkers)
+}
+
+// Close stops the analysis workers shared by the in-memory indexes, once
+// the blocks being indexed are done. Blocks preprocessed afterwards fail.
+func (i *PreIndexer) Close() {
+	i.analysisLock.Lock()
+	defer i.analysisLock.Unlock()
+
+	if i.analysisQueue == nil || i.closed {
+		return
+	}
+	i.analysisQueue.Close()
+	i.closed = true
+}
+
 func (i *PreIndexer) Preprocess(blk *bstream.Block) (interface{}, error) {
 	docsList, err := i.mapper.Map(blk)
 	if err != nil {
 		return nil, err
 	}
 
+	if i.analysisQueue != nil {
+		return i.indexInMemory(blk.ID(), docsList)
+	}
+
 	idx, analysisQueue, err := i.openLiveIndex(blk.Num(), blk.ID())
 	if err != nil {
 		return nil, err
@@ -87,6 +136,13 @@ func (i *PreIndexer) Preprocess(blk *bstream.Block) (interface{}, error) {
 	}
 
 	analysisQueue.Close()
+
+	if i.manifest != nil {
+		idx.manifest = i.manifest
+		if err := i.manifest.add(blk, idx.path); err != nil {
+			zlog.Warn("cannot record live index in manifest, it will not be reloaded on restart", zap.Stringer("block", blk), zap.Error(err))
+		}
+	}
 	return idx, nil
 
 }
@@ -94,26 +150,73 @@ func (i *PreIndexer) Preprocess(blk *bstream.Block) (interface{}, error) {
 func (i *PreIndexer) openLiveIndex(blockNum uint64, blockID string) (*SingleIndex, *index.AnalysisQueue, error) {
 	path := fmt.Sprintf(filepath.Join(i.liveIndexesPath, "%d-%s-%d.bleve"), blockNum, blockID, time.Now().UnixNano())
 	analysisQueue := index.NewAnalysisQueue(1)
+	idxer, err := openLiveScorch(path, analysisQueue)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx := &SingleIndex{
+		Index:   idxer,
+		blockID: blockID,
+		path:    path,
+	}
+	return idx, analysisQueue, nil
+}
+
+func (i *PreIndexer) indexInMemory(blockID string, docsList []*document.Document) (*SingleIndex, error) {
+	i.analysisLock.RLock()
+	defer i.analysisLock.RUnlock()
+	if i.closed {
+		return nil, fmt.Errorf("pre-indexer closed, not indexing block %s", blockID)
+	}
+
+	// with an empty path, scorch keeps its segments in memory and runs
+	// neither the persister nor the merger
 	idxer, err := scorch.NewScorch("data", map[string]interface{}{
 		"forceSegmentType":    "zap",
 		"forceSegmentVersion": 14,
-		"path":                path,
-		"unsafe_batch":        true,
-	}, analysisQueue)
-
+		"path":                "",
+	}, i.analysisQueue)
 	if err != nil {
-		return nil, nil, fmt.Errorf("creating ramdisk-based scorch index: %s", err)
+		return nil, fmt.Errorf("creating in-memory scorch index: %s", err)
 	}
 
 	err = idxer.Open()
 	if err != nil {
-		return nil, nil, fmt.Errorf("opening ramdisk-based scorch index: %s", err)
+		return nil, fmt.Errorf("opening in-memory scorch index: %s", err)
 	}
 
-	idx := &SingleIndex{
+	batch := index.NewBatch()
+	for _, doc := range docsList {
+		batch.Update(doc)
+	}
+	err = idxer.Batch(batch)
+	if err != nil {
+		idxer.Close()
+		return nil, err
+	}
+
+	return &SingleIndex{
 		Index:   idxer,
 		blockID: blockID,
-		path:    path,
+	}, nil
+}
+
+func openLiveScorch(path string, analysisQueue *index.AnalysisQueue) (index.Index, error) {
+	idxer, err := scorch.NewScorch("data", map[string]interface{}{
+		"forceSegmentType":    "zap",
+		"forceSegmentVersion": 14,
+		"path":                path,
+		"unsafe_batch":        true,
+	}, analysisQueue)
+
+	if err != nil {
+		return nil, fmt.Errorf("creating ramdisk-based scorch index: %s", err)
 	}
-	return idx, analysisQueue, nil
+
+	err = idxer.Open()
+	if err != nil {
+		return nil, fmt.Errorf("opening ramdisk-based scorch index: %s", err)
+	}
+	return idxer, nil
 }
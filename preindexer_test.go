@@ -0,0 +1,114 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/blevesearch/bleve/document"
+	"github.com/dfuse-io/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAccountMapper struct {
+	accounts []string
+}
+
+func (m *testAccountMapper) Map(blk *bstream.Block) (out []*document.Document, err error) {
+	for i, account := range m.accounts {
+		doc := document.NewDocument(fmt.Sprintf("%08x:trx%d:%04x", blk.Num(), i, 0))
+		doc.AddField(document.NewTextField("account", nil, []byte(account)))
+		doc.AddField(document.NewNumericField("block_num", nil, float64(blk.Num())))
+		doc.AddField(document.NewNumericField("trx_idx", nil, float64(i)))
+		out = append(out, doc)
+	}
+	return out, nil
+}
+
+func (m *testAccountMapper) Validate() error {
+	return nil
+}
+
+func TestPreIndexer_Preprocess(t *testing.T) {
+	tests := []struct {
+		name     string
+		inMemory bool
+	}{
+		{name: "on disk"},
+		{name: "in memory", inMemory: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "preindexer")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			preIndexer := NewPreIndexer(&testAccountMapper{accounts: []string{"eoscanadacom", "eosio", "eoscanadacom"}}, dir)
+			if test.inMemory {
+				preIndexer.EnableInMemoryIndexes(2)
+			}
+
+			obj, err := preIndexer.Preprocess(bstream.TestBlock("00000002a", "00000001a"))
+			require.NoError(t, err)
+			idx := obj.(*SingleIndex)
+
+			files, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			if test.inMemory {
+				assert.Len(t, files, 0)
+			} else {
+				assert.Len(t, files, 1)
+			}
+
+			bquery := &BleveQuery{Raw: "account:eoscanadacom"}
+			require.NoError(t, bquery.Parse())
+
+			matches, err := RunSingleIndexQuery(context.Background(), false, 0, 10, TestMatchCollector, bquery, idx.GetIndex(), func() {}, nil)
+			require.NoError(t, err)
+
+			var trxIDs []string
+			for _, match := range matches {
+				trxIDs = append(trxIDs, match.TransactionIDPrefix())
+			}
+			assert.Equal(t, []string{"trx0", "trx2"}, trxIDs)
+
+			idx.Delete()
+			files, err = ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, files, 0)
+		})
+	}
+}
+
+func TestPreIndexer_Close(t *testing.T) {
+	preIndexer := NewPreIndexer(&testAccountMapper{accounts: []string{"eoscanadacom"}}, "")
+	preIndexer.EnableInMemoryIndexes(2)
+
+	obj, err := preIndexer.Preprocess(bstream.TestBlock("00000002a", "00000001a"))
+	require.NoError(t, err)
+	obj.(*SingleIndex).Delete()
+
+	preIndexer.Close()
+	preIndexer.Close()
+
+	_, err = preIndexer.Preprocess(bstream.TestBlock("00000003a", "00000002a"))
+	assert.Error(t, err)
+}
@@ -22,6 +22,7 @@ import (
 
 	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
 	"github.com/dfuse-io/derr"
+	"github.com/dfuse-io/search"
 	"github.com/dfuse-io/search/metrics"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
@@ -43,6 +44,10 @@ type BackendQuery struct {
 	request *pb.BackendRequest // include the `sortDesc`, necesssary here
 
 	LastBlockRead int64
+
+	// MissingRanges are advertised by archive backends holding gaps, see `search.MissingRangesTrailerKey`
+	MissingRanges    []search.BlockRange
+	HasMissingRanges bool
 }
 
 func newBackendQuery(client pb.BackendClient, request *pb.BackendRequest) *BackendQuery {
@@ -53,7 +58,7 @@ func newBackendQuery(client pb.BackendClient, request *pb.BackendRequest) *Backe
 }
 
 func (q *BackendQuery) run(ctx context.Context, zlogger *zap.Logger, streamSend func(*pb.SearchMatch) error) (err error) {
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(search.WithForwardedHeartbeatInterval(search.WithForwardedClientID(ctx)))
 	defer cancel()
 	resp, err := q.client.StreamMatches(ctx, q.request)
 	if err != nil {
@@ -67,8 +72,21 @@ func (q *BackendQuery) run(ctx context.Context, zlogger *zap.Logger, streamSend
 		msg, err := resp.Recv()
 		if err == io.EOF {
 			trailer := resp.Trailer()
+			if x := trailer.Get(search.MissingRangesTrailerKey); len(x) > 0 {
+				q.HasMissingRanges = true
+				if q.MissingRanges, err = search.ParseBlockRanges(x[0]); err != nil {
+					zlogger.Warn("invalid missing ranges trailer from search backend", zap.Error(err))
+					q.HasMissingRanges = false
+				}
+			}
+
 			if x := trailer.Get("last-block-read"); len(x) > 0 {
 				if x[0] == "-1" {
+					if len(q.MissingRanges) != 0 {
+						// the query starts in a gap of the backend, it read nothing
+						q.LastBlockRead = -1
+						return nil
+					}
 					return fmt.Errorf("backend last-block-read is -1, backend should returned an error")
 				}
 
@@ -92,7 +110,7 @@ func (q *BackendQuery) run(ctx context.Context, zlogger *zap.Logger, streamSend
 			return err
 		}
 
-		if !within(msg.BlockNum, q.request.LowBlockNum, q.request.HighBlockNum) {
+		if !within(msg.BlockNum, q.request.LowBlockNum, q.request.HighBlockNum) && !search.IsHeartbeat(msg) {
 			zlogger.Error("received search match block num from backend client outside of backend query range",
 				zap.Reflect("search_match", msg),
 				zap.Uint64("low_block_num", q.request.LowBlockNum),
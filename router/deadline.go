@@ -0,0 +1,151 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"google.golang.org/grpc/metadata"
+)
+
+// TimeBudgetMetadataKey is the gRPC metadata key through which a client
+// gives a query a time budget (a Go duration, like `5s`), after which the
+// router stops it and returns a cursor to resume from, instead of an error.
+const TimeBudgetMetadataKey = "x-search-time-budget"
+
+// maxDeadlineSafetyMargin bounds the time kept, out of the gRPC deadline,
+// to stop the query and send the trailers before the client gives up.
+const maxDeadlineSafetyMargin = time.Second
+
+// requestDeadline returns when the query needs to stop, from either the
+// time budget metadata or the gRPC deadline of `ctx`, whichever comes first.
+// A zero time means the query has no deadline.
+func requestDeadline(ctx context.Context, now time.Time) (deadline time.Time, err error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(TimeBudgetMetadataKey); len(values) > 0 {
+			budget, err := time.ParseDuration(values[0])
+			if err != nil || budget <= 0 {
+				return deadline, fmt.Errorf("invalid %s metadata %q, expecting a positive duration like `5s`", TimeBudgetMetadataKey, values[0])
+			}
+			deadline = now.Add(budget)
+		}
+	}
+
+	if grpcDeadline, ok := ctx.Deadline(); ok {
+		margin := grpcDeadline.Sub(now) / 10
+		if margin > maxDeadlineSafetyMargin {
+			margin = maxDeadlineSafetyMargin
+		}
+
+		grpcDeadline = grpcDeadline.Add(-margin)
+		if deadline.IsZero() || grpcDeadline.Before(deadline) {
+			deadline = grpcDeadline
+		}
+	}
+
+	return deadline, nil
+}
+
+// minBackendTimeShare is the least time given to a backend query when
+// splitting the time left across segments, so that a small segment is
+// not stopped before its backend could respond.
+var minBackendTimeShare = 500 * time.Millisecond
+
+// backendDeadline returns when the backend query of `targetPeer` needs to
+// stop, the query range left being `[lowBlockNum, highBlockNum]`. The time
+// left before the query deadline is split across the segments left, in
+// proportion of their blocks, so a slow segment cannot use up the time of
+// the following ones. What a backend query leaves unused goes to the next
+// ones. Overrunning its share stops the query like its deadline does,
+// except before anything was read, so that each page of a query moves
+// forward. Peers serving reversible blocks follow the head, they get all
+// the time left.
+func (q *queryExecutor) backendDeadline(targetPeer *PeerRange, lowBlockNum, highBlockNum uint64, now time.Time) time.Time {
+	if q.deadline.IsZero() || targetPeer.ServesReversible || q.queryRange.mode != pb.RouterRequest_PAGINATED {
+		return q.deadline
+	}
+
+	if !q.hasProgress && q.lastCursor == "" {
+		return q.deadline
+	}
+
+	remaining := q.deadline.Sub(now)
+	remainingBlocks := highBlockNum - lowBlockNum + 1
+	segmentBlocks := targetPeer.HighBlockNum - targetPeer.LowBlockNum + 1
+	if remaining <= 0 || remainingBlocks == 0 || segmentBlocks >= remainingBlocks {
+		return q.deadline
+	}
+
+	share := time.Duration(float64(remaining) * float64(segmentBlocks) / float64(remainingBlocks))
+	if share < minBackendTimeShare {
+		share = minBackendTimeShare
+	}
+	if share >= remaining {
+		return q.deadline
+	}
+	return now.Add(share)
+}
+
+// resumeCursor returns the cursor from which a query stopped before the
+// end of its range can be resumed: after the last match sent when it is
+// past the blocks known to be fully read, otherwise after those blocks.
+func (q *queryExecutor) resumeCursor() string {
+	if q.lastCursor != "" && (!q.hasProgress || q.pastProgress(q.lastBlockReceived)) {
+		return q.lastCursor
+	}
+
+	if q.hasProgress {
+		return search.NewCursor(q.progressBlockNum, "", "")
+	}
+
+	// nothing was read, the same request can be sent again
+	return q.request.Cursor
+}
+
+func (q *queryExecutor) pastProgress(blockNum uint64) bool {
+	if q.request.Descending {
+		return blockNum < q.progressBlockNum
+	}
+	return blockNum > q.progressBlockNum
+}
+
+func (q *queryExecutor) recordProgress(lastBlockRead uint64) {
+	q.progressBlockNum = lastBlockRead
+	q.hasProgress = true
+}
+
+// deadlineReached flags the query as stopped by its deadline when
+// `backendCtx` expired while the client is still there.
+func (q *queryExecutor) deadlineReached(backendCtx context.Context) bool {
+	if q.deadline.IsZero() || q.ctx.Err() != nil || backendCtx.Err() != context.DeadlineExceeded {
+		return false
+	}
+
+	q.deadlineExceeded = true
+	q.incompleteRange = true
+	return true
+}
+
+func setDeadlineExceeded(trailer metadata.MD, q *queryExecutor) {
+	trailer.Set("range-completed", "false")
+	trailer.Set("deadline-exceeded", "true")
+	if cursor := q.resumeCursor(); cursor != "" {
+		trailer.Set("cursor", cursor)
+	}
+}
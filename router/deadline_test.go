@@ -0,0 +1,345 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func Test_requestDeadline(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	withBudget := func(ctx context.Context, budget string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(TimeBudgetMetadataKey, budget))
+	}
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	withDeadline := func(deadline time.Time) context.Context {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		cancels = append(cancels, cancel)
+		return ctx
+	}
+
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		expectDeadline time.Time
+		expectError    bool
+	}{
+		{
+			name: "no deadline",
+			ctx:  context.Background(),
+		},
+		{
+			name:           "time budget",
+			ctx:            withBudget(context.Background(), "5s"),
+			expectDeadline: now.Add(5 * time.Second),
+		},
+		{
+			name:        "invalid time budget",
+			ctx:         withBudget(context.Background(), "soon"),
+			expectError: true,
+		},
+		{
+			name:           "grpc deadline keeps a margin",
+			ctx:            withDeadline(now.Add(5 * time.Second)),
+			expectDeadline: now.Add(4500 * time.Millisecond),
+		},
+		{
+			name:           "grpc deadline margin is bounded",
+			ctx:            withDeadline(now.Add(time.Minute)),
+			expectDeadline: now.Add(59 * time.Second),
+		},
+		{
+			name:           "earliest of time budget and grpc deadline",
+			ctx:            withBudget(withDeadline(now.Add(time.Minute)), "5s"),
+			expectDeadline: now.Add(5 * time.Second),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deadline, err := requestDeadline(test.ctx, now)
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectDeadline, deadline)
+		})
+	}
+}
+
+func Test_resumeCursor(t *testing.T) {
+	tests := []struct {
+		name         string
+		request      *pb.RouterRequest
+		progress     *uint64
+		lastBlock    uint64
+		lastCursor   string
+		expectCursor string
+	}{
+		{
+			name:         "nothing read, same cursor",
+			request:      &pb.RouterRequest{Cursor: "1:10::abc"},
+			expectCursor: "1:10::abc",
+		},
+		{
+			name:         "match sent, no progress",
+			request:      &pb.RouterRequest{},
+			lastBlock:    12,
+			lastCursor:   "1:12::def",
+			expectCursor: "1:12::def",
+		},
+		{
+			name:         "match sent past progress",
+			request:      &pb.RouterRequest{},
+			progress:     uint64Ptr(100),
+			lastBlock:    112,
+			lastCursor:   "1:112::def",
+			expectCursor: "1:112::def",
+		},
+		{
+			name:         "progress past last match",
+			request:      &pb.RouterRequest{},
+			progress:     uint64Ptr(100),
+			lastBlock:    90,
+			lastCursor:   "1:90::def",
+			expectCursor: "1:100::",
+		},
+		{
+			name:         "progress past last match descending",
+			request:      &pb.RouterRequest{Descending: true},
+			progress:     uint64Ptr(100),
+			lastBlock:    112,
+			lastCursor:   "1:112::def",
+			expectCursor: "1:100::",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := &queryExecutor{request: test.request, lastBlockReceived: test.lastBlock, lastCursor: test.lastCursor}
+			if test.progress != nil {
+				q.recordProgress(*test.progress)
+			}
+			assert.Equal(t, test.expectCursor, q.resumeCursor())
+		})
+	}
+}
+
+func uint64Ptr(v uint64) *uint64 { return &v }
+
+func Test_backendDeadline(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	deadline := now.Add(10 * time.Second)
+	archive := &PeerRange{Addr: "archive", LowBlockNum: 101, HighBlockNum: 200}
+
+	tests := []struct {
+		name           string
+		deadline       time.Time
+		mode           pb.RouterRequest_Mode
+		progress       bool
+		peer           *PeerRange
+		low, high      uint64
+		expectDeadline time.Time
+	}{
+		{
+			name: "no deadline",
+			mode: pb.RouterRequest_PAGINATED, progress: true,
+			peer: archive, low: 101, high: 1100,
+		},
+		{
+			name:     "share in proportion of the blocks",
+			deadline: deadline, mode: pb.RouterRequest_PAGINATED, progress: true,
+			peer: archive, low: 101, high: 500,
+			expectDeadline: now.Add(2500 * time.Millisecond),
+		},
+		{
+			name:     "share is bounded below",
+			deadline: deadline, mode: pb.RouterRequest_PAGINATED, progress: true,
+			peer: archive, low: 101, high: 100100,
+			expectDeadline: now.Add(minBackendTimeShare),
+		},
+		{
+			name:     "last segment gets the time left",
+			deadline: deadline, mode: pb.RouterRequest_PAGINATED, progress: true,
+			peer: archive, low: 101, high: 200,
+			expectDeadline: deadline,
+		},
+		{
+			name:     "nothing read yet gets the time left",
+			deadline: deadline, mode: pb.RouterRequest_PAGINATED,
+			peer: archive, low: 101, high: 500,
+			expectDeadline: deadline,
+		},
+		{
+			name:     "reversible segment gets the time left",
+			deadline: deadline, mode: pb.RouterRequest_PAGINATED, progress: true,
+			peer: &PeerRange{Addr: "live", LowBlockNum: 101, HighBlockNum: 200, ServesReversible: true}, low: 101, high: 500,
+			expectDeadline: deadline,
+		},
+		{
+			name:     "streaming query gets the time left",
+			deadline: deadline, mode: pb.RouterRequest_STREAMING, progress: true,
+			peer: archive, low: 101, high: 500,
+			expectDeadline: deadline,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := &queryExecutor{deadline: test.deadline, queryRange: &QueryRange{mode: test.mode}}
+			if test.progress {
+				q.recordProgress(100)
+			}
+			assert.Equal(t, test.expectDeadline, q.backendDeadline(test.peer, test.low, test.high, now))
+		})
+	}
+}
+
+// blockingBackendClient sends its responses, then blocks until the context is done
+type blockingBackendClient struct {
+	responses []*pb.SearchMatch
+}
+
+func (c *blockingBackendClient) StreamMatches(ctx context.Context, in *pb.BackendRequest, opts ...grpc.CallOption) (pb.Backend_StreamMatchesClient, error) {
+	return &blockingBackendStreamer{testBackendStreamer: &testBackendStreamer{client: &testBackendClient{responses: c.responses}}, ctx: ctx}, nil
+}
+
+type blockingBackendStreamer struct {
+	*testBackendStreamer
+	ctx context.Context
+}
+
+func (s *blockingBackendStreamer) Recv() (*pb.SearchMatch, error) {
+	if match, err := s.testBackendStreamer.Recv(); match != nil {
+		return match, err
+	}
+	<-s.ctx.Done()
+	return nil, status.Error(codes.DeadlineExceeded, s.ctx.Err().Error())
+}
+
+func Test_QueryDeadlineExceeded(t *testing.T) {
+	request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_STREAMING}
+	planner := &testPlanner{plans: []*PeerRange{
+		{Addr: "archive-tier-0-1", LowBlockNum: 20, HighBlockNum: 100},
+		{Addr: "archive-tier-1-1", LowBlockNum: 101, HighBlockNum: 230},
+	}}
+	clients := map[string]pb.BackendClient{
+		"archive-tier-0-1": &testBackendClient{
+			responses: []*pb.SearchMatch{{TrxIdPrefix: "a", BlockNum: 24, Cursor: "1:24::a"}},
+			error:     io.EOF,
+			trailer:   metadata.Pairs("last-block-read", "100"),
+		},
+		"archive-tier-1-1": &blockingBackendClient{
+			responses: []*pb.SearchMatch{{TrxIdPrefix: "b", BlockNum: 132, Cursor: "1:132::b"}},
+		},
+	}
+	clientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+
+	inboundStream := &testInboundStream{}
+	q := newQueryExecutor(context.Background(), request, planner, nil, &QueryRange{lowBlockNum: 20, highBlockNum: 230, mode: pb.RouterRequest_STREAMING}, zlog, clientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+	q.deadline = time.Now().Add(50 * time.Millisecond)
+
+	require.NoError(t, q.Query())
+	assert.True(t, q.deadlineExceeded)
+	assert.Len(t, inboundStream.matches, 2)
+
+	trailer := metadata.New(nil)
+	setDeadlineExceeded(trailer, q)
+	assert.Equal(t, []string{"false"}, trailer.Get("range-completed"))
+	assert.Equal(t, []string{"true"}, trailer.Get("deadline-exceeded"))
+	assert.Equal(t, []string{"1:132::b"}, trailer.Get("cursor"))
+}
+
+func Test_QueryBackendTimeShareExceeded(t *testing.T) {
+	request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_PAGINATED}
+	planner := &testPlanner{plans: []*PeerRange{
+		{Addr: "archive-tier-0-1", LowBlockNum: 20, HighBlockNum: 100},
+		{Addr: "archive-tier-1-1", LowBlockNum: 101, HighBlockNum: 200},
+	}}
+	clients := map[string]pb.BackendClient{
+		"archive-tier-0-1": &testBackendClient{
+			responses: []*pb.SearchMatch{{TrxIdPrefix: "a", BlockNum: 24, Cursor: "1:24::a"}},
+			error:     io.EOF,
+			trailer:   metadata.Pairs("last-block-read", "100"),
+		},
+		"archive-tier-1-1": &blockingBackendClient{},
+	}
+	clientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+
+	defer func(share time.Duration) { minBackendTimeShare = share }(minBackendTimeShare)
+	minBackendTimeShare = 50 * time.Millisecond
+
+	inboundStream := &testInboundStream{}
+	q := newQueryExecutor(context.Background(), request, planner, nil, &QueryRange{lowBlockNum: 20, highBlockNum: 100000, mode: pb.RouterRequest_PAGINATED}, zlog, clientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+	q.deadline = time.Now().Add(time.Minute)
+
+	require.NoError(t, q.Query())
+	assert.True(t, q.deadlineExceeded, "the second segment overran its share of the time budget")
+	assert.Len(t, inboundStream.matches, 1)
+	assert.Equal(t, "1:100::", q.resumeCursor())
+}
+
+func Test_QueryBackendTimeShareExceededPrefetched(t *testing.T) {
+	request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_PAGINATED}
+	planner := &testPlanner{plans: []*PeerRange{
+		{Addr: "archive-tier-0-1", LowBlockNum: 20, HighBlockNum: 100},
+		{Addr: "archive-tier-1-1", LowBlockNum: 101, HighBlockNum: 200},
+	}}
+	clients := map[string]pb.BackendClient{
+		"archive-tier-0-1": &testBackendClient{
+			responses: []*pb.SearchMatch{{TrxIdPrefix: "a", BlockNum: 24, Cursor: "1:24::a"}},
+			error:     io.EOF,
+			trailer:   metadata.Pairs("last-block-read", "100"),
+		},
+		"archive-tier-1-1": &blockingBackendClient{},
+	}
+	clientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+
+	defer func(share time.Duration) { minBackendTimeShare = share }(minBackendTimeShare)
+	minBackendTimeShare = 50 * time.Millisecond
+
+	// bounds the test when the prefetched segment has no share of the time budget
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inboundStream := &testInboundStream{}
+	q := newQueryExecutor(ctx, request, planner, nil, &QueryRange{lowBlockNum: 20, highBlockNum: 100000, mode: pb.RouterRequest_PAGINATED}, zlog, clientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+	q.deadline = time.Now().Add(time.Minute)
+	q.lastCursor = "1:19::" // resumed, the segments get their share of the time budget from the start
+	q.prefetchSegments = 1
+
+	require.NoError(t, q.Query())
+	assert.True(t, q.deadlineExceeded, "the prefetched segment overran its share of the time budget")
+	assert.Len(t, inboundStream.matches, 1)
+	assert.Equal(t, "1:100::", q.resumeCursor())
+}
@@ -45,6 +45,9 @@ func (r *Router) setRouterAvailability() {
 		peers := r.dmeshClient.Peers()
 		readyPeers := getReadyPeers(peers)
 
+		r.peerStats.prune(peers)
+		r.missingRanges.prune(peers)
+
 		if len(readyPeers) > 0 {
 			r.ready.Store(true)
 		} else {
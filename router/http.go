@@ -0,0 +1,311 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dfuse-io/derr"
+	"github.com/dfuse-io/logging"
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// httpMetadataHeaders are the HTTP headers passed to the query as gRPC
+// metadata, the same way a gRPC client would send them.
+var httpMetadataHeaders = map[string]string{
+	"X-Search-Client-Id":          search.ClientIDMetadataKey,
+	"X-Search-Time-Budget":        TimeBudgetMetadataKey,
+	"X-Search-Heartbeat-Interval": search.HeartbeatIntervalMetadataKey,
+}
+
+// EnableHTTPGateway serves, on `listenAddr`, the `/v1/search` HTTP
+// endpoint running the same queries as the gRPC `StreamMatches`.
+func (r *Router) EnableHTTPGateway(listenAddr string) {
+	r.httpListenAddr = listenAddr
+}
+
+func (r *Router) startHTTPServer() {
+	router := mux.NewRouter()
+	router.Use(search.OpenCensusMiddleware, search.NewLoggingMiddleware(zlog))
+	router.HandleFunc("/v1/search", r.searchHandler()).Methods("GET", "POST")
+
+	r.httpServer = &http.Server{Addr: r.httpListenAddr, Handler: router}
+	go func() {
+		zlog.Info("listening & serving HTTP content", zap.String("http_listen_addr", r.httpListenAddr))
+		if err := r.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			r.Shutter.Shutdown(fmt.Errorf("failed listening http %q: %w", r.httpListenAddr, err))
+		}
+	}()
+}
+
+func (r *Router) shutdownHTTPServer() {
+	if r.httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := r.httpServer.Shutdown(ctx); err != nil {
+		zlog.Info("error shutting down http server", zap.Error(err))
+	}
+}
+
+// searchHandler serves `/v1/search`, taking the `RouterRequest` either as
+// a JSON body or as URL parameters, with the same field names. Matches are
+// streamed as NDJSON, or as Server-Sent Events when asked for through the
+// `Accept: text/event-stream` header or the `format=sse` parameter. The
+// stream ends with a `trailer` message, carrying the cursor to resume from
+// and whether the range was completed.
+func (r *Router) searchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		routerRequest, err := httpRouterRequest(req)
+		if err != nil {
+			writeHTTPError(ctx, w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		md := metadata.MD{}
+		for header, key := range httpMetadataHeaders {
+			if value := req.Header.Get(header); value != "" {
+				md.Set(key, value)
+			}
+		}
+
+		stream := newHTTPMatchStream(metadata.NewIncomingContext(ctx, md), w, wantsServerSentEvents(req))
+		if err := r.StreamMatches(routerRequest, stream); err != nil {
+			if !stream.started {
+				writeHTTPError(ctx, w, err)
+				return
+			}
+
+			logging.Logger(ctx, zlog).Debug("search query failed after streaming started", zap.Error(err))
+			stream.writeEvent("error", derr.ToErrorResponse(ctx, withHTTPStatus(ctx, err)))
+			return
+		}
+
+		stream.writeEvent("trailer", stream.trailerValues())
+	}
+}
+
+func wantsServerSentEvents(req *http.Request) bool {
+	return req.FormValue("format") == "sse" || strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+func httpRouterRequest(req *http.Request) (*pb.RouterRequest, error) {
+	routerRequest := &pb.RouterRequest{}
+
+	if req.Method == "POST" && strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := jsonpb.Unmarshal(req.Body, routerRequest); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %s", err)
+		}
+		return routerRequest, nil
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return nil, fmt.Errorf("invalid parameters: %s", err)
+	}
+
+	return routerRequestFromValues(req.Form)
+}
+
+func routerRequestFromValues(values url.Values) (*pb.RouterRequest, error) {
+	routerRequest := &pb.RouterRequest{
+		Query:  values.Get("query"),
+		Cursor: values.Get("cursor"),
+	}
+
+	var err error
+	parseInt := func(name string, target *int64) {
+		if value := values.Get(name); value != "" && err == nil {
+			if *target, err = strconv.ParseInt(value, 10, 64); err != nil {
+				err = fmt.Errorf("invalid %s %q, expecting an integer", name, value)
+			}
+		}
+	}
+	parseUint := func(name string, target *uint64) {
+		if value := values.Get(name); value != "" && err == nil {
+			if *target, err = strconv.ParseUint(value, 10, 64); err != nil {
+				err = fmt.Errorf("invalid %s %q, expecting an unsigned integer", name, value)
+			}
+		}
+	}
+	parseBool := func(name string, target *bool) {
+		if value := values.Get(name); value != "" && err == nil {
+			if *target, err = strconv.ParseBool(value); err != nil {
+				err = fmt.Errorf("invalid %s %q, expecting a boolean", name, value)
+			}
+		}
+	}
+
+	parseInt("lowBlockNum", &routerRequest.LowBlockNum)
+	parseInt("highBlockNum", &routerRequest.HighBlockNum)
+	parseBool("lowBlockUnbounded", &routerRequest.LowBlockUnbounded)
+	parseBool("highBlockUnbounded", &routerRequest.HighBlockUnbounded)
+	parseBool("descending", &routerRequest.Descending)
+	parseInt("limit", &routerRequest.Limit)
+	parseBool("withReversible", &routerRequest.WithReversible)
+	parseBool("useLegacyBoundaries", &routerRequest.UseLegacyBoundaries)
+	parseUint("startBlock", &routerRequest.StartBlock)
+	parseUint("blockCount", &routerRequest.BlockCount)
+	parseUint("liveMarkerInterval", &routerRequest.LiveMarkerInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode := values.Get("mode"); mode != "" {
+		value, found := pb.RouterRequest_Mode_value[strings.ToUpper(mode)]
+		if !found {
+			return nil, fmt.Errorf("invalid mode %q, expecting `streaming` or `paginated`", mode)
+		}
+		routerRequest.Mode = pb.RouterRequest_Mode(value)
+	}
+
+	return routerRequest, nil
+}
+
+// withHTTPStatus turns the gRPC status of `err` into a `derr` error
+// response with the matching HTTP status.
+func withHTTPStatus(ctx context.Context, err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	var httpStatus int
+	switch st.Code() {
+	case codes.InvalidArgument, codes.OutOfRange:
+		httpStatus = http.StatusBadRequest
+	case codes.NotFound:
+		httpStatus = http.StatusNotFound
+	case codes.ResourceExhausted:
+		httpStatus = http.StatusTooManyRequests
+	case codes.Unavailable:
+		httpStatus = http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		httpStatus = http.StatusGatewayTimeout
+	case codes.Unimplemented:
+		httpStatus = http.StatusNotImplemented
+	default:
+		return err
+	}
+
+	errorCode := derr.C(strings.ToLower(strings.Replace(fmt.Sprintf("%s_error", st.Code()), " ", "_", -1)))
+	return derr.HTTPErrorFromStatus(httpStatus, ctx, err, errorCode, st.Message())
+}
+
+func writeHTTPError(ctx context.Context, w http.ResponseWriter, err error) {
+	derr.WriteError(ctx, w, "unable to fulfill search request", withHTTPStatus(ctx, err))
+}
+
+// httpMatchStream implements `pb.Router_StreamMatchesServer` over an HTTP
+// response.
+type httpMatchStream struct {
+	ctx       context.Context
+	w         http.ResponseWriter
+	sse       bool
+	marshaler *jsonpb.Marshaler
+
+	started bool
+	trailer metadata.MD
+}
+
+func newHTTPMatchStream(ctx context.Context, w http.ResponseWriter, sse bool) *httpMatchStream {
+	return &httpMatchStream{
+		ctx:       ctx,
+		w:         w,
+		sse:       sse,
+		marshaler: &jsonpb.Marshaler{},
+		trailer:   metadata.New(nil),
+	}
+}
+
+func (s *httpMatchStream) Send(match *pb.SearchMatch) error {
+	buf := &bytes.Buffer{}
+	if err := s.marshaler.Marshal(buf, match); err != nil {
+		return fmt.Errorf("marshalling match: %w", err)
+	}
+
+	return s.writeEvent("match", json.RawMessage(buf.Bytes()))
+}
+
+func (s *httpMatchStream) writeEvent(kind string, payload interface{}) error {
+	if !s.started {
+		s.started = true
+		if s.sse {
+			s.w.Header().Set("Content-Type", "text/event-stream")
+			s.w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			s.w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		s.w.WriteHeader(http.StatusOK)
+	}
+
+	var err error
+	if s.sse {
+		var data []byte
+		if data, err = json.Marshal(payload); err == nil {
+			_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", kind, data)
+		}
+	} else {
+		err = json.NewEncoder(s.w).Encode(map[string]interface{}{kind: payload})
+	}
+	if err != nil {
+		return err
+	}
+
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (s *httpMatchStream) trailerValues() map[string]string {
+	out := map[string]string{}
+	for key, values := range s.trailer {
+		if len(values) > 0 {
+			out[key] = values[len(values)-1]
+		}
+	}
+	return out
+}
+
+func (s *httpMatchStream) SetHeader(metadata.MD) error  { return nil }
+func (s *httpMatchStream) SendHeader(metadata.MD) error { return nil }
+func (s *httpMatchStream) SetTrailer(md metadata.MD) {
+	for key, values := range md {
+		s.trailer.Append(key, values...)
+	}
+}
+func (s *httpMatchStream) Context() context.Context    { return s.ctx }
+func (s *httpMatchStream) SendMsg(m interface{}) error { return s.Send(m.(*pb.SearchMatch)) }
+func (s *httpMatchStream) RecvMsg(m interface{}) error { return fmt.Errorf("not supported over http") }
@@ -0,0 +1,170 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func Test_routerRequestFromValues(t *testing.T) {
+	tests := []struct {
+		name          string
+		values        url.Values
+		expectRequest *pb.RouterRequest
+		expectError   bool
+	}{
+		{
+			name: "all fields",
+			values: url.Values{
+				"query":        {"action:onblock"},
+				"lowBlockNum":  {"-10"},
+				"highBlockNum": {"200"},
+				"descending":   {"true"},
+				"limit":        {"5"},
+				"cursor":       {"1:12::abc"},
+				"mode":         {"paginated"},
+			},
+			expectRequest: &pb.RouterRequest{
+				Query:        "action:onblock",
+				LowBlockNum:  -10,
+				HighBlockNum: 200,
+				Descending:   true,
+				Limit:        5,
+				Cursor:       "1:12::abc",
+				Mode:         pb.RouterRequest_PAGINATED,
+			},
+		},
+		{
+			name:          "defaults",
+			values:        url.Values{"query": {"action:onblock"}},
+			expectRequest: &pb.RouterRequest{Query: "action:onblock"},
+		},
+		{
+			name:        "invalid integer",
+			values:      url.Values{"lowBlockNum": {"ten"}},
+			expectError: true,
+		},
+		{
+			name:        "invalid boolean",
+			values:      url.Values{"descending": {"maybe"}},
+			expectError: true,
+		},
+		{
+			name:        "invalid mode",
+			values:      url.Values{"mode": {"batch"}},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := routerRequestFromValues(test.values)
+			if test.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectRequest, request)
+		})
+	}
+}
+
+func Test_searchHandler(t *testing.T) {
+	r := &Router{}
+
+	tests := []struct {
+		name         string
+		request      *http.Request
+		expectStatus int
+	}{
+		{
+			name:         "invalid parameters",
+			request:      httptest.NewRequest("GET", "/v1/search?query=a&limit=many", nil),
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "invalid json body",
+			request:      jsonRequest(`{"query": 12}`),
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "router not ready",
+			request:      jsonRequest(`{"query": "action:onblock", "lowBlockNum": "10"}`),
+			expectStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.searchHandler()(recorder, test.request)
+			assert.Equal(t, test.expectStatus, recorder.Code)
+		})
+	}
+}
+
+func jsonRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/search", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func Test_httpMatchStream(t *testing.T) {
+	tests := []struct {
+		name         string
+		sse          bool
+		expectType   string
+		expectOutput string
+	}{
+		{
+			name:       "ndjson",
+			expectType: "application/x-ndjson",
+			expectOutput: `{"match":{"trxIdPrefix":"a","blockNum":"12","cursor":"1:12::a"}}` + "\n" +
+				`{"trailer":{"cursor":"1:12::a","range-completed":"false"}}` + "\n",
+		},
+		{
+			name:       "server-sent events",
+			sse:        true,
+			expectType: "text/event-stream",
+			expectOutput: "event: match\n" + `data: {"trxIdPrefix":"a","blockNum":"12","cursor":"1:12::a"}` + "\n\n" +
+				"event: trailer\n" + `data: {"cursor":"1:12::a","range-completed":"false"}` + "\n\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			stream := newHTTPMatchStream(context.Background(), recorder, test.sse)
+
+			require.NoError(t, stream.Send(&pb.SearchMatch{TrxIdPrefix: "a", BlockNum: 12, Cursor: "1:12::a"}))
+			stream.SetTrailer(metadata.Pairs("range-completed", "false"))
+			stream.SetTrailer(metadata.Pairs("cursor", "1:12::a"))
+			require.NoError(t, stream.writeEvent("trailer", stream.trailerValues()))
+
+			assert.Equal(t, test.expectType, recorder.Header().Get("Content-Type"))
+			assert.Equal(t, test.expectOutput, recorder.Body.String())
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sync"
+
+	"github.com/dfuse-io/dmesh"
+	"github.com/dfuse-io/search"
+)
+
+// peerMissingRanges remembers the block ranges each backend advertised as
+// missing, through the `search.MissingRangesTrailerKey` trailer of its last
+// response. The dmesh search peer record only carries the outer bounds of
+// a backend, it has no field for the intervals it covers, and
+// `dmesh.UnmarshalPeer` drops any field a backend would add to it, so the
+// covered intervals cannot be published through dmesh until it has one.
+type peerMissingRanges struct {
+	lock   sync.RWMutex
+	ranges map[string][]search.BlockRange
+}
+
+func newPeerMissingRanges() *peerMissingRanges {
+	return &peerMissingRanges{
+		ranges: map[string][]search.BlockRange{},
+	}
+}
+
+func (m *peerMissingRanges) set(addr string, ranges []search.BlockRange) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(ranges) == 0 {
+		delete(m.ranges, addr)
+		return
+	}
+	m.ranges[addr] = ranges
+}
+
+// prune forgets the ranges of the peers other than `peers`, which left dmesh.
+func (m *peerMissingRanges) prune(peers []*dmesh.SearchPeer) {
+	known := peerAddrs(peers)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for addr := range m.ranges {
+		if !known[addr] {
+			delete(m.ranges, addr)
+		}
+	}
+}
+
+func (m *peerMissingRanges) get(addr string) []search.BlockRange {
+	if m == nil {
+		return nil
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.ranges[addr]
+}
+
+// missingRangeAt returns the range of `ranges` containing `blockNum`.
+func missingRangeAt(ranges []search.BlockRange, blockNum uint64) *search.BlockRange {
+	for i := range ranges {
+		if ranges[i].Contains(blockNum) {
+			return &ranges[i]
+		}
+	}
+	return nil
+}
+
+// clipToMissingRanges shortens `peerRange` so it stops before the first
+// of `ranges` in the query direction, the backend would stop there anyway.
+func clipToMissingRanges(peerRange *PeerRange, ranges []search.BlockRange, descending bool) {
+	for _, missing := range ranges {
+		if descending {
+			if missing.High < peerRange.HighBlockNum && missing.High >= peerRange.LowBlockNum {
+				peerRange.LowBlockNum = missing.High + 1
+			}
+			continue
+		}
+
+		if missing.Low > peerRange.LowBlockNum && missing.Low <= peerRange.HighBlockNum {
+			peerRange.HighBlockNum = missing.Low - 1
+		}
+	}
+}
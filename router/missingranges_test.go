@@ -0,0 +1,176 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/dfuse-io/dmesh"
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestDmeshPlanner_NextPeer_missingRanges(t *testing.T) {
+	peers := []*dmesh.SearchPeer{
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-1"), BlockRangeData: dmesh.NewTestBlockRangeData(0, 299, 299), TierLevel: 2},
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-2"), BlockRangeData: dmesh.NewTestBlockRangeData(0, 299, 299), TierLevel: 1},
+	}
+
+	tests := []struct {
+		name            string
+		missingRanges   map[string][]search.BlockRange
+		lowBlockNum     uint64
+		highBlockNum    uint64
+		descending      bool
+		expectPeerRange *PeerRange
+	}{
+		{
+			name:            "clipped before the next missing range",
+			missingRanges:   map[string][]search.BlockRange{"archive-1": {{Low: 100, High: 199}}},
+			lowBlockNum:     0,
+			highBlockNum:    299,
+			expectPeerRange: &PeerRange{Addr: "archive-1", LowBlockNum: 0, HighBlockNum: 99},
+		},
+		{
+			name:            "clipped before the next missing range descending",
+			missingRanges:   map[string][]search.BlockRange{"archive-1": {{Low: 100, High: 199}}},
+			lowBlockNum:     0,
+			highBlockNum:    299,
+			descending:      true,
+			expectPeerRange: &PeerRange{Addr: "archive-1", LowBlockNum: 200, HighBlockNum: 299},
+		},
+		{
+			name:            "routed to a peer holding the range",
+			missingRanges:   map[string][]search.BlockRange{"archive-1": {{Low: 100, High: 199}}},
+			lowBlockNum:     100,
+			highBlockNum:    299,
+			expectPeerRange: &PeerRange{Addr: "archive-2", LowBlockNum: 100, HighBlockNum: 299},
+		},
+		{
+			name:            "held by no peer, up to where the first one resumes",
+			missingRanges:   map[string][]search.BlockRange{"archive-1": {{Low: 100, High: 199}}, "archive-2": {{Low: 100, High: 149}}},
+			lowBlockNum:     120,
+			highBlockNum:    299,
+			expectPeerRange: &PeerRange{Missing: true, LowBlockNum: 120, HighBlockNum: 149},
+		},
+		{
+			name:            "held by no peer descending",
+			missingRanges:   map[string][]search.BlockRange{"archive-1": {{Low: 100, High: 199}}, "archive-2": {{Low: 100, High: 149}}},
+			lowBlockNum:     0,
+			highBlockNum:    120,
+			descending:      true,
+			expectPeerRange: &PeerRange{Missing: true, LowBlockNum: 100, HighBlockNum: 120},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewDmeshPlanner(func() []*dmesh.SearchPeer { return peers }, 0)
+			p.missingRanges = newPeerMissingRanges()
+			for addr, ranges := range test.missingRanges {
+				p.ReportMissingRanges(addr, ranges)
+			}
+
+			peerRange := p.NextPeer(test.lowBlockNum, test.highBlockNum, test.descending, false)
+			if peerRange != nil {
+				peerRange.Conn = nil
+			}
+			assert.Equal(t, test.expectPeerRange, peerRange)
+		})
+	}
+}
+
+func Test_QuerySkipsMissingRanges(t *testing.T) {
+	peers := []*dmesh.SearchPeer{
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-1"), BlockRangeData: dmesh.NewTestBlockRangeData(0, 299, 299), TierLevel: 1},
+	}
+	planner := NewDmeshPlanner(func() []*dmesh.SearchPeer { return peers }, 0)
+	planner.missingRanges = newPeerMissingRanges()
+
+	clients := map[string]pb.BackendClient{
+		"archive-1:0": &testBackendClient{
+			responses: []*pb.SearchMatch{{TrxIdPrefix: "a", BlockNum: 50}},
+			error:     io.EOF,
+			trailer:   metadata.Pairs("last-block-read", "99", search.MissingRangesTrailerKey, "100-199"),
+		},
+		"archive-1:200": &testBackendClient{
+			responses: []*pb.SearchMatch{{TrxIdPrefix: "b", BlockNum: 250}},
+			error:     io.EOF,
+			trailer:   metadata.Pairs("last-block-read", "299", search.MissingRangesTrailerKey, "100-199"),
+		},
+	}
+	clientFactory := func(peerRange *PeerRange) pb.BackendClient {
+		return clients[fmt.Sprintf("%s:%d", peerRange.Addr, peerRange.LowBlockNum)]
+	}
+
+	inboundStream := &testInboundStream{}
+	request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_STREAMING}
+	q := newQueryExecutor(context.Background(), request, planner, nil, &QueryRange{lowBlockNum: 0, highBlockNum: 299, mode: pb.RouterRequest_STREAMING}, zlog, clientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+
+	require.NoError(t, q.Query())
+	assert.Len(t, inboundStream.matches, 2)
+	assert.Equal(t, []search.BlockRange{{Low: 100, High: 199}}, q.skippedRanges)
+}
+
+func TestPeerMissingRanges_Prune(t *testing.T) {
+	missingRanges := newPeerMissingRanges()
+	missingRanges.set("archive-1", []search.BlockRange{{Low: 10, High: 20}})
+	missingRanges.set("archive-2", []search.BlockRange{{Low: 10, High: 20}})
+
+	missingRanges.prune([]*dmesh.SearchPeer{
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-1")},
+	})
+
+	assert.Len(t, missingRanges.get("archive-1"), 1)
+	assert.Nil(t, missingRanges.get("archive-2"))
+}
+
+type countingBackendClient struct {
+	*testBackendClient
+	calls int
+}
+
+func (c *countingBackendClient) StreamMatches(ctx context.Context, in *pb.BackendRequest, opts ...grpc.CallOption) (pb.Backend_StreamMatchesClient, error) {
+	c.calls++
+	c.testBackendClient.LastResponse = 0
+	return c.testBackendClient.StreamMatches(ctx, in, opts...)
+}
+
+func Test_QueryRetriesBackendsReadingNoBlock(t *testing.T) {
+	defer func(backoffs []int) { queryRetryBackoffs = backoffs }(queryRetryBackoffs)
+	queryRetryBackoffs = []int{1, 1, 1}
+
+	peerRange := &PeerRange{Addr: "archive-1", LowBlockNum: 0, HighBlockNum: 299}
+	planner := &testPlanner{plans: []*PeerRange{peerRange, peerRange, peerRange, peerRange, peerRange, peerRange}}
+
+	client := &countingBackendClient{testBackendClient: &testBackendClient{
+		error:   io.EOF,
+		trailer: metadata.Pairs("last-block-read", "-1", search.MissingRangesTrailerKey, "0-99"),
+	}}
+	clientFactory := func(peerRange *PeerRange) pb.BackendClient { return client }
+
+	request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_STREAMING}
+	q := newQueryExecutor(context.Background(), request, planner, nil, &QueryRange{lowBlockNum: 0, highBlockNum: 299, mode: pb.RouterRequest_STREAMING}, zlog, clientFactory, newBackendQuery, newTestStreamSend(&testInboundStream{}))
+
+	assert.Error(t, q.Query())
+	assert.Equal(t, 4, client.calls, "the first query and one per retry")
+}
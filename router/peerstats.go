@@ -0,0 +1,249 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dfuse-io/dmesh"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+// peerLatencyWeight and peerErrorWeight are the weights of the latest
+// backend query in the moving averages of a peer.
+var peerLatencyWeight = 0.3
+var peerErrorWeight = 0.2
+
+// A peer failing `peerMaxConsecutiveFailures` backend queries in a row is
+// ejected from the planner for `peerEjectionDuration`.
+var peerMaxConsecutiveFailures = 3
+var peerEjectionDuration = 30 * time.Second
+
+// peerLatencySamples is the number of the latest times to first result,
+// across all peers, the latency percentiles are computed on. They are not
+// computed before `peerLatencyMinSamples` were recorded.
+var peerLatencySamples = 1000
+var peerLatencyMinSamples = 20
+
+// peerStats keeps, across queries, statistics on each backend so the
+// planner steers queries away from slow, loaded or failing ones. dmesh
+// only tells which backends can serve a range.
+type peerStats struct {
+	lock  sync.Mutex
+	peers map[string]*peerStat
+
+	latencies   []time.Duration // ring of the latest times to first result, across peers
+	nextLatency int
+}
+
+type peerStat struct {
+	latency             time.Duration // moving average of the time to first result
+	inflight            int
+	errorRate           float64 // moving average of failed backend queries, between 0 and 1
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+func newPeerStats() *peerStats {
+	return &peerStats{
+		peers: map[string]*peerStat{},
+	}
+}
+
+func (s *peerStats) get(addr string) *peerStat {
+	stat := s.peers[addr]
+	if stat == nil {
+		stat = &peerStat{}
+		s.peers[addr] = stat
+	}
+	return stat
+}
+
+func (s *peerStats) queryStarted(addr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stat := s.get(addr)
+	stat.inflight++
+	metrics.PeerInflightQueries.SetInt(stat.inflight, addr)
+}
+
+// queryEnded records the end of a backend query on `addr`. The time to
+// its first result is not sampled when `firstResultLatency` is 0, as it
+// is when the query had no results.
+func (s *peerStats) queryEnded(addr string, firstResultLatency time.Duration, failed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stat := s.peers[addr]
+	if stat == nil {
+		// pruned while the query was in flight
+		return
+	}
+	if stat.inflight > 0 {
+		// a peer pruned while the query was in flight and recreated by
+		// `pick` since does not count it
+		stat.inflight--
+	}
+	metrics.PeerInflightQueries.SetInt(stat.inflight, addr)
+
+	if firstResultLatency != 0 {
+		if stat.latency == 0 {
+			stat.latency = firstResultLatency
+		} else {
+			stat.latency = time.Duration(peerLatencyWeight*float64(firstResultLatency) + (1-peerLatencyWeight)*float64(stat.latency))
+		}
+		metrics.PeerFirstResultLatency.SetFloat64(stat.latency.Seconds(), addr)
+
+		s.sampleLatency(firstResultLatency)
+	}
+
+	stat.errorRate = (1 - peerErrorWeight) * stat.errorRate
+	if !failed {
+		stat.consecutiveFailures = 0
+	} else {
+		stat.errorRate += peerErrorWeight
+		stat.consecutiveFailures++
+		if stat.consecutiveFailures >= peerMaxConsecutiveFailures {
+			zlog.Warn("ejecting peer failing repeatedly", zap.String("addr", addr), zap.Int("consecutive_failures", stat.consecutiveFailures), zap.Duration("ejection_duration", peerEjectionDuration))
+			stat.consecutiveFailures = 0
+			stat.ejectedUntil = time.Now().Add(peerEjectionDuration)
+			metrics.PeerEjections.Inc(addr)
+		}
+	}
+	metrics.PeerErrorRate.SetFloat64(stat.errorRate, addr)
+}
+
+// queryOutrun records a hedged backend query on `addr` canceled after
+// `elapsed`, before its first result, because another one responded
+// first. Its time to first result is at least `elapsed`, sampling it as
+// such keeps the slowest backends from being left out of the percentiles.
+func (s *peerStats) queryOutrun(addr string, elapsed time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sampleLatency(elapsed)
+}
+
+func (s *peerStats) sampleLatency(latency time.Duration) {
+	if len(s.latencies) < peerLatencySamples {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	s.latencies[s.nextLatency] = latency
+	s.nextLatency = (s.nextLatency + 1) % peerLatencySamples
+}
+
+// prune forgets the peers other than `peers`, which left dmesh, and drops
+// their metrics.
+func (s *peerStats) prune(peers []*dmesh.SearchPeer) {
+	known := peerAddrs(peers)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for addr := range s.peers {
+		if known[addr] {
+			continue
+		}
+
+		zlog.Debug("forgetting statistics of peer gone from dmesh", zap.String("addr", addr))
+		delete(s.peers, addr)
+		metrics.PeerInflightQueries.Native().DeleteLabelValues(addr)
+		metrics.PeerFirstResultLatency.Native().DeleteLabelValues(addr)
+		metrics.PeerErrorRate.Native().DeleteLabelValues(addr)
+		metrics.PeerEjections.Native().DeleteLabelValues(addr)
+	}
+}
+
+func peerAddrs(peers []*dmesh.SearchPeer) map[string]bool {
+	addrs := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		addrs[peer.Addr()] = true
+	}
+	return addrs
+}
+
+// latencyPercentile returns the `percentile` (between 0 and 1) of the
+// latest times to first result, across peers, or false when too few were
+// recorded. Those of outrun hedged queries are lower bounds, see
+// `queryOutrun`.
+func (s *peerStats) latencyPercentile(percentile float64) (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.latencies) < peerLatencyMinSamples {
+		return 0, false
+	}
+
+	sorted := make([]time.Duration, len(s.latencies))
+	copy(sorted, s.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(math.Ceil(percentile*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx], true
+}
+
+// pick returns one of `peers` by the power of two choices: the least
+// costly of two peers taken at random. Ejected peers are left out, unless
+// all of them are.
+func (s *peerStats) pick(peers []*dmesh.SearchPeer, random *rand.Rand) *dmesh.SearchPeer {
+	if s == nil {
+		return peers[random.Intn(len(peers))]
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	var eligible []*dmesh.SearchPeer
+	for _, peer := range peers {
+		if s.get(peer.Addr()).ejectedUntil.Before(now) {
+			eligible = append(eligible, peer)
+		}
+	}
+	if len(eligible) == 0 {
+		eligible = peers
+	}
+
+	first := eligible[random.Intn(len(eligible))]
+	if len(eligible) == 1 {
+		return first
+	}
+
+	second := first
+	for second == first {
+		second = eligible[random.Intn(len(eligible))]
+	}
+
+	if s.get(second.Addr()).cost() < s.get(first.Addr()).cost() {
+		return second
+	}
+	return first
+}
+
+// cost is the expected wait for a new query on the peer, peers with no
+// latency recorded yet still weigh by their in-flight queries.
+func (p *peerStat) cost() float64 {
+	return float64(p.latency+time.Millisecond) * float64(p.inflight+1) / (1 - math.Min(p.errorRate, 0.99))
+}
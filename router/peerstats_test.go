@@ -0,0 +1,161 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/dmesh"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerStats_QueryEnded(t *testing.T) {
+	stats := newPeerStats()
+
+	stats.queryStarted("archive-1")
+	stats.queryStarted("archive-1")
+	assert.Equal(t, 2, stats.peers["archive-1"].inflight)
+
+	stats.queryEnded("archive-1", 100*time.Millisecond, false)
+	stats.queryEnded("archive-1", 200*time.Millisecond, false)
+	assert.Equal(t, 0, stats.peers["archive-1"].inflight)
+	assert.Equal(t, 130*time.Millisecond, stats.peers["archive-1"].latency)
+	assert.Equal(t, 0.0, stats.peers["archive-1"].errorRate)
+
+	for i := 0; i < peerMaxConsecutiveFailures; i++ {
+		stats.queryStarted("archive-1")
+		stats.queryEnded("archive-1", 0, true)
+	}
+	assert.InDelta(t, 0.488, stats.peers["archive-1"].errorRate, 0.0001)
+	assert.Equal(t, 130*time.Millisecond, stats.peers["archive-1"].latency)
+	assert.True(t, stats.peers["archive-1"].ejectedUntil.After(time.Now()))
+}
+
+func TestPeerStats_Prune(t *testing.T) {
+	stats := newPeerStats()
+
+	stats.queryStarted("archive-1")
+	stats.queryStarted("archive-2")
+
+	stats.prune([]*dmesh.SearchPeer{
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-1")},
+	})
+	assert.Contains(t, stats.peers, "archive-1")
+	assert.NotContains(t, stats.peers, "archive-2")
+
+	stats.queryEnded("archive-2", 100*time.Millisecond, false)
+	assert.NotContains(t, stats.peers, "archive-2", "not recreated by a query in flight when pruned")
+
+	stats.queryStarted("archive-1")
+	stats.prune(nil)
+	stats.pick([]*dmesh.SearchPeer{
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-1")},
+	}, rand.New(rand.NewSource(1)))
+	stats.queryEnded("archive-1", 100*time.Millisecond, false)
+	assert.Equal(t, 0, stats.peers["archive-1"].inflight, "query in flight when pruned not counted by the recreated peer")
+	assert.True(t, stats.peers["archive-1"].cost() > 0)
+}
+
+func TestPeerStats_Pick(t *testing.T) {
+	peers := []*dmesh.SearchPeer{
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-1")},
+		{GenericPeer: dmesh.NewTestReadyGenericPeer("v1", "search", "archive-2")},
+	}
+
+	tests := []struct {
+		name       string
+		stats      map[string]*peerStat
+		expectAddr string
+	}{
+		{
+			name: "lower latency",
+			stats: map[string]*peerStat{
+				"archive-1": {latency: 500 * time.Millisecond},
+				"archive-2": {latency: 100 * time.Millisecond},
+			},
+			expectAddr: "archive-2",
+		},
+		{
+			name: "fewer in flight queries",
+			stats: map[string]*peerStat{
+				"archive-1": {latency: 100 * time.Millisecond},
+				"archive-2": {latency: 100 * time.Millisecond, inflight: 3},
+			},
+			expectAddr: "archive-1",
+		},
+		{
+			name: "lower error rate",
+			stats: map[string]*peerStat{
+				"archive-1": {latency: 100 * time.Millisecond, errorRate: 0.5},
+				"archive-2": {latency: 100 * time.Millisecond},
+			},
+			expectAddr: "archive-2",
+		},
+		{
+			name: "ejected peer left out",
+			stats: map[string]*peerStat{
+				"archive-1": {latency: 100 * time.Millisecond},
+				"archive-2": {latency: 500 * time.Millisecond, ejectedUntil: time.Now().Add(time.Minute)},
+			},
+			expectAddr: "archive-1",
+		},
+		{
+			name: "all peers ejected",
+			stats: map[string]*peerStat{
+				"archive-1": {latency: 500 * time.Millisecond, ejectedUntil: time.Now().Add(time.Minute)},
+				"archive-2": {latency: 100 * time.Millisecond, ejectedUntil: time.Now().Add(time.Minute)},
+			},
+			expectAddr: "archive-2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := &peerStats{peers: test.stats}
+			for i := 0; i < 10; i++ {
+				assert.Equal(t, test.expectAddr, stats.pick(peers, rand.New(rand.NewSource(int64(i)))).Addr())
+			}
+		})
+	}
+}
+
+func TestPeerStats_LatencyPercentile(t *testing.T) {
+	stats := newPeerStats()
+
+	for i := 1; i < peerLatencyMinSamples; i++ {
+		stats.queryStarted("archive-1")
+		stats.queryEnded("archive-1", time.Duration(i)*time.Millisecond, false)
+	}
+	_, ok := stats.latencyPercentile(0.95)
+	assert.False(t, ok)
+
+	stats.queryStarted("archive-2")
+	stats.queryEnded("archive-2", time.Duration(peerLatencyMinSamples)*time.Millisecond, false)
+
+	delay, ok := stats.latencyPercentile(0.95)
+	assert.True(t, ok)
+	assert.Equal(t, 19*time.Millisecond, delay)
+
+	delay, ok = stats.latencyPercentile(1)
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Millisecond, delay)
+
+	stats.queryOutrun("archive-2", time.Second)
+	delay, ok = stats.latencyPercentile(1)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+}
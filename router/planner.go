@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/dfuse-io/dmesh"
+	"github.com/dfuse-io/search"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
@@ -43,6 +44,12 @@ type Planner interface {
 type dmeshPlanner struct {
 	peers              func() []*dmesh.SearchPeer
 	headDelayTolerance uint64
+
+	// missingRanges, when set, are avoided, see `ReportMissingRanges`
+	missingRanges *peerMissingRanges
+
+	// stats, when set, steer queries to the fastest and healthiest peers, see `QueryStarted`
+	stats *peerStats
 }
 
 func NewDmeshPlanner(peerFetcher func() []*dmesh.SearchPeer, liveDriftThreshold uint64) *dmeshPlanner {
@@ -53,6 +60,34 @@ func NewDmeshPlanner(peerFetcher func() []*dmesh.SearchPeer, liveDriftThreshold
 }
 
 func (s *dmeshPlanner) NextPeer(lowBlockNum uint64, highBlockNum uint64, descending bool, withReversible bool) *PeerRange {
+	return s.nextPeer(lowBlockNum, highBlockNum, descending, withReversible, "")
+}
+
+// NextPeerExcluding is `NextPeer` leaving out the peer at `excludeAddr`.
+func (s *dmeshPlanner) NextPeerExcluding(lowBlockNum uint64, highBlockNum uint64, descending bool, withReversible bool, excludeAddr string) *PeerRange {
+	return s.nextPeer(lowBlockNum, highBlockNum, descending, withReversible, excludeAddr)
+}
+
+// NextHedgePeer returns a peer, other than the one of `peerRange`, serving
+// the whole of `peerRange` too, or nil when there is none.
+func (s *dmeshPlanner) NextHedgePeer(peerRange *PeerRange, descending bool, withReversible bool) *PeerRange {
+	hedgeRange := s.nextPeer(peerRange.LowBlockNum, peerRange.HighBlockNum, descending, withReversible, peerRange.Addr)
+	if hedgeRange == nil || hedgeRange.Missing || hedgeRange.LowBlockNum != peerRange.LowBlockNum || hedgeRange.HighBlockNum != peerRange.HighBlockNum {
+		return nil
+	}
+	return hedgeRange
+}
+
+// HedgeDelay returns the `percentile` of the latest times to first result
+// of the peers, or false when it isn't known yet.
+func (s *dmeshPlanner) HedgeDelay(percentile float64) (time.Duration, bool) {
+	if s.stats == nil {
+		return 0, false
+	}
+	return s.stats.latencyPercentile(percentile)
+}
+
+func (s *dmeshPlanner) nextPeer(lowBlockNum uint64, highBlockNum uint64, descending bool, withReversible bool, excludeAddr string) *PeerRange {
 	zlog.Debug("finding peers for range",
 		zap.Uint64("low_block_num", lowBlockNum),
 		zap.Uint64("high_block_num", highBlockNum),
@@ -62,10 +97,25 @@ func (s *dmeshPlanner) NextPeer(lowBlockNum uint64, highBlockNum uint64, descend
 	peers := getReadyPeers(s.peers())
 
 	var candidatePeers []*dmesh.SearchPeer
+	var holes []*search.BlockRange
+
+	startBlockNum := lowBlockNum
+	if descending {
+		startBlockNum = highBlockNum
+	}
 
 	highestSeenTierLevel := uint32(0)
 	for _, peer := range peers {
+		if peer.Addr() == excludeAddr {
+			continue
+		}
+
 		if peerCanServeRange(peer, withReversible, descending, highBlockNum, lowBlockNum, s.headDelayTolerance) {
+			if hole := missingRangeAt(s.missingRanges.get(peer.Addr()), startBlockNum); hole != nil {
+				holes = append(holes, hole)
+				continue
+			}
+
 			candidatePeers = append(candidatePeers, peer)
 			if peer.TierLevel > highestSeenTierLevel {
 				highestSeenTierLevel = peer.TierLevel
@@ -74,6 +124,9 @@ func (s *dmeshPlanner) NextPeer(lowBlockNum uint64, highBlockNum uint64, descend
 	}
 
 	if len(candidatePeers) == 0 {
+		if len(holes) != 0 {
+			return missingPeerRange(lowBlockNum, highBlockNum, descending, holes)
+		}
 		return nil
 	}
 
@@ -84,11 +137,58 @@ func (s *dmeshPlanner) NextPeer(lowBlockNum uint64, highBlockNum uint64, descend
 		}
 	}
 
-	idx := rand.New(rand.NewSource(getSeed())).Int() % len(highestTierPeers)
-	selectedPeer := highestTierPeers[idx]
+	selectedPeer := s.stats.pick(highestTierPeers, rand.New(rand.NewSource(getSeed())))
 
 	zlog.Debug("dmesh planner peer selected", zap.Reflect("search_peer", selectedPeer), zap.Any("highest_tier_peers", highestTierPeers), zap.Any("all_candidate_peers", candidatePeers))
-	return getPeerRange(lowBlockNum, highBlockNum, selectedPeer, descending, withReversible)
+	peerRange := getPeerRange(lowBlockNum, highBlockNum, selectedPeer, descending, withReversible)
+	clipToMissingRanges(peerRange, s.missingRanges.get(peerRange.Addr), descending)
+	return peerRange
+}
+
+// ReportMissingRanges records the block ranges the backend at `addr`
+// advertised as missing, replacing those previously reported.
+func (s *dmeshPlanner) ReportMissingRanges(addr string, ranges []search.BlockRange) {
+	if s.missingRanges != nil {
+		s.missingRanges.set(addr, ranges)
+	}
+}
+
+// QueryStarted records a backend query starting on the peer at `addr`.
+func (s *dmeshPlanner) QueryStarted(addr string) {
+	if s.stats != nil {
+		s.stats.queryStarted(addr)
+	}
+}
+
+// QueryEnded records the end of a backend query on the peer at `addr`,
+// see `peerStats.queryEnded`.
+func (s *dmeshPlanner) QueryEnded(addr string, firstResultLatency time.Duration, failed bool) {
+	if s.stats != nil {
+		s.stats.queryEnded(addr, firstResultLatency, failed)
+	}
+}
+
+// QueryOutrun records a hedged backend query on the peer at `addr`
+// canceled before its first result, see `peerStats.queryOutrun`.
+func (s *dmeshPlanner) QueryOutrun(addr string, elapsed time.Duration) {
+	if s.stats != nil {
+		s.stats.queryOutrun(addr, elapsed)
+	}
+}
+
+// missingPeerRange returns the range no peer can serve, from the start of
+// the query up to where the first of the peers missing it resumes.
+func missingPeerRange(lowBlockNum, highBlockNum uint64, descending bool, holes []*search.BlockRange) *PeerRange {
+	peerRange := &PeerRange{Missing: true, LowBlockNum: lowBlockNum, HighBlockNum: highBlockNum}
+	for _, hole := range holes {
+		if descending && hole.Low > peerRange.LowBlockNum {
+			peerRange.LowBlockNum = hole.Low
+		}
+		if !descending && hole.High < peerRange.HighBlockNum {
+			peerRange.HighBlockNum = hole.High
+		}
+	}
+	return peerRange
 }
 
 type PeerRange struct {
@@ -97,6 +197,9 @@ type PeerRange struct {
 	LowBlockNum      uint64
 	HighBlockNum     uint64
 	ServesReversible bool
+
+	// Missing ranges are held by no peer, they are skipped
+	Missing bool
 }
 
 func NewPeerRange(peer *dmesh.SearchPeer, lowBlockNum, highBlockNum uint64) *PeerRange {
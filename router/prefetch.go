@@ -0,0 +1,198 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search/metrics"
+	"go.uber.org/zap"
+)
+
+// prefetchBufferedMatches is the number of matches a prefetched segment
+// buffers, its backend query then waits for the segment's turn.
+var prefetchBufferedMatches = 1000
+
+// segmentPrefetcher runs ahead the backend queries of the segments planned
+// after the current one, assuming each one reads its whole range. Their
+// matches are buffered until their turn comes, so they still go through
+// `senderFilter` in order. When a segment ends anywhere else, or fails,
+// the ones after it are canceled and planned again.
+type segmentPrefetcher struct {
+	q         *queryExecutor
+	ctx       context.Context
+	lookAhead int
+
+	segments []*prefetchedSegment // in query order, the first one is the next to send
+}
+
+type prefetchedSegment struct {
+	peer    *PeerRange
+	matches chan *pb.SearchMatch // closed once the backend query ended, with `query`, `winner` and `err` set
+	query   *BackendQuery
+	winner  *PeerRange // the peer which responded, another one than `peer` when hedged
+	err     error
+	ctx     context.Context // bounded by the segment's share of the query deadline, see `queryExecutor.backendDeadline`
+	cancel  context.CancelFunc
+}
+
+func newSegmentPrefetcher(q *queryExecutor, ctx context.Context, lookAhead int) *segmentPrefetcher {
+	return &segmentPrefetcher{
+		q:         q,
+		ctx:       ctx,
+		lookAhead: lookAhead,
+	}
+}
+
+// prefetchable tells if the backend query of `peerRange` can run ahead of
+// its turn. Those of peers serving reversible blocks follow the head and
+// don't end.
+func prefetchable(peerRange *PeerRange) bool {
+	return !peerRange.ServesReversible && !peerRange.Missing
+}
+
+// nextPeer returns the peer of the prefetched segment starting at the
+// moving bound of the query, `lowBlockNum` or `highBlockNum` depending on
+// its direction. When there is none, the prefetched segments are canceled.
+func (p *segmentPrefetcher) nextPeer(lowBlockNum uint64, highBlockNum uint64) *PeerRange {
+	if len(p.segments) == 0 {
+		return nil
+	}
+
+	next := p.segments[0].peer
+	if p.q.request.Descending && next.HighBlockNum == highBlockNum || !p.q.request.Descending && next.LowBlockNum == lowBlockNum {
+		return next
+	}
+
+	p.cancel()
+	return nil
+}
+
+// run starts the backend queries of the segments following the one of
+// `targetPeer`, then sends the matches of the latter through `senderFilter`.
+// It returns the peer which responded, see `prefetchedSegment.winner`, and
+// the context the backend query ran with.
+func (p *segmentPrefetcher) run(targetPeer *PeerRange, backendRequest *pb.BackendRequest) (*BackendQuery, *PeerRange, context.Context, error) {
+	if len(p.segments) == 0 || p.segments[0].peer != targetPeer {
+		p.cancel()
+		p.start(targetPeer, backendRequest)
+	}
+	p.fill()
+
+	segment := p.segments[0]
+	p.segments = p.segments[1:]
+
+	for match := range segment.matches {
+		if err := p.q.senderFilter(match); err != nil {
+			segment.cancel()
+			for range segment.matches {
+			}
+			// the segments queued after this one are not sent, see `nextPeer`
+			p.cancel()
+			return segment.query, segment.winner, segment.ctx, err
+		}
+	}
+	return segment.query, segment.winner, segment.ctx, segment.err
+}
+
+// fill plans and starts the segments following the last one, up to the
+// look-ahead.
+func (p *segmentPrefetcher) fill() {
+	for len(p.segments) <= p.lookAhead {
+		last := p.segments[len(p.segments)-1].peer
+
+		var next *PeerRange
+		if p.q.request.Descending {
+			if last.LowBlockNum <= p.q.queryRange.lowBlockNum {
+				return
+			}
+			next = p.q.planner.NextPeer(p.q.queryRange.lowBlockNum, last.LowBlockNum-1, true, p.q.request.WithReversible)
+		} else {
+			if last.HighBlockNum >= p.q.queryRange.highBlockNum {
+				return
+			}
+			next = p.q.planner.NextPeer(last.HighBlockNum+1, p.q.queryRange.highBlockNum, false, p.q.request.WithReversible)
+		}
+
+		if next == nil || !prefetchable(next) {
+			return
+		}
+
+		p.q.zlogger.Debug("prefetching segment",
+			zap.String("backend_addr", next.Addr),
+			zap.Uint64("low_block_num", next.LowBlockNum),
+			zap.Uint64("high_block_num", next.HighBlockNum))
+		metrics.PrefetchedSegments.Inc()
+		p.start(next, p.q.createBackendQuery(next))
+	}
+}
+
+// start runs the backend query of a segment, hedged like any other when
+// its query is, see `queryExecutor.hedgeDelay`. Its share of the query
+// deadline is that of the blocks left from the segment on, when started.
+func (p *segmentPrefetcher) start(peerRange *PeerRange, backendRequest *pb.BackendRequest) {
+	lowBlockNum, highBlockNum := peerRange.LowBlockNum, p.q.queryRange.highBlockNum
+	if p.q.request.Descending {
+		lowBlockNum, highBlockNum = p.q.queryRange.lowBlockNum, peerRange.HighBlockNum
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline := p.q.backendDeadline(peerRange, lowBlockNum, highBlockNum, time.Now()); !deadline.Equal(p.q.deadline) {
+		ctx, cancel = context.WithDeadline(p.ctx, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(p.ctx)
+	}
+	segment := &prefetchedSegment{
+		peer:    peerRange,
+		matches: make(chan *pb.SearchMatch, prefetchBufferedMatches),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	p.segments = append(p.segments, segment)
+
+	go func() {
+		defer cancel()
+		send := func(match *pb.SearchMatch) error {
+			select {
+			case <-ctx.Done():
+				return ContextCanceled
+			case segment.matches <- match:
+				return nil
+			}
+		}
+
+		if hedgeDelay, ok := p.q.hedgeDelay(peerRange); ok {
+			segment.query, segment.winner, segment.err = p.q.runHedgedBackendQuery(ctx, peerRange, backendRequest, hedgeDelay, send)
+		} else {
+			segment.query, segment.winner = p.q.backendQueryFactory(p.q.backendClientFactory(peerRange), backendRequest), peerRange
+			segment.err = p.q.runBackendQuery(ctx, peerRange, segment.query, send, nil)
+		}
+		close(segment.matches)
+	}()
+}
+
+// cancel cancels the backend queries of the prefetched segments.
+func (p *segmentPrefetcher) cancel() {
+	for _, segment := range p.segments {
+		segment.cancel()
+	}
+	if len(p.segments) != 0 {
+		metrics.CanceledPrefetchedSegments.AddInt(len(p.segments))
+	}
+	p.segments = nil
+}
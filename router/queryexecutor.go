@@ -16,11 +16,15 @@ package router
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/dfuse-io/derr"
 	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
+	"github.com/dfuse-io/search/metrics"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
@@ -41,11 +45,58 @@ type queryExecutor struct {
 	backendClientFactory backendClientFactory
 	backendQueryFactory  backendQueryFactory
 	lastBlockReceived    uint64
+	lastTrxPrefix        string
+	lastCursor           string
+
+	// lastBlockTrxPrefixes are those of the matches sent at `lastBlockReceived`
+	lastBlockTrxPrefixes map[string]bool
+	// resumeGate is nil unless a backend query resumed after a failure, see `resumeAfterLastMatch`
+	resumeGate *resumeGate
+
+	// deadline, when set, is when the query stops, see `requestDeadline`
+	deadline         time.Time
+	deadlineExceeded bool
+	progressBlockNum uint64 // last block fully read, in the query direction
+	hasProgress      bool
 
 	limitReached    bool
 	incompleteRange bool
+
+	// skippedRanges are held by no backend, see `search.SkippedRangesTrailerKey`
+	skippedRanges []search.BlockRange
+
+	// hedgePercentile is 0 unless paginated queries are hedged, see `Router.EnableHedging`
+	hedgePercentile float64
+
+	// resumeOnFailure retries backend queries failing after sending matches, see `Router.EnableResumeOnFailure`
+	resumeOnFailure bool
+
+	// prefetchSegments is 0 unless segments are queried ahead, see `segmentPrefetcher`
+	prefetchSegments int
+}
+
+type missingRangesReporter interface {
+	ReportMissingRanges(addr string, ranges []search.BlockRange)
 }
 
+type peerStatsReporter interface {
+	QueryStarted(addr string)
+	QueryEnded(addr string, firstResultLatency time.Duration, failed bool)
+	QueryOutrun(addr string, elapsed time.Duration)
+}
+
+type excludingPlanner interface {
+	NextPeerExcluding(lowBlockNum uint64, highBlockNum uint64, descending bool, withReversible bool, excludeAddr string) *PeerRange
+}
+
+type hedgePlanner interface {
+	NextHedgePeer(peerRange *PeerRange, descending bool, withReversible bool) *PeerRange
+	HedgeDelay(percentile float64) (time.Duration, bool)
+}
+
+// errHedgeLost stops the backend query of a hedge that responded second.
+var errHedgeLost = errors.New("other hedged backend query responded first")
+
 func newQueryExecutor(ctx context.Context, req *pb.RouterRequest, planner Planner, cur *cursor, qRange *QueryRange, logger *zap.Logger, backendCliFactory backendClientFactory, backendQuFactory backendQueryFactory, streamSend func(*pb.SearchMatch) error) *queryExecutor {
 	q := &queryExecutor{
 		ctx:                  ctx,
@@ -68,6 +119,10 @@ func (q *queryExecutor) Err() error {
 	return q.ctx.Err()
 }
 
+// queryRetryBackoffs are the pauses, in milliseconds, before each retry of
+// a backend query
+var queryRetryBackoffs = []int{50, 200, 500, 1000, 1500}
+
 func (q *queryExecutor) Query() error {
 
 	// only one will move based on the queries direction
@@ -75,11 +130,36 @@ func (q *queryExecutor) Query() error {
 	movingHighBlockNum := q.queryRange.highBlockNum
 
 	retryCount := 0
-	retryBackoffs := []int{50, 200, 500, 1000, 1500}
+	retryBackoffs := queryRetryBackoffs
 	retryMax := len(retryBackoffs)
+	failedAddr := "" // peer of the last backend query, when it failed
+
+	backendCtx := q.ctx
+	if !q.deadline.IsZero() {
+		var cancel context.CancelFunc
+		backendCtx, cancel = context.WithDeadline(q.ctx, q.deadline)
+		defer cancel()
+	}
+
+	var prefetcher *segmentPrefetcher
+	if q.prefetchSegments > 0 {
+		prefetcher = newSegmentPrefetcher(q, backendCtx, q.prefetchSegments)
+		defer prefetcher.cancel()
+	}
 
 	for {
-		targetPeer := q.planner.NextPeer(movingLowBlockNum, movingHighBlockNum, q.request.Descending, q.request.WithReversible)
+		if q.deadlineReached(backendCtx) {
+			q.zlogger.Info("query deadline reached", zap.Uint64("progress_block_num", q.progressBlockNum))
+			return nil
+		}
+
+		var targetPeer *PeerRange
+		if prefetcher != nil {
+			targetPeer = prefetcher.nextPeer(movingLowBlockNum, movingHighBlockNum)
+		}
+		if targetPeer == nil {
+			targetPeer = q.nextPeer(movingLowBlockNum, movingHighBlockNum, failedAddr)
+		}
 		if targetPeer == nil {
 			if retryCount >= retryMax {
 				q.zlogger.Info("cannot get next target peer from planner",
@@ -100,6 +180,28 @@ func (q *queryExecutor) Query() error {
 			continue
 		}
 
+		if targetPeer.Missing {
+			skipped := search.BlockRange{Low: targetPeer.LowBlockNum, High: targetPeer.HighBlockNum}
+			q.zlogger.Info("skipping block range held by no backend", zap.Stringer("skipped_range", skipped))
+			q.skippedRanges = append(q.skippedRanges, skipped)
+			metrics.SkippedRangesCount.Inc()
+
+			if q.request.Descending {
+				if skipped.Low <= q.queryRange.lowBlockNum {
+					return nil
+				}
+				movingHighBlockNum = skipped.Low - 1
+				q.recordProgress(skipped.Low)
+			} else {
+				if skipped.High >= q.queryRange.highBlockNum {
+					return nil
+				}
+				movingLowBlockNum = skipped.High + 1
+				q.recordProgress(skipped.High)
+			}
+			continue
+		}
+
 		backendRequest := q.createBackendQuery(targetPeer)
 
 		q.zlogger.Info("running backend query request",
@@ -109,13 +211,35 @@ func (q *queryExecutor) Query() error {
 			zap.Bool("serves_reversible", targetPeer.ServesReversible),
 			zap.Any("backend_request", backendRequest))
 
-		backendClient := q.backendClientFactory(targetPeer)
+		trxCountBefore := q.trxCount
 
-		backendQuery := q.backendQueryFactory(backendClient, backendRequest)
+		callCtx, cancelCall := backendCtx, context.CancelFunc(func() {})
+		if deadline := q.backendDeadline(targetPeer, movingLowBlockNum, movingHighBlockNum, time.Now()); !deadline.Equal(q.deadline) {
+			callCtx, cancelCall = context.WithDeadline(backendCtx, deadline)
+		}
 
-		err := backendQuery.run(q.ctx, q.zlogger, q.senderFilter)
+		var backendQuery *BackendQuery
+		var err error
+		if prefetcher != nil && prefetchable(targetPeer) {
+			// prefetched segments got their share of the deadline when started
+			backendQuery, targetPeer, callCtx, err = prefetcher.run(targetPeer, backendRequest)
+		} else if hedgeDelay, ok := q.hedgeDelay(targetPeer); ok {
+			backendQuery, targetPeer, err = q.runHedgedBackendQuery(callCtx, targetPeer, backendRequest, hedgeDelay, q.senderFilter)
+		} else {
+			backendQuery = q.backendQueryFactory(q.backendClientFactory(targetPeer), backendRequest)
+			err = q.runBackendQuery(callCtx, targetPeer, backendQuery, q.senderFilter, nil)
+		}
+		cancelCall()
 
 		if err != nil {
+			if q.deadlineReached(callCtx) {
+				q.zlogger.Info("query deadline reached while running backend query",
+					zap.String("backend_addr", targetPeer.Addr),
+					zap.Uint64("progress_block_num", q.progressBlockNum),
+				)
+				return nil
+			}
+
 			// Our own ctx done should always cover the contextCanceled error upstream
 			if err == ContextCanceled || q.ctx.Err() != nil || status.Code(err) == codes.Canceled {
 				return nil
@@ -125,6 +249,14 @@ func (q *queryExecutor) Query() error {
 				return nil
 			}
 
+			if err == errResumeMarkerMissed {
+				q.zlogger.Error("resumed backend query did not replay the last match sent, backends disagree",
+					zap.String("backend_addr", targetPeer.Addr),
+					zap.Uint64("last_block_received", q.resumeGate.blockNum),
+					zap.String("last_trx_prefix", q.resumeGate.marker))
+				return fmt.Errorf("Internal server error")
+			}
+
 			q.zlogger.Warn("backend query ran with error!",
 				zap.String("backend_addr", targetPeer.Addr),
 				zap.Int64("last_block_read", backendQuery.LastBlockRead),
@@ -132,7 +264,8 @@ func (q *queryExecutor) Query() error {
 				zap.Error(err),
 			)
 
-			if q.trxCount > 0 {
+			sentMatches := q.trxCount > trxCountBefore
+			if q.trxCount > 0 && (!q.resumeOnFailure || sentMatches && !resumable(targetPeer, q.request.WithReversible)) {
 				q.zlogger.Error("backend error but results where already returned ",
 					zap.Int64("trx_count", q.trxCount),
 					zap.Error(err))
@@ -151,13 +284,41 @@ func (q *queryExecutor) Query() error {
 				zap.Int("retry_count", retryCount),
 				zap.Int("retry_max", retryMax),
 				zap.Uint64("last_block_received", q.lastBlockReceived),
+				zap.Bool("resuming", sentMatches),
 				zap.Error(err))
+
+			if sentMatches {
+				q.resumeAfterLastMatch()
+				if q.request.Descending {
+					movingHighBlockNum = q.lastBlockReceived
+				} else {
+					movingLowBlockNum = q.lastBlockReceived
+				}
+			}
+			failedAddr = targetPeer.Addr
 			continue
 
 			// on the live when we disconnect forward, maybe we are in a firk, we don't want a retry in the live forward if the suer got one result
 			// the reason why is because you could have been in a fork
 
 		}
+		failedAddr = ""
+
+		if q.resumeGate != nil && backendQuery.LastBlockRead >= 0 {
+			if err := q.resumeGate.readPast(uint64(backendQuery.LastBlockRead)); err != nil {
+				q.zlogger.Error("resumed backend query read past the last match sent without replaying it, backends disagree",
+					zap.String("backend_addr", targetPeer.Addr),
+					zap.Uint64("last_block_received", q.resumeGate.blockNum),
+					zap.String("last_trx_prefix", q.resumeGate.marker),
+					zap.Int64("last_block_read", backendQuery.LastBlockRead))
+				return fmt.Errorf("Internal server error")
+			}
+		}
+
+		if reporter, ok := q.planner.(missingRangesReporter); ok && backendQuery.HasMissingRanges {
+			reporter.ReportMissingRanges(targetPeer.Addr, backendQuery.MissingRanges)
+		}
+
 		q.zlogger.Debug("backend query ran",
 			zap.String("backend_addr", targetPeer.Addr),
 			zap.Int("retry_count", retryCount),
@@ -166,7 +327,19 @@ func (q *queryExecutor) Query() error {
 		)
 
 		if backendQuery.LastBlockRead == -1 {
-			q.zlogger.Warn("backend query return no block read", zap.String("backend_addr", targetPeer.Addr))
+			// the range starts in a gap of the backend, the planner now routes around it
+			if retryCount >= retryMax {
+				q.zlogger.Error("backends repeatedly read no block", zap.String("backend_addr", targetPeer.Addr))
+				return fmt.Errorf("Internal server error")
+			}
+
+			time.Sleep(time.Duration(retryBackoffs[retryCount]) * time.Millisecond)
+			retryCount++
+			q.zlogger.Warn("backend query return no block read, router will retry",
+				zap.String("backend_addr", targetPeer.Addr),
+				zap.Int("retry_count", retryCount),
+				zap.Int("retry_max", retryMax))
+			failedAddr = targetPeer.Addr
 			continue
 		}
 
@@ -186,6 +359,7 @@ func (q *queryExecutor) Query() error {
 				return fmt.Errorf("descending request queried outside of lower query bound")
 			}
 			movingHighBlockNum = lastBlockRead - 1
+			q.recordProgress(lastBlockRead)
 		} else {
 			if targetPeer.ServesReversible {
 				// you just finished the live backend
@@ -209,6 +383,183 @@ func (q *queryExecutor) Query() error {
 				return fmt.Errorf("ascending request queried outside of lower query bound")
 			}
 			movingLowBlockNum = lastBlockRead + 1
+			q.recordProgress(lastBlockRead)
+		}
+	}
+}
+
+// nextPeer returns the next peer to query, other than the one at
+// `failedAddr` which just failed, unless it is the only one left.
+func (q *queryExecutor) nextPeer(lowBlockNum uint64, highBlockNum uint64, failedAddr string) *PeerRange {
+	if planner, ok := q.planner.(excludingPlanner); ok && failedAddr != "" {
+		if peerRange := planner.NextPeerExcluding(lowBlockNum, highBlockNum, q.request.Descending, q.request.WithReversible, failedAddr); peerRange != nil {
+			return peerRange
+		}
+	}
+	return q.planner.NextPeer(lowBlockNum, highBlockNum, q.request.Descending, q.request.WithReversible)
+}
+
+// resumable tells if a query can go on after `targetPeer` failed once it
+// sent matches. Those of a peer serving reversible blocks can be on a fork
+// the next peer doesn't know about.
+func resumable(targetPeer *PeerRange, withReversible bool) bool {
+	return !(targetPeer.ServesReversible && withReversible)
+}
+
+// resumeAfterLastMatch makes the next backend query skip the matches of the
+// block of the last one sent which were already sent, see `resumeGate`. It
+// starts again at that block, which may have others after them.
+func (q *queryExecutor) resumeAfterLastMatch() {
+	q.resumeGate = newResumeGate(q.lastBlockReceived, q.lastBlockTrxPrefixes, q.lastTrxPrefix, q.request.Descending)
+}
+
+// runBackendQuery runs `backendQuery` on `targetPeer`, reporting it to the
+// planner's peer statistics. When set, `outrun` tells if the query was
+// canceled because another hedged one responded first.
+func (q *queryExecutor) runBackendQuery(ctx context.Context, targetPeer *PeerRange, backendQuery *BackendQuery, streamSend func(*pb.SearchMatch) error, outrun func() bool) error {
+	statsReporter, _ := q.planner.(peerStatsReporter)
+	if statsReporter != nil {
+		statsReporter.QueryStarted(targetPeer.Addr)
+	}
+
+	start := time.Now()
+	var firstResultLatency time.Duration
+	err := backendQuery.run(ctx, q.zlogger, func(match *pb.SearchMatch) error {
+		if firstResultLatency == 0 {
+			firstResultLatency = time.Since(start)
+		}
+		return streamSend(match)
+	})
+
+	if statsReporter != nil {
+		if firstResultLatency == 0 && outrun != nil && outrun() {
+			statsReporter.QueryOutrun(targetPeer.Addr, time.Since(start))
+		}
+		// our own cancellation, deadline, limit or hedge don't tell anything about the backend
+		failed := err != nil && err != LimitReached && err != ContextCanceled && err != errHedgeLost && status.Code(err) != codes.Canceled && ctx.Err() == nil
+		statsReporter.QueryEnded(targetPeer.Addr, firstResultLatency, failed)
+	}
+	return err
+}
+
+// hedgeDelay returns how long to wait for `targetPeer` to respond before
+// hedging, or false when its query is not hedged. Only paginated queries on
+// peers not serving reversible blocks are, those on the live tier follow
+// forks and are not interchangeable.
+func (q *queryExecutor) hedgeDelay(targetPeer *PeerRange) (time.Duration, bool) {
+	if q.hedgePercentile == 0 || q.queryRange.mode != pb.RouterRequest_PAGINATED || targetPeer.ServesReversible {
+		return 0, false
+	}
+
+	planner, ok := q.planner.(hedgePlanner)
+	if !ok {
+		return 0, false
+	}
+	return planner.HedgeDelay(q.hedgePercentile)
+}
+
+type hedgedBackendQuery struct {
+	peer   *PeerRange
+	query  *BackendQuery
+	cancel context.CancelFunc
+	outrun bool // canceled because another one responded first
+	err    error
+}
+
+// runHedgedBackendQuery runs `backendRequest` on `targetPeer` and, when it
+// sent neither a match nor its last block read after `hedgeDelay`, on a
+// second peer serving the same range. The first of them to respond wins,
+// the other one is canceled. Only the matches of the winner reach
+// `streamSend`, so none is ever sent twice.
+func (q *queryExecutor) runHedgedBackendQuery(ctx context.Context, targetPeer *PeerRange, backendRequest *pb.BackendRequest, hedgeDelay time.Duration, streamSend func(*pb.SearchMatch) error) (*BackendQuery, *PeerRange, error) {
+	var lock sync.Mutex
+	var hedges []*hedgedBackendQuery
+	var winner *hedgedBackendQuery
+
+	// claim makes `hedge` the winner, unless another one is already
+	claim := func(hedge *hedgedBackendQuery) bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if winner == nil {
+			winner = hedge
+			for _, other := range hedges {
+				if other != hedge {
+					other.outrun = true
+					other.cancel()
+				}
+			}
+		}
+		return winner == hedge
+	}
+
+	done := make(chan *hedgedBackendQuery, 2)
+	launch := func(peer *PeerRange) {
+		hedgeCtx, cancel := context.WithCancel(ctx)
+		hedge := &hedgedBackendQuery{
+			peer:   peer,
+			query:  q.backendQueryFactory(q.backendClientFactory(peer), backendRequest),
+			cancel: cancel,
+		}
+		hedges = append(hedges, hedge)
+
+		go func() {
+			defer cancel()
+			hedge.err = q.runBackendQuery(hedgeCtx, peer, hedge.query, func(match *pb.SearchMatch) error {
+				if !claim(hedge) {
+					return errHedgeLost
+				}
+				return streamSend(match)
+			}, func() bool {
+				lock.Lock()
+				defer lock.Unlock()
+				return hedge.outrun
+			})
+			if hedge.err == nil && !claim(hedge) {
+				hedge.err = errHedgeLost
+			}
+			done <- hedge
+		}()
+	}
+
+	lock.Lock()
+	launch(targetPeer)
+	lock.Unlock()
+
+	timer := time.NewTimer(hedgeDelay)
+	defer timer.Stop()
+
+	running := 1
+	for {
+		select {
+		case <-timer.C:
+			lock.Lock()
+			if winner == nil {
+				if hedgePeer := q.planner.(hedgePlanner).NextHedgePeer(targetPeer, q.request.Descending, q.request.WithReversible); hedgePeer != nil {
+					q.zlogger.Debug("backend slow to respond, hedging backend query",
+						zap.String("backend_addr", targetPeer.Addr),
+						zap.String("hedge_backend_addr", hedgePeer.Addr),
+						zap.Duration("hedge_delay", hedgeDelay))
+					metrics.HedgedBackendQueries.Inc()
+					launch(hedgePeer)
+					running++
+				}
+			}
+			lock.Unlock()
+
+		case hedge := <-done:
+			running--
+
+			lock.Lock()
+			won := winner == hedge
+			lock.Unlock()
+
+			if won || running == 0 {
+				if won && hedge.peer != targetPeer {
+					metrics.HedgedBackendQueryWins.Inc()
+				}
+				return hedge.query, hedge.peer, hedge.err
+			}
 		}
 	}
 }
@@ -241,6 +592,10 @@ func (q *queryExecutor) createBackendQuery(targetPeerRange *PeerRange) *pb.Backe
 }
 
 func (q *queryExecutor) senderFilter(match *pb.SearchMatch) error {
+	if search.IsHeartbeat(match) {
+		// heartbeats carry no match, they don't move the cursor nor count toward the limit
+		return q.streamSend(match)
+	}
 
 	if !within(match.BlockNum, q.queryRange.lowBlockNum, q.queryRange.highBlockNum) {
 		q.zlogger.Warn("received matched outside requested query range",
@@ -255,8 +610,24 @@ func (q *queryExecutor) senderFilter(match *pb.SearchMatch) error {
 		return nil
 	}
 
+	if q.resumeGate != nil {
+		pass, err := q.resumeGate.passed(match.BlockNum, match.TrxIdPrefix)
+		if err != nil {
+			return err
+		}
+		if !pass {
+			return nil
+		}
+	}
+
 	q.trxCount++
+	if match.BlockNum != q.lastBlockReceived || q.lastBlockTrxPrefixes == nil {
+		q.lastBlockTrxPrefixes = map[string]bool{}
+	}
+	q.lastBlockTrxPrefixes[match.TrxIdPrefix] = true
 	q.lastBlockReceived = match.BlockNum
+	q.lastTrxPrefix = match.TrxIdPrefix
+	q.lastCursor = match.Cursor
 
 	err := q.streamSend(match)
 	if err != nil {
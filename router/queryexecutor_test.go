@@ -16,13 +16,19 @@ package router
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"testing"
+	"time"
 
 	pb "github.com/dfuse-io/pbgo/dfuse/search/v1"
+	"github.com/dfuse-io/search"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -994,6 +1000,525 @@ func Test_Limit(t *testing.T) {
 	}
 }
 
+func Test_Heartbeat(t *testing.T) {
+	heartbeat, err := search.NewHeartbeatMatch(0, "", &search.Heartbeat{HeadBlockNum: 12, HeadBlockID: "0000000ca", LIBNum: 10, LIBID: "0000000aa"})
+	require.NoError(t, err)
+
+	test := testQuerySharder{
+		request: &pb.RouterRequest{
+			Query: "action:onblock",
+			Mode:  pb.RouterRequest_STREAMING,
+			Limit: 1,
+		},
+		queryRange: &QueryRange{
+			lowBlockNum:  20,
+			highBlockNum: 100,
+			mode:         pb.RouterRequest_STREAMING,
+		},
+		planner: &testPlanner{
+			plans: []*PeerRange{
+				{Addr: "live-1", LowBlockNum: 20, HighBlockNum: 100},
+			},
+		},
+		backendClientsWrapper: map[string]*testBackendClient{
+			"live-1": {
+				responses: []*pb.SearchMatch{
+					heartbeat,
+					{TrxIdPrefix: "a", BlockNum: 24, Index: 13},
+				},
+				error:   io.EOF,
+				trailer: metadata.Pairs("last-block-read", "100"),
+			},
+		},
+	}
+
+	inboundStream := &testInboundStream{}
+	sharder := newQueryExecutor(context.Background(), test.request, test.planner, test.cursor, test.queryRange, zlog, newTestBackendClient(&test), newBackendQuery, newTestStreamSend(inboundStream))
+	sharder.Query()
+
+	assert.Equal(t, []*pb.SearchMatch{heartbeat, {TrxIdPrefix: "a", BlockNum: 24, Index: 13}}, inboundStream.matches)
+	assert.Equal(t, int64(1), sharder.trxCount)
+	assert.Equal(t, uint64(24), sharder.lastBlockReceived)
+}
+
+func Test_ResumeAfterFailure(t *testing.T) {
+	failingClient := func() *testBackendClient {
+		return &testBackendClient{
+			responses: []*pb.SearchMatch{
+				{TrxIdPrefix: "a", BlockNum: 20},
+				{TrxIdPrefix: "x", BlockNum: 24},
+				{TrxIdPrefix: "b", BlockNum: 24},
+			},
+			error: errors.New("archive went away"),
+		}
+	}
+
+	resumed := []*pb.SearchMatch{
+		{TrxIdPrefix: "x", BlockNum: 24},
+		{TrxIdPrefix: "b", BlockNum: 24},
+		{TrxIdPrefix: "c", BlockNum: 24},
+		{TrxIdPrefix: "d", BlockNum: 30},
+	}
+
+	tests := []struct {
+		name             string
+		resumeOnFailure  bool
+		withReversible   bool
+		servesReversible bool
+		resumedResponses []*pb.SearchMatch
+		expectError      bool
+		expectMatches    []string
+	}{
+		{
+			name:            "resumes after last match sent",
+			resumeOnFailure: true,
+			expectMatches:   []string{"a", "x", "b", "c", "d"},
+		},
+		{
+			name:            "resumes with the last block replayed in another order",
+			resumeOnFailure: true,
+			resumedResponses: []*pb.SearchMatch{
+				{TrxIdPrefix: "c", BlockNum: 24},
+				{TrxIdPrefix: "b", BlockNum: 24},
+				{TrxIdPrefix: "x", BlockNum: 24},
+				{TrxIdPrefix: "d", BlockNum: 30},
+			},
+			expectMatches: []string{"a", "x", "b", "c", "d"},
+		},
+		{
+			name:            "last match sent never replayed",
+			resumeOnFailure: true,
+			resumedResponses: []*pb.SearchMatch{
+				{TrxIdPrefix: "x", BlockNum: 24},
+				{TrxIdPrefix: "d", BlockNum: 30},
+			},
+			expectError:   true,
+			expectMatches: []string{"a", "x", "b"},
+		},
+		{
+			name:          "retries disabled",
+			expectError:   true,
+			expectMatches: []string{"a", "x", "b"},
+		},
+		{
+			name:             "reversible matches not resumed",
+			resumeOnFailure:  true,
+			withReversible:   true,
+			servesReversible: true,
+			expectError:      true,
+			expectMatches:    []string{"a", "x", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resumedResponses := resumed
+			if test.resumedResponses != nil {
+				resumedResponses = test.resumedResponses
+			}
+			resumedRequest := &pb.BackendRequest{}
+			clients := map[string]pb.BackendClient{
+				"archive-1": failingClient(),
+				"archive-2": &testRequestRecordingClient{
+					testBackendClient: &testBackendClient{
+						responses: resumedResponses,
+						error:     io.EOF,
+						trailer: metadata.Pairs("last-block-read", "100"),
+					},
+					request: resumedRequest,
+				},
+			}
+
+			planner := &testPlanner{
+				plans: []*PeerRange{
+					{Addr: "archive-1", LowBlockNum: 20, HighBlockNum: 100, ServesReversible: test.servesReversible},
+					{Addr: "archive-2", LowBlockNum: 24, HighBlockNum: 100},
+				},
+			}
+			queryRange := &QueryRange{lowBlockNum: 20, highBlockNum: 100, mode: pb.RouterRequest_STREAMING}
+			request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_STREAMING, WithReversible: test.withReversible}
+
+			inboundStream := &testInboundStream{}
+			backendClientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+			sharder := newQueryExecutor(context.Background(), request, planner, nil, queryRange, zlog, backendClientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+			sharder.resumeOnFailure = test.resumeOnFailure
+
+			err := sharder.Query()
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, uint64(24), resumedRequest.LowBlockNum)
+			}
+
+			var trxPrefixes []string
+			for _, match := range inboundStream.matches {
+				trxPrefixes = append(trxPrefixes, match.TrxIdPrefix)
+			}
+			assert.Equal(t, test.expectMatches, trxPrefixes)
+			assert.Equal(t, int64(len(test.expectMatches)), sharder.trxCount)
+		})
+	}
+}
+
+type testStatsPlanner struct {
+	testPlanner
+	latencies []time.Duration
+}
+
+func (p *testStatsPlanner) QueryStarted(addr string) {}
+
+func (p *testStatsPlanner) QueryEnded(addr string, firstResultLatency time.Duration, failed bool) {
+	p.latencies = append(p.latencies, firstResultLatency)
+}
+
+func (p *testStatsPlanner) QueryOutrun(addr string, elapsed time.Duration) {}
+
+func Test_FirstResultLatency(t *testing.T) {
+	tests := []struct {
+		name          string
+		responses     []*pb.SearchMatch
+		expectSampled bool
+	}{
+		{
+			name:          "sampled on first result",
+			responses:     []*pb.SearchMatch{{TrxIdPrefix: "a", BlockNum: 20}},
+			expectSampled: true,
+		},
+		{
+			name: "not sampled without results",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sharder := &testQuerySharder{
+				backendClientsWrapper: map[string]*testBackendClient{
+					"archive-1": {
+						responses: test.responses,
+						error:     io.EOF,
+						trailer:   metadata.Pairs("last-block-read", "100"),
+					},
+				},
+			}
+			planner := &testStatsPlanner{
+				testPlanner: testPlanner{
+					plans: []*PeerRange{{Addr: "archive-1", LowBlockNum: 20, HighBlockNum: 100}},
+				},
+			}
+			queryRange := &QueryRange{lowBlockNum: 20, highBlockNum: 100, mode: pb.RouterRequest_STREAMING}
+			request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_STREAMING}
+
+			executor := newQueryExecutor(context.Background(), request, planner, nil, queryRange, zlog, newTestBackendClient(sharder), newBackendQuery, newTestStreamSend(&testInboundStream{}))
+			require.NoError(t, executor.Query())
+
+			require.Len(t, planner.latencies, 1)
+			assert.Equal(t, test.expectSampled, planner.latencies[0] != 0)
+		})
+	}
+}
+
+type testRequestRecordingClient struct {
+	*testBackendClient
+	request *pb.BackendRequest
+}
+
+func (c *testRequestRecordingClient) StreamMatches(ctx context.Context, in *pb.BackendRequest, opts ...grpc.CallOption) (pb.Backend_StreamMatchesClient, error) {
+	*c.request = *in
+	return c.testBackendClient.StreamMatches(ctx, in, opts...)
+}
+
+type testHedgePlanner struct {
+	testPlanner
+	hedge      *PeerRange
+	hedgeDelay time.Duration
+
+	lock   sync.Mutex
+	outrun []string
+}
+
+func (p *testHedgePlanner) QueryStarted(addr string) {}
+
+func (p *testHedgePlanner) QueryEnded(addr string, firstResultLatency time.Duration, failed bool) {}
+
+func (p *testHedgePlanner) QueryOutrun(addr string, elapsed time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.outrun = append(p.outrun, addr)
+}
+
+func (p *testHedgePlanner) outrunAddrs() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.outrun...)
+}
+
+func (p *testHedgePlanner) NextHedgePeer(peerRange *PeerRange, descending bool, withReversible bool) *PeerRange {
+	return p.hedge
+}
+
+func (p *testHedgePlanner) HedgeDelay(percentile float64) (time.Duration, bool) {
+	return p.hedgeDelay, true
+}
+
+type testSlowBackendClient struct {
+	*testBackendClient
+	delay time.Duration
+	calls atomic.Int32
+}
+
+func (c *testSlowBackendClient) StreamMatches(ctx context.Context, in *pb.BackendRequest, opts ...grpc.CallOption) (pb.Backend_StreamMatchesClient, error) {
+	c.calls.Inc()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.delay):
+	}
+	return c.testBackendClient.StreamMatches(ctx, in, opts...)
+}
+
+func Test_HedgedBackendQuery(t *testing.T) {
+	tests := []struct {
+		name         string
+		primaryDelay time.Duration
+		expectHedged bool
+	}{
+		{name: "slow primary, hedge responds first", primaryDelay: time.Second, expectHedged: true},
+		{name: "primary responds before hedge delay"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newClient := func(delay time.Duration) *testSlowBackendClient {
+				return &testSlowBackendClient{
+					testBackendClient: &testBackendClient{
+						responses: []*pb.SearchMatch{
+							{TrxIdPrefix: "a", BlockNum: 20, Index: 13},
+							{TrxIdPrefix: "b", BlockNum: 24, Index: 16},
+						},
+						error:   io.EOF,
+						trailer: metadata.Pairs("last-block-read", "100"),
+					},
+					delay: delay,
+				}
+			}
+			clients := map[string]*testSlowBackendClient{
+				"archive-1": newClient(test.primaryDelay),
+				"archive-2": newClient(0),
+			}
+
+			planner := &testHedgePlanner{
+				testPlanner: testPlanner{
+					plans: []*PeerRange{{Addr: "archive-1", LowBlockNum: 20, HighBlockNum: 100}},
+				},
+				hedge:      &PeerRange{Addr: "archive-2", LowBlockNum: 20, HighBlockNum: 100},
+				hedgeDelay: 50 * time.Millisecond,
+			}
+			queryRange := &QueryRange{lowBlockNum: 20, highBlockNum: 100, mode: pb.RouterRequest_PAGINATED}
+			request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_PAGINATED}
+
+			inboundStream := &testInboundStream{}
+			backendClientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+			sharder := newQueryExecutor(context.Background(), request, planner, nil, queryRange, zlog, backendClientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+			sharder.hedgePercentile = 0.95
+
+			require.NoError(t, sharder.Query())
+			assert.Equal(t, []*pb.SearchMatch{
+				{TrxIdPrefix: "a", BlockNum: 20, Index: 13},
+				{TrxIdPrefix: "b", BlockNum: 24, Index: 16},
+			}, inboundStream.matches)
+			assert.Equal(t, int64(2), sharder.trxCount)
+
+			if test.expectHedged {
+				assert.Equal(t, int32(1), clients["archive-2"].calls.Load())
+				// the outrun backend query returns after the hedge won
+				assert.Eventually(t, func() bool { return len(planner.outrunAddrs()) == 1 }, time.Second, time.Millisecond)
+				assert.Equal(t, []string{"archive-1"}, planner.outrunAddrs())
+			} else {
+				assert.Equal(t, int32(0), clients["archive-2"].calls.Load())
+				assert.Len(t, planner.outrunAddrs(), 0)
+			}
+		})
+	}
+}
+
+type testBlockingBackendClient struct {
+	*testBackendClient
+	started chan struct{} // closed when the backend query starts
+	wait    chan struct{} // the backend query waits for it to be closed before responding
+}
+
+func (c *testBlockingBackendClient) StreamMatches(ctx context.Context, in *pb.BackendRequest, opts ...grpc.CallOption) (pb.Backend_StreamMatchesClient, error) {
+	close(c.started)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.wait:
+	}
+	return c.testBackendClient.StreamMatches(ctx, in, opts...)
+}
+
+func Test_SegmentPrefetch(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int64
+		expectMatches []string
+	}{
+		{
+			name:          "segments sent in order",
+			expectMatches: []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:          "limit reached in first segment",
+			limit:         1,
+			expectMatches: []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			newClient := func(lastBlockRead string, responses ...*pb.SearchMatch) *testBlockingBackendClient {
+				return &testBlockingBackendClient{
+					testBackendClient: &testBackendClient{
+						responses: responses,
+						error:     io.EOF,
+						trailer:   metadata.Pairs("last-block-read", lastBlockRead),
+					},
+					started: make(chan struct{}),
+					wait:    release,
+				}
+			}
+			clients := map[string]*testBlockingBackendClient{
+				"archive-1": newClient("40", &pb.SearchMatch{TrxIdPrefix: "a", BlockNum: 20}, &pb.SearchMatch{TrxIdPrefix: "b", BlockNum: 40}),
+				"archive-2": newClient("70", &pb.SearchMatch{TrxIdPrefix: "c", BlockNum: 50}),
+				"archive-3": newClient("100", &pb.SearchMatch{TrxIdPrefix: "d", BlockNum: 71}, &pb.SearchMatch{TrxIdPrefix: "e", BlockNum: 100}),
+			}
+
+			// no segment responds before all of them were queried, which only
+			// happens when they are queried in parallel
+			go func() {
+				for _, client := range clients {
+					<-client.started
+				}
+				close(release)
+			}()
+
+			planner := &testPlanner{
+				plans: []*PeerRange{
+					{Addr: "archive-1", LowBlockNum: 20, HighBlockNum: 40},
+					{Addr: "archive-2", LowBlockNum: 41, HighBlockNum: 70},
+					{Addr: "archive-3", LowBlockNum: 71, HighBlockNum: 100},
+				},
+			}
+			queryRange := &QueryRange{lowBlockNum: 20, highBlockNum: 100, mode: pb.RouterRequest_STREAMING}
+			request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_STREAMING, Limit: test.limit}
+
+			// bounds the test when the segments are not queried in parallel
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			inboundStream := &testInboundStream{}
+			backendClientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+			sharder := newQueryExecutor(ctx, request, planner, nil, queryRange, zlog, backendClientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+			sharder.prefetchSegments = 2
+
+			require.NoError(t, sharder.Query())
+
+			var trxPrefixes []string
+			for _, match := range inboundStream.matches {
+				trxPrefixes = append(trxPrefixes, match.TrxIdPrefix)
+			}
+			assert.Equal(t, test.expectMatches, trxPrefixes)
+		})
+	}
+}
+
+func Test_SegmentPrefetchHedged(t *testing.T) {
+	newClient := func(delay time.Duration, lastBlockRead string, responses ...*pb.SearchMatch) *testSlowBackendClient {
+		return &testSlowBackendClient{
+			testBackendClient: &testBackendClient{
+				responses: responses,
+				error:     io.EOF,
+				trailer:   metadata.Pairs("last-block-read", lastBlockRead),
+			},
+			delay: delay,
+		}
+	}
+	clients := map[string]*testSlowBackendClient{
+		"archive-1": newClient(0, "40", &pb.SearchMatch{TrxIdPrefix: "a", BlockNum: 20}),
+		"archive-2": newClient(time.Minute, "100", &pb.SearchMatch{TrxIdPrefix: "x", BlockNum: 50}),
+		"archive-3": newClient(0, "100", &pb.SearchMatch{TrxIdPrefix: "b", BlockNum: 50}),
+	}
+
+	planner := &testHedgePlanner{
+		testPlanner: testPlanner{
+			plans: []*PeerRange{
+				{Addr: "archive-1", LowBlockNum: 20, HighBlockNum: 40},
+				{Addr: "archive-2", LowBlockNum: 41, HighBlockNum: 100},
+			},
+		},
+		hedge:      &PeerRange{Addr: "archive-3", LowBlockNum: 41, HighBlockNum: 100},
+		hedgeDelay: 50 * time.Millisecond,
+	}
+	queryRange := &QueryRange{lowBlockNum: 20, highBlockNum: 100, mode: pb.RouterRequest_PAGINATED}
+	request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_PAGINATED}
+
+	inboundStream := &testInboundStream{}
+	backendClientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+	sharder := newQueryExecutor(context.Background(), request, planner, nil, queryRange, zlog, backendClientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+	sharder.hedgePercentile = 0.95
+	sharder.prefetchSegments = 1
+
+	require.NoError(t, sharder.Query())
+
+	var trxPrefixes []string
+	for _, match := range inboundStream.matches {
+		trxPrefixes = append(trxPrefixes, match.TrxIdPrefix)
+	}
+	assert.Equal(t, []string{"a", "b"}, trxPrefixes)
+	assert.Equal(t, int32(1), clients["archive-3"].calls.Load())
+	// the outrun backend query returns after the hedge won
+	assert.Eventually(t, func() bool { return len(planner.outrunAddrs()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"archive-2"}, planner.outrunAddrs())
+}
+
+func Test_SegmentPrefetchCanceledOnLimitReached(t *testing.T) {
+	clients := map[string]pb.BackendClient{
+		"archive-1": &testBackendClient{
+			responses: []*pb.SearchMatch{{TrxIdPrefix: "a", BlockNum: 24}},
+			error:     io.EOF,
+			trailer:   metadata.Pairs("last-block-read", "40"),
+		},
+		"archive-2": &blockingBackendClient{},
+	}
+	planner := &testPlanner{
+		plans: []*PeerRange{
+			{Addr: "archive-2", LowBlockNum: 41, HighBlockNum: 100},
+		},
+	}
+	queryRange := &QueryRange{lowBlockNum: 20, highBlockNum: 100, mode: pb.RouterRequest_STREAMING}
+	request := &pb.RouterRequest{Query: "action:onblock", Mode: pb.RouterRequest_STREAMING, Limit: 1}
+
+	inboundStream := &testInboundStream{}
+	backendClientFactory := func(peerRange *PeerRange) pb.BackendClient { return clients[peerRange.Addr] }
+	q := newQueryExecutor(context.Background(), request, planner, nil, queryRange, zlog, backendClientFactory, newBackendQuery, newTestStreamSend(inboundStream))
+
+	prefetcher := newSegmentPrefetcher(q, context.Background(), 1)
+	defer prefetcher.cancel()
+
+	targetPeer := &PeerRange{Addr: "archive-1", LowBlockNum: 20, HighBlockNum: 40}
+	prefetcher.start(targetPeer, q.createBackendQuery(targetPeer))
+	prefetcher.fill()
+	require.Len(t, prefetcher.segments, 2)
+	queued := prefetcher.segments[1]
+
+	_, _, _, err := prefetcher.run(targetPeer, q.createBackendQuery(targetPeer))
+	require.Equal(t, LimitReached, err)
+	assert.Equal(t, context.Canceled, queued.ctx.Err())
+	assert.Empty(t, prefetcher.segments)
+}
+
 func Test_createBackendQuery(t *testing.T) {
 	tests := []struct {
 		name                 string
@@ -0,0 +1,76 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"errors"
+)
+
+// errResumeMarkerMissed fails the query, the backend it resumed on
+// disagrees with the one that failed, see `resumeGate`.
+var errResumeMarkerMissed = errors.New("resumed backend query did not replay the last match sent")
+
+// resumeGate filters the matches of a backend query resumed at the block of
+// the last match sent before a failure, leaving out those of that block
+// already sent, in whatever order the backend replays them. The last match
+// sent, the marker, must be replayed before the query goes past its block,
+// otherwise the backends disagree and the query fails.
+type resumeGate struct {
+	blockNum   uint64
+	sent       map[string]bool // trx prefixes already sent at `blockNum`
+	marker     string
+	markerSeen bool
+	descending bool
+}
+
+func newResumeGate(blockNum uint64, sent map[string]bool, marker string, descending bool) *resumeGate {
+	return &resumeGate{
+		blockNum:   blockNum,
+		sent:       sent,
+		marker:     marker,
+		descending: descending,
+	}
+}
+
+// passed tells if the match of `trxIDPrefix` at `blockNum` was not sent yet.
+func (g *resumeGate) passed(blockNum uint64, trxIDPrefix string) (bool, error) {
+	if blockNum == g.blockNum {
+		if trxIDPrefix == g.marker {
+			g.markerSeen = true
+		}
+		return !g.sent[trxIDPrefix], nil
+	}
+
+	if g.descending && blockNum > g.blockNum || !g.descending && blockNum < g.blockNum {
+		return false, nil
+	}
+
+	if !g.markerSeen {
+		return false, errResumeMarkerMissed
+	}
+	return true, nil
+}
+
+// readPast returns an error when the backend read past the block of the
+// marker, up to `lastBlockRead`, without replaying it.
+func (g *resumeGate) readPast(lastBlockRead uint64) error {
+	if g.markerSeen {
+		return nil
+	}
+	if g.descending && lastBlockRead <= g.blockNum || !g.descending && lastBlockRead >= g.blockNum {
+		return errResumeMarkerMissed
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeGate_Passed(t *testing.T) {
+	type match struct {
+		blockNum  uint64
+		trxPrefix string
+	}
+
+	tests := []struct {
+		name          string
+		descending    bool
+		matches       []match
+		expectPassed  []string
+		expectError   bool
+		lastBlockRead uint64
+		expectReadErr bool
+	}{
+		{
+			name:          "fwd, sent ones of the block left out",
+			matches:       []match{{24, "x"}, {24, "c"}, {24, "b"}, {30, "d"}},
+			expectPassed:  []string{"c", "d"},
+			lastBlockRead: 30,
+		},
+		{
+			name:          "bwd, sent ones of the block left out",
+			descending:    true,
+			matches:       []match{{24, "b"}, {24, "c"}, {24, "x"}, {20, "d"}},
+			expectPassed:  []string{"c", "d"},
+			lastBlockRead: 20,
+		},
+		{
+			name:         "fwd, marker missed",
+			matches:      []match{{24, "x"}, {30, "d"}},
+			expectPassed: nil,
+			expectError:  true,
+		},
+		{
+			name:          "fwd, block read without marker",
+			matches:       []match{{24, "x"}},
+			lastBlockRead: 24,
+			expectReadErr: true,
+		},
+		{
+			name:          "fwd, marker block not read yet",
+			matches:       []match{{24, "x"}},
+			lastBlockRead: 23,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gate := newResumeGate(24, map[string]bool{"x": true, "b": true}, "b", test.descending)
+
+			var passed []string
+			var err error
+			for _, m := range test.matches {
+				var pass bool
+				pass, err = gate.passed(m.blockNum, m.trxPrefix)
+				if err != nil {
+					break
+				}
+				if pass {
+					passed = append(passed, m.trxPrefix)
+				}
+			}
+
+			if test.expectError {
+				assert.Equal(t, errResumeMarkerMissed, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectPassed, passed)
+
+			if test.expectReadErr {
+				assert.Equal(t, errResumeMarkerMissed, gate.readPast(test.lastBlockRead))
+			} else {
+				assert.NoError(t, gate.readPast(test.lastBlockRead))
+			}
+		})
+	}
+}
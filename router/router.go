@@ -18,6 +18,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"time"
 
 	"github.com/dfuse-io/bstream"
 	"github.com/dfuse-io/derr"
@@ -48,6 +50,24 @@ type Router struct {
 	headDelayTolerance uint64
 	libDelayTolerance  uint64
 	enableRetry        bool
+
+	httpListenAddr string
+	httpServer     *http.Server
+
+	// missingRanges are reported by backends across queries
+	missingRanges *peerMissingRanges
+
+	// peerStats are recorded across queries
+	peerStats *peerStats
+
+	// hedgePercentile is 0 unless paginated queries are hedged, see `EnableHedging`
+	hedgePercentile float64
+
+	// resumeOnFailure is false unless failed backend queries are resumed, see `EnableResumeOnFailure`
+	resumeOnFailure bool
+
+	// prefetchSegments is 0 unless segments are queried ahead, see `EnableSegmentPrefetch`
+	prefetchSegments int
 }
 
 func New(dmeshClient dmeshClient.SearchClient, headDelayTolerance uint64, libDelayTolerance uint64, blockIDClient pbblockmeta.BlockIDClient, forksClient pbblockmeta.ForksClient, enableRetry bool) *Router {
@@ -59,9 +79,42 @@ func New(dmeshClient dmeshClient.SearchClient, headDelayTolerance uint64, libDel
 		headDelayTolerance: headDelayTolerance,
 		libDelayTolerance:  libDelayTolerance,
 		enableRetry:        enableRetry,
+		missingRanges:      newPeerMissingRanges(),
+		peerStats:          newPeerStats(),
 	}
 }
 
+// EnableHedging sends the backend queries of paginated queries to a second
+// backend too, when the first one did not respond within the `percentile`
+// (like 0.95) of the latest times to first result across backends.
+func (r *Router) EnableHedging(percentile float64) error {
+	if percentile <= 0 || percentile > 1 {
+		return fmt.Errorf("invalid hedging percentile %f, expecting a value in ]0, 1]", percentile)
+	}
+	r.hedgePercentile = percentile
+	return nil
+}
+
+// EnableResumeOnFailure retries a backend query failing after it sent
+// matches on another backend, resuming at the block of the last match sent.
+// Reversible matches of the live tier are never resumed, they could be on
+// a fork the other backend doesn't know about.
+func (r *Router) EnableResumeOnFailure() {
+	r.resumeOnFailure = true
+}
+
+// EnableSegmentPrefetch starts the backend queries of up to `lookAhead`
+// segments, planned after the one being queried, without waiting for
+// their turn. Their matches are buffered to be sent in order. Prefetched
+// backend queries are hedged like the others, see `EnableHedging`.
+func (r *Router) EnableSegmentPrefetch(lookAhead int) error {
+	if lookAhead < 0 {
+		return fmt.Errorf("invalid segment prefetch look-ahead %d, expecting a positive value", lookAhead)
+	}
+	r.prefetchSegments = lookAhead
+	return nil
+}
+
 func checkCursorStillValid(ctx context.Context, cur *cursor, libnum uint64, blockmeta pbblockmeta.BlockIDClient) error {
 	zlogger := logging.Logger(ctx, zlog)
 	if cur == nil {
@@ -105,6 +158,15 @@ func (r *Router) StreamMatches(req *pb.RouterRequest, stream pb.Router_StreamMat
 		return err
 	}
 
+	deadline, err := requestDeadline(ctx, time.Now())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := search.HeartbeatIntervalFromContext(ctx); err != nil {
+		return status.Errorf(codes.InvalidArgument, err.Error())
+	}
+
 	headBlock, irrBlock := getSearchHighestHeadInfo(r.dmeshClient.Peers())
 	headBlockNumber.SetUint64(headBlock)
 	metrics.IRRBlockNumber.SetUint64(irrBlock)
@@ -175,11 +237,17 @@ func (r *Router) StreamMatches(req *pb.RouterRequest, stream pb.Router_StreamMat
 	defer stream.SetTrailer(trailer)
 
 	planner := NewDmeshPlanner(r.dmeshClient.Peers, r.headDelayTolerance)
+	planner.missingRanges = r.missingRanges
+	planner.stats = r.peerStats
 
 	q := newQueryExecutor(ctx, req, planner, cur, qRange, zlogger, newBackendClient, newBackendQuery, stream.Send)
 	if resolvedForkTrxCount != 0 {
 		q.trxCount = resolvedForkTrxCount
 	}
+	q.deadline = deadline
+	q.hedgePercentile = r.hedgePercentile
+	q.resumeOnFailure = r.resumeOnFailure
+	q.prefetchSegments = r.prefetchSegments
 	defer stream.SetTrailer(q.trailer) // set trailer before canceling context (thus, after in code)
 
 	if err := q.Query(); err != nil {
@@ -187,6 +255,16 @@ func (r *Router) StreamMatches(req *pb.RouterRequest, stream pb.Router_StreamMat
 		return err
 	}
 
+	if len(q.skippedRanges) != 0 {
+		trailer.Set(search.SkippedRangesTrailerKey, search.FormatBlockRanges(q.skippedRanges))
+	}
+
+	if q.deadlineExceeded {
+		metrics.DeadlineExceededRequestCount.Inc()
+		setDeadlineExceeded(trailer, q)
+		return nil
+	}
+
 	if q.Err() != nil {
 		return nil
 	}
@@ -218,6 +296,10 @@ func (r *Router) startServer(listenAddr string) {
 
 func (r *Router) Launch(grpcListenAddr string) {
 	r.startServer(grpcListenAddr)
+	if r.httpListenAddr != "" {
+		r.OnTerminating(func(_ error) { r.shutdownHTTPServer() })
+		r.startHTTPServer()
+	}
 	go r.setRouterAvailability()
 	select {
 	case <-r.Terminating():
@@ -97,6 +97,10 @@ type ShardIndex struct {
 	EndBlockTime   time.Time
 	analysisQueue  *index.AnalysisQueue
 
+	// FieldTermsFilterFile is nil when the shard was produced without a
+	// field terms filter
+	FieldTermsFilterFile *FieldTermsFilterFile
+
 	blockID string // for live indexes // TODO is this stil needed here in archive/?
 
 	mergeDone bool